@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/db"
+)
+
+// AuditLogModel 管理后台写操作的审计日志
+// 每条记录的Hash包含上一条记录的Hash，形成哈希链，中间记录被删除或篡改后校验会失败
+type AuditLogModel struct {
+	ID         int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`                       // 主键ID
+	Seq        int64  `json:"seq" gorm:"unique_index"`                                    // 链上序号，从1开始连续递增
+	Operator   string `json:"operator" gorm:"type:varchar(64);index"`                     // 操作人
+	Role       string `json:"role" gorm:"type:varchar(32)"`                               // 操作人角色
+	ClientIP   string `json:"client_ip" gorm:"type:varchar(64)"`                          // 来源IP
+	Route      string `json:"route" gorm:"type:varchar(128)"`                             // 接口路由
+	EntityType string `json:"entity_type" gorm:"type:varchar(64);index:idx_audit_entity"` // 操作对象类型
+	EntityID   string `json:"entity_id" gorm:"type:varchar(128);index:idx_audit_entity"`  // 操作对象id
+	ReqBody    string `json:"req_body" gorm:"type:text"`                                  // 请求内容（已脱敏）
+	Diff       string `json:"diff" gorm:"type:text"`                                      // 变更前后的字段（已脱敏）
+	ResultCode int    `json:"result_code"`                                                // 返回码
+	ResultMsg  string `json:"result_msg" gorm:"type:varchar(512)"`                        // 返回信息
+	CreatedTs  int64  `json:"created_ts" gorm:"index"`                                    // 创建时间
+	PrevHash   string `json:"prev_hash" gorm:"type:varchar(64)"`                          // 上一条记录的Hash
+	Hash       string `json:"hash" gorm:"type:varchar(64)"`                               // 本条记录的Hash
+}
+
+const audit_log_tableName = "audit_log"
+
+// AuditLogInterface 审计日志数据模型接口
+type AuditLogInterface interface {
+	// 追加审计日志，在事务里接上链尾
+	AppendAuditLog(stAuditLogModel *AuditLogModel) error
+
+	// 按条件查询审计日志，按序号降序
+	GetAuditLogList(operator string, entityType string, entityId string, begTs int64, endTs int64, offset int, limit int) ([]AuditLogModel, error)
+
+	// 按序号升序获取一段审计日志，用于校验哈希链
+	GetAuditLogListBySeq(begSeq int64, limit int) ([]AuditLogModel, error)
+}
+
+// AuditLogInterfaceImp 审计日志数据模型实现
+type AuditLogInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpAuditLog AuditLogInterface = &AuditLogInterfaceImp{}
+
+func (imp *AuditLogInterfaceImp) AppendAuditLog(stAuditLogModel *AuditLogModel) error {
+	cli := db.Get()
+	return cli.Transaction(func(tx *gorm.DB) error {
+		// 锁住链尾，多实例同时写入时串行接链
+		var last AuditLogModel
+		err := tx.Set("gorm:query_option", "FOR UPDATE").Table(audit_log_tableName).Order("seq DESC").Limit(1).Find(&last).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		stAuditLogModel.Seq = last.Seq + 1
+		stAuditLogModel.PrevHash = last.Hash
+		stAuditLogModel.Hash = calcAuditLogHash(stAuditLogModel)
+		return tx.Table(audit_log_tableName).Create(stAuditLogModel).Error
+	})
+}
+
+func (imp *AuditLogInterfaceImp) GetAuditLogList(operator string, entityType string, entityId string, begTs int64, endTs int64, offset int, limit int) ([]AuditLogModel, error) {
+	var vecAuditLogModel []AuditLogModel
+	cli := db.Get().Table(audit_log_tableName)
+	if operator != "" {
+		cli = cli.Where("operator = ?", operator)
+	}
+	if entityType != "" {
+		cli = cli.Where("entity_type = ?", entityType)
+	}
+	if entityId != "" {
+		cli = cli.Where("entity_id = ?", entityId)
+	}
+	if begTs > 0 {
+		cli = cli.Where("created_ts >= ?", begTs)
+	}
+	if endTs > 0 {
+		cli = cli.Where("created_ts < ?", endTs)
+	}
+	err := cli.Order("seq DESC").Offset(offset).Limit(limit).Find(&vecAuditLogModel).Error
+	return vecAuditLogModel, err
+}
+
+func (imp *AuditLogInterfaceImp) GetAuditLogListBySeq(begSeq int64, limit int) ([]AuditLogModel, error) {
+	var vecAuditLogModel []AuditLogModel
+	cli := db.Get()
+	err := cli.Table(audit_log_tableName).Where("seq >= ?", begSeq).Order("seq ASC").Limit(limit).Find(&vecAuditLogModel).Error
+	return vecAuditLogModel, err
+}
+
+// calcAuditLogHash 计算审计日志的Hash，包含上一条的Hash和本条全部内容
+func calcAuditLogHash(log *AuditLogModel) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%d\n%s\n%d",
+		log.PrevHash, log.Seq, log.Operator, log.Role, log.ClientIP, log.Route, log.EntityType, log.EntityID,
+		log.ReqBody, log.Diff, log.ResultCode, log.ResultMsg, log.CreatedTs)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// auditFieldChange 单个字段的变更
+type auditFieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// auditEntityChange 单个对象的变更
+type auditEntityChange struct {
+	EntityType string                      `json:"entity_type"`
+	EntityID   string                      `json:"entity_id"`
+	Fields     map[string]auditFieldChange `json:"fields"`
+}
+
+// auditContext 一次请求的审计信息，由中间件创建，handler通过 AddAuditChange 补充变更内容
+type auditContext struct {
+	mu        sync.Mutex
+	vecChange []auditEntityChange
+}
+
+type auditCtxKey struct{}
+
+// AddAuditChange 记录一个对象的变更，before为变更前的数据（新建时传nil），after为更新的列或变更后的数据
+// 列名需要和before序列化后的json字段名一致，只记录前后不同的字段
+func AddAuditChange(r *http.Request, entityType string, entityId string, before interface{}, after interface{}) {
+	auditCtx, _ := r.Context().Value(auditCtxKey{}).(*auditContext)
+	if auditCtx == nil {
+		return
+	}
+
+	mapBefore := make(map[string]interface{})
+	if before != nil {
+		if data, err := json.Marshal(before); err == nil {
+			json.Unmarshal(data, &mapBefore)
+		}
+	}
+
+	// 统一转成json类型再比较，避免int和float64之类的差异
+	mapAfter := make(map[string]interface{})
+	if data, err := json.Marshal(after); err == nil {
+		json.Unmarshal(data, &mapAfter)
+	}
+
+	change := auditEntityChange{
+		EntityType: entityType,
+		EntityID:   entityId,
+		Fields:     make(map[string]auditFieldChange),
+	}
+	for k, afterValue := range mapAfter {
+		beforeValue, ok := mapBefore[k]
+		if ok && fmt.Sprint(beforeValue) == fmt.Sprint(afterValue) {
+			continue
+		}
+		change.Fields[k] = auditFieldChange{Before: maskAuditValue(k, beforeValue), After: maskAuditValue(k, afterValue)}
+	}
+
+	auditCtx.mu.Lock()
+	auditCtx.vecChange = append(auditCtx.vecChange, change)
+	auditCtx.mu.Unlock()
+}
+
+// 请求内容最多记录的字节数
+const auditReqBodyMaxLen = 16 * 1024
+
+// auditResponseWriter 记录handler的回包，用于提取返回码
+type auditResponseWriter struct {
+	http.ResponseWriter
+	buf bytes.Buffer
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	w.buf.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// serveWithAudit 执行handler并写审计日志，审计日志写入失败只打告警日志，不影响接口返回
+func serveWithAudit(handler http.Handler, w http.ResponseWriter, r *http.Request, pattern string) {
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		Printf("serveWithAudit read body err, err:%+v route:%s\n", err, pattern)
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+
+	auditCtx := &auditContext{}
+	r = r.WithContext(context.WithValue(r.Context(), auditCtxKey{}, auditCtx))
+	aw := &auditResponseWriter{ResponseWriter: w}
+	handler.ServeHTTP(aw, r)
+
+	stAuditLogModel := &AuditLogModel{
+		Route:     pattern,
+		ClientIP:  getClientIP(r),
+		ReqBody:   maskAuditJson(reqBody, auditReqBodyMaxLen),
+		CreatedTs: time.Now().Unix(),
+	}
+	if identity := getOperatorIdentity(r); identity != nil {
+		stAuditLogModel.Operator = identity.Operator
+		stAuditLogModel.Role = identity.Role
+	}
+
+	// 返回码兼容 code 和 errcode 两种字段
+	var rspResult struct {
+		Code     *int   `json:"code"`
+		ErrCode  *int   `json:"errcode"`
+		ErrorMsg string `json:"errorMsg"`
+		ErrMsg   string `json:"errmsg"`
+	}
+	if err := json.Unmarshal(aw.buf.Bytes(), &rspResult); err == nil {
+		if rspResult.Code != nil {
+			stAuditLogModel.ResultCode = *rspResult.Code
+		} else if rspResult.ErrCode != nil {
+			stAuditLogModel.ResultCode = *rspResult.ErrCode
+		}
+		stAuditLogModel.ResultMsg = rspResult.ErrorMsg + rspResult.ErrMsg
+		if len(stAuditLogModel.ResultMsg) > 512 {
+			stAuditLogModel.ResultMsg = stAuditLogModel.ResultMsg[:512]
+		}
+	}
+
+	auditCtx.mu.Lock()
+	vecChange := auditCtx.vecChange
+	auditCtx.mu.Unlock()
+	if len(vecChange) > 0 {
+		stAuditLogModel.EntityType = vecChange[0].EntityType
+		stAuditLogModel.EntityID = vecChange[0].EntityID
+		if data, err := json.Marshal(vecChange); err == nil {
+			stAuditLogModel.Diff = string(data)
+		}
+	}
+
+	// 接链失败时重试，多实例首条记录同时写入时唯一索引会冲突
+	for i := 0; i < 3; i++ {
+		if err = ImpAuditLog.AppendAuditLog(stAuditLogModel); err == nil {
+			// 链尾Hash同时打到日志里，作为库外的锚点，用于发现链尾记录被删除
+			Printf("serveWithAudit append succ, seq:%d hash:%s route:%s operator:%s\n", stAuditLogModel.Seq, stAuditLogModel.Hash, pattern, stAuditLogModel.Operator)
+			return
+		}
+	}
+	Printf("[AuditAlarm]serveWithAudit AppendAuditLog err, err:%+v log:%+v\n", err, stAuditLogModel)
+}
+
+// 需要脱敏的字段名关键字
+var (
+	vecAuditPhoneKey  = []string{"phone", "mobile"}
+	vecAuditSecretKey = []string{"password", "passwd", "token", "secret"}
+)
+
+// maskAuditJson 对json中的手机号、密码等字段脱敏，非json内容只记录长度
+func maskAuditJson(data []byte, maxLen int) string {
+	if len(data) == 0 {
+		return ""
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Sprintf("<non-json body, len:%d>", len(data))
+	}
+	masked, err := json.Marshal(maskAuditNode("", v))
+	if err != nil {
+		return ""
+	}
+	if len(masked) > maxLen {
+		return string(masked[:maxLen]) + "...(truncated)"
+	}
+	return string(masked)
+}
+
+func maskAuditNode(key string, v interface{}) interface{} {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for k, child := range node {
+			node[k] = maskAuditNode(k, child)
+		}
+		return node
+	case []interface{}:
+		for i, child := range node {
+			node[i] = maskAuditNode(key, child)
+		}
+		return node
+	default:
+		return maskAuditValue(key, v)
+	}
+}
+
+// maskAuditValue 按字段名对单个值脱敏
+func maskAuditValue(key string, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	lowerKey := strings.ToLower(key)
+	for _, k := range vecAuditSecretKey {
+		if strings.Contains(lowerKey, k) {
+			return "***"
+		}
+	}
+	for _, k := range vecAuditPhoneKey {
+		if strings.Contains(lowerKey, k) {
+			return maskPhone(fmt.Sprint(v))
+		}
+	}
+	return v
+}
+
+// maskPhone 手机号只保留前3位和后4位
+func maskPhone(phone string) string {
+	if len(phone) < 7 {
+		return "***"
+	}
+	return phone[:3] + "****" + phone[len(phone)-4:]
+}
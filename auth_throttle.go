@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/db"
+)
+
+// 密码错误计数的维度
+const (
+	AuthThrottleScope_User = "user" // 按登录名计数
+	AuthThrottleScope_IP   = "ip"   // 按来源IP计数
+)
+
+// 密码错误限制策略：超过免惩罚次数后，每多错一次锁定时间翻倍，直到最长锁定时间
+const (
+	authThrottleUserFreeCnt = 3         // 同一登录名允许连续错误的次数
+	authThrottleIPFreeCnt   = 10        // 同一IP允许连续错误的次数（IP下可能有多个账号）
+	authThrottleBaseLockSec = 5         // 第一次锁定的时长
+	authThrottleMaxLockSec  = 30 * 60   // 最长锁定时长
+	authThrottleResetSec    = 24 * 3600 // 超过这个时间没有再出错，计数清零
+)
+
+// AuthThrottleModel 登录失败计数，存在数据库中，多实例共享
+type AuthThrottleModel struct {
+	ID          int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`                            // 主键ID
+	Scope       string `json:"scope" gorm:"type:varchar(16);unique_index:uk_scope_key"`         // 计数维度
+	ThrottleKey string `json:"throttle_key" gorm:"type:varchar(128);unique_index:uk_scope_key"` // 登录名或IP
+	FailCnt     int    `json:"fail_cnt"`                                                        // 连续错误次数
+	LastFailTs  int64  `json:"last_fail_ts"`                                                    // 最后一次错误时间
+	LockUntilTs int64  `json:"lock_until_ts"`                                                   // 锁定到什么时候
+	UpdatedTs   int64  `json:"updated_ts"`                                                      // 更新时间
+}
+
+const auth_throttle_tableName = "auth_throttle"
+
+// 安全事件类型
+const (
+	SecurityEvent_AuthFail     = "auth_fail"     // 密码错误
+	SecurityEvent_AuthLock     = "auth_lock"     // 错误次数过多被锁定
+	SecurityEvent_LockedReject = "locked_reject" // 锁定期间的请求被拒绝
+	SecurityEvent_Unlock       = "unlock"        // 管理员解锁
+)
+
+// SecurityEventModel 安全事件记录
+type SecurityEventModel struct {
+	ID        int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`   // 主键ID
+	EventType string `json:"event_type" gorm:"type:varchar(32)"`     // 事件类型
+	Username  string `json:"username" gorm:"type:varchar(64);index"` // 涉及的登录名
+	ClientIP  string `json:"client_ip" gorm:"type:varchar(64)"`      // 来源IP
+	Detail    string `json:"detail" gorm:"type:varchar(512)"`        // 详情
+	Operator  string `json:"operator" gorm:"type:varchar(64)"`       // 操作人（管理员解锁时有值）
+	CreatedTs int64  `json:"created_ts" gorm:"index"`                // 创建时间
+}
+
+const security_event_tableName = "security_event"
+
+// AuthThrottleInterface 登录失败计数数据模型接口
+type AuthThrottleInterface interface {
+	// 获取计数，没有记录时返回 gorm.ErrRecordNotFound
+	GetThrottle(scope string, key string) (*AuthThrottleModel, error)
+
+	// 记录一次错误，返回更新后的计数
+	IncrFail(scope string, key string, nowTs int64) (*AuthThrottleModel, error)
+
+	// 清零计数并解除锁定
+	ResetThrottle(scope string, key string) error
+
+	// 记录安全事件
+	AddSecurityEvent(stSecurityEventModel *SecurityEventModel) error
+
+	// 查询安全事件，按时间降序
+	GetSecurityEventList(username string, offset int, limit int) ([]SecurityEventModel, error)
+}
+
+// AuthThrottleInterfaceImp 登录失败计数数据模型实现
+type AuthThrottleInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpAuthThrottle AuthThrottleInterface = &AuthThrottleInterfaceImp{}
+
+func (imp *AuthThrottleInterfaceImp) GetThrottle(scope string, key string) (*AuthThrottleModel, error) {
+	var throttle = new(AuthThrottleModel)
+	cli := db.Get()
+	err := cli.Table(auth_throttle_tableName).Where("scope = ? AND throttle_key = ?", scope, key).First(throttle).Error
+	return throttle, err
+}
+
+func (imp *AuthThrottleInterfaceImp) IncrFail(scope string, key string, nowTs int64) (*AuthThrottleModel, error) {
+	var throttle AuthThrottleModel
+	var err error
+	// 首次出错时多个实例可能同时插入，唯一索引冲突后重试一次走更新
+	for i := 0; i < 2; i++ {
+		err = db.Get().Transaction(func(tx *gorm.DB) error {
+			throttle = AuthThrottleModel{}
+			errFind := tx.Set("gorm:query_option", "FOR UPDATE").Table(auth_throttle_tableName).
+				Where("scope = ? AND throttle_key = ?", scope, key).First(&throttle).Error
+			if errFind != nil && !gorm.IsRecordNotFoundError(errFind) {
+				return errFind
+			}
+			if errFind != nil {
+				throttle = AuthThrottleModel{Scope: scope, ThrottleKey: key}
+			}
+			if nowTs-throttle.LastFailTs > authThrottleResetSec {
+				throttle.FailCnt = 0
+			}
+			throttle.FailCnt++
+			throttle.LastFailTs = nowTs
+			throttle.UpdatedTs = nowTs
+			if lockSec := calcAuthLockSec(scope, throttle.FailCnt); lockSec > 0 {
+				throttle.LockUntilTs = nowTs + lockSec
+			}
+			if throttle.ID == 0 {
+				return tx.Table(auth_throttle_tableName).Create(&throttle).Error
+			}
+			mapUpdates := make(map[string]interface{})
+			mapUpdates["fail_cnt"] = throttle.FailCnt
+			mapUpdates["last_fail_ts"] = throttle.LastFailTs
+			mapUpdates["lock_until_ts"] = throttle.LockUntilTs
+			mapUpdates["updated_ts"] = throttle.UpdatedTs
+			return tx.Table(auth_throttle_tableName).Model(&AuthThrottleModel{}).Where("id = ?", throttle.ID).Updates(mapUpdates).Error
+		})
+		if err == nil {
+			return &throttle, nil
+		}
+	}
+	return nil, err
+}
+
+func (imp *AuthThrottleInterfaceImp) ResetThrottle(scope string, key string) error {
+	cli := db.Get()
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["fail_cnt"] = 0
+	mapUpdates["lock_until_ts"] = 0
+	mapUpdates["updated_ts"] = time.Now().Unix()
+	return cli.Table(auth_throttle_tableName).Model(&AuthThrottleModel{}).
+		Where("scope = ? AND throttle_key = ? AND (fail_cnt > 0 OR lock_until_ts > 0)", scope, key).Updates(mapUpdates).Error
+}
+
+func (imp *AuthThrottleInterfaceImp) AddSecurityEvent(stSecurityEventModel *SecurityEventModel) error {
+	cli := db.Get()
+	return cli.Table(security_event_tableName).Create(stSecurityEventModel).Error
+}
+
+func (imp *AuthThrottleInterfaceImp) GetSecurityEventList(username string, offset int, limit int) ([]SecurityEventModel, error) {
+	var vecSecurityEventModel []SecurityEventModel
+	cli := db.Get().Table(security_event_tableName)
+	if username != "" {
+		cli = cli.Where("username = ?", username)
+	}
+	err := cli.Order("id DESC").Offset(offset).Limit(limit).Find(&vecSecurityEventModel).Error
+	return vecSecurityEventModel, err
+}
+
+// calcAuthLockSec 按连续错误次数计算锁定时长，未超过免惩罚次数时返回0
+func calcAuthLockSec(scope string, failCnt int) int64 {
+	freeCnt := authThrottleUserFreeCnt
+	if scope == AuthThrottleScope_IP {
+		freeCnt = authThrottleIPFreeCnt
+	}
+	if failCnt <= freeCnt {
+		return 0
+	}
+	lockSec := int64(authThrottleBaseLockSec)
+	for i := freeCnt + 1; i < failCnt && lockSec < authThrottleMaxLockSec; i++ {
+		lockSec *= 2
+	}
+	if lockSec > authThrottleMaxLockSec {
+		lockSec = authThrottleMaxLockSec
+	}
+	return lockSec
+}
+
+// addSecurityEvent 记录安全事件，失败只打日志
+func addSecurityEvent(eventType string, username string, clientIP string, detail string, operator string) {
+	stSecurityEventModel := &SecurityEventModel{
+		EventType: eventType,
+		Username:  username,
+		ClientIP:  clientIP,
+		Detail:    detail,
+		Operator:  operator,
+		CreatedTs: time.Now().Unix(),
+	}
+	if err := ImpAuthThrottle.AddSecurityEvent(stSecurityEventModel); err != nil {
+		Printf("addSecurityEvent err, err:%+v event:%+v\n", err, stSecurityEventModel)
+	}
+}
+
+// checkAuthLocked 检查登录名和IP是否处于锁定中，返回剩余锁定秒数，未锁定返回0
+// 查询计数失败时不拦截，避免数据库抖动导致所有人无法登录
+func checkAuthLocked(username string, clientIP string) int64 {
+	nowTs := time.Now().Unix()
+	var remainSec int64
+	for _, v := range [][2]string{{AuthThrottleScope_User, username}, {AuthThrottleScope_IP, clientIP}} {
+		if v[1] == "" {
+			continue
+		}
+		throttle, err := ImpAuthThrottle.GetThrottle(v[0], v[1])
+		if err != nil {
+			if !gorm.IsRecordNotFoundError(err) {
+				Printf("checkAuthLocked GetThrottle err, err:%+v scope:%s key:%s\n", err, v[0], v[1])
+			}
+			continue
+		}
+		if throttle.LockUntilTs-nowTs > remainSec {
+			remainSec = throttle.LockUntilTs - nowTs
+		}
+	}
+	return remainSec
+}
+
+// recordAuthFail 记录一次密码错误，按登录名和IP分别计数，触发锁定时记录安全事件
+func recordAuthFail(username string, clientIP string) {
+	nowTs := time.Now().Unix()
+	addSecurityEvent(SecurityEvent_AuthFail, username, clientIP, "", "")
+	for _, v := range [][2]string{{AuthThrottleScope_User, username}, {AuthThrottleScope_IP, clientIP}} {
+		if v[1] == "" {
+			continue
+		}
+		throttle, err := ImpAuthThrottle.IncrFail(v[0], v[1], nowTs)
+		if err != nil {
+			Printf("recordAuthFail IncrFail err, err:%+v scope:%s key:%s\n", err, v[0], v[1])
+			continue
+		}
+		if throttle.LockUntilTs > nowTs {
+			detail := fmt.Sprintf("scope:%s fail_cnt:%d lock_sec:%d", v[0], throttle.FailCnt, throttle.LockUntilTs-nowTs)
+			addSecurityEvent(SecurityEvent_AuthLock, username, clientIP, detail, "")
+			Printf("[SecurityAlarm]recordAuthFail locked, username:%s ip:%s %s\n", username, clientIP, detail)
+		}
+	}
+}
+
+// resetAuthFail 登录成功后清零登录名的计数，IP计数保留，防止用一个已知账号给IP解锁
+func resetAuthFail(username string) {
+	if err := ImpAuthThrottle.ResetThrottle(AuthThrottleScope_User, username); err != nil {
+		Printf("resetAuthFail ResetThrottle err, err:%+v username:%s\n", err, username)
+	}
+}
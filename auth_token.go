@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/db"
+)
+
+// 令牌有效期
+const (
+	accessTokenTTLSec  = 2 * 3600      // 访问令牌有效期2小时
+	refreshTokenTTLSec = 7 * 24 * 3600 // 刷新令牌有效期7天，从登录开始计算，刷新不延长，即登录态最长保持7天
+)
+
+// 令牌类型
+const (
+	tokenType_Access  = "access"
+	tokenType_Refresh = "refresh"
+)
+
+var (
+	errTokenSecretNotSet = errors.New("AUTH_TOKEN_SECRET not set")
+	errTokenInvalid      = errors.New("token invalid")
+	errTokenExpired      = errors.New("token expired")
+	errSessionRevoked    = errors.New("session revoked")
+)
+
+// OperatorSessionModel 操作员登录会话，令牌中携带会话id，撤销会话后该会话签发的令牌全部失效
+type OperatorSessionModel struct {
+	ID              int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`            // 主键ID
+	SessionID       string `json:"session_id" gorm:"type:varchar(64);unique_index"` // 会话id
+	Operator        string `json:"operator" gorm:"type:varchar(64);index"`          // 登录名
+	Role            string `json:"role" gorm:"type:varchar(32)"`                    // 登录时的角色
+	RefreshSeq      int    `json:"refresh_seq"`                                     // 刷新序号，每次刷新加1，旧的刷新令牌立即失效
+	RefreshExpireTs int64  `json:"refresh_expire_ts"`                               // 会话过期时间
+	Revoked         bool   `json:"revoked"`                                         // 是否已撤销
+	RevokedBy       string `json:"revoked_by"`                                      // 撤销人
+	ClientIP        string `json:"client_ip"`                                       // 登录IP
+	CreatedTs       int64  `json:"created_ts"`                                      // 创建时间
+	UpdatedTs       int64  `json:"updated_ts"`                                      // 更新时间
+}
+
+const operator_session_tableName = "operator_session"
+
+// OperatorSessionInterface 操作员会话数据模型接口
+type OperatorSessionInterface interface {
+	// 添加会话
+	AddSession(stOperatorSessionModel *OperatorSessionModel) error
+
+	// 根据会话id获取会话
+	GetSession(sessionId string) (*OperatorSessionModel, error)
+
+	// 刷新序号为fromSeq时才加1，返回是否更新成功
+	IncrRefreshSeq(sessionId string, fromSeq int) (bool, error)
+
+	// 撤销会话
+	RevokeSession(sessionId string, revokedBy string) error
+
+	// 撤销某个操作员的全部会话
+	RevokeOperatorSessions(operator string, revokedBy string) error
+}
+
+// OperatorSessionInterfaceImp 操作员会话数据模型实现
+type OperatorSessionInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpOperatorSession OperatorSessionInterface = &OperatorSessionInterfaceImp{}
+
+func (imp *OperatorSessionInterfaceImp) AddSession(stOperatorSessionModel *OperatorSessionModel) error {
+	cli := db.Get()
+	return cli.Table(operator_session_tableName).Create(stOperatorSessionModel).Error
+}
+
+func (imp *OperatorSessionInterfaceImp) GetSession(sessionId string) (*OperatorSessionModel, error) {
+	var session = new(OperatorSessionModel)
+	cli := db.Get()
+	err := cli.Table(operator_session_tableName).Where("session_id = ?", sessionId).First(session).Error
+	return session, err
+}
+
+func (imp *OperatorSessionInterfaceImp) IncrRefreshSeq(sessionId string, fromSeq int) (bool, error) {
+	cli := db.Get()
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["refresh_seq"] = fromSeq + 1
+	mapUpdates["updated_ts"] = time.Now().Unix()
+	result := cli.Table(operator_session_tableName).Model(&OperatorSessionModel{}).
+		Where("session_id = ? AND refresh_seq = ? AND revoked = ?", sessionId, fromSeq, false).Updates(mapUpdates)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (imp *OperatorSessionInterfaceImp) RevokeSession(sessionId string, revokedBy string) error {
+	cli := db.Get()
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["revoked"] = true
+	mapUpdates["revoked_by"] = revokedBy
+	mapUpdates["updated_ts"] = time.Now().Unix()
+	return cli.Table(operator_session_tableName).Model(&OperatorSessionModel{}).Where("session_id = ?", sessionId).Updates(mapUpdates).Error
+}
+
+func (imp *OperatorSessionInterfaceImp) RevokeOperatorSessions(operator string, revokedBy string) error {
+	cli := db.Get()
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["revoked"] = true
+	mapUpdates["revoked_by"] = revokedBy
+	mapUpdates["updated_ts"] = time.Now().Unix()
+	return cli.Table(operator_session_tableName).Model(&OperatorSessionModel{}).
+		Where("operator = ? AND revoked = ?", operator, false).Updates(mapUpdates).Error
+}
+
+// authTokenClaims 令牌内容
+type authTokenClaims struct {
+	SessionID string `json:"sid"`           // 会话id
+	Operator  string `json:"op"`            // 登录名
+	Role      string `json:"role"`          // 角色
+	Type      string `json:"typ"`           // 令牌类型
+	Seq       int    `json:"seq,omitempty"` // 刷新序号（仅刷新令牌）
+	Iat       int64  `json:"iat"`           // 签发时间
+	Exp       int64  `json:"exp"`           // 过期时间
+}
+
+// getTokenSecret 令牌签名密钥，通过环境变量 AUTH_TOKEN_SECRET 配置，多实例需保持一致
+func getTokenSecret() ([]byte, error) {
+	secret := os.Getenv("AUTH_TOKEN_SECRET")
+	if len(secret) == 0 {
+		return nil, errTokenSecretNotSet
+	}
+	return []byte(secret), nil
+}
+
+// signToken 签发令牌，格式为 base64url(内容).base64url(HMAC-SHA256签名)
+func signToken(claims authTokenClaims) (string, error) {
+	secret, err := getTokenSecret()
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	strPayload := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strPayload))
+	return strPayload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// parseToken 校验签名和有效期并解析令牌内容
+func parseToken(token string, tokenType string) (*authTokenClaims, error) {
+	secret, err := getTokenSecret()
+	if err != nil {
+		return nil, err
+	}
+	vecPart := strings.Split(token, ".")
+	if len(vecPart) != 2 {
+		return nil, errTokenInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(vecPart[1])
+	if err != nil {
+		return nil, errTokenInvalid
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(vecPart[0]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(vecPart[0])
+	if err != nil {
+		return nil, errTokenInvalid
+	}
+	claims := &authTokenClaims{}
+	if err = json.Unmarshal(payload, claims); err != nil {
+		return nil, errTokenInvalid
+	}
+	if claims.Type != tokenType {
+		return nil, errTokenInvalid
+	}
+	if claims.Exp <= time.Now().Unix() {
+		return nil, errTokenExpired
+	}
+	return claims, nil
+}
+
+// genSessionId 生成随机会话id
+func genSessionId() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// AuthTokenPair 登录或刷新后下发的令牌
+type AuthTokenPair struct {
+	AccessToken     string `json:"access_token"`      // 访问令牌，请求时放在 Authorization: Bearer 中
+	AccessExpireTs  int64  `json:"access_expire_ts"`  // 访问令牌过期时间
+	RefreshToken    string `json:"refresh_token"`     // 刷新令牌，只用于换取新的令牌，每次刷新后旧的失效
+	RefreshExpireTs int64  `json:"refresh_expire_ts"` // 刷新令牌过期时间
+}
+
+// issueTokenPair 为会话签发访问令牌和刷新令牌
+func issueTokenPair(session *OperatorSessionModel, nowTs int64) (AuthTokenPair, error) {
+	var pair AuthTokenPair
+	accessToken, err := signToken(authTokenClaims{
+		SessionID: session.SessionID,
+		Operator:  session.Operator,
+		Role:      session.Role,
+		Type:      tokenType_Access,
+		Iat:       nowTs,
+		Exp:       nowTs + accessTokenTTLSec,
+	})
+	if err != nil {
+		return pair, err
+	}
+	refreshToken, err := signToken(authTokenClaims{
+		SessionID: session.SessionID,
+		Operator:  session.Operator,
+		Role:      session.Role,
+		Type:      tokenType_Refresh,
+		Seq:       session.RefreshSeq,
+		Iat:       nowTs,
+		Exp:       session.RefreshExpireTs,
+	})
+	if err != nil {
+		return pair, err
+	}
+	pair.AccessToken = accessToken
+	pair.AccessExpireTs = nowTs + accessTokenTTLSec
+	if pair.AccessExpireTs > session.RefreshExpireTs {
+		pair.AccessExpireTs = session.RefreshExpireTs
+	}
+	pair.RefreshToken = refreshToken
+	pair.RefreshExpireTs = session.RefreshExpireTs
+	return pair, nil
+}
+
+// getBearerToken 从 Authorization header 中提取令牌
+func getBearerToken(r *http.Request) string {
+	strAuth := r.Header.Get("Authorization")
+	if len(strAuth) > 7 && strings.EqualFold(strAuth[:7], "Bearer ") {
+		return strings.TrimSpace(strAuth[7:])
+	}
+	return ""
+}
+
+// validateAccessToken 校验访问令牌，会话被撤销或过期时令牌失效
+func validateAccessToken(token string) (*authTokenClaims, error) {
+	claims, err := parseToken(token, tokenType_Access)
+	if err != nil {
+		return nil, err
+	}
+	session, err := ImpOperatorSession.GetSession(claims.SessionID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errSessionRevoked
+		}
+		return nil, err
+	}
+	if session.Revoked || session.RefreshExpireTs <= time.Now().Unix() {
+		return nil, errSessionRevoked
+	}
+	return claims, nil
+}
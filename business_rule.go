@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/db"
+)
+
+// 扫描任务使用的业务规则
+const (
+	BizRule_MissedGraceSec        = "missed_grace_sec"         // 课程结束后多久还没核销才标记旷课（秒）
+	BizRule_MissedReturnMinute    = "missed_return_minute"     // 每天几点开始归还旷课课时（当天0点起的分钟数）
+	BizRule_LessonStartRemindSec  = "lesson_start_remind_sec"  // 私教课开课前多久提醒学员（秒）
+	BizRule_CommentRemindDelaySec = "comment_remind_delay_sec" // 私教课结束后多久提醒评价（秒）
+	BizRule_PassCardRemindBegSec  = "pass_card_remind_beg_sec" // 通卡锻炼前提醒窗口的开始，距开始时间（秒）
+	BizRule_PassCardRemindEndSec  = "pass_card_remind_end_sec" // 通卡锻炼前提醒窗口的结束，距开始时间（秒）
+	BizRule_TrialRemindDay        = "trial_remind_day"         // 体验课包领取后第几天开始提醒即将过期
+	BizRule_TrialValidDay         = "trial_valid_day"          // 体验课包的有效天数
+	BizRule_NoShowWindowDay       = "noshow_window_day"        // 统计学员旷课次数的滚动窗口（天）
+	BizRule_NoShowThreshold       = "noshow_threshold"         // 窗口内旷课达到多少次开始处罚，0表示不处罚
+	BizRule_NoShowAction          = "noshow_action"            // 达到次数后的处罚方式，见 NoShowAction_*
+	BizRule_NoShowBlockDay        = "noshow_block_day"         // 处罚方式为暂停预约时，暂停的天数
+)
+
+// 规则的生效范围，同一规则按 课程 > 场地 > 全局 > 内置默认值 的顺序取值
+const (
+	BizRuleScope_Global      = "global"        // 全局
+	BizRuleScope_Gym         = "gym"           // 私教场地
+	BizRuleScope_Course      = "course"        // 私教课程
+	BizRuleScope_PassCardGym = "pass_card_gym" // 通卡场地
+)
+
+// BizRuleDef 规则定义：默认值、取值范围和可以配置的范围
+type BizRuleDef struct {
+	Key      string   `json:"key"`       // 规则名
+	Desc     string   `json:"desc"`      // 说明
+	Unit     string   `json:"unit"`      // 单位
+	Default  int64    `json:"default"`   // 内置默认值
+	Min      int64    `json:"min"`       // 最小值（包含）
+	Max      int64    `json:"max"`       // 最大值（包含）
+	VecScope []string `json:"vec_scope"` // 可以配置的范围
+}
+
+var vecBizRuleDef = []BizRuleDef{
+	{
+		Key: BizRule_MissedGraceSec, Desc: "课程结束后多久还没核销才标记旷课", Unit: "秒",
+		Default: 1800, Min: 0, Max: 86400,
+		VecScope: []string{BizRuleScope_Global, BizRuleScope_Gym, BizRuleScope_Course},
+	},
+	{
+		// 只允许晚上归还，避免当天的课刚标记旷课就被归还
+		Key: BizRule_MissedReturnMinute, Desc: "每天几点开始归还旷课课时", Unit: "当天0点起的分钟数",
+		Default: 23*60 + 30, Min: 18 * 60, Max: 23*60 + 59,
+		VecScope: []string{BizRuleScope_Global, BizRuleScope_Gym, BizRuleScope_Course},
+	},
+	{
+		Key: BizRule_LessonStartRemindSec, Desc: "私教课开课前多久提醒学员", Unit: "秒",
+		Default: 3600, Min: 300, Max: 43200,
+		VecScope: []string{BizRuleScope_Global, BizRuleScope_Gym, BizRuleScope_Course},
+	},
+	{
+		Key: BizRule_CommentRemindDelaySec, Desc: "私教课结束后多久提醒评价", Unit: "秒",
+		Default: 3600, Min: 0, Max: 86400,
+		VecScope: []string{BizRuleScope_Global, BizRuleScope_Gym, BizRuleScope_Course},
+	},
+	{
+		Key: BizRule_PassCardRemindBegSec, Desc: "通卡锻炼前提醒窗口的开始，距开始时间", Unit: "秒",
+		Default: 7200, Min: 600, Max: 43200,
+		VecScope: []string{BizRuleScope_Global, BizRuleScope_PassCardGym},
+	},
+	{
+		Key: BizRule_PassCardRemindEndSec, Desc: "通卡锻炼前提醒窗口的结束，距开始时间，需小于窗口开始", Unit: "秒",
+		Default: 6600, Min: 0, Max: 43200,
+		VecScope: []string{BizRuleScope_Global, BizRuleScope_PassCardGym},
+	},
+	{
+		// 剩余天数会写进微信消息的备注，最多两位数才不超过字段长度
+		Key: BizRule_TrialRemindDay, Desc: "体验课包领取后第几天开始提醒即将过期，需小于有效天数", Unit: "天",
+		Default: 7, Min: 1, Max: 90,
+		VecScope: []string{BizRuleScope_Global, BizRuleScope_Gym, BizRuleScope_Course},
+	},
+	{
+		Key: BizRule_TrialValidDay, Desc: "体验课包的有效天数", Unit: "天",
+		Default: 14, Min: 1, Max: 90,
+		VecScope: []string{BizRuleScope_Global, BizRuleScope_Gym, BizRuleScope_Course},
+	},
+	{
+		Key: BizRule_NoShowWindowDay, Desc: "统计学员旷课次数的滚动窗口", Unit: "天",
+		Default: 30, Min: 1, Max: 365,
+		VecScope: []string{BizRuleScope_Global, BizRuleScope_Gym, BizRuleScope_Course},
+	},
+	{
+		Key: BizRule_NoShowThreshold, Desc: "窗口内旷课达到多少次开始处罚（含本次），0表示不处罚", Unit: "次",
+		Default: 0, Min: 0, Max: 100,
+		VecScope: []string{BizRuleScope_Global, BizRuleScope_Gym, BizRuleScope_Course},
+	},
+	{
+		Key: BizRule_NoShowAction, Desc: "处罚方式：1=不再自动归还课时 2=顾问审批后才归还 3=照常归还并暂停预约", Unit: "",
+		Default: NoShowAction_NoReturn, Min: NoShowAction_NoReturn, Max: NoShowAction_BlockBooking,
+		VecScope: []string{BizRuleScope_Global, BizRuleScope_Gym, BizRuleScope_Course},
+	},
+	{
+		Key: BizRule_NoShowBlockDay, Desc: "处罚方式为暂停预约时，暂停的天数", Unit: "天",
+		Default: 7, Min: 1, Max: 90,
+		VecScope: []string{BizRuleScope_Global, BizRuleScope_Gym, BizRuleScope_Course},
+	},
+}
+
+// 两个规则需要满足 Less 对应的值小于 Greater 对应的值
+var vecBizRulePair = []struct {
+	Less    string
+	Greater string
+}{
+	{Less: BizRule_PassCardRemindEndSec, Greater: BizRule_PassCardRemindBegSec},
+	{Less: BizRule_TrialRemindDay, Greater: BizRule_TrialValidDay},
+}
+
+func getBizRuleDef(key string) (BizRuleDef, bool) {
+	for _, v := range vecBizRuleDef {
+		if v.Key == key {
+			return v, true
+		}
+	}
+	return BizRuleDef{}, false
+}
+
+// checkBizRuleValue 检查规则在该范围下的取值是否合法，返回错误信息
+func checkBizRuleValue(key string, scopeType string, scopeId int64, value int64) string {
+	stDef, ok := getBizRuleDef(key)
+	if !ok {
+		return "规则不存在"
+	}
+	scopeAllowed := false
+	for _, v := range stDef.VecScope {
+		if v == scopeType {
+			scopeAllowed = true
+			break
+		}
+	}
+	if !scopeAllowed {
+		return "该规则不支持按此范围配置"
+	}
+	if scopeType == BizRuleScope_Global && scopeId != 0 {
+		return "全局规则的范围id必须为0"
+	}
+	if scopeType != BizRuleScope_Global && scopeId <= 0 {
+		return "范围id不合法"
+	}
+	if value < stDef.Min || value > stDef.Max {
+		return fmt.Sprintf("取值范围为%d~%d", stDef.Min, stDef.Max)
+	}
+	return ""
+}
+
+// BusinessRuleModel 按范围配置的规则值，没有配置的使用上一级范围或内置默认值
+type BusinessRuleModel struct {
+	ID        int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`                               // 主键ID
+	RuleKey   string `json:"rule_key" gorm:"type:varchar(64);unique_index:uniq_business_rule"`   // 规则名
+	ScopeType string `json:"scope_type" gorm:"type:varchar(16);unique_index:uniq_business_rule"` // 范围类型
+	ScopeID   int64  `json:"scope_id" gorm:"unique_index:uniq_business_rule"`                    // 范围id（场地id或课程id），全局为0
+	Value     int64  `json:"value"`                                                              // 规则值
+	UpdatedBy string `json:"updated_by" gorm:"type:varchar(64)"`                                 // 最后修改人
+	UpdatedTs int64  `json:"updated_ts"`                                                         // 最后修改时间
+}
+
+const business_rule_tableName = "business_rule"
+
+// 规则变更的类型
+const (
+	BizRuleAction_Set   = "set"   // 新增或修改
+	BizRuleAction_Reset = "reset" // 删除配置，恢复使用上一级范围或内置默认值
+)
+
+// BusinessRuleChangeModel 规则的变更历史
+type BusinessRuleChangeModel struct {
+	ID        int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`                              // 主键ID
+	RuleKey   string `json:"rule_key" gorm:"type:varchar(64);index:idx_business_rule_change"`   // 规则名
+	ScopeType string `json:"scope_type" gorm:"type:varchar(16);index:idx_business_rule_change"` // 范围类型
+	ScopeID   int64  `json:"scope_id" gorm:"index:idx_business_rule_change"`                    // 范围id
+	Action    string `json:"action" gorm:"type:varchar(16)"`                                    // 变更类型
+	OldValue  *int64 `json:"old_value"`                                                         // 变更前的值，之前没有配置时为空
+	NewValue  *int64 `json:"new_value"`                                                         // 变更后的值，恢复默认时为空
+	Reason    string `json:"reason" gorm:"type:varchar(256)"`                                   // 变更原因
+	Operator  string `json:"operator" gorm:"type:varchar(64)"`                                  // 操作人
+	CreatedTs int64  `json:"created_ts"`                                                        // 变更时间
+}
+
+const business_rule_change_tableName = "business_rule_change"
+
+// BusinessRuleInterface 业务规则数据模型接口
+type BusinessRuleInterface interface {
+	// 获取全部规则配置
+	GetAllBusinessRule() ([]BusinessRuleModel, error)
+
+	// 保存规则配置并记录变更历史，在同一个事务里
+	SaveBusinessRule(stBusinessRuleModel *BusinessRuleModel, stBusinessRuleChangeModel *BusinessRuleChangeModel) error
+
+	// 删除规则配置并记录变更历史，在同一个事务里
+	DeleteBusinessRule(id int64, stBusinessRuleChangeModel *BusinessRuleChangeModel) error
+
+	// 查询变更历史，按id降序，条件为空不过滤
+	GetBusinessRuleChangeList(ruleKey string, scopeType string, scopeId int64, offset int, limit int) ([]BusinessRuleChangeModel, error)
+}
+
+// BusinessRuleInterfaceImp 业务规则数据模型实现
+type BusinessRuleInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpBusinessRule BusinessRuleInterface = &BusinessRuleInterfaceImp{}
+
+func (imp *BusinessRuleInterfaceImp) GetAllBusinessRule() ([]BusinessRuleModel, error) {
+	var vecBusinessRuleModel []BusinessRuleModel
+	cli := db.Get()
+	err := cli.Table(business_rule_tableName).Order("id ASC").Find(&vecBusinessRuleModel).Error
+	return vecBusinessRuleModel, err
+}
+
+func (imp *BusinessRuleInterfaceImp) SaveBusinessRule(stBusinessRuleModel *BusinessRuleModel, stBusinessRuleChangeModel *BusinessRuleChangeModel) error {
+	return db.Get().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(business_rule_tableName).Save(stBusinessRuleModel).Error; err != nil {
+			return err
+		}
+		return tx.Table(business_rule_change_tableName).Create(stBusinessRuleChangeModel).Error
+	})
+}
+
+func (imp *BusinessRuleInterfaceImp) DeleteBusinessRule(id int64, stBusinessRuleChangeModel *BusinessRuleChangeModel) error {
+	return db.Get().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(business_rule_tableName).Where("id = ?", id).Delete(&BusinessRuleModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Table(business_rule_change_tableName).Create(stBusinessRuleChangeModel).Error
+	})
+}
+
+func (imp *BusinessRuleInterfaceImp) GetBusinessRuleChangeList(ruleKey string, scopeType string, scopeId int64, offset int, limit int) ([]BusinessRuleChangeModel, error) {
+	var vecBusinessRuleChangeModel []BusinessRuleChangeModel
+	cli := db.Get().Table(business_rule_change_tableName)
+	if ruleKey != "" {
+		cli = cli.Where("rule_key = ?", ruleKey)
+	}
+	if scopeType != "" {
+		cli = cli.Where("scope_type = ?", scopeType)
+	}
+	if scopeId > 0 {
+		cli = cli.Where("scope_id = ?", scopeId)
+	}
+	err := cli.Order("id DESC").Offset(offset).Limit(limit).Find(&vecBusinessRuleChangeModel).Error
+	return vecBusinessRuleChangeModel, err
+}
+
+// BusinessRules 某一时刻的全部规则配置，扫描任务每次执行开始时加载一份，执行过程中不变
+type BusinessRules struct {
+	mapValue map[string]int64 // rule_key|scope_type|scope_id -> value
+}
+
+func genBizRuleKey(ruleKey string, scopeType string, scopeId int64) string {
+	return fmt.Sprintf("%s|%s|%d", ruleKey, scopeType, scopeId)
+}
+
+func newBusinessRules(vecBusinessRuleModel []BusinessRuleModel) *BusinessRules {
+	rules := &BusinessRules{mapValue: make(map[string]int64)}
+	for _, v := range vecBusinessRuleModel {
+		if errMsg := checkBizRuleValue(v.RuleKey, v.ScopeType, v.ScopeID, v.Value); errMsg != "" {
+			Printf("[RuleAlarm]business rule invalid, ignored, reason:%s rule:%+v\n", errMsg, v)
+			continue
+		}
+		rules.mapValue[genBizRuleKey(v.RuleKey, v.ScopeType, v.ScopeID)] = v.Value
+	}
+	return rules
+}
+
+type bizRuleScope struct {
+	scopeType string
+	scopeId   int64
+}
+
+// get 按传入范围的顺序取第一个有配置的值，都没有时取全局配置，再没有取内置默认值
+func (rules *BusinessRules) get(key string, vecScope ...bizRuleScope) int64 {
+	for _, v := range vecScope {
+		if value, ok := rules.mapValue[genBizRuleKey(key, v.scopeType, v.scopeId)]; ok {
+			return value
+		}
+	}
+	return rules.global(key)
+}
+
+// global 全局配置的值，没有配置时取内置默认值
+func (rules *BusinessRules) global(key string) int64 {
+	if value, ok := rules.mapValue[genBizRuleKey(key, BizRuleScope_Global, 0)]; ok {
+		return value
+	}
+	stDef, _ := getBizRuleDef(key)
+	return stDef.Default
+}
+
+// lesson 私教课相关的规则，课程配置优先于场地配置
+func (rules *BusinessRules) lesson(key string, gymId int, courseId int) int64 {
+	return rules.get(key, bizRuleScope{BizRuleScope_Course, int64(courseId)}, bizRuleScope{BizRuleScope_Gym, int64(gymId)})
+}
+
+// minValue 规则在所有范围中最小的值
+func (rules *BusinessRules) minValue(key string) int64 {
+	value := rules.global(key)
+	prefix := key + "|"
+	for k, v := range rules.mapValue {
+		if strings.HasPrefix(k, prefix) && v < value {
+			value = v
+		}
+	}
+	return value
+}
+
+// maxValue 规则在所有范围中最大的值，用于确定扫描的时间范围
+func (rules *BusinessRules) maxValue(key string) int64 {
+	value := rules.global(key)
+	prefix := key + "|"
+	for k, v := range rules.mapValue {
+		if strings.HasPrefix(k, prefix) && v > value {
+			value = v
+		}
+	}
+	return value
+}
+
+// passCardRemindWindow 通卡锻炼前提醒的窗口，配置组合出的窗口不合法时使用内置默认值
+func (rules *BusinessRules) passCardRemindWindow(gymId int) (int64, int64) {
+	scope := bizRuleScope{BizRuleScope_PassCardGym, int64(gymId)}
+	begSec := rules.get(BizRule_PassCardRemindBegSec, scope)
+	endSec := rules.get(BizRule_PassCardRemindEndSec, scope)
+	if endSec >= begSec {
+		Printf("[RuleAlarm]pass card remind window invalid, use default, gymId:%d beg:%d end:%d\n", gymId, begSec, endSec)
+		begDef, _ := getBizRuleDef(BizRule_PassCardRemindBegSec)
+		endDef, _ := getBizRuleDef(BizRule_PassCardRemindEndSec)
+		return begDef.Default, endDef.Default
+	}
+	return begSec, endSec
+}
+
+// trialExpireDays 体验课包开始提醒的天数和有效天数，配置组合不合法时使用内置默认值
+func (rules *BusinessRules) trialExpireDays(gymId int, courseId int) (int64, int64) {
+	remindDay := rules.lesson(BizRule_TrialRemindDay, gymId, courseId)
+	validDay := rules.lesson(BizRule_TrialValidDay, gymId, courseId)
+	if remindDay >= validDay {
+		Printf("[RuleAlarm]trial expire days invalid, use default, gymId:%d courseId:%d remind:%d valid:%d\n", gymId, courseId, remindDay, validDay)
+		remindDef, _ := getBizRuleDef(BizRule_TrialRemindDay)
+		validDef, _ := getBizRuleDef(BizRule_TrialValidDay)
+		return remindDef.Default, validDef.Default
+	}
+	return remindDay, validDay
+}
+
+// 最近一次成功加载的规则，数据库读取失败时沿用
+var lastBusinessRules struct {
+	mu    sync.Mutex
+	rules *BusinessRules
+}
+
+// loadBusinessRules 加载当前的规则配置，数据库读取失败时沿用上一次的结果，从未加载成功时使用内置默认值
+func loadBusinessRules() *BusinessRules {
+	lastBusinessRules.mu.Lock()
+	defer lastBusinessRules.mu.Unlock()
+	vecBusinessRuleModel, err := ImpBusinessRule.GetAllBusinessRule()
+	if err != nil {
+		Printf("[RuleAlarm]GetAllBusinessRule err, keep last rules, err:%+v\n", err)
+		if lastBusinessRules.rules == nil {
+			return newBusinessRules(nil)
+		}
+		return lastBusinessRules.rules
+	}
+	lastBusinessRules.rules = newBusinessRules(vecBusinessRuleModel)
+	return lastBusinessRules.rules
+}
+
+// minuteOfDay 当天0点起的分钟数
+func minuteOfDay(t time.Time) int64 {
+	return int64(t.Hour()*60 + t.Minute())
+}
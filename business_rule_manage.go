@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/db/dao"
+	"github.com/xionghengheng/ff_plib/db/pass_card_dao"
+)
+
+type GetBusinessRuleListReq struct {
+	GymId         int `json:"gym_id"`           // 私教场地id，传了会返回该场地下生效的值
+	CourseId      int `json:"course_id"`        // 私教课程id，传了会返回该课程下生效的值
+	PassCardGymId int `json:"pass_card_gym_id"` // 通卡场地id，传了会返回该通卡场地下生效的值
+}
+
+type GetBusinessRuleListRsp struct {
+	Code      int                 `json:"code"`
+	ErrorMsg  string              `json:"errorMsg,omitempty"`
+	VecDef    []BizRuleDef        `json:"vec_def,omitempty"`   // 全部规则的定义
+	List      []BusinessRuleModel `json:"list,omitempty"`      // 全部已配置的值
+	Effective map[string]int64    `json:"effective,omitempty"` // 按请求的场地、课程生效的值，都不传时为全局生效的值
+}
+
+func getGetBusinessRuleListReq(r *http.Request) (GetBusinessRuleListReq, error) {
+	req := GetBusinessRuleListReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// GetBusinessRuleListHandler 查询业务规则的定义、已配置的值和生效的值
+func GetBusinessRuleListHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getGetBusinessRuleListReq(r)
+	rsp := &GetBusinessRuleListRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetBusinessRuleListHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	vecBusinessRuleModel, err := ImpBusinessRule.GetAllBusinessRule()
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询业务规则失败"
+		Printf("GetBusinessRuleListHandler GetAllBusinessRule err, err:%+v\n", err)
+		return
+	}
+
+	rules := newBusinessRules(vecBusinessRuleModel)
+	rsp.Effective = make(map[string]int64)
+	for _, v := range vecBizRuleDef {
+		if v.Key == BizRule_PassCardRemindBegSec || v.Key == BizRule_PassCardRemindEndSec {
+			rsp.Effective[v.Key] = rules.get(v.Key, bizRuleScope{BizRuleScope_PassCardGym, int64(req.PassCardGymId)})
+			continue
+		}
+		rsp.Effective[v.Key] = rules.lesson(v.Key, req.GymId, req.CourseId)
+	}
+	rsp.VecDef = vecBizRuleDef
+	rsp.List = vecBusinessRuleModel
+	rsp.Code = 0
+	return
+}
+
+type SetBusinessRuleReq struct {
+	RuleKey   string `json:"rule_key"`   // 规则名
+	ScopeType string `json:"scope_type"` // 范围类型：global/gym/course/pass_card_gym
+	ScopeID   int64  `json:"scope_id"`   // 范围id（场地id或课程id），全局传0
+	Value     int64  `json:"value"`      // 规则值，reset为true时忽略
+	Reset     bool   `json:"reset"`      // 是否删除该范围的配置，恢复使用上一级范围或内置默认值
+	Reason    string `json:"reason"`     // 变更原因，必填
+}
+
+type SetBusinessRuleRsp struct {
+	Code     int    `json:"code"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+}
+
+func getSetBusinessRuleReq(r *http.Request) (SetBusinessRuleReq, error) {
+	req := SetBusinessRuleReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// checkBizRuleScopeExist 检查范围id对应的场地、课程是否存在，返回错误信息
+func checkBizRuleScopeExist(scopeType string, scopeId int64) (string, error) {
+	var err error
+	switch scopeType {
+	case BizRuleScope_Gym:
+		_, err = dao.ImpGym.GetGymInfoByGymId(int(scopeId))
+	case BizRuleScope_Course:
+		_, err = dao.ImpCourse.GetCourseById(int(scopeId))
+	case BizRuleScope_PassCardGym:
+		_, err = pass_card_dao.ImpGym.GetGymInfoByGymId(int(scopeId))
+	}
+	if gorm.IsRecordNotFoundError(err) {
+		return "范围id对应的场地或课程不存在", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// checkBizRulePairs 检查变更后有配置的每个范围，成对的规则是否仍然满足大小关系，返回错误信息
+// 课程范围只和课程自身及全局的配置比较，和场地配置的组合由扫描任务在使用时兜底
+func checkBizRulePairs(vecBusinessRuleModel []BusinessRuleModel) string {
+	rules := newBusinessRules(vecBusinessRuleModel)
+	for _, pair := range vecBizRulePair {
+		vecScope := []bizRuleScope{{BizRuleScope_Global, 0}}
+		for _, v := range vecBusinessRuleModel {
+			if v.RuleKey == pair.Less || v.RuleKey == pair.Greater {
+				vecScope = append(vecScope, bizRuleScope{v.ScopeType, v.ScopeID})
+			}
+		}
+		for _, scope := range vecScope {
+			less := rules.get(pair.Less, scope)
+			greater := rules.get(pair.Greater, scope)
+			if less >= greater {
+				return fmt.Sprintf("%s:%d 下 %s(%d) 需小于 %s(%d)", scope.scopeType, scope.scopeId, pair.Less, less, pair.Greater, greater)
+			}
+		}
+	}
+	return ""
+}
+
+// SetBusinessRuleHandler 修改或删除某个范围的业务规则，扫描任务下次执行时生效
+func SetBusinessRuleHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getSetBusinessRuleReq(r)
+	rsp := &SetBusinessRuleRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("SetBusinessRuleHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if req.Reason == "" || len(req.Reason) > 256 {
+		rsp.Code = -996
+		rsp.ErrorMsg = "变更原因不能为空且不超过256字节"
+		return
+	}
+	value := req.Value
+	if req.Reset {
+		// 删除时只校验规则和范围，值取默认值占位
+		stDef, _ := getBizRuleDef(req.RuleKey)
+		value = stDef.Default
+	}
+	if errMsg := checkBizRuleValue(req.RuleKey, req.ScopeType, req.ScopeID, value); errMsg != "" {
+		rsp.Code = -996
+		rsp.ErrorMsg = errMsg
+		return
+	}
+	errMsg, err := checkBizRuleScopeExist(req.ScopeType, req.ScopeID)
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询场地或课程失败"
+		Printf("SetBusinessRuleHandler checkBizRuleScopeExist err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	if errMsg != "" {
+		rsp.Code = -996
+		rsp.ErrorMsg = errMsg
+		return
+	}
+
+	vecBusinessRuleModel, err := ImpBusinessRule.GetAllBusinessRule()
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询业务规则失败"
+		Printf("SetBusinessRuleHandler GetAllBusinessRule err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	var before *BusinessRuleModel
+	var vecAfter []BusinessRuleModel
+	for i := range vecBusinessRuleModel {
+		v := vecBusinessRuleModel[i]
+		if v.RuleKey == req.RuleKey && v.ScopeType == req.ScopeType && v.ScopeID == req.ScopeID {
+			before = &v
+			continue
+		}
+		vecAfter = append(vecAfter, v)
+	}
+	if req.Reset && before == nil {
+		rsp.Code = -996
+		rsp.ErrorMsg = "该范围没有配置，无需恢复默认"
+		return
+	}
+
+	nowTs := time.Now().Unix()
+	stBusinessRuleChangeModel := &BusinessRuleChangeModel{
+		RuleKey:   req.RuleKey,
+		ScopeType: req.ScopeType,
+		ScopeID:   req.ScopeID,
+		Action:    BizRuleAction_Set,
+		Reason:    req.Reason,
+		Operator:  authResult.Operator,
+		CreatedTs: nowTs,
+	}
+	if before != nil {
+		oldValue := before.Value
+		stBusinessRuleChangeModel.OldValue = &oldValue
+	}
+
+	var after *BusinessRuleModel
+	if !req.Reset {
+		after = &BusinessRuleModel{
+			RuleKey:   req.RuleKey,
+			ScopeType: req.ScopeType,
+			ScopeID:   req.ScopeID,
+			Value:     req.Value,
+			UpdatedBy: authResult.Operator,
+			UpdatedTs: nowTs,
+		}
+		if before != nil {
+			after.ID = before.ID
+		}
+		vecAfter = append(vecAfter, *after)
+		newValue := req.Value
+		stBusinessRuleChangeModel.NewValue = &newValue
+	} else {
+		stBusinessRuleChangeModel.Action = BizRuleAction_Reset
+	}
+	if errMsg := checkBizRulePairs(vecAfter); errMsg != "" {
+		rsp.Code = -996
+		rsp.ErrorMsg = errMsg
+		return
+	}
+
+	if req.Reset {
+		err = ImpBusinessRule.DeleteBusinessRule(before.ID, stBusinessRuleChangeModel)
+	} else {
+		err = ImpBusinessRule.SaveBusinessRule(after, stBusinessRuleChangeModel)
+	}
+	if err != nil {
+		rsp.Code = -922
+		rsp.ErrorMsg = "保存业务规则失败"
+		Printf("SetBusinessRuleHandler save err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	AddAuditChange(r, "business_rule", genBizRuleKey(req.RuleKey, req.ScopeType, req.ScopeID), before, after)
+
+	rsp.Code = 0
+	Printf("SetBusinessRuleHandler success, req:%+v operator:%s\n", req, authResult.Operator)
+	return
+}
+
+type GetBusinessRuleHistoryReq struct {
+	RuleKey   string `json:"rule_key"`   // 规则名，为空不过滤
+	ScopeType string `json:"scope_type"` // 范围类型，为空不过滤
+	ScopeID   int64  `json:"scope_id"`   // 范围id，为0不过滤
+	Passback  string `json:"passback"`   // 翻页标记，首次请求传空字符串，后续传上次返回的passback
+	PageSize  int    `json:"page_size"`  // 每页数量
+}
+
+type GetBusinessRuleHistoryRsp struct {
+	Code     int                       `json:"code"`
+	ErrorMsg string                    `json:"errorMsg,omitempty"`
+	List     []BusinessRuleChangeModel `json:"list,omitempty"`
+	Passback string                    `json:"passback"` // 下一页的翻页标记，为空字符串表示没有更多数据
+}
+
+func getGetBusinessRuleHistoryReq(r *http.Request) (GetBusinessRuleHistoryReq, error) {
+	req := GetBusinessRuleHistoryReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// GetBusinessRuleHistoryHandler 查询业务规则的变更历史
+func GetBusinessRuleHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getGetBusinessRuleHistoryReq(r)
+	rsp := &GetBusinessRuleHistoryRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetBusinessRuleHistoryHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	var offset int64
+	if len(req.Passback) > 0 {
+		offset, _ = strconv.ParseInt(req.Passback, 10, 64)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	pageSize := req.PageSize
+	if pageSize <= 0 {
+		pageSize = 20 // 默认每页20条
+	}
+	if pageSize > 100 {
+		pageSize = 100 // 最大每页100条
+	}
+
+	vecBusinessRuleChangeModel, err := ImpBusinessRule.GetBusinessRuleChangeList(req.RuleKey, req.ScopeType, req.ScopeID, int(offset), pageSize)
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询变更历史失败"
+		Printf("GetBusinessRuleHistoryHandler GetBusinessRuleChangeList err, err:%+v req:%+v\n", err, req)
+		return
+	}
+
+	rsp.List = vecBusinessRuleChangeModel
+	if len(vecBusinessRuleChangeModel) == pageSize {
+		rsp.Passback = strconv.FormatInt(offset+int64(pageSize), 10)
+	}
+	rsp.Code = 0
+	return
+}
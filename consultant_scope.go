@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/comm"
+	"github.com/xionghengheng/ff_plib/db"
+	"github.com/xionghengheng/ff_plib/db/model"
+)
+
+// 顾问越权访问的错误码
+const (
+	ErrCode_ConsultantGymDenied     = -4001 // 门店未分配给该顾问
+	ErrCode_ConsultantCreatorDenied = -4002 // 记录不是该顾问创建的
+)
+
+// ConsultantScopeModel 顾问的数据范围，顾问只能查看和修改分配门店内、自己创建的预体验课
+type ConsultantScopeModel struct {
+	ID         int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`             // 主键ID
+	Consultant string `json:"consultant" gorm:"type:varchar(128);unique_index"` // 顾问标识（小程序顾问为OpenID，账号顾问为登录名）
+	Nick       string `json:"nick" gorm:"type:varchar(64)"`                     // 顾问昵称，仅用于展示
+	GymIDs     string `json:"gym_ids" gorm:"type:varchar(512)"`                 // 分配的门店id列表（英文逗号分隔）
+	UpdatedBy  string `json:"updated_by" gorm:"type:varchar(64)"`               // 最后修改人
+	CreatedTs  int64  `json:"created_ts"`                                       // 创建时间
+	UpdatedTs  int64  `json:"updated_ts"`                                       // 更新时间
+}
+
+const consultant_scope_tableName = "consultant_scope"
+
+// ConsultantScopeInterface 顾问数据范围数据模型接口
+type ConsultantScopeInterface interface {
+	// 获取顾问的数据范围
+	GetConsultantScope(consultant string) (*ConsultantScopeModel, error)
+
+	// 获取全部顾问的数据范围
+	GetAllConsultantScope() ([]ConsultantScopeModel, error)
+
+	// 新增或更新顾问的数据范围
+	SaveConsultantScope(stConsultantScopeModel *ConsultantScopeModel) error
+
+	// 按门店和创建人分页获取预体验课（按创建时间降序）
+	GetTrailManageListByScope(vecGymId []int, createdBy string, offset int, limit int) ([]model.PreTrailManageModel, error)
+}
+
+// ConsultantScopeInterfaceImp 顾问数据范围数据模型实现
+type ConsultantScopeInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpConsultantScope ConsultantScopeInterface = &ConsultantScopeInterfaceImp{}
+
+func (imp *ConsultantScopeInterfaceImp) GetConsultantScope(consultant string) (*ConsultantScopeModel, error) {
+	var scope = new(ConsultantScopeModel)
+	cli := db.Get()
+	err := cli.Table(consultant_scope_tableName).Where("consultant = ?", consultant).First(scope).Error
+	return scope, err
+}
+
+func (imp *ConsultantScopeInterfaceImp) GetAllConsultantScope() ([]ConsultantScopeModel, error) {
+	var vecConsultantScopeModel []ConsultantScopeModel
+	cli := db.Get()
+	err := cli.Table(consultant_scope_tableName).Order("id ASC").Find(&vecConsultantScopeModel).Error
+	return vecConsultantScopeModel, err
+}
+
+func (imp *ConsultantScopeInterfaceImp) SaveConsultantScope(stConsultantScopeModel *ConsultantScopeModel) error {
+	cli := db.Get()
+	return cli.Table(consultant_scope_tableName).Save(stConsultantScopeModel).Error
+}
+
+func (imp *ConsultantScopeInterfaceImp) GetTrailManageListByScope(vecGymId []int, createdBy string, offset int, limit int) ([]model.PreTrailManageModel, error) {
+	var vecTrailManage []model.PreTrailManageModel
+	cli := db.Get()
+	err := cli.Table(pre_trail_manage_tableName).Where("gym_id IN (?) AND created_by = ?", vecGymId, createdBy).
+		Order("created_ts DESC").Offset(offset).Limit(limit).Find(&vecTrailManage).Error
+	return vecTrailManage, err
+}
+
+// trialDataScope 当前操作人可访问的预体验课范围
+type trialDataScope struct {
+	Global   bool         // 是否全局可见（管理员等非顾问角色）
+	Creator  string       // 顾问的创建人标识，和预体验课的CreatedBy对应
+	VecGymId []int        // 分配的门店
+	mapGymId map[int]bool // 分配的门店
+}
+
+// getTrialDataScope 获取操作人的预体验课数据范围，顾问角色必须已分配门店
+func getTrialDataScope(authResult ConsultantOrAdminAuthResult) (*trialDataScope, CheckParamResult) {
+	if authResult.Role != OperatorRole_Consultant {
+		return &trialDataScope{Global: true}, CheckParamResult{Success: true}
+	}
+
+	scope := &trialDataScope{
+		Creator:  getConsultantCreator(authResult),
+		mapGymId: make(map[int]bool),
+	}
+	stConsultantScopeModel, err := ImpConsultantScope.GetConsultantScope(authResult.Operator)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			Printf("getTrialDataScope consultant has no scope, operator:%s\n", authResult.Operator)
+			return nil, CheckParamResult{Success: false, Code: ErrCode_ConsultantGymDenied, ErrorMsg: "该顾问未分配门店，请联系管理员"}
+		}
+		Printf("getTrialDataScope GetConsultantScope err, err:%+v operator:%s\n", err, authResult.Operator)
+		return nil, CheckParamResult{Success: false, Code: -2005, ErrorMsg: "查询顾问门店失败"}
+	}
+	for _, gymId := range comm.GetAllGymIds(stConsultantScopeModel.GymIDs) {
+		scope.VecGymId = append(scope.VecGymId, gymId)
+		scope.mapGymId[gymId] = true
+	}
+	if len(scope.VecGymId) == 0 {
+		Printf("getTrialDataScope consultant has no gym, operator:%s\n", authResult.Operator)
+		return nil, CheckParamResult{Success: false, Code: ErrCode_ConsultantGymDenied, ErrorMsg: "该顾问未分配门店，请联系管理员"}
+	}
+	return scope, CheckParamResult{Success: true}
+}
+
+// getConsultantCreator 顾问创建预体验课时记录的创建人，小程序顾问沿用昵称，账号顾问用登录名
+func getConsultantCreator(authResult ConsultantOrAdminAuthResult) string {
+	if authResult.IsConsultant {
+		return authResult.ConsultantNick
+	}
+	return authResult.Operator
+}
+
+// checkGym 检查门店是否在范围内
+func (scope *trialDataScope) checkGym(gymId int) CheckParamResult {
+	if scope.Global || scope.mapGymId[gymId] {
+		return CheckParamResult{Success: true}
+	}
+	return CheckParamResult{Success: false, Code: ErrCode_ConsultantGymDenied, ErrorMsg: "无权操作该门店的预体验课"}
+}
+
+// checkRecord 检查预体验课记录是否在范围内：门店已分配且是自己创建的
+func (scope *trialDataScope) checkRecord(record *model.PreTrailManageModel) CheckParamResult {
+	if scope.Global {
+		return CheckParamResult{Success: true}
+	}
+	if result := scope.checkGym(record.GymID); !result.Success {
+		return result
+	}
+	if record.CreatedBy != scope.Creator {
+		return CheckParamResult{Success: false, Code: ErrCode_ConsultantCreatorDenied, ErrorMsg: "无权操作其他顾问创建的预体验课"}
+	}
+	return CheckParamResult{Success: true}
+}
+
+type SetConsultantScopeReq struct {
+	Consultant string `json:"consultant"` // 顾问标识（小程序顾问为OpenID，账号顾问为登录名）
+	Nick       string `json:"nick"`       // 顾问昵称
+	GymIDs     string `json:"gym_ids"`    // 分配的门店id列表（英文逗号分隔），传空表示取消全部门店
+}
+
+type SetConsultantScopeRsp struct {
+	Code     int    `json:"code"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+}
+
+func getSetConsultantScopeReq(r *http.Request) (SetConsultantScopeReq, error) {
+	req := SetConsultantScopeReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// SetConsultantScopeHandler 给顾问分配门店
+func SetConsultantScopeHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getSetConsultantScopeReq(r)
+	rsp := &SetConsultantScopeRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("SetConsultantScopeHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if req.Consultant == "" {
+		rsp.Code = -996
+		rsp.ErrorMsg = "顾问标识不能为空"
+		return
+	}
+
+	// 门店id必须存在，统一整理成逗号分隔的格式
+	mapGym, err := comm.GetAllGym()
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "获取门店信息失败"
+		Printf("SetConsultantScopeHandler GetAllGym err, err:%+v\n", err)
+		return
+	}
+	var vecStrGymId []string
+	for _, v := range strings.Split(req.GymIDs, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		gymId, err := strconv.Atoi(v)
+		if err != nil {
+			rsp.Code = -996
+			rsp.ErrorMsg = "门店id格式错误：" + v
+			return
+		}
+		if _, ok := mapGym[gymId]; !ok {
+			rsp.Code = -996
+			rsp.ErrorMsg = "门店不存在：" + v
+			return
+		}
+		vecStrGymId = append(vecStrGymId, v)
+	}
+
+	nowTs := time.Now().Unix()
+	stConsultantScopeModel, err := ImpConsultantScope.GetConsultantScope(req.Consultant)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			rsp.Code = -922
+			rsp.ErrorMsg = "查询顾问门店失败"
+			Printf("SetConsultantScopeHandler GetConsultantScope err, err:%+v consultant:%s\n", err, req.Consultant)
+			return
+		}
+		stConsultantScopeModel = &ConsultantScopeModel{Consultant: req.Consultant, CreatedTs: nowTs}
+	}
+	stBeforeScope := *stConsultantScopeModel
+	if req.Nick != "" {
+		stConsultantScopeModel.Nick = req.Nick
+	}
+	stConsultantScopeModel.GymIDs = strings.Join(vecStrGymId, ",")
+	stConsultantScopeModel.UpdatedBy = authResult.Operator
+	stConsultantScopeModel.UpdatedTs = nowTs
+	if err = ImpConsultantScope.SaveConsultantScope(stConsultantScopeModel); err != nil {
+		rsp.Code = -933
+		rsp.ErrorMsg = "保存顾问门店失败"
+		Printf("SetConsultantScopeHandler SaveConsultantScope err, err:%+v scope:%+v\n", err, stConsultantScopeModel)
+		return
+	}
+	AddAuditChange(r, "consultant_scope", req.Consultant, stBeforeScope, stConsultantScopeModel)
+
+	rsp.Code = 0
+	Printf("SetConsultantScopeHandler success, scope:%+v operator:%s\n", stConsultantScopeModel, authResult.Operator)
+	return
+}
+
+type GetConsultantScopeListRsp struct {
+	Code     int                    `json:"code"`
+	ErrorMsg string                 `json:"errorMsg,omitempty"`
+	List     []ConsultantScopeModel `json:"list"`
+}
+
+// GetConsultantScopeListHandler 获取全部顾问的门店分配
+func GetConsultantScopeListHandler(w http.ResponseWriter, r *http.Request) {
+	rsp := &GetConsultantScopeListRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetConsultantScopeListHandler start\n")
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	vecConsultantScopeModel, err := ImpConsultantScope.GetAllConsultantScope()
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询顾问门店失败"
+		Printf("GetConsultantScopeListHandler GetAllConsultantScope err, err:%+v\n", err)
+		return
+	}
+
+	rsp.Code = 0
+	rsp.List = vecConsultantScopeModel
+	return
+}
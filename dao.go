@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/xionghengheng/ff_plib/db"
+)
+
+// ff_plib 中的表名，需要在本服务的事务里直接操作这些表时使用，需和 ff_plib/db/dao 保持一致
+const (
+	payment_order_tableName                = "payment_orders"
+	course_package_tableName               = "course_packages"
+	pre_trail_manage_tableName             = "pre_trail_manage"
+	course_package_single_lesson_tableName = "course_package_single_lessons"
+	pass_card_lesson_tableName             = "pass_card_lesson"
+)
+
+// initTables 本服务自有的表，启动时自动建表/补字段
+func initTables() error {
+	cli := db.Get()
+	if err := cli.Table(refund_ledger_tableName).AutoMigrate(&RefundLedgerModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(operator_account_tableName).AutoMigrate(&OperatorAccountModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(operator_session_tableName).AutoMigrate(&OperatorSessionModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(audit_log_tableName).AutoMigrate(&AuditLogModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(auth_throttle_tableName).AutoMigrate(&AuthThrottleModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(security_event_tableName).AutoMigrate(&SecurityEventModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(consultant_scope_tableName).AutoMigrate(&ConsultantScopeModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(job_lease_tableName).AutoMigrate(&JobLeaseModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(job_run_tableName).AutoMigrate(&JobRunModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(job_control_tableName).AutoMigrate(&JobControlModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(notify_outbox_tableName).AutoMigrate(&NotifyOutboxModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(notify_template_tableName).AutoMigrate(&NotifyTemplateModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(notify_attempt_tableName).AutoMigrate(&NotifyAttemptModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(messaging_config_tableName).AutoMigrate(&MessagingConfigModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(suppressed_message_tableName).AutoMigrate(&SuppressedMessageModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(notify_preference_tableName).AutoMigrate(&NotifyPreferenceModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(notify_route_policy_tableName).AutoMigrate(&NotifyRoutePolicyModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(business_rule_tableName).AutoMigrate(&BusinessRuleModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(business_rule_change_tableName).AutoMigrate(&BusinessRuleChangeModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(lesson_appeal_tableName).AutoMigrate(&LessonAppealModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(noshow_decision_tableName).AutoMigrate(&NoShowDecisionModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(user_booking_block_tableName).AutoMigrate(&UserBookingBlockModel{}).Error; err != nil {
+		return err
+	}
+	if err := cli.Table(trial_package_state_tableName).AutoMigrate(&TrialPackageStateModel{}).Error; err != nil {
+		return err
+	}
+	return nil
+}
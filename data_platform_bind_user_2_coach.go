@@ -6,7 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"strconv"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -67,36 +67,10 @@ func bindUser2CoachHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 验证用户名和密码
-	adminUserName := os.Getenv("ADMIN_USER_NAME")
-	adminPasswd := os.Getenv("ADMIN_PASSWD")
-	if len(adminUserName) == 0 || len(adminPasswd) == 0 {
-		rsp.Code = -900
-		rsp.ErrorMsg = "后台配置错误"
-		Printf("conf err, adminUserName:%s adminPasswd:%s\n", adminUserName, adminPasswd)
-		return
-	}
-
-	// 从header中提取用户名和密码进行校验
-	username := r.Header.Get("X-Username")
-	if username == "" {
-		rsp.Code = -995
-		rsp.ErrorMsg = "缺少X-Username header"
-		Printf("bindUser2CoachHandler missing X-Username header\n")
-		return
-	}
-
-	password := r.Header.Get("X-Password")
-	if password == "" {
-		rsp.Code = -995
-		rsp.ErrorMsg = "缺少X-Password header"
-		Printf("bindUser2CoachHandler missing X-Password header\n")
-		return
-	}
-
-	if username != adminUserName || password != adminPasswd {
-		rsp.Code = -994
-		rsp.ErrorMsg = "用户名或密码错误"
-		Printf("bindUser2CoachHandler auth failed, username:%s\n", username)
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
 		return
 	}
 
@@ -134,6 +108,7 @@ func bindUser2CoachHandler(w http.ResponseWriter, r *http.Request) {
 			Printf("UpdateCoachInfo err, err:%+v CoachName:%s CoachPhone:%s\n", err, req.CoachName, req.CoachPhone)
 			return
 		}
+		AddAuditChange(r, "coach", strconv.Itoa(stCoachModel.CoachID), stCoachModel, mapUpdates)
 	}
 
 	// 根据手机号获取用户信息
@@ -162,6 +137,7 @@ func bindUser2CoachHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	AddAuditChange(r, "user", strconv.FormatInt(stCoachUserInfoModel.UserID, 10), stCoachUserInfoModel, mapUpdates)
 	Printf("bindUser2CoachHandler succ, uid:%d coachId:%d CoachName:%s CoachPhone:%s\n", stCoachUserInfoModel.UserID, stCoachModel.CoachID, req.CoachName, req.CoachPhone)
 	rsp.Code = 0
 	go TestTriggerSetCoachLessonAvaliable(stCoachModel.CoachID, req.CoachName)
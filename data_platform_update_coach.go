@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
+	"strconv"
 
 	"github.com/xionghengheng/ff_plib/comm"
 	"github.com/xionghengheng/ff_plib/db/dao"
@@ -72,36 +72,10 @@ func UpdateCoachHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 验证用户名和密码
-	adminUserName := os.Getenv("ADMIN_USER_NAME")
-	adminPasswd := os.Getenv("ADMIN_PASSWD")
-	if len(adminUserName) == 0 || len(adminPasswd) == 0 {
-		rsp.Code = -900
-		rsp.ErrorMsg = "后台配置错误"
-		Printf("conf err, adminUserName:%s adminPasswd:%s\n", adminUserName, adminPasswd)
-		return
-	}
-
-	// 从header中提取用户名和密码进行校验
-	username := r.Header.Get("X-Username")
-	if username == "" {
-		rsp.Code = -995
-		rsp.ErrorMsg = "缺少X-Username header"
-		Printf("UpdateCoachHandler missing X-Username header\n")
-		return
-	}
-
-	password := r.Header.Get("X-Password")
-	if password == "" {
-		rsp.Code = -995
-		rsp.ErrorMsg = "缺少X-Password header"
-		Printf("UpdateCoachHandler missing X-Password header\n")
-		return
-	}
-
-	if username != adminUserName || password != adminPasswd {
-		rsp.Code = -994
-		rsp.ErrorMsg = "用户名或密码错误"
-		Printf("UpdateCoachHandler auth failed, username:%s\n", username)
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
 		return
 	}
 
@@ -205,6 +179,7 @@ func UpdateCoachHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	AddAuditChange(r, "coach", strconv.Itoa(req.CoachID), coachInfo, mapUpdates)
 	Printf("UpdateCoachHandler succ, CoachID:%d mapUpdates:%+v\n", req.CoachID, mapUpdates)
 	rsp.Code = 0
 }
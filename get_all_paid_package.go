@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	"sort"
 
 	"github.com/xionghengheng/ff_plib/comm"
@@ -46,6 +45,24 @@ type PaidPackageItem struct {
 	RealPayPrice     int64  `json:"real_pay_price"`      // 实际支付的价格，单位元
 	RenewCnt         int    `json:"renew_cnt"`           // 续费次数
 	IsRenew          bool   `json:"is_renew"`            // 是否为续费订单
+
+	VecRefundRecord []RefundRecordItem `json:"vec_refund_record,omitempty"` // 退款记录（按申请时间降序）
+}
+
+type RefundRecordItem struct {
+	RefundNo        string `json:"refund_no"`                // 业务退款单号
+	OutTradeNo      string `json:"out_trade_no"`             // 退款订单号
+	RefundCourseCnt int    `json:"refund_course_cnt"`        // 退课节数
+	RefundAmount    int    `json:"refund_amount"`            // 退款金额，单位元
+	Status          int    `json:"status"`                   // 退款状态（参考 Enum_Refund_Status）
+	StatusText      string `json:"status_text"`              // 退款状态描述
+	ErrMsg          string `json:"err_msg,omitempty"`        // 失败原因
+	Operator        string `json:"operator"`                 // 发起人
+	Approver        string `json:"approver,omitempty"`       // 审批人
+	ApproveTs       int64  `json:"approve_ts,omitempty"`     // 审批时间
+	ApproveRemark   string `json:"approve_remark,omitempty"` // 审批备注（驳回原因）
+	CreatedTs       int64  `json:"created_ts"`               // 申请时间
+	UpdatedTs       int64  `json:"updated_ts"`               // 最后更新时间
 }
 
 func getGetAllPaidPackageReq(r *http.Request) (GetAllPaidPackageReq, error) {
@@ -76,36 +93,10 @@ func GetAllPaidPackageHandler(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	// 验证用户名和密码
-	adminUserName := os.Getenv("ADMIN_USER_NAME")
-	adminPasswd := os.Getenv("ADMIN_PASSWD")
-	if len(adminUserName) == 0 || len(adminPasswd) == 0 {
-		rsp.Code = -900
-		rsp.ErrorMsg = "后台配置错误"
-		Printf("conf err, adminUserName:%s adminPasswd:%s\n", adminUserName, adminPasswd)
-		return
-	}
-
-	// 从header中提取用户名和密码进行校验
-	username := r.Header.Get("X-Username")
-	if username == "" {
-		rsp.Code = -995
-		rsp.ErrorMsg = "缺少X-Username header"
-		Printf("GetAllPaidPackageHandler missing X-Username header\n")
-		return
-	}
-
-	password := r.Header.Get("X-Password")
-	if password == "" {
-		rsp.Code = -995
-		rsp.ErrorMsg = "缺少X-Password header"
-		Printf("GetAllPaidPackageHandler missing X-Password header\n")
-		return
-	}
-
-	if username != adminUserName || password != adminPasswd {
-		rsp.Code = -994
-		rsp.ErrorMsg = "用户名或密码错误"
-		Printf("GetAllPaidPackageHandler auth failed, username:%s\n", username)
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
 		return
 	}
 
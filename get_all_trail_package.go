@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 
 	"github.com/xionghengheng/ff_plib/comm"
 	"github.com/xionghengheng/ff_plib/db/dao"
@@ -37,6 +36,8 @@ type TrailPackageItem struct {
 	RemainCnt    int    `json:"remain_cnt"`     // 课包中剩余的课程次数
 	Price        int    `json:"price"`          // 价格
 	LastLessonTs int64  `json:"last_lesson_ts"` // 上次约课时间
+	Status       string `json:"status"`         // 有效期状态：active有效期内，expired已过期不能约课，还没被扫描到的为空
+	ExpireTs     int64  `json:"expire_ts"`      // 过期时间，还没被扫描到的为0
 }
 
 func getGetAllTrailPackageReq(r *http.Request) (GetAllTrailPackageReq, error) {
@@ -67,36 +68,10 @@ func GetAllTrailPackageHandler(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	// 验证用户名和密码
-	adminUserName := os.Getenv("ADMIN_USER_NAME")
-	adminPasswd := os.Getenv("ADMIN_PASSWD")
-	if len(adminUserName) == 0 || len(adminPasswd) == 0 {
-		rsp.Code = -900
-		rsp.ErrorMsg = "后台配置错误"
-		Printf("conf err, adminUserName:%s adminPasswd:%s\n", adminUserName, adminPasswd)
-		return
-	}
-
-	// 从header中提取用户名和密码进行校验
-	username := r.Header.Get("X-Username")
-	if username == "" {
-		rsp.Code = -995
-		rsp.ErrorMsg = "缺少X-Username header"
-		Printf("GetAllTrailPackageHandler missing X-Username header\n")
-		return
-	}
-
-	password := r.Header.Get("X-Password")
-	if password == "" {
-		rsp.Code = -995
-		rsp.ErrorMsg = "缺少X-Password header"
-		Printf("GetAllTrailPackageHandler missing X-Password header\n")
-		return
-	}
-
-	if username != adminUserName || password != adminPasswd {
-		rsp.Code = -994
-		rsp.ErrorMsg = "用户名或密码错误"
-		Printf("GetAllTrailPackageHandler auth failed, username:%s\n", username)
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
 		return
 	}
 
@@ -150,26 +125,33 @@ func GetAllTrailPackageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 有效期状态，按课包id批量查询
+	vecPackageId := make([]string, 0, len(vecAllTrailPackageModel))
+	for _, v := range vecAllTrailPackageModel {
+		vecPackageId = append(vecPackageId, v.PackageID)
+	}
+	mapTrialPackageState := getTrialPackageStateMapForShow(vecPackageId)
+
 	if req.RemainCnt == -1 {
 		for _, v := range vecAllTrailPackageModel {
-			rsp.VecTrailPackageItem = append(rsp.VecTrailPackageItem, ConvertPackageItemModel2TrailRspItem(v, mapAllCoach, mapALlCourseModel, mapAllUserModel, mapGym))
+			rsp.VecTrailPackageItem = append(rsp.VecTrailPackageItem, ConvertPackageItemModel2TrailRspItem(v, mapAllCoach, mapALlCourseModel, mapAllUserModel, mapGym, mapTrialPackageState[v.PackageID]))
 		}
 	} else if req.RemainCnt == 0 {
 		for _, v := range vecAllTrailPackageModel {
 			if v.RemainCnt == 0 {
-				rsp.VecTrailPackageItem = append(rsp.VecTrailPackageItem, ConvertPackageItemModel2TrailRspItem(v, mapAllCoach, mapALlCourseModel, mapAllUserModel, mapGym))
+				rsp.VecTrailPackageItem = append(rsp.VecTrailPackageItem, ConvertPackageItemModel2TrailRspItem(v, mapAllCoach, mapALlCourseModel, mapAllUserModel, mapGym, mapTrialPackageState[v.PackageID]))
 			}
 		}
 	} else if req.RemainCnt == 1 {
 		for _, v := range vecAllTrailPackageModel {
 			if v.RemainCnt == 1 {
-				rsp.VecTrailPackageItem = append(rsp.VecTrailPackageItem, ConvertPackageItemModel2TrailRspItem(v, mapAllCoach, mapALlCourseModel, mapAllUserModel, mapGym))
+				rsp.VecTrailPackageItem = append(rsp.VecTrailPackageItem, ConvertPackageItemModel2TrailRspItem(v, mapAllCoach, mapALlCourseModel, mapAllUserModel, mapGym, mapTrialPackageState[v.PackageID]))
 			}
 		}
 	} else if req.RemainCnt == 2 {
 		for _, v := range vecAllTrailPackageModel {
 			if v.RemainCnt == 2 {
-				rsp.VecTrailPackageItem = append(rsp.VecTrailPackageItem, ConvertPackageItemModel2TrailRspItem(v, mapAllCoach, mapALlCourseModel, mapAllUserModel, mapGym))
+				rsp.VecTrailPackageItem = append(rsp.VecTrailPackageItem, ConvertPackageItemModel2TrailRspItem(v, mapAllCoach, mapALlCourseModel, mapAllUserModel, mapGym, mapTrialPackageState[v.PackageID]))
 			}
 		}
 	}
@@ -181,7 +163,8 @@ func ConvertPackageItemModel2TrailRspItem(item model.CoursePackageModel,
 	mapAllCoach map[int]model.CoachModel,
 	mapALlCourseModel map[int]model.CourseModel,
 	mapAllUserModel map[int64]model.UserInfoModel,
-	mapGym map[int]model.GymInfoModel) TrailPackageItem {
+	mapGym map[int]model.GymInfoModel,
+	stTrialPackageStateModel *TrialPackageStateModel) TrailPackageItem {
 
 	strPhone := ""
 	phone := mapAllUserModel[item.Uid].PhoneNumber
@@ -189,7 +172,7 @@ func ConvertPackageItemModel2TrailRspItem(item model.CoursePackageModel,
 		strPhone = *phone
 	}
 
-	return TrailPackageItem{
+	stTrailPackageItem := TrailPackageItem{
 		Uid:          item.Uid,
 		UserName:     mapAllUserModel[item.Uid].Nick,
 		PhoneNumber:  strPhone,
@@ -206,4 +189,9 @@ func ConvertPackageItemModel2TrailRspItem(item model.CoursePackageModel,
 		Price:        mapALlCourseModel[item.CourseId].Price,
 		LastLessonTs: item.LastLessonTs,
 	}
+	if stTrialPackageStateModel != nil {
+		stTrailPackageItem.Status = stTrialPackageStateModel.Status
+		stTrailPackageItem.ExpireTs = stTrialPackageStateModel.ExpireTs
+	}
+	return stTrailPackageItem
 }
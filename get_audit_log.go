@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type GetAuditLogReq struct {
+	Operator   string `json:"operator"`    // 操作人，为空不过滤
+	EntityType string `json:"entity_type"` // 操作对象类型（coach/user/pre_trial_lesson/refund_ledger/operator），为空不过滤
+	EntityID   string `json:"entity_id"`   // 操作对象id，为空不过滤
+	BegTs      int64  `json:"beg_ts"`      // 开始时间（包含），为0不过滤
+	EndTs      int64  `json:"end_ts"`      // 结束时间（不包含），为0不过滤
+	Passback   string `json:"passback"`    // 翻页标记，首次请求传空字符串，后续传上次返回的passback
+	PageSize   int    `json:"page_size"`   // 每页数量
+}
+
+type GetAuditLogRsp struct {
+	Code     int             `json:"code"`
+	ErrorMsg string          `json:"errorMsg,omitempty"`
+	List     []AuditLogModel `json:"list,omitempty"`
+	Passback string          `json:"passback"` // 下一页的翻页标记，为空字符串表示没有更多数据
+}
+
+func getGetAuditLogReq(r *http.Request) (GetAuditLogReq, error) {
+	req := GetAuditLogReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// GetAuditLogHandler 按操作人、操作对象、时间范围查询审计日志
+func GetAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getGetAuditLogReq(r)
+	rsp := &GetAuditLogRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetAuditLogHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if req.BegTs > 0 && req.EndTs > 0 && req.BegTs >= req.EndTs {
+		rsp.Code = -996
+		rsp.ErrorMsg = "开始时间必须早于结束时间"
+		return
+	}
+
+	var offset int64
+	if len(req.Passback) > 0 {
+		offset, _ = strconv.ParseInt(req.Passback, 10, 64)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	pageSize := req.PageSize
+	if pageSize <= 0 {
+		pageSize = 20 // 默认每页20条
+	}
+	if pageSize > 100 {
+		pageSize = 100 // 最大每页100条
+	}
+
+	vecAuditLogModel, err := ImpAuditLog.GetAuditLogList(req.Operator, req.EntityType, req.EntityID, req.BegTs, req.EndTs, int(offset), pageSize)
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询审计日志失败"
+		Printf("GetAuditLogHandler GetAuditLogList err, err:%+v req:%+v\n", err, req)
+		return
+	}
+
+	rsp.List = vecAuditLogModel
+	if len(vecAuditLogModel) == pageSize {
+		rsp.Passback = strconv.FormatInt(offset+int64(pageSize), 10)
+	}
+	rsp.Code = 0
+	Printf("GetAuditLogHandler success, offset:%d count:%d\n", offset, len(rsp.List))
+	return
+}
+
+// 单次校验最多检查的记录数
+const verifyAuditLogMaxCnt = 20000
+
+type VerifyAuditLogReq struct {
+	BegSeq int64 `json:"beg_seq"` // 从哪个序号开始校验，不传从第1条开始；分段校验时传上次返回的next_seq
+}
+
+type VerifyAuditLogRsp struct {
+	Code      int    `json:"code"`
+	ErrorMsg  string `json:"errorMsg,omitempty"`
+	Intact    bool   `json:"intact"`     // 已校验的部分是否完整
+	CheckCnt  int    `json:"check_cnt"`  // 本次校验的记录数
+	BrokenSeq int64  `json:"broken_seq"` // 第一处断链的序号，完整时为0
+	Reason    string `json:"reason"`     // 断链原因
+	NextSeq   int64  `json:"next_seq"`   // 还有未校验的记录时，下次从这个序号继续；为0表示已校验到链尾
+}
+
+func getVerifyAuditLogReq(r *http.Request) (VerifyAuditLogReq, error) {
+	req := VerifyAuditLogReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// VerifyAuditLogHandler 校验审计日志哈希链，记录被删除、插入或修改后会在对应位置断链
+func VerifyAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getVerifyAuditLogReq(r)
+	rsp := &VerifyAuditLogRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("VerifyAuditLogHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	begSeq := req.BegSeq
+	if begSeq <= 0 {
+		begSeq = 1
+	}
+
+	// 从中间开始校验时，取前一条的Hash作为链头
+	var prevHash string
+	expectSeq := begSeq
+	if begSeq > 1 {
+		vecPrev, err := ImpAuditLog.GetAuditLogListBySeq(begSeq-1, 1)
+		if err != nil {
+			rsp.Code = -911
+			rsp.ErrorMsg = "查询审计日志失败"
+			Printf("VerifyAuditLogHandler GetAuditLogListBySeq err, err:%+v seq:%d\n", err, begSeq-1)
+			return
+		}
+		if len(vecPrev) == 0 || vecPrev[0].Seq != begSeq-1 {
+			rsp.Code = 0
+			rsp.BrokenSeq = begSeq - 1
+			rsp.Reason = "记录缺失"
+			return
+		}
+		prevHash = vecPrev[0].Hash
+	}
+
+	const batchSize = 500
+	for rsp.CheckCnt < verifyAuditLogMaxCnt {
+		vecAuditLogModel, err := ImpAuditLog.GetAuditLogListBySeq(expectSeq, batchSize)
+		if err != nil {
+			rsp.Code = -922
+			rsp.ErrorMsg = "查询审计日志失败"
+			Printf("VerifyAuditLogHandler GetAuditLogListBySeq err, err:%+v seq:%d\n", err, expectSeq)
+			return
+		}
+		for _, v := range vecAuditLogModel {
+			rsp.CheckCnt++
+			if v.Seq != expectSeq {
+				rsp.BrokenSeq = expectSeq
+				rsp.Reason = "记录缺失"
+			} else if v.PrevHash != prevHash {
+				rsp.BrokenSeq = v.Seq
+				rsp.Reason = "与上一条记录的Hash不一致"
+			} else if calcAuditLogHash(&v) != v.Hash {
+				rsp.BrokenSeq = v.Seq
+				rsp.Reason = "记录内容与Hash不一致"
+			}
+			if rsp.BrokenSeq > 0 {
+				rsp.Code = 0
+				Printf("[AuditAlarm]VerifyAuditLogHandler chain broken, seq:%d reason:%s operator:%s\n", rsp.BrokenSeq, rsp.Reason, authResult.Operator)
+				return
+			}
+			prevHash = v.Hash
+			expectSeq++
+		}
+		if len(vecAuditLogModel) < batchSize {
+			rsp.Code = 0
+			rsp.Intact = true
+			Printf("VerifyAuditLogHandler success, begSeq:%d checkCnt:%d\n", begSeq, rsp.CheckCnt)
+			return
+		}
+	}
+
+	rsp.Code = 0
+	rsp.Intact = true
+	rsp.NextSeq = expectSeq
+	Printf("VerifyAuditLogHandler partial success, begSeq:%d checkCnt:%d nextSeq:%d\n", begSeq, rsp.CheckCnt, rsp.NextSeq)
+	return
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	"sort"
 	"sync"
 	"time"
@@ -82,36 +81,10 @@ func GetCoachProfileHandler(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	// 验证用户名和密码
-	adminUserName := os.Getenv("ADMIN_USER_NAME")
-	adminPasswd := os.Getenv("ADMIN_PASSWD")
-	if len(adminUserName) == 0 || len(adminPasswd) == 0 {
-		rsp.Code = -900
-		rsp.ErrorMsg = "后台配置错误"
-		Printf("conf err, adminUserName:%s adminPasswd:%s\n", adminUserName, adminPasswd)
-		return
-	}
-
-	// 从header中提取用户名和密码进行校验
-	username := r.Header.Get("X-Username")
-	if username == "" {
-		rsp.Code = -995
-		rsp.ErrorMsg = "缺少X-Username header"
-		Printf("GetCoachProfileHandler missing X-Username header\n")
-		return
-	}
-
-	password := r.Header.Get("X-Password")
-	if password == "" {
-		rsp.Code = -995
-		rsp.ErrorMsg = "缺少X-Password header"
-		Printf("GetCoachProfileHandler missing X-Password header\n")
-		return
-	}
-
-	if username != adminUserName || password != adminPasswd {
-		rsp.Code = -994
-		rsp.ErrorMsg = "用户名或密码错误"
-		Printf("GetCoachProfileHandler auth failed, username:%s\n", username)
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
 		return
 	}
 
@@ -132,7 +105,8 @@ func GetCoachProfileHandler(w http.ResponseWriter, r *http.Request) {
 	var mapAllUserModel map[int64]model.UserInfoModel
 	var vecAllPackageModel []model.CoursePackageModel
 	var vecAllSingleLesson []model.CoursePackageSingleLessonModel
-	var errCoach, errUser, errPackage, errLesson error
+	var mapLateWriteOffLesson map[string]bool
+	var errCoach, errUser, errPackage, errLesson, errAppeal error
 
 	// 获取所有教练信息
 	wg.Add(1)
@@ -190,6 +164,13 @@ func GetCoachProfileHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	// 获取近30天通过旷课申诉补核销的课程
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		mapLateWriteOffLesson, errAppeal = ImpLessonAppeal.GetLateWriteOffLessonIdSet(last30DaysBegTs)
+	}()
+
 	// 等待所有goroutine完成
 	wg.Wait()
 
@@ -216,6 +197,12 @@ func GetCoachProfileHandler(w http.ResponseWriter, r *http.Request) {
 		rsp.ErrorMsg = "获取课程信息失败"
 		return
 	}
+	if errAppeal != nil {
+		rsp.Code = -966
+		rsp.ErrorMsg = "获取旷课申诉记录失败"
+		Printf("GetCoachProfileHandler GetLateWriteOffLessonIdSet err, err:%+v\n", errAppeal)
+		return
+	}
 
 	// 构建教练画像数据
 	for _, coach := range mapCoach {
@@ -229,6 +216,7 @@ func GetCoachProfileHandler(w http.ResponseWriter, r *http.Request) {
 			mapAllUserModel,
 			vecAllPackageModel,
 			vecAllSingleLesson,
+			mapLateWriteOffLesson,
 			last30DaysBegTs,
 			monthBegTs,
 		)
@@ -252,6 +240,7 @@ func buildCoachProfile(
 	mapAllUserModel map[int64]model.UserInfoModel,
 	vecAllPackageModel []model.CoursePackageModel,
 	vecAllSingleLesson []model.CoursePackageSingleLessonModel,
+	mapLateWriteOffLesson map[string]bool,
 	last30DaysBegTs int64,
 	monthBegTs int64,
 ) CoachProfileItem {
@@ -282,7 +271,7 @@ func buildCoachProfile(
 		calculatePackageStats(coach.CoachID, vecAllPackageModel, monthBegTs)
 
 	// 统计课程相关数据
-	lessonStats := calculateLessonStats(coach.CoachID, vecAllSingleLesson, last30DaysBegTs, monthBegTs)
+	lessonStats := calculateLessonStats(coach.CoachID, vecAllSingleLesson, mapLateWriteOffLesson, last30DaysBegTs, monthBegTs)
 	profile.TotalCommentCount = lessonStats.TotalCommentCount
 	profile.MonthLessonCount = lessonStats.MonthLessonCount
 	profile.Last30DaysLessonCount = lessonStats.Last30DaysWriteOffLessonCount
@@ -360,7 +349,7 @@ type LessonStatsResult struct {
 	TotalCommentCount             int    // 用户累计评价数（所有有评价内容的课程数）
 	MonthLessonCount              int    // 近1个月付费课包的消课量（本月核销的付费课包课程数）
 	Last30DaysWriteOffLessonCount int    // 近30天实际核销上课数（已完成状态且核销时间在近30天内）
-	Last30DaysOvertimeCount       int    // 近30天超时核销数（核销时间超过预约结束时间2小时以上的课程数）
+	Last30DaysOvertimeCount       int    // 近30天超时核销数（核销时间超过预约结束时间2小时以上的课程数，含旷课后申诉补核销的课程）
 	OvertimeRate                  string // 超时率 = 超时核销课数 / 近30天总课程数 * 100%
 	Last30DaysRescheduleCount     int    // 近30天系统改课数（教练主动取消用户预约的课程数）
 	RescheduleRate                string // 改课率 = 改课次数 / 近30天预约课程总数 * 100%
@@ -372,6 +361,7 @@ type LessonStatsResult struct {
 func calculateLessonStats(
 	coachID int,
 	vecAllSingleLesson []model.CoursePackageSingleLessonModel,
+	mapLateWriteOffLesson map[string]bool,
 	last30DaysBegTs int64,
 	monthBegTs int64,
 ) LessonStatsResult {
@@ -412,7 +402,8 @@ func calculateLessonStats(
 
 				// 统计超时核销数（预约时间2小时后核销记为超时）
 				// 超时定义：用户具体预约时间的2小时内核销记为正常，超过2小时核销记为超时
-				if lesson.ScheduleEndTs > 0 && lesson.WriteOffTs > lesson.ScheduleEndTs+2*3600 {
+				// 被标记旷课后通过申诉补核销的课程，教练没有按时核销，也记为超时
+				if (lesson.ScheduleEndTs > 0 && lesson.WriteOffTs > lesson.ScheduleEndTs+2*3600) || mapLateWriteOffLesson[lesson.LessonID] {
 					result.Last30DaysOvertimeCount++
 				}
 
@@ -5,7 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/xionghengheng/ff_plib/comm"
@@ -18,9 +18,10 @@ type GetPaidPackageByUserPhoneReq struct {
 }
 
 type GetPaidPackageByUserPhoneRsp struct {
-	Code               int               `json:"code"`
-	ErrorMsg           string            `json:"errorMsg,omitempty"`
-	VecPaidPackageItem []PaidPackageItem `json:"vec_paid_package_item"`
+	Code               int                    `json:"code"`
+	ErrorMsg           string                 `json:"errorMsg,omitempty"`
+	VecPaidPackageItem []PaidPackageItem      `json:"vec_paid_package_item"`
+	BookingBlock       *UserBookingBlockModel `json:"booking_block,omitempty"` // 学员因多次旷课被暂停预约、还没到期时有值，暂停期间不能约课
 }
 
 func getGetPaidPackageByUserPhoneReq(r *http.Request) (GetPaidPackageByUserPhoneReq, error) {
@@ -50,36 +51,10 @@ func GetPaidPackageByUserPhoneHandler(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	// 验证用户名和密码
-	adminUserName := os.Getenv("ADMIN_USER_NAME")
-	adminPasswd := os.Getenv("ADMIN_PASSWD")
-	if len(adminUserName) == 0 || len(adminPasswd) == 0 {
-		rsp.Code = -900
-		rsp.ErrorMsg = "后台配置错误"
-		Printf("conf err, adminUserName:%s adminPasswd:%s\n", adminUserName, adminPasswd)
-		return
-	}
-
-	// 从header中提取用户名和密码进行校验
-	username := r.Header.Get("X-Username")
-	if username == "" {
-		rsp.Code = -995
-		rsp.ErrorMsg = "缺少X-Username header"
-		Printf("GetPaidPackageByUserPhoneHandler missing X-Username header\n")
-		return
-	}
-
-	password := r.Header.Get("X-Password")
-	if password == "" {
-		rsp.Code = -995
-		rsp.ErrorMsg = "缺少X-Password header"
-		Printf("GetPaidPackageByUserPhoneHandler missing X-Password header\n")
-		return
-	}
-
-	if username != adminUserName || password != adminPasswd {
-		rsp.Code = -994
-		rsp.ErrorMsg = "用户名或密码错误"
-		Printf("GetPaidPackageByUserPhoneHandler auth failed, username:%s\n", username)
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
 		return
 	}
 
@@ -111,6 +86,14 @@ func GetPaidPackageByUserPhoneHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 预约暂停，查询失败不影响课包信息展示
+	stUserBookingBlockModel, err := ImpNoShow.GetUserBookingBlock(stUserInfoModel.UserID)
+	if err != nil {
+		Printf("GetPaidPackageByUserPhoneHandler GetUserBookingBlock err, err:%+v uid:%d\n", err, stUserInfoModel.UserID)
+	} else if stUserBookingBlockModel != nil && stUserBookingBlockModel.UntilTs > time.Now().Unix() {
+		rsp.BookingBlock = stUserBookingBlockModel
+	}
+
 	// 根据用户ID获取付费课包列表
 	vecPayCoursePackageModel, err := dao.ImpCoursePackage.GetPayCoursePackageList(stUserInfoModel.UserID)
 	if err != nil {
@@ -182,6 +165,15 @@ func GetPaidPackageByUserPhoneHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		item := items[0]
 		item.WeixinPayOrderId = vecPaymentOrderModel[0].OrderID
+
+		// 退款记录，查询失败不影响课包信息展示
+		vecRefundLedgerModel, err := ImpRefundLedger.GetRefundLedgerListByPackageId(v.PackageID)
+		if err != nil {
+			Printf("GetPaidPackageByUserPhoneHandler GetRefundLedgerListByPackageId err, err:%+v PackageID:%s\n", err, v.PackageID)
+		}
+		for _, ledger := range vecRefundLedgerModel {
+			item.VecRefundRecord = append(item.VecRefundRecord, ConvertRefundLedger2RecordItem(ledger))
+		}
 		rsp.VecPaidPackageItem = append(rsp.VecPaidPackageItem, item)
 	}
 
@@ -44,6 +44,8 @@ type UserStatisticItem struct {
 	TrialPackageLevel     string `json:"trial_package_level"`      //体验课，档位
 	TrialCoachId          int    `json:"trial_coach_id"`           //体验课，教练id
 	TrialCoachName        string `json:"trial_coach_name"`         //体验课，教练名称
+	TrialPackageStatus    string `json:"trial_package_status"`     //体验课，有效期状态 active=有效期内 expired=已过期，还没被扫描到的为空
+	TrialPackageExpireTs  int64  `json:"trial_package_expire_ts"`  //体验课，过期时间
 	BuyPackage            bool   `json:"buy_package"`              //是否买了正式课
 }
 
@@ -141,6 +143,7 @@ func GetUserStatiticHandler(w http.ResponseWriter, r *http.Request) {
 	rsp.UnsubscribedUsers = rsp.TotalUsers - rsp.TotalSubscriptions
 
 	//处理单条记录信息
+	mapTrialPackageId2Idx := make(map[string]int)
 	for _, v := range vecAllUserModel {
 		stTrailCoursePackage, err := dao.ImpCoursePackage.GetTrailCoursePackage(v.UserID)
 		if err != nil {
@@ -175,8 +178,20 @@ func GetUserStatiticHandler(w http.ResponseWriter, r *http.Request) {
 				break
 			}
 		}
+		mapTrialPackageId2Idx[stTrailCoursePackage.PackageID] = len(rsp.UserStatisticItemList)
 		rsp.UserStatisticItemList = append(rsp.UserStatisticItemList, rspItem)
 	}
+
+	//体验课包的有效期状态，按课包id批量查询
+	vecTrialPackageId := make([]string, 0, len(mapTrialPackageId2Idx))
+	for packageId := range mapTrialPackageId2Idx {
+		vecTrialPackageId = append(vecTrialPackageId, packageId)
+	}
+	for packageId, stTrialPackageStateModel := range getTrialPackageStateMapForShow(vecTrialPackageId) {
+		idx := mapTrialPackageId2Idx[packageId]
+		rsp.UserStatisticItemList[idx].TrialPackageStatus = stTrialPackageStateModel.Status
+		rsp.UserStatisticItemList[idx].TrialPackageExpireTs = stTrialPackageStateModel.ExpireTs
+	}
 	return
 }
 
@@ -3,7 +3,7 @@ module ff_scan_coach
 go 1.21
 
 require (
-	github.com/jinzhu/gorm v1.9.16 // indirect
+	github.com/jinzhu/gorm v1.9.16
 	github.com/xionghengheng/ff_plib v0.0.0-20260212080125-669836b5cb4a
 )
 
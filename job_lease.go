@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/db"
+)
+
+// 任务租约参数：持有者每 jobLeaseRenewInterval 续约一次，持有者挂掉后最多 jobLeaseTTL 由其他实例接管
+const (
+	jobLeaseTTL           = 30 * time.Second
+	jobLeaseRenewInterval = 10 * time.Second
+	jobLeaseSafeMargin    = 5 * time.Second // 本地判断是否持有租约时预留的时间，避免和接管的实例时钟误差导致同时执行
+)
+
+// JobLeaseModel 定时任务的租约，同一时间只有持有租约的实例执行该任务
+type JobLeaseModel struct {
+	ID           int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`          // 主键ID
+	JobName      string `json:"job_name" gorm:"type:varchar(64);unique_index"` // 任务名
+	Holder       string `json:"holder" gorm:"type:varchar(128)"`               // 持有者（实例标识）
+	LeaseUntilTs int64  `json:"lease_until_ts"`                                // 租约到期时间
+	AcquiredTs   int64  `json:"acquired_ts"`                                   // 本次持有开始时间
+	Version      int64  `json:"version"`                                       // 每次续约加1，保证续约一定更新到行
+	UpdatedTs    int64  `json:"updated_ts"`                                    // 更新时间
+}
+
+const job_lease_tableName = "job_lease"
+
+// JobLeaseInterface 任务租约数据模型接口
+type JobLeaseInterface interface {
+	// 获取或续约租约，租约空闲、已过期或本来就由holder持有时成功
+	TryAcquireLease(jobName string, holder string, nowTs int64, ttlSec int64) (bool, error)
+
+	// 主动释放租约，只释放自己持有的
+	ReleaseLease(jobName string, holder string) error
+
+	// 获取全部租约
+	GetAllLease() ([]JobLeaseModel, error)
+}
+
+// JobLeaseInterfaceImp 任务租约数据模型实现
+type JobLeaseInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpJobLease JobLeaseInterface = &JobLeaseInterfaceImp{}
+
+func (imp *JobLeaseInterfaceImp) TryAcquireLease(jobName string, holder string, nowTs int64, ttlSec int64) (bool, error) {
+	cli := db.Get()
+
+	// 先按自己持有续约
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["lease_until_ts"] = nowTs + ttlSec
+	mapUpdates["version"] = gorm.Expr("version + 1")
+	mapUpdates["updated_ts"] = nowTs
+	result := cli.Table(job_lease_tableName).Model(&JobLeaseModel{}).
+		Where("job_name = ? AND holder = ? AND lease_until_ts >= ?", jobName, holder, nowTs).Updates(mapUpdates)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	// 再尝试接管已过期的租约
+	mapUpdates["holder"] = holder
+	mapUpdates["acquired_ts"] = nowTs
+	result = cli.Table(job_lease_tableName).Model(&JobLeaseModel{}).
+		Where("job_name = ? AND lease_until_ts < ?", jobName, nowTs).Updates(mapUpdates)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	// 没有更新到，可能是租约被别人持有，也可能是任务第一次运行还没有记录
+	var count int
+	if err := cli.Table(job_lease_tableName).Where("job_name = ?", jobName).Count(&count).Error; err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+	stJobLeaseModel := &JobLeaseModel{
+		JobName:      jobName,
+		Holder:       holder,
+		LeaseUntilTs: nowTs + ttlSec,
+		AcquiredTs:   nowTs,
+		Version:      1,
+		UpdatedTs:    nowTs,
+	}
+	if err := cli.Table(job_lease_tableName).Create(stJobLeaseModel).Error; err != nil {
+		// 其他实例同时插入，唯一索引冲突，视为没抢到
+		Printf("TryAcquireLease create err, err:%+v job:%s\n", err, jobName)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (imp *JobLeaseInterfaceImp) ReleaseLease(jobName string, holder string) error {
+	cli := db.Get()
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["lease_until_ts"] = 0
+	mapUpdates["updated_ts"] = time.Now().Unix()
+	return cli.Table(job_lease_tableName).Model(&JobLeaseModel{}).
+		Where("job_name = ? AND holder = ?", jobName, holder).Updates(mapUpdates).Error
+}
+
+func (imp *JobLeaseInterfaceImp) GetAllLease() ([]JobLeaseModel, error) {
+	var vecJobLeaseModel []JobLeaseModel
+	cli := db.Get()
+	err := cli.Table(job_lease_tableName).Order("job_name ASC").Find(&vecJobLeaseModel).Error
+	return vecJobLeaseModel, err
+}
+
+// genInstanceId 生成实例标识：主机名-进程号-随机数，容器重启后是新的持有者
+func genInstanceId() string {
+	hostname, _ := os.Hostname()
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(buf))
+}
+
+// jobLeaseKeeper 在后台为每个任务持续抢占和续约租约，实现每个任务只在一个实例上执行
+type jobLeaseKeeper struct {
+	holder       string
+	mu           sync.Mutex
+	vecJobName   []string
+	mapHeldUntil map[string]time.Time          // 本实例持有的租约及其到期时间
+	mapRunCancel map[string]context.CancelFunc // 正在执行的任务，租约丢失时取消
+	wg           sync.WaitGroup
+}
+
+func newJobLeaseKeeper(holder string) *jobLeaseKeeper {
+	return &jobLeaseKeeper{
+		holder:       holder,
+		mapHeldUntil: make(map[string]time.Time),
+		mapRunCancel: make(map[string]context.CancelFunc),
+	}
+}
+
+// start 先同步抢一次租约，保证启动即执行的任务能在持有者上执行，之后在后台定期续约
+func (k *jobLeaseKeeper) start(ctx context.Context) {
+	k.renewAll()
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+		ticker := time.NewTicker(jobLeaseRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				k.renewAll()
+			}
+		}
+	}()
+}
+
+func (k *jobLeaseKeeper) renewAll() {
+	for _, name := range k.vecJobName {
+		k.renew(name)
+	}
+}
+
+// renew 抢占或续约一个任务的租约，续约失败说明已被其他实例接管，取消本地正在执行的任务
+func (k *jobLeaseKeeper) renew(jobName string) {
+	now := time.Now()
+	ok, err := ImpJobLease.TryAcquireLease(jobName, k.holder, now.Unix(), int64(jobLeaseTTL/time.Second))
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	heldUntil, held := k.mapHeldUntil[jobName]
+	if err != nil {
+		// 数据库异常时先保留本地的到期时间，但下一次续约前租约就会到期的，
+		// 说明其他实例随时可能接管，直接放弃并取消正在执行的任务
+		Printf("jobLeaseKeeper TryAcquireLease err, err:%+v job:%s holder:%s\n", err, jobName, k.holder)
+		if held && !now.Add(jobLeaseRenewInterval+jobLeaseSafeMargin).Before(heldUntil) {
+			Printf("[SchedulerAlarm]jobLeaseKeeper lease expiring without renew, job:%s holder:%s heldUntil:%s\n",
+				jobName, k.holder, heldUntil.Format("2006-01-02 15:04:05"))
+			k.dropLeaseLocked(jobName)
+		}
+		return
+	}
+	if ok {
+		if !held {
+			Printf("jobLeaseKeeper acquired, job:%s holder:%s\n", jobName, k.holder)
+		}
+		k.mapHeldUntil[jobName] = now.Add(jobLeaseTTL)
+		return
+	}
+	if held {
+		Printf("[SchedulerAlarm]jobLeaseKeeper lease lost, job:%s holder:%s\n", jobName, k.holder)
+		k.dropLeaseLocked(jobName)
+	}
+}
+
+// dropLeaseLocked 放弃本地持有的租约并取消正在执行的任务，调用方需持有锁
+func (k *jobLeaseKeeper) dropLeaseLocked(jobName string) {
+	delete(k.mapHeldUntil, jobName)
+	if cancel, ok := k.mapRunCancel[jobName]; ok {
+		cancel()
+	}
+}
+
+// isHolder 本实例当前是否持有任务租约
+func (k *jobLeaseKeeper) isHolder(jobName string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	heldUntil, ok := k.mapHeldUntil[jobName]
+	return ok && time.Now().Add(jobLeaseSafeMargin).Before(heldUntil)
+}
+
+// bindRun 记录正在执行的任务，租约丢失时取消
+func (k *jobLeaseKeeper) bindRun(jobName string, cancel context.CancelFunc) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.mapRunCancel[jobName] = cancel
+}
+
+func (k *jobLeaseKeeper) unbindRun(jobName string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.mapRunCancel, jobName)
+}
+
+// releaseAll 停服时主动释放持有的租约，其他实例下一次续约即可接管，不用等租约过期
+func (k *jobLeaseKeeper) releaseAll() {
+	k.wg.Wait()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for jobName := range k.mapHeldUntil {
+		if err := ImpJobLease.ReleaseLease(jobName, k.holder); err != nil {
+			Printf("jobLeaseKeeper ReleaseLease err, err:%+v job:%s holder:%s\n", err, jobName, k.holder)
+			continue
+		}
+		Printf("jobLeaseKeeper released, job:%s holder:%s\n", jobName, k.holder)
+	}
+	k.mapHeldUntil = make(map[string]time.Time)
+}
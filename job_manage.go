@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jinzhu/gorm"
+)
+
+// jobScheduler 后台任务调度器，启动时赋值，供运维接口查询已注册的任务
+var jobScheduler *Scheduler
+
+// checkJobName 检查任务是否已注册，返回错误信息
+func checkJobName(jobName string) string {
+	if jobName == "" {
+		return "任务名不能为空"
+	}
+	if jobScheduler == nil || !jobScheduler.HasJob(jobName) {
+		return "任务不存在"
+	}
+	return ""
+}
+
+type GetJobListReq struct {
+}
+
+type JobStatusItem struct {
+	JobInfo
+	Paused         bool         `json:"paused"`          // 是否暂停
+	PausedBy       string       `json:"paused_by"`       // 暂停/恢复的操作人
+	PausedTs       int64        `json:"paused_ts"`       // 暂停/恢复的时间
+	TriggerPending bool         `json:"trigger_pending"` // 是否有等待执行的手动触发
+	LeaseHolder    string       `json:"lease_holder"`    // 当前持有租约的实例
+	LeaseUntilTs   int64        `json:"lease_until_ts"`  // 租约到期时间
+	LastRun        *JobRunModel `json:"last_run"`        // 最近一次执行
+	LastSuccRun    *JobRunModel `json:"last_succ_run"`   // 最近一次成功的执行
+}
+
+type GetJobListRsp struct {
+	Code     int             `json:"code"`
+	ErrorMsg string          `json:"errorMsg,omitempty"`
+	List     []JobStatusItem `json:"list,omitempty"`
+}
+
+func getGetJobListReq(r *http.Request) (GetJobListReq, error) {
+	req := GetJobListReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// GetJobListHandler 查询全部后台任务的状态：暂停状态、租约持有者、最近一次执行和最近一次成功
+func GetJobListHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getGetJobListReq(r)
+	rsp := &GetJobListRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetJobListHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if jobScheduler == nil {
+		rsp.Code = -900
+		rsp.ErrorMsg = "调度器未启动"
+		return
+	}
+
+	vecJobControlModel, err := ImpJobRun.GetAllJobControl()
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询任务控制信息失败"
+		Printf("GetJobListHandler GetAllJobControl err, err:%+v\n", err)
+		return
+	}
+	mapJobControl := make(map[string]JobControlModel)
+	for _, v := range vecJobControlModel {
+		mapJobControl[v.JobName] = v
+	}
+
+	vecJobLeaseModel, err := ImpJobLease.GetAllLease()
+	if err != nil {
+		rsp.Code = -922
+		rsp.ErrorMsg = "查询任务租约失败"
+		Printf("GetJobListHandler GetAllLease err, err:%+v\n", err)
+		return
+	}
+	mapJobLease := make(map[string]JobLeaseModel)
+	for _, v := range vecJobLeaseModel {
+		mapJobLease[v.JobName] = v
+	}
+
+	for _, v := range jobScheduler.GetJobInfoList() {
+		item := JobStatusItem{JobInfo: v}
+		if stJobControlModel, ok := mapJobControl[v.Name]; ok {
+			item.Paused = stJobControlModel.Paused
+			item.PausedBy = stJobControlModel.PausedBy
+			item.PausedTs = stJobControlModel.PausedTs
+			item.TriggerPending = stJobControlModel.TriggerReqTs > 0
+		}
+		if stJobLeaseModel, ok := mapJobLease[v.Name]; ok {
+			item.LeaseHolder = stJobLeaseModel.Holder
+			item.LeaseUntilTs = stJobLeaseModel.LeaseUntilTs
+		}
+
+		vecJobRunModel, err := ImpJobRun.GetJobRunList(v.Name, 0, 1)
+		if err != nil {
+			rsp.Code = -933
+			rsp.ErrorMsg = "查询任务执行记录失败"
+			Printf("GetJobListHandler GetJobRunList err, err:%+v job:%s\n", err, v.Name)
+			return
+		}
+		if len(vecJobRunModel) > 0 {
+			item.LastRun = &vecJobRunModel[0]
+		}
+
+		stJobRunModel, err := ImpJobRun.GetLastJobRun(v.Name, JobRunStatus_Succ)
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			rsp.Code = -944
+			rsp.ErrorMsg = "查询任务执行记录失败"
+			Printf("GetJobListHandler GetLastJobRun err, err:%+v job:%s\n", err, v.Name)
+			return
+		}
+		if err == nil {
+			item.LastSuccRun = stJobRunModel
+		}
+		rsp.List = append(rsp.List, item)
+	}
+
+	rsp.Code = 0
+	Printf("GetJobListHandler success, count:%d\n", len(rsp.List))
+	return
+}
+
+type GetJobRunListReq struct {
+	JobName  string `json:"job_name"`  // 任务名，为空不过滤
+	Passback string `json:"passback"`  // 翻页标记，首次请求传空字符串，后续传上次返回的passback
+	PageSize int    `json:"page_size"` // 每页数量
+}
+
+type GetJobRunListRsp struct {
+	Code     int           `json:"code"`
+	ErrorMsg string        `json:"errorMsg,omitempty"`
+	List     []JobRunModel `json:"list,omitempty"`
+	Passback string        `json:"passback"` // 下一页的翻页标记，为空字符串表示没有更多数据
+}
+
+func getGetJobRunListReq(r *http.Request) (GetJobRunListReq, error) {
+	req := GetJobRunListReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// GetJobRunListHandler 查询后台任务的执行记录，按开始时间降序
+func GetJobRunListHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getGetJobRunListReq(r)
+	rsp := &GetJobRunListRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetJobRunListHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	var offset int64
+	if len(req.Passback) > 0 {
+		offset, _ = strconv.ParseInt(req.Passback, 10, 64)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	pageSize := req.PageSize
+	if pageSize <= 0 {
+		pageSize = 20 // 默认每页20条
+	}
+	if pageSize > 100 {
+		pageSize = 100 // 最大每页100条
+	}
+
+	vecJobRunModel, err := ImpJobRun.GetJobRunList(req.JobName, int(offset), pageSize)
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询任务执行记录失败"
+		Printf("GetJobRunListHandler GetJobRunList err, err:%+v req:%+v\n", err, req)
+		return
+	}
+
+	rsp.List = vecJobRunModel
+	if len(vecJobRunModel) == pageSize {
+		rsp.Passback = strconv.FormatInt(offset+int64(pageSize), 10)
+	}
+	rsp.Code = 0
+	Printf("GetJobRunListHandler success, offset:%d count:%d\n", offset, len(rsp.List))
+	return
+}
+
+type TriggerJobReq struct {
+	JobName string `json:"job_name"` // 任务名
+}
+
+type TriggerJobRsp struct {
+	Code     int    `json:"code"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+}
+
+func getTriggerJobReq(r *http.Request) (TriggerJobReq, error) {
+	req := TriggerJobReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// TriggerJobHandler 手动触发一次后台任务
+// 请求写入 job_control 表，由持有租约的实例在下一次同步时（最多10秒）领取并执行，暂停中的任务也会执行
+func TriggerJobHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getTriggerJobReq(r)
+	rsp := &TriggerJobRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("TriggerJobHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if errMsg := checkJobName(req.JobName); errMsg != "" {
+		rsp.Code = -996
+		rsp.ErrorMsg = errMsg
+		return
+	}
+
+	if err = ImpJobRun.RequestJobTrigger(req.JobName, authResult.Operator); err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "触发任务失败"
+		Printf("TriggerJobHandler RequestJobTrigger err, err:%+v job:%s\n", err, req.JobName)
+		return
+	}
+	AddAuditChange(r, "job", req.JobName, nil, map[string]interface{}{"trigger": true})
+
+	rsp.Code = 0
+	Printf("TriggerJobHandler success, job:%s operator:%s\n", req.JobName, authResult.Operator)
+	return
+}
+
+type SetJobPausedReq struct {
+	JobName string `json:"job_name"` // 任务名
+	Paused  bool   `json:"paused"`   // true暂停，false恢复
+}
+
+type SetJobPausedRsp struct {
+	Code     int    `json:"code"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+}
+
+func getSetJobPausedReq(r *http.Request) (SetJobPausedReq, error) {
+	req := SetJobPausedReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// SetJobPausedHandler 暂停或恢复后台任务，所有实例在下一次同步时（最多10秒）生效，已经在执行的不会中断
+func SetJobPausedHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getSetJobPausedReq(r)
+	rsp := &SetJobPausedRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("SetJobPausedHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if errMsg := checkJobName(req.JobName); errMsg != "" {
+		rsp.Code = -996
+		rsp.ErrorMsg = errMsg
+		return
+	}
+
+	if err = ImpJobRun.SetJobPaused(req.JobName, req.Paused, authResult.Operator); err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "设置任务暂停状态失败"
+		Printf("SetJobPausedHandler SetJobPaused err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	AddAuditChange(r, "job", req.JobName, nil, map[string]interface{}{"paused": req.Paused})
+
+	rsp.Code = 0
+	Printf("SetJobPausedHandler success, job:%s paused:%t operator:%s\n", req.JobName, req.Paused, authResult.Operator)
+	return
+}
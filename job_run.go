@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xionghengheng/ff_plib/db"
+)
+
+// 任务执行的触发方式
+const (
+	JobTrigger_Schedule = "schedule" // 按执行计划
+	JobTrigger_Start    = "start"    // 服务启动时执行
+	JobTrigger_Manual   = "manual"   // 管理员手动触发
+)
+
+// 任务执行结果
+const (
+	JobRunStatus_Running  = "running"  // 执行中（实例异常退出时会一直停留在该状态）
+	JobRunStatus_Succ     = "succ"     // 执行完成，单条数据处理失败记在 error_cnt 里
+	JobRunStatus_Failed   = "failed"   // 整体失败，例如拉取待处理数据失败
+	JobRunStatus_Panic    = "panic"    // 执行中panic
+	JobRunStatus_Canceled = "canceled" // 停服或租约丢失被取消
+)
+
+// JobRunModel 定时任务的一次执行记录
+type JobRunModel struct {
+	ID          int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`                       // 主键ID
+	JobName     string `json:"job_name" gorm:"type:varchar(64);index:idx_job_name_beg_ts"` // 任务名
+	Holder      string `json:"holder" gorm:"type:varchar(128)"`                            // 执行的实例
+	TriggerType string `json:"trigger_type" gorm:"type:varchar(16)"`                       // 触发方式
+	TriggerBy   string `json:"trigger_by" gorm:"type:varchar(64)"`                         // 手动触发的操作人
+	Status      string `json:"status" gorm:"type:varchar(16)"`                             // 执行结果
+	BegTs       int64  `json:"beg_ts" gorm:"index:idx_job_name_beg_ts"`                    // 开始时间
+	EndTs       int64  `json:"end_ts"`                                                     // 结束时间
+	CostMs      int64  `json:"cost_ms"`                                                    // 耗时（毫秒）
+	ExaminedCnt int64  `json:"examined_cnt"`                                               // 检查的数据条数
+	ChangedCnt  int64  `json:"changed_cnt"`                                                // 修改的数据条数
+	NotifiedCnt int64  `json:"notified_cnt"`                                               // 发送成功的通知数
+	ErrorCnt    int64  `json:"error_cnt"`                                                  // 出错次数
+	BacklogCnt  int64  `json:"backlog_cnt"`                                                // 本次没来得及处理、留到下次的数据条数
+	LastError   string `json:"last_error" gorm:"type:varchar(512)"`                        // 最后一次错误
+}
+
+const job_run_tableName = "job_run"
+
+// JobControlModel 定时任务的运维控制，暂停和手动触发对所有实例生效
+type JobControlModel struct {
+	ID           int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`          // 主键ID
+	JobName      string `json:"job_name" gorm:"type:varchar(64);unique_index"` // 任务名
+	Paused       bool   `json:"paused"`                                        // 是否暂停
+	PausedBy     string `json:"paused_by" gorm:"type:varchar(64)"`             // 暂停/恢复的操作人
+	PausedTs     int64  `json:"paused_ts"`                                     // 暂停/恢复的时间
+	TriggerReqTs int64  `json:"trigger_req_ts"`                                // 手动触发的请求时间，被执行实例领取后清零
+	TriggerBy    string `json:"trigger_by" gorm:"type:varchar(64)"`            // 手动触发的操作人
+	UpdatedTs    int64  `json:"updated_ts"`                                    // 更新时间
+}
+
+const job_control_tableName = "job_control"
+
+// JobRunInterface 任务执行记录数据模型接口
+type JobRunInterface interface {
+	// 新增执行记录
+	AddJobRun(stJobRunModel *JobRunModel) error
+
+	// 更新执行记录
+	UpdateJobRun(id int64, mapUpdates map[string]interface{}) error
+
+	// 查询执行记录，按开始时间降序，jobName为空不过滤
+	GetJobRunList(jobName string, offset int, limit int) ([]JobRunModel, error)
+
+	// 获取任务最近一次指定结果的执行记录，没有时返回 gorm.ErrRecordNotFound
+	GetLastJobRun(jobName string, status string) (*JobRunModel, error)
+
+	// 获取全部任务的控制信息
+	GetAllJobControl() ([]JobControlModel, error)
+
+	// 暂停或恢复任务，记录不存在时新增
+	SetJobPaused(jobName string, paused bool, operator string) error
+
+	// 请求手动触发任务，记录不存在时新增
+	RequestJobTrigger(jobName string, operator string) error
+
+	// 领取手动触发请求，只有一个实例能领取成功
+	ClaimJobTrigger(jobName string, triggerReqTs int64) (bool, error)
+}
+
+// JobRunInterfaceImp 任务执行记录数据模型实现
+type JobRunInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpJobRun JobRunInterface = &JobRunInterfaceImp{}
+
+func (imp *JobRunInterfaceImp) AddJobRun(stJobRunModel *JobRunModel) error {
+	cli := db.Get()
+	return cli.Table(job_run_tableName).Create(stJobRunModel).Error
+}
+
+func (imp *JobRunInterfaceImp) UpdateJobRun(id int64, mapUpdates map[string]interface{}) error {
+	cli := db.Get()
+	return cli.Table(job_run_tableName).Model(&JobRunModel{}).Where("id = ?", id).Updates(mapUpdates).Error
+}
+
+func (imp *JobRunInterfaceImp) GetJobRunList(jobName string, offset int, limit int) ([]JobRunModel, error) {
+	var vecJobRunModel []JobRunModel
+	cli := db.Get().Table(job_run_tableName)
+	if jobName != "" {
+		cli = cli.Where("job_name = ?", jobName)
+	}
+	err := cli.Order("beg_ts DESC, id DESC").Offset(offset).Limit(limit).Find(&vecJobRunModel).Error
+	return vecJobRunModel, err
+}
+
+func (imp *JobRunInterfaceImp) GetLastJobRun(jobName string, status string) (*JobRunModel, error) {
+	var stJobRunModel = new(JobRunModel)
+	cli := db.Get()
+	err := cli.Table(job_run_tableName).Where("job_name = ? AND status = ?", jobName, status).
+		Order("beg_ts DESC, id DESC").First(stJobRunModel).Error
+	return stJobRunModel, err
+}
+
+func (imp *JobRunInterfaceImp) GetAllJobControl() ([]JobControlModel, error) {
+	var vecJobControlModel []JobControlModel
+	cli := db.Get()
+	err := cli.Table(job_control_tableName).Order("job_name ASC").Find(&vecJobControlModel).Error
+	return vecJobControlModel, err
+}
+
+func (imp *JobRunInterfaceImp) SetJobPaused(jobName string, paused bool, operator string) error {
+	nowTs := time.Now().Unix()
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["paused"] = paused
+	mapUpdates["paused_by"] = operator
+	mapUpdates["paused_ts"] = nowTs
+	mapUpdates["updated_ts"] = nowTs
+	return imp.saveJobControl(jobName, mapUpdates, &JobControlModel{
+		JobName:   jobName,
+		Paused:    paused,
+		PausedBy:  operator,
+		PausedTs:  nowTs,
+		UpdatedTs: nowTs,
+	})
+}
+
+func (imp *JobRunInterfaceImp) RequestJobTrigger(jobName string, operator string) error {
+	nowTs := time.Now().Unix()
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["trigger_req_ts"] = nowTs
+	mapUpdates["trigger_by"] = operator
+	mapUpdates["updated_ts"] = nowTs
+	return imp.saveJobControl(jobName, mapUpdates, &JobControlModel{
+		JobName:      jobName,
+		TriggerReqTs: nowTs,
+		TriggerBy:    operator,
+		UpdatedTs:    nowTs,
+	})
+}
+
+// saveJobControl 有记录时更新，没有时插入；并发插入唯一索引冲突时再更新一次
+func (imp *JobRunInterfaceImp) saveJobControl(jobName string, mapUpdates map[string]interface{}, stJobControlModel *JobControlModel) error {
+	cli := db.Get()
+	var count int
+	if err := cli.Table(job_control_tableName).Where("job_name = ?", jobName).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		if err := cli.Table(job_control_tableName).Create(stJobControlModel).Error; err == nil {
+			return nil
+		}
+	}
+	return cli.Table(job_control_tableName).Model(&JobControlModel{}).Where("job_name = ?", jobName).Updates(mapUpdates).Error
+}
+
+func (imp *JobRunInterfaceImp) ClaimJobTrigger(jobName string, triggerReqTs int64) (bool, error) {
+	cli := db.Get()
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["trigger_req_ts"] = 0
+	mapUpdates["updated_ts"] = time.Now().Unix()
+	result := cli.Table(job_control_tableName).Model(&JobControlModel{}).
+		Where("job_name = ? AND trigger_req_ts = ?", jobName, triggerReqTs).Updates(mapUpdates)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// JobRunStat 一次执行过程中的计数，由任务在执行过程中累加，执行结束后写入执行记录
+// 方法都允许接收者为nil，任务不在调度器中执行（没有计数）时直接忽略
+type JobRunStat struct {
+	examinedCnt int64
+	changedCnt  int64
+	notifiedCnt int64
+	errorCnt    int64
+	backlogCnt  int64
+
+	mu        sync.Mutex
+	lastError string
+	failed    bool
+}
+
+type jobRunStatCtxKey struct{}
+
+// withJobRunStat 把计数放到ctx中传给任务
+func withJobRunStat(ctx context.Context, stat *JobRunStat) context.Context {
+	return context.WithValue(ctx, jobRunStatCtxKey{}, stat)
+}
+
+// getJobRunStat 从ctx中取出本次执行的计数，没有时返回nil
+func getJobRunStat(ctx context.Context) *JobRunStat {
+	stat, _ := ctx.Value(jobRunStatCtxKey{}).(*JobRunStat)
+	return stat
+}
+
+// AddExamined 累加检查的数据条数
+func (s *JobRunStat) AddExamined(n int) {
+	if s != nil {
+		atomic.AddInt64(&s.examinedCnt, int64(n))
+	}
+}
+
+// AddChanged 累加修改的数据条数
+func (s *JobRunStat) AddChanged(n int) {
+	if s != nil {
+		atomic.AddInt64(&s.changedCnt, int64(n))
+	}
+}
+
+// AddNotified 累加发送成功的通知数
+func (s *JobRunStat) AddNotified(n int) {
+	if s != nil {
+		atomic.AddInt64(&s.notifiedCnt, int64(n))
+	}
+}
+
+// AddBacklog 累加没来得及处理的数据条数
+func (s *JobRunStat) AddBacklog(n int) {
+	if s != nil {
+		atomic.AddInt64(&s.backlogCnt, int64(n))
+	}
+}
+
+// AddError 记录一次单条数据处理失败，任务继续执行
+func (s *JobRunStat) AddError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	atomic.AddInt64(&s.errorCnt, 1)
+	s.mu.Lock()
+	s.lastError = err.Error()
+	s.mu.Unlock()
+}
+
+// Fail 记录任务整体失败
+func (s *JobRunStat) Fail(err error) {
+	if s == nil {
+		return
+	}
+	s.AddError(err)
+	s.mu.Lock()
+	s.failed = true
+	s.mu.Unlock()
+}
+
+// fillJobRun 把计数写到执行记录的更新字段中
+func (s *JobRunStat) fillJobRun(mapUpdates map[string]interface{}) {
+	mapUpdates["examined_cnt"] = atomic.LoadInt64(&s.examinedCnt)
+	mapUpdates["changed_cnt"] = atomic.LoadInt64(&s.changedCnt)
+	mapUpdates["notified_cnt"] = atomic.LoadInt64(&s.notifiedCnt)
+	mapUpdates["error_cnt"] = atomic.LoadInt64(&s.errorCnt)
+	mapUpdates["backlog_cnt"] = atomic.LoadInt64(&s.backlogCnt)
+	s.mu.Lock()
+	lastError := s.lastError
+	s.mu.Unlock()
+	if len(lastError) > 500 {
+		lastError = lastError[:500]
+	}
+	mapUpdates["last_error"] = lastError
+}
+
+func (s *JobRunStat) isFailed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failed
+}
+
+// beginJobRun 写入一条执行中的记录，写入失败只打日志，不影响任务执行
+func beginJobRun(jobName string, holder string, triggerType string, triggerBy string, begTime time.Time) int64 {
+	stJobRunModel := &JobRunModel{
+		JobName:     jobName,
+		Holder:      holder,
+		TriggerType: triggerType,
+		TriggerBy:   triggerBy,
+		Status:      JobRunStatus_Running,
+		BegTs:       begTime.Unix(),
+	}
+	if err := ImpJobRun.AddJobRun(stJobRunModel); err != nil {
+		Printf("beginJobRun AddJobRun err, err:%+v job:%s\n", err, jobName)
+		return 0
+	}
+	return stJobRunModel.ID
+}
+
+// finishJobRun 更新执行结果和计数
+func finishJobRun(runId int64, jobName string, status string, stat *JobRunStat, begTime time.Time) {
+	endTime := time.Now()
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["status"] = status
+	mapUpdates["end_ts"] = endTime.Unix()
+	mapUpdates["cost_ms"] = endTime.Sub(begTime).Milliseconds()
+	stat.fillJobRun(mapUpdates)
+	Printf("Scheduler job run stat, job:%s status:%s stat:%+v\n", jobName, status, mapUpdates)
+	if runId == 0 {
+		return
+	}
+	if err := ImpJobRun.UpdateJobRun(runId, mapUpdates); err != nil {
+		Printf("finishJobRun UpdateJobRun err, err:%+v job:%s runId:%d\n", err, jobName, runId)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/db"
+	"github.com/xionghengheng/ff_plib/db/model"
+)
+
+// 旷课申诉的处理方式
+const (
+	LessonAppeal_Attended = "attended" // 实际已上课，补核销为已完成
+	LessonAppeal_Excused  = "excused"  // 有正当理由，免责并归还课时
+	LessonAppeal_Disputed = "disputed" // 只登记争议，不改变课程状态和课时
+)
+
+// LessonAppealModel 旷课课程的申诉处理记录，每次处理一条
+type LessonAppealModel struct {
+	ID             int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`     // 主键ID
+	LessonID       string `json:"lesson_id" gorm:"type:varchar(128);index"` // 课程id
+	PackageID      string `json:"package_id" gorm:"type:varchar(128)"`      // 课包id
+	Uid            int64  `json:"uid" gorm:"index"`                         // 学员id
+	CoachId        int    `json:"coach_id" gorm:"index"`                    // 教练id
+	Action         string `json:"action" gorm:"type:varchar(16)"`           // 处理方式
+	Reason         string `json:"reason" gorm:"type:varchar(512)"`          // 处理原因
+	StatusBefore   int    `json:"status_before"`                            // 处理前的课程状态
+	StatusAfter    int    `json:"status_after"`                             // 处理后的课程状态
+	ReturnedBefore bool   `json:"returned_before"`                          // 处理前是否已归还课时
+	ReturnedAfter  bool   `json:"returned_after"`                           // 处理后是否已归还课时
+	RemainCntDelta int    `json:"remain_cnt_delta"`                         // 课包剩余次数的变化
+	WriteOffTs     int64  `json:"write_off_ts"`                             // 补核销的时间，只有attended有
+	Operator       string `json:"operator" gorm:"type:varchar(64)"`         // 操作人
+	CreatedTs      int64  `json:"created_ts" gorm:"index"`                  // 处理时间
+}
+
+const lesson_appeal_tableName = "lesson_appeal"
+
+// errAppealRemainCntNotEnough 旷课课时已归还且已被用掉，无法补核销
+var errAppealRemainCntNotEnough = errors.New("remain cnt not enough")
+
+// LessonAppealInterface 旷课申诉数据模型接口
+type LessonAppealInterface interface {
+	// 处理旷课申诉：在同一个事务里修改课程状态、课包剩余次数并写入处理记录
+	// 课程已经不是旷课状态时返回 errStateChanged，需要扣回课时但剩余次数不足时返回 errAppealRemainCntNotEnough
+	ApplyLessonAppeal(uid int64, lessonId string, action string, stLessonAppealModel *LessonAppealModel) error
+
+	// 查询处理记录，按id降序，条件为空不过滤
+	GetLessonAppealList(uid int64, lessonId string, coachId int, offset int, limit int) ([]LessonAppealModel, error)
+
+	// 获取从begTs起补核销的课程id，用于统计教练超时核销
+	GetLateWriteOffLessonIdSet(begTs int64) (map[string]bool, error)
+}
+
+// LessonAppealInterfaceImp 旷课申诉数据模型实现
+type LessonAppealInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpLessonAppeal LessonAppealInterface = &LessonAppealInterfaceImp{}
+
+func (imp *LessonAppealInterfaceImp) ApplyLessonAppeal(uid int64, lessonId string, action string, stLessonAppealModel *LessonAppealModel) error {
+	return db.Get().Transaction(func(tx *gorm.DB) error {
+		// 锁住课程，避免和夜间归还课时的扫描同时修改
+		var stLessonModel model.CoursePackageSingleLessonModel
+		err := tx.Set("gorm:query_option", "FOR UPDATE").Table(course_package_single_lesson_tableName).
+			Where("uid = ? AND lesson_id = ?", uid, lessonId).First(&stLessonModel).Error
+		if err != nil {
+			return err
+		}
+		if stLessonModel.Status != model.En_LessonStatusMissed {
+			return errStateChanged
+		}
+
+		stLessonAppealModel.LessonID = stLessonModel.LessonID
+		stLessonAppealModel.PackageID = stLessonModel.PackageID
+		stLessonAppealModel.Uid = stLessonModel.Uid
+		stLessonAppealModel.CoachId = stLessonModel.CoachId
+		stLessonAppealModel.Action = action
+		stLessonAppealModel.StatusBefore = stLessonModel.Status
+		stLessonAppealModel.StatusAfter = stLessonModel.Status
+		stLessonAppealModel.ReturnedBefore = stLessonModel.WriteOffMissedReturnCnt
+		stLessonAppealModel.ReturnedAfter = stLessonModel.WriteOffMissedReturnCnt
+
+		mapUpdates := make(map[string]interface{})
+		switch action {
+		case LessonAppeal_Attended:
+			// 预约时已经扣过课时；如果夜间已经归还，需要扣回来
+			if stLessonModel.WriteOffMissedReturnCnt {
+				stLessonAppealModel.RemainCntDelta = -1
+			}
+			mapUpdates["status"] = model.En_LessonStatusCompleted
+			mapUpdates["write_off_ts"] = stLessonAppealModel.CreatedTs
+			mapUpdates["write_off_missed_return_cnt"] = false
+			stLessonAppealModel.StatusAfter = model.En_LessonStatusCompleted
+			stLessonAppealModel.ReturnedAfter = false
+			stLessonAppealModel.WriteOffTs = stLessonAppealModel.CreatedTs
+		case LessonAppeal_Excused:
+			// 还没归还的现在归还，之后夜间扫描不会再归还
+			if !stLessonModel.WriteOffMissedReturnCnt {
+				stLessonAppealModel.RemainCntDelta = 1
+				mapUpdates["write_off_missed_return_cnt"] = true
+				stLessonAppealModel.ReturnedAfter = true
+			}
+		}
+
+		if len(mapUpdates) > 0 {
+			result := tx.Table(course_package_single_lesson_tableName).Model(&model.CoursePackageSingleLessonModel{}).
+				Where("uid = ? AND lesson_id = ?", uid, lessonId).Updates(mapUpdates)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+		if stLessonAppealModel.RemainCntDelta != 0 {
+			cli := tx.Table(course_package_tableName).Model(&model.CoursePackageModel{}).Where("package_id = ?", stLessonModel.PackageID)
+			if stLessonAppealModel.RemainCntDelta < 0 {
+				cli = cli.Where("remain_cnt >= ?", -stLessonAppealModel.RemainCntDelta)
+			}
+			result := cli.UpdateColumn("remain_cnt", gorm.Expr("remain_cnt + ?", stLessonAppealModel.RemainCntDelta))
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				if stLessonAppealModel.RemainCntDelta < 0 {
+					return errAppealRemainCntNotEnough
+				}
+				return fmt.Errorf("course package not found, package_id:%s", stLessonModel.PackageID)
+			}
+		}
+		return tx.Table(lesson_appeal_tableName).Create(stLessonAppealModel).Error
+	})
+}
+
+func (imp *LessonAppealInterfaceImp) GetLessonAppealList(uid int64, lessonId string, coachId int, offset int, limit int) ([]LessonAppealModel, error) {
+	var vecLessonAppealModel []LessonAppealModel
+	cli := db.Get().Table(lesson_appeal_tableName)
+	if uid > 0 {
+		cli = cli.Where("uid = ?", uid)
+	}
+	if lessonId != "" {
+		cli = cli.Where("lesson_id = ?", lessonId)
+	}
+	if coachId > 0 {
+		cli = cli.Where("coach_id = ?", coachId)
+	}
+	err := cli.Order("id DESC").Offset(offset).Limit(limit).Find(&vecLessonAppealModel).Error
+	return vecLessonAppealModel, err
+}
+
+func (imp *LessonAppealInterfaceImp) GetLateWriteOffLessonIdSet(begTs int64) (map[string]bool, error) {
+	var vecLessonId []string
+	cli := db.Get()
+	err := cli.Table(lesson_appeal_tableName).Where("action = ? AND write_off_ts >= ?", LessonAppeal_Attended, begTs).
+		Pluck("lesson_id", &vecLessonId).Error
+	if err != nil {
+		return nil, err
+	}
+	mapLessonId := make(map[string]bool)
+	for _, v := range vecLessonId {
+		mapLessonId[v] = true
+	}
+	return mapLessonId, nil
+}
+
+type AppealMissedLessonReq struct {
+	Uid      int64  `json:"uid"`       // 学员id
+	LessonID string `json:"lesson_id"` // 课程id
+	Action   string `json:"action"`    // 处理方式：attended（补核销）/excused（免责归还课时）/disputed（只登记争议）
+	Reason   string `json:"reason"`    // 处理原因，必填
+}
+
+type AppealMissedLessonRsp struct {
+	Code     int                `json:"code"`
+	ErrorMsg string             `json:"errorMsg,omitempty"`
+	Appeal   *LessonAppealModel `json:"appeal,omitempty"` // 本次的处理记录
+}
+
+func getAppealMissedLessonReq(r *http.Request) (AppealMissedLessonReq, error) {
+	req := AppealMissedLessonReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// AppealMissedLessonHandler 处理已旷课的课程：补核销为已完成、免责归还课时，或只登记争议
+func AppealMissedLessonHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getAppealMissedLessonReq(r)
+	rsp := &AppealMissedLessonRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("AppealMissedLessonHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if req.Uid <= 0 || req.LessonID == "" {
+		rsp.Code = -996
+		rsp.ErrorMsg = "用户id和课程id不能为空"
+		return
+	}
+	if req.Action != LessonAppeal_Attended && req.Action != LessonAppeal_Excused && req.Action != LessonAppeal_Disputed {
+		rsp.Code = -996
+		rsp.ErrorMsg = "处理方式不合法"
+		return
+	}
+	if req.Reason == "" || len(req.Reason) > 512 {
+		rsp.Code = -996
+		rsp.ErrorMsg = "处理原因不能为空且不超过512字节"
+		return
+	}
+
+	stLessonAppealModel := &LessonAppealModel{
+		Reason:    req.Reason,
+		Operator:  authResult.Operator,
+		CreatedTs: time.Now().Unix(),
+	}
+	err = ImpLessonAppeal.ApplyLessonAppeal(req.Uid, req.LessonID, req.Action, stLessonAppealModel)
+	if gorm.IsRecordNotFoundError(err) {
+		rsp.Code = -996
+		rsp.ErrorMsg = "课程不存在"
+		return
+	}
+	if err == errStateChanged {
+		rsp.Code = -996
+		rsp.ErrorMsg = "课程不是旷课状态"
+		return
+	}
+	if err == errAppealRemainCntNotEnough {
+		rsp.Code = -996
+		rsp.ErrorMsg = "旷课归还的课时已被使用，课包剩余次数不足，无法补核销"
+		return
+	}
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "处理旷课申诉失败"
+		Printf("AppealMissedLessonHandler ApplyLessonAppeal err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	AddAuditChange(r, "lesson_appeal", req.LessonID,
+		map[string]interface{}{"status": stLessonAppealModel.StatusBefore, "returned": stLessonAppealModel.ReturnedBefore},
+		map[string]interface{}{"status": stLessonAppealModel.StatusAfter, "returned": stLessonAppealModel.ReturnedAfter, "remain_cnt_delta": stLessonAppealModel.RemainCntDelta})
+
+	rsp.Appeal = stLessonAppealModel
+	rsp.Code = 0
+	Printf("AppealMissedLessonHandler success, appeal:%+v\n", stLessonAppealModel)
+	return
+}
+
+type GetLessonAppealListReq struct {
+	Uid      int64  `json:"uid"`       // 学员id，为0不过滤
+	LessonID string `json:"lesson_id"` // 课程id，为空不过滤
+	CoachId  int    `json:"coach_id"`  // 教练id，为0不过滤
+	Passback string `json:"passback"`  // 翻页标记，首次请求传空字符串，后续传上次返回的passback
+	PageSize int    `json:"page_size"` // 每页数量
+}
+
+type GetLessonAppealListRsp struct {
+	Code     int                 `json:"code"`
+	ErrorMsg string              `json:"errorMsg,omitempty"`
+	List     []LessonAppealModel `json:"list,omitempty"`
+	Passback string              `json:"passback"` // 下一页的翻页标记，为空字符串表示没有更多数据
+}
+
+func getGetLessonAppealListReq(r *http.Request) (GetLessonAppealListReq, error) {
+	req := GetLessonAppealListReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// GetLessonAppealListHandler 查询旷课申诉的处理记录
+func GetLessonAppealListHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getGetLessonAppealListReq(r)
+	rsp := &GetLessonAppealListRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetLessonAppealListHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	var offset int64
+	if len(req.Passback) > 0 {
+		offset, _ = strconv.ParseInt(req.Passback, 10, 64)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	pageSize := req.PageSize
+	if pageSize <= 0 {
+		pageSize = 20 // 默认每页20条
+	}
+	if pageSize > 100 {
+		pageSize = 100 // 最大每页100条
+	}
+
+	vecLessonAppealModel, err := ImpLessonAppeal.GetLessonAppealList(req.Uid, req.LessonID, req.CoachId, int(offset), pageSize)
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询旷课申诉记录失败"
+		Printf("GetLessonAppealListHandler GetLessonAppealList err, err:%+v req:%+v\n", err, req)
+		return
+	}
+
+	rsp.List = vecLessonAppealModel
+	if len(vecLessonAppealModel) == pageSize {
+		rsp.Passback = strconv.FormatInt(offset+int64(pageSize), 10)
+	}
+	rsp.Code = 0
+	return
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"time"
+
+	"github.com/xionghengheng/ff_plib/db"
+	"github.com/xionghengheng/ff_plib/db/model"
+	"github.com/xionghengheng/ff_plib/db/pass_card_model"
+)
+
+// 课程扫描的分页参数：每页的条数，以及单次执行最多占用的时间，超出的部分留到下一次执行，并记为积压
+const (
+	lessonScanPageSize = 100
+	lessonScanBudget   = 3 * time.Minute // 扫描每5分钟执行一次，留出余量避免和下一次重叠
+)
+
+// LessonScanCursor 课程扫描的游标，按 (schedule_end_ts, lesson_id) 升序翻页
+// 处理过的课程状态会变化，用偏移量翻页会跳过数据，所以用上一页最后一条作为游标
+type LessonScanCursor struct {
+	ScheduleEndTs int64
+	LessonID      string
+}
+
+// advance 游标移动到刚处理的课程
+func (c *LessonScanCursor) advance(scheduleEndTs int64, lessonId string) {
+	c.ScheduleEndTs = scheduleEndTs
+	c.LessonID = lessonId
+}
+
+// 游标条件，游标为空时 schedule_end_ts 从0开始，等价于不过滤
+const lessonScanCursorWhere = "(schedule_end_ts > ? OR (schedule_end_ts = ? AND lesson_id > ?))"
+
+// 还没有旷课处罚决定的课程，用 NOT EXISTS 走 noshow_decision 的 lesson_id 索引，决定表变大也不影响扫描
+const lessonNoShowUndecidedWhere = "NOT EXISTS (SELECT 1 FROM " + noshow_decision_tableName + " d WHERE d.lesson_id = " +
+	course_package_single_lesson_tableName + ".lesson_id)"
+
+// LessonScanInterface 课程扫描分页查询接口
+// ff_plib 中对应的查询没有排序，也没有生效的limit，数据量大时一次拉全表，这里按游标分页
+type LessonScanInterface interface {
+	// 私教课：已过结束时间仍未核销的课程
+	GetSingleLessonNotFinishPage(nowTs int64, cursor LessonScanCursor, limit int) ([]model.CoursePackageSingleLessonModel, error)
+	CountSingleLessonNotFinish(nowTs int64, cursor LessonScanCursor) (int, error)
+
+	// 私教课：已旷课还没有归还次数、也还没有按旷课处罚规则做出决定的课程
+	GetSingleLessonMissedPage(cursor LessonScanCursor, limit int) ([]model.CoursePackageSingleLessonModel, error)
+	CountSingleLessonMissed(cursor LessonScanCursor) (int, error)
+
+	// 通卡：已过结束时间仍未核销的课程
+	GetPassCardLessonNotFinishPage(nowTs int64, cursor LessonScanCursor, limit int) ([]pass_card_model.LessonModel, error)
+	CountPassCardLessonNotFinish(nowTs int64, cursor LessonScanCursor) (int, error)
+}
+
+// LessonScanInterfaceImp 课程扫描分页查询实现
+type LessonScanInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpLessonScan LessonScanInterface = &LessonScanInterfaceImp{}
+
+func (imp *LessonScanInterfaceImp) GetSingleLessonNotFinishPage(nowTs int64, cursor LessonScanCursor, limit int) ([]model.CoursePackageSingleLessonModel, error) {
+	var vecCoursePackageSingleLessonModel []model.CoursePackageSingleLessonModel
+	cli := db.Get()
+	err := cli.Table(course_package_single_lesson_tableName).
+		Where("status = ? AND schedule_end_ts < ?", model.En_LessonStatus_Scheduled, nowTs).
+		Where(lessonScanCursorWhere, cursor.ScheduleEndTs, cursor.ScheduleEndTs, cursor.LessonID).
+		Order("schedule_end_ts ASC, lesson_id ASC").Limit(limit).Find(&vecCoursePackageSingleLessonModel).Error
+	return vecCoursePackageSingleLessonModel, err
+}
+
+func (imp *LessonScanInterfaceImp) CountSingleLessonNotFinish(nowTs int64, cursor LessonScanCursor) (int, error) {
+	var count int
+	cli := db.Get()
+	err := cli.Table(course_package_single_lesson_tableName).
+		Where("status = ? AND schedule_end_ts < ?", model.En_LessonStatus_Scheduled, nowTs).
+		Where(lessonScanCursorWhere, cursor.ScheduleEndTs, cursor.ScheduleEndTs, cursor.LessonID).Count(&count).Error
+	return count, err
+}
+
+func (imp *LessonScanInterfaceImp) GetSingleLessonMissedPage(cursor LessonScanCursor, limit int) ([]model.CoursePackageSingleLessonModel, error) {
+	var vecCoursePackageSingleLessonModel []model.CoursePackageSingleLessonModel
+	cli := db.Get()
+	err := cli.Table(course_package_single_lesson_tableName).
+		Where("status = ? AND write_off_missed_return_cnt = false", model.En_LessonStatusMissed).
+		Where(lessonNoShowUndecidedWhere).
+		Where(lessonScanCursorWhere, cursor.ScheduleEndTs, cursor.ScheduleEndTs, cursor.LessonID).
+		Order("schedule_end_ts ASC, lesson_id ASC").Limit(limit).Find(&vecCoursePackageSingleLessonModel).Error
+	return vecCoursePackageSingleLessonModel, err
+}
+
+func (imp *LessonScanInterfaceImp) CountSingleLessonMissed(cursor LessonScanCursor) (int, error) {
+	var count int
+	cli := db.Get()
+	err := cli.Table(course_package_single_lesson_tableName).
+		Where("status = ? AND write_off_missed_return_cnt = false", model.En_LessonStatusMissed).
+		Where(lessonNoShowUndecidedWhere).
+		Where(lessonScanCursorWhere, cursor.ScheduleEndTs, cursor.ScheduleEndTs, cursor.LessonID).Count(&count).Error
+	return count, err
+}
+
+func (imp *LessonScanInterfaceImp) GetPassCardLessonNotFinishPage(nowTs int64, cursor LessonScanCursor, limit int) ([]pass_card_model.LessonModel, error) {
+	var vecLessonModel []pass_card_model.LessonModel
+	cli := db.Get()
+	err := cli.Table(pass_card_lesson_tableName).
+		Where("status = ? AND schedule_end_ts < ?", pass_card_model.En_LessonStatus_Scheduled, nowTs).
+		Where(lessonScanCursorWhere, cursor.ScheduleEndTs, cursor.ScheduleEndTs, cursor.LessonID).
+		Order("schedule_end_ts ASC, lesson_id ASC").Limit(limit).Find(&vecLessonModel).Error
+	return vecLessonModel, err
+}
+
+func (imp *LessonScanInterfaceImp) CountPassCardLessonNotFinish(nowTs int64, cursor LessonScanCursor) (int, error) {
+	var count int
+	cli := db.Get()
+	err := cli.Table(pass_card_lesson_tableName).
+		Where("status = ? AND schedule_end_ts < ?", pass_card_model.En_LessonStatus_Scheduled, nowTs).
+		Where(lessonScanCursorWhere, cursor.ScheduleEndTs, cursor.ScheduleEndTs, cursor.LessonID).Count(&count).Error
+	return count, err
+}
+
+// reportLessonScanBacklog 时间预算用完时统计游标之后还没处理的数量，记入本次执行的积压
+func reportLessonScanBacklog(stat *JobRunStat, scanName string, countFunc func() (int, error)) {
+	backlogCnt, err := countFunc()
+	if err != nil {
+		Printf("reportLessonScanBacklog count err, err:%+v scan:%s\n", err, scanName)
+		stat.AddError(err)
+		return
+	}
+	stat.AddBacklog(backlogCnt)
+	Printf("[SchedulerAlarm]lesson scan budget exhausted, scan:%s backlog:%d\n", scanName, backlogCnt)
+}
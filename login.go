@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type LoginReq struct {
+	Username string `json:"username"` // 登录名
+	Password string `json:"password"` // 密码
+}
+
+type LoginRsp struct {
+	Code     int    `json:"code"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+	AuthTokenPair
+	Operator string `json:"operator,omitempty"` // 登录名
+	Role     string `json:"role,omitempty"`     // 角色
+}
+
+func getLoginReq(r *http.Request) (LoginReq, error) {
+	req := LoginReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// LoginHandler 用账号密码换取访问令牌和刷新令牌，之后的请求通过 Authorization: Bearer 携带访问令牌，不再每次发送密码
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getLoginReq(r)
+	rsp := &LoginRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕（不打印密码）
+	Printf("LoginHandler start, username:%s ip:%s\n", req.Username, getClientIP(r))
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if req.Username == "" || req.Password == "" {
+		rsp.Code = -996
+		rsp.ErrorMsg = "用户名和密码不能为空"
+		return
+	}
+
+	authResult := checkOperatorPassword(req.Username, req.Password, getClientIP(r))
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	sessionId, err := genSessionId()
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "生成会话失败"
+		Printf("LoginHandler genSessionId err, err:%+v\n", err)
+		return
+	}
+
+	nowTs := time.Now().Unix()
+	stOperatorSessionModel := &OperatorSessionModel{
+		SessionID:       sessionId,
+		Operator:        authResult.Operator,
+		Role:            authResult.Role,
+		RefreshExpireTs: nowTs + refreshTokenTTLSec,
+		ClientIP:        getClientIP(r),
+		CreatedTs:       nowTs,
+		UpdatedTs:       nowTs,
+	}
+	pair, err := issueTokenPair(stOperatorSessionModel, nowTs)
+	if err != nil {
+		rsp.Code = -900
+		rsp.ErrorMsg = "后台配置错误"
+		Printf("LoginHandler issueTokenPair err, err:%+v\n", err)
+		return
+	}
+	if err = ImpOperatorSession.AddSession(stOperatorSessionModel); err != nil {
+		rsp.Code = -922
+		rsp.ErrorMsg = "保存会话失败"
+		Printf("LoginHandler AddSession err, err:%+v\n", err)
+		return
+	}
+
+	rsp.Code = 0
+	rsp.AuthTokenPair = pair
+	rsp.Operator = authResult.Operator
+	rsp.Role = authResult.Role
+	Printf("LoginHandler success, username:%s role:%s session:%s\n", authResult.Operator, authResult.Role, sessionId)
+	return
+}
+
+type RefreshTokenReq struct {
+	RefreshToken string `json:"refresh_token"` // 刷新令牌
+}
+
+func getRefreshTokenReq(r *http.Request) (RefreshTokenReq, error) {
+	req := RefreshTokenReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// RefreshTokenHandler 用刷新令牌换取新的令牌，旧的刷新令牌失效；已失效的刷新令牌被再次使用时视为泄露，撤销整个会话
+func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getRefreshTokenReq(r)
+	rsp := &LoginRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("RefreshTokenHandler start, ip:%s\n", getClientIP(r))
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	claims, err := parseToken(req.RefreshToken, tokenType_Refresh)
+	if err != nil {
+		rsp.Code = -991
+		rsp.ErrorMsg = "登录已失效，请重新登录"
+		Printf("RefreshTokenHandler parseToken err, err:%+v\n", err)
+		return
+	}
+
+	stOperatorSessionModel, err := ImpOperatorSession.GetSession(claims.SessionID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			rsp.Code = -991
+			rsp.ErrorMsg = "登录已失效，请重新登录"
+		} else {
+			rsp.Code = -922
+			rsp.ErrorMsg = "查询会话失败"
+		}
+		Printf("RefreshTokenHandler GetSession err, err:%+v session:%s\n", err, claims.SessionID)
+		return
+	}
+	if stOperatorSessionModel.Revoked {
+		rsp.Code = -991
+		rsp.ErrorMsg = "登录已失效，请重新登录"
+		Printf("RefreshTokenHandler session revoked, session:%+v\n", stOperatorSessionModel)
+		return
+	}
+
+	// 重新加载账号，停用或角色变更后旧会话不能再续期
+	reason, err := checkSessionOperator(stOperatorSessionModel)
+	if err != nil {
+		rsp.Code = -900
+		rsp.ErrorMsg = "查询账号失败"
+		Printf("RefreshTokenHandler checkSessionOperator err, err:%+v session:%s\n", err, claims.SessionID)
+		return
+	}
+	if reason != "" {
+		if err = ImpOperatorSession.RevokeSession(stOperatorSessionModel.SessionID, reason); err != nil {
+			Printf("RefreshTokenHandler RevokeSession err, err:%+v session:%s\n", err, claims.SessionID)
+		}
+		rsp.Code = -991
+		rsp.ErrorMsg = "登录已失效，请重新登录"
+		Printf("RefreshTokenHandler operator changed, revoke session, reason:%s session:%+v\n", reason, stOperatorSessionModel)
+		return
+	}
+
+	// 刷新序号不一致说明旧的刷新令牌被重复使用，撤销会话
+	ok, err := ImpOperatorSession.IncrRefreshSeq(stOperatorSessionModel.SessionID, claims.Seq)
+	if err != nil {
+		rsp.Code = -933
+		rsp.ErrorMsg = "刷新会话失败"
+		Printf("RefreshTokenHandler IncrRefreshSeq err, err:%+v session:%s\n", err, claims.SessionID)
+		return
+	}
+	if !ok {
+		if err = ImpOperatorSession.RevokeSession(stOperatorSessionModel.SessionID, "refresh_token_reuse"); err != nil {
+			Printf("RefreshTokenHandler RevokeSession err, err:%+v session:%s\n", err, claims.SessionID)
+		}
+		rsp.Code = -991
+		rsp.ErrorMsg = "登录已失效，请重新登录"
+		Printf("RefreshTokenHandler refresh token reused, revoke session, seq:%d session:%+v\n", claims.Seq, stOperatorSessionModel)
+		return
+	}
+	stOperatorSessionModel.RefreshSeq = claims.Seq + 1
+
+	nowTs := time.Now().Unix()
+	pair, err := issueTokenPair(stOperatorSessionModel, nowTs)
+	if err != nil {
+		rsp.Code = -900
+		rsp.ErrorMsg = "后台配置错误"
+		Printf("RefreshTokenHandler issueTokenPair err, err:%+v\n", err)
+		return
+	}
+
+	rsp.Code = 0
+	rsp.AuthTokenPair = pair
+	rsp.Operator = stOperatorSessionModel.Operator
+	rsp.Role = stOperatorSessionModel.Role
+	Printf("RefreshTokenHandler success, username:%s session:%s seq:%d\n", stOperatorSessionModel.Operator, stOperatorSessionModel.SessionID, stOperatorSessionModel.RefreshSeq)
+	return
+}
+
+// checkSessionOperator 检查会话的账号当前是否还能使用该会话，不能使用时返回撤销原因
+// 环境变量配置的超级管理员没有账号记录，只在还没有任何账号时可以续期
+func checkSessionOperator(stOperatorSessionModel *OperatorSessionModel) (string, error) {
+	stOperatorAccountModel, err := ImpOperatorAccount.GetOperatorByUsername(stOperatorSessionModel.Operator)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		operatorCnt, err := ImpOperatorAccount.CountOperator()
+		if err != nil {
+			return "", err
+		}
+		if operatorCnt > 0 {
+			return "bootstrap_done", nil
+		}
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if stOperatorAccountModel.Disabled {
+		return "operator_disabled", nil
+	}
+	if stOperatorAccountModel.Role != stOperatorSessionModel.Role {
+		return "role_changed", nil
+	}
+	return "", nil
+}
+
+type LogoutRsp struct {
+	Code     int    `json:"code"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+}
+
+// LogoutHandler 撤销当前令牌所属的会话
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	rsp := &LogoutRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("LogoutHandler start\n")
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	claims, err := parseToken(getBearerToken(r), tokenType_Access)
+	if err != nil {
+		rsp.Code = -991
+		rsp.ErrorMsg = "登录已失效"
+		Printf("LogoutHandler parseToken err, err:%+v\n", err)
+		return
+	}
+
+	if err = ImpOperatorSession.RevokeSession(claims.SessionID, claims.Operator); err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "退出登录失败"
+		Printf("LogoutHandler RevokeSession err, err:%+v session:%s\n", err, claims.SessionID)
+		return
+	}
+
+	rsp.Code = 0
+	Printf("LogoutHandler success, username:%s session:%s\n", claims.Operator, claims.SessionID)
+	return
+}
+
+type RevokeOperatorSessionReq struct {
+	Username string `json:"username"` // 登录名
+}
+
+func getRevokeOperatorSessionReq(r *http.Request) (RevokeOperatorSessionReq, error) {
+	req := RevokeOperatorSessionReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// RevokeOperatorSessionHandler 撤销某个操作员的全部会话，用于账号泄露等情况强制下线
+func RevokeOperatorSessionHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getRevokeOperatorSessionReq(r)
+	rsp := &LogoutRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("RevokeOperatorSessionHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if req.Username == "" {
+		rsp.Code = -996
+		rsp.ErrorMsg = "登录名不能为空"
+		return
+	}
+
+	if err = ImpOperatorSession.RevokeOperatorSessions(req.Username, authResult.Operator); err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "撤销会话失败"
+		Printf("RevokeOperatorSessionHandler RevokeOperatorSessions err, err:%+v username:%s\n", err, req.Username)
+		return
+	}
+
+	AddAuditChange(r, "operator", req.Username, nil, map[string]interface{}{"revoke_session": true})
+	rsp.Code = 0
+	Printf("RevokeOperatorSessionHandler success, username:%s operator:%s\n", req.Username, authResult.Operator)
+	return
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/xionghengheng/ff_plib/comm"
@@ -15,7 +19,7 @@ func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Username, X-Password")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		if r.Method == "OPTIONS" {
 			return
 		}
@@ -28,142 +32,179 @@ func main() {
 		panic(fmt.Sprintf("mysql init failed with %+v", err))
 	}
 
-	mux := http.NewServeMux()
-	handler := enableCORS(mux)
+	if err := initTables(); err != nil {
+		panic(fmt.Sprintf("init tables failed with %+v", err))
+	}
+
+	// 所有接口都通过router注册，注册时必须声明权限（或在公开白名单中），请求统一经过身份验证中间件
+	router := newApiRouter()
+	handler := enableCORS(router)
 
-	mux.HandleFunc("/api/getUserStatistic", GetUserStatiticHandler)
+	router.Handle("/api/getUserStatistic", Perm_StatisticRead, GetUserStatiticHandler)
 
-	mux.HandleFunc("/api/getLessonStatistic", GetLessonStatiticHandler)
+	router.Handle("/api/getLessonStatistic", Perm_StatisticRead, GetLessonStatiticHandler)
 
-	mux.HandleFunc("/api/getCoachStatistic", GetCoachStatiticHandler)
+	router.Handle("/api/getCoachStatistic", Perm_StatisticRead, GetCoachStatiticHandler)
 
-	mux.HandleFunc("/api/getUvPvStatistic", GetUvPvStatisticHandler)
+	router.Handle("/api/getUvPvStatistic", Perm_StatisticRead, GetUvPvStatisticHandler)
 
 	//------------------ 离线数据管理平台相关接口 -------------------------//
 	// ----------------------------教练信息管理平台----------------------------//
-	mux.HandleFunc("/api/getAllCoachList", GetAllCoachListHandler)
+	router.Handle("/api/getAllCoachList", Perm_BaseRead, GetAllCoachListHandler)
 
-	mux.HandleFunc("/api/getAllGymList", GetAllGymListHandler)
+	router.Handle("/api/getAllGymList", Perm_BaseRead, GetAllGymListHandler)
 
-	mux.HandleFunc("/api/getAllCourseList", GetAllCourseListHandler)
+	router.Handle("/api/getAllCourseList", Perm_BaseRead, GetAllCourseListHandler)
 
-	mux.HandleFunc("/api/bindUser2Coach", bindUser2CoachHandler)
+	router.HandleAudited("/api/bindUser2Coach", Perm_CoachWrite, bindUser2CoachHandler)
 
-	mux.HandleFunc("/api/updateCoach", UpdateCoachHandler)
+	router.HandleAudited("/api/updateCoach", Perm_CoachWrite, UpdateCoachHandler)
 
 	// 退费相关
-	mux.HandleFunc("/api/getPaidPackageByUserPhone", GetPaidPackageByUserPhoneHandler)
-	mux.HandleFunc("/api/refundPackage", RefundPackagePhoneHandler)
+	router.Handle("/api/getPaidPackageByUserPhone", Perm_RefundRead, GetPaidPackageByUserPhoneHandler)
+	router.HandleAudited("/api/refundPackage", Perm_RefundWrite, RefundPackagePhoneHandler)
+	router.Handle("/api/quoteRefund", Perm_RefundRead, QuoteRefundHandler)
+	router.HandleAudited("/api/approveRefund", Perm_RefundApprove, ApproveRefundHandler)
+	router.Handle("/api/getRefundApprovalList", Perm_RefundRead, GetRefundApprovalListHandler)
+	router.Handle("/api/getRefundApprovalDetail", Perm_RefundRead, GetRefundApprovalDetailHandler)
 
 	// 获取教练的用户画像
-	mux.HandleFunc("/api/getCoachProfile", GetCoachProfileHandler)
+	router.Handle("/api/getCoachProfile", Perm_CoachRead, GetCoachProfileHandler)
 
 	// ----------------------------预体验课管理----------------------------//
 	// 创建预体验课（顾问预先生成体验课信息）
-	mux.HandleFunc("/api/createPreTrialLesson", CreatePreTrialLessonHandler)
+	router.HandleAudited("/api/createPreTrialLesson", Perm_TrialManage, CreatePreTrialLessonHandler)
 	// 获取预体验课列表
-	mux.HandleFunc("/api/getPreTrialLessonList", GetPreTrialLessonListHandler)
+	router.Handle("/api/getPreTrialLessonList", Perm_TrialManage, GetPreTrialLessonListHandler)
 	// 更新预体验课
-	mux.HandleFunc("/api/updatePreTrialLesson", UpdatePreTrialLessonHandler)
+	router.HandleAudited("/api/updatePreTrialLesson", Perm_TrialManage, UpdatePreTrialLessonHandler)
+	// 顾问门店分配
+	router.HandleAudited("/api/setConsultantScope", Perm_OperatorManage, SetConsultantScopeHandler)
+	router.Handle("/api/getConsultantScopeList", Perm_OperatorManage, GetConsultantScopeListHandler)
 
 	// ----------------------------数据统计平台----------------------------//
-	mux.HandleFunc("/api/getAllPaidLesson", GetAllPaidLessonHandler)
-
-	mux.HandleFunc("/api/getAllPaidPackage", GetAllPaidPackageHandler)
-
-	mux.HandleFunc("/api/getAllUserWithBindPhone", GetAllUserWithBindPhoneHandler)
-
-	mux.HandleFunc("/api/getAllTrailPackage", GetAllTrailPackageHandler)
-
-	//mux.HandleFunc("/api/login", LoginHandler)
-
-	autoScanCoachPersonalPageData()
-
-	autoScanAllCoursePackageSingleLesson()
-
-	// 暂时不需要上线
-	if !comm.IsProd() {
-		// 给体验课包发送过期通知
-		autoScanAllPackage()
-
-		// 调用函数，设置每天晚上 11 点执行任务
-		autoScanAllAppointments()
+	router.Handle("/api/getAllPaidLesson", Perm_StatisticRead, GetAllPaidLessonHandler)
+
+	router.Handle("/api/getAllPaidPackage", Perm_StatisticRead, GetAllPaidPackageHandler)
+
+	router.Handle("/api/getAllUserWithBindPhone", Perm_StatisticRead, GetAllUserWithBindPhoneHandler)
+
+	router.Handle("/api/getAllTrailPackage", Perm_StatisticRead, GetAllTrailPackageHandler)
+
+	// ----------------------------操作员账号管理----------------------------//
+	router.HandleAudited("/api/addOperator", Perm_OperatorManage, AddOperatorHandler)
+	router.HandleAudited("/api/updateOperator", Perm_OperatorManage, UpdateOperatorHandler)
+	router.Handle("/api/getOperatorList", Perm_OperatorManage, GetOperatorListHandler)
+	router.HandleAudited("/api/unlockOperator", Perm_OperatorManage, UnlockOperatorHandler)
+	router.Handle("/api/getSecurityEventList", Perm_AuditRead, GetSecurityEventListHandler)
+
+	// ----------------------------登录----------------------------//
+	router.HandlePublic("/api/login", LoginHandler)
+	router.HandlePublic("/api/refreshToken", RefreshTokenHandler)
+	router.Handle("/api/logout", Perm_Authenticated, LogoutHandler)
+	router.HandleAudited("/api/revokeOperatorSession", Perm_OperatorManage, RevokeOperatorSessionHandler)
+
+	// ----------------------------审计日志----------------------------//
+	router.Handle("/api/getAuditLog", Perm_AuditRead, GetAuditLogHandler)
+	router.Handle("/api/verifyAuditLog", Perm_AuditRead, VerifyAuditLogHandler)
+
+	// ----------------------------后台任务----------------------------//
+	router.Handle("/api/getJobList", Perm_JobManage, GetJobListHandler)
+	router.Handle("/api/getJobRunList", Perm_JobManage, GetJobRunListHandler)
+	router.HandleAudited("/api/triggerJob", Perm_JobManage, TriggerJobHandler)
+	router.HandleAudited("/api/setJobPaused", Perm_JobManage, SetJobPausedHandler)
+
+	// ----------------------------通知----------------------------//
+	router.Handle("/api/getNotifyOutboxList", Perm_NotifyManage, GetNotifyOutboxListHandler)
+	router.HandleAudited("/api/replayNotifyOutbox", Perm_NotifyManage, ReplayNotifyOutboxHandler)
+	router.Handle("/api/getNotificationHistory", Perm_NotifyRead, GetNotificationHistoryHandler)
+	router.Handle("/api/getMessagingMode", Perm_NotifyManage, GetMessagingModeHandler)
+	router.HandleAudited("/api/setMessagingMode", Perm_NotifyManage, SetMessagingModeHandler)
+	router.Handle("/api/getSuppressedMessageList", Perm_NotifyManage, GetSuppressedMessageListHandler)
+	router.Handle("/api/getNotifyPreferenceList", Perm_NotifyRead, GetNotifyPreferenceListHandler)
+	router.HandleAudited("/api/setNotifyPreference", Perm_NotifyManage, SetNotifyPreferenceHandler)
+	router.Handle("/api/getNotifyRoutePolicyList", Perm_NotifyManage, GetNotifyRoutePolicyListHandler)
+	router.HandleAudited("/api/setNotifyRoutePolicy", Perm_NotifyManage, SetNotifyRoutePolicyHandler)
+
+	// ----------------------------业务规则----------------------------//
+	router.Handle("/api/getBusinessRuleList", Perm_RuleManage, GetBusinessRuleListHandler)
+	router.HandleAudited("/api/setBusinessRule", Perm_RuleManage, SetBusinessRuleHandler)
+	router.Handle("/api/getBusinessRuleHistory", Perm_RuleManage, GetBusinessRuleHistoryHandler)
+
+	// ----------------------------旷课申诉----------------------------//
+	router.HandleAudited("/api/appealMissedLesson", Perm_LessonAppeal, AppealMissedLessonHandler)
+	router.Handle("/api/getLessonAppealList", Perm_LessonAppeal, GetLessonAppealListHandler)
+
+	// ----------------------------旷课处罚----------------------------//
+	router.Handle("/api/getNoShowDecisionList", Perm_NoShowApprove, GetNoShowDecisionListHandler)
+	router.HandleAudited("/api/approveNoShowDecision", Perm_NoShowApprove, ApproveNoShowDecisionHandler)
+	router.HandleAudited("/api/liftBookingBlock", Perm_NoShowApprove, LiftBookingBlockHandler)
+
+	// 有路由没有声明权限时拒绝启动
+	if err := router.CheckPolicy(); err != nil {
+		panic(fmt.Sprintf("route auth policy check failed with %+v", err))
 	}
 
-	// 通卡
-	autoScanPassCardAllLesson()
-
-	if err := http.ListenAndServe(":80", handler); err != nil {
-		log.Fatalf("服务器启动失败: %v", err)
+	// 发送渠道策略需要发短信但场景没有短信模板时拒绝启动
+	if err := CheckNotifyRoutes(); err != nil {
+		panic(fmt.Sprintf("notify route policy check failed with %+v", err))
 	}
-}
-
-// 扫描订单表和课程表，生成教练单月的营收数据统计（每17分钟扫描一次）
-func autoScanCoachPersonalPageData() {
-	go func() {
-		ticker := time.NewTicker(time.Second * time.Duration(1020))
-		for range ticker.C {
-			ScanCoachPersonalPageData()
-		}
-	}()
-}
 
-// 扫描所有单次课程，处理旷课以及旷课退回的情况（每5分钟扫描一次）
-func autoScanAllCoursePackageSingleLesson() {
-	go func() {
-		ticker := time.NewTicker(time.Second * time.Duration(300))
-		for range ticker.C {
-			ScanAllCoursePackageSingleLesson()
-		}
-	}()
-}
+	// 后台扫描任务统一交给调度器
+	// 服务会扩容到多个实例，每个任务通过数据库租约保证同一时间只在一个实例上执行
+	scheduler := NewScheduler()
+	scheduler.EnableClusterLease()
+	registerScanJobs(scheduler)
+	jobScheduler = scheduler
+	scheduler.Start()
 
-// 每小时扫描一次
-func autoScanAllPackage() {
+	server := &http.Server{Addr: ":80", Handler: handler}
 	go func() {
-		ticker := time.NewTicker(time.Second * time.Duration(600))
-		for range ticker.C {
-			ScanAllPackage()
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("服务器启动失败: %v", err)
 		}
 	}()
-}
 
-// 扫描所有预约，如果有教练连续两天没有设置课程，则触发微信通知告诉教练试课
-func autoScanAllAppointments() {
-	// 计算下一个执行时间
-	now := time.Now()
-	nextRun := time.Date(now.Year(), now.Month(), now.Day(), 23, 0, 0, 0, now.Location())
+	// 收到SIGTERM后先停止接收新请求，再等待正在执行的扫描任务结束
+	chSignal := make(chan os.Signal, 1)
+	signal.Notify(chSignal, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-chSignal
+	Printf("receive signal %v, shutting down\n", sig)
 
-	// 如果当前时间已经过了晚上 11 点，则设置下一个执行时间为明天的 11 点
-	if now.After(nextRun) {
-		nextRun = nextRun.Add(24 * time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		Printf("server shutdown err, err:%+v\n", err)
 	}
-
-	// 计算到下一个执行时间的间隔
-	durationUntilNextRun := nextRun.Sub(now)
-
-	// 创建一个 ticker，间隔为 24 小时
-	ticker := time.NewTicker(24 * time.Hour)
-
-	// 启动一个 goroutine 在下一个执行时间执行任务
-	go func() {
-		time.Sleep(durationUntilNextRun) // 等待到下一个执行时间
-		for {
-			ScanAllAppointments() // 执行任务
-			<-ticker.C            // 等待下一个周期
-		}
-	}()
+	scheduler.Stop(20 * time.Second)
 }
 
-// ---------------------------通卡相关扫描-------------------------------
-// 扫描所有单次课程，把过期的课程设置为已完成（每5分钟扫描一次）
-func autoScanPassCardAllLesson() {
-	ScanAllPassCardLesson()
+// registerScanJobs 注册所有后台扫描任务，任务注册失败说明执行计划写错了，直接拒绝启动
+func registerScanJobs(scheduler *Scheduler) {
+	vecJob := []Job{
+		// 扫描订单表和课程表，生成教练单月的营收数据统计（每17分钟扫描一次）
+		{Name: "ScanCoachPersonalPageData", Spec: "@every 17m", Run: ScanCoachPersonalPageData},
+		// 扫描所有单次课程，处理旷课以及旷课退回的情况（每5分钟扫描一次）
+		{Name: "ScanAllCoursePackageSingleLesson", Spec: "@every 5m", Run: ScanAllCoursePackageSingleLesson},
+		// 通卡：扫描所有单次课程，把过期的课程设置为已完成（每5分钟扫描一次，启动时先执行一次）
+		{Name: "ScanAllPassCardLesson", Spec: "@every 5m", RunOnStart: true, Run: ScanAllPassCardLesson},
+		// 发送通知发件箱中待发送的通知（每30秒一次）
+		{Name: "DeliverNotifyOutbox", Spec: "@every 30s", Run: DeliverNotifyOutbox},
+		// 体验课包分阶段发送过期提醒，到期标记为过期（每10分钟扫描一次）
+		{Name: "ScanAllPackage", Spec: "@every 10m", Run: ScanAllPackage},
+	}
 
-	go func() {
-		ticker := time.NewTicker(time.Second * time.Duration(300))
-		for range ticker.C {
-			ScanAllPassCardLesson()
+	// 暂时不需要上线
+	if !comm.IsProd() {
+		vecJob = append(vecJob,
+			// 扫描所有预约，如果有教练连续两天没有设置课程，则触发微信通知告诉教练试课
+			Job{Name: "ScanAllAppointments", Spec: "@daily 23:00 Asia/Shanghai", Run: ScanAllAppointments},
+		)
+	}
+
+	for _, job := range vecJob {
+		if err := scheduler.Register(job); err != nil {
+			panic(fmt.Sprintf("register scan job failed with %+v", err))
 		}
-	}()
+	}
 }
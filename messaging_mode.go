@@ -0,0 +1,539 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/comm"
+	"github.com/xionghengheng/ff_plib/db"
+)
+
+// 消息发送模式，对所有微信订阅消息和短信生效
+const (
+	MessagingMode_Live     = "live"     // 正常发送给用户
+	MessagingMode_Redirect = "redirect" // 改发给测试接收人，原消息记录下来
+	MessagingMode_DryRun   = "dry_run"  // 不发送，只记录下来
+)
+
+// 发送模式的刷新间隔，其他实例修改后最多这么久生效
+const messagingConfigReloadSec = 10
+
+// 测试接收人数量上限
+const messagingRedirectMaxCnt = 10
+
+// MessagingConfigModel 消息发送模式配置，只有一行
+type MessagingConfigModel struct {
+	ID              int64  `json:"id" gorm:"primary_key"`                       // 固定为1
+	Mode            string `json:"mode" gorm:"type:varchar(16)"`                // 发送模式
+	RedirectOpenIds string `json:"redirect_open_ids" gorm:"type:varchar(1024)"` // 测试接收人的小程序openid，JSON数组
+	RedirectPhones  string `json:"redirect_phones" gorm:"type:varchar(512)"`    // 测试接收人的手机号，JSON数组
+	UpdatedBy       string `json:"updated_by" gorm:"type:varchar(64)"`          // 最后修改人
+	UpdatedTs       int64  `json:"updated_ts"`                                  // 最后修改时间
+}
+
+const messaging_config_tableName = "messaging_config"
+
+// 配置行的主键
+const messagingConfigId = 1
+
+// SuppressedMessageModel 没有发给原接收人的消息（dry_run 或 redirect 模式下），用于检查消息内容
+type SuppressedMessageModel struct {
+	ID         int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`  // 主键ID
+	Mode       string `json:"mode" gorm:"type:varchar(16)"`          // 当时的发送模式
+	Scene      string `json:"scene" gorm:"type:varchar(32)"`         // 通知场景
+	Channel    string `json:"channel" gorm:"type:varchar(8)"`        // 通知渠道
+	Uid        int64  `json:"uid" gorm:"index"`                      // 业务关联的用户id
+	Recipient  string `json:"recipient" gorm:"type:varchar(128)"`    // 原接收人（openid或手机号）
+	RedirectTo string `json:"redirect_to" gorm:"type:varchar(1024)"` // 实际改发的测试接收人，dry_run为空
+	TemplateID string `json:"template_id" gorm:"type:varchar(64)"`   // 微信模板id或短信模板id
+	Payload    string `json:"payload" gorm:"type:text"`              // 消息内容
+	CreatedTs  int64  `json:"created_ts" gorm:"index"`               // 记录时间
+}
+
+const suppressed_message_tableName = "suppressed_message"
+
+// MessagingInterface 消息发送模式数据模型接口
+type MessagingInterface interface {
+	// 获取发送模式配置，没有配置时返回nil
+	GetMessagingConfig() (*MessagingConfigModel, error)
+
+	// 保存发送模式配置
+	SaveMessagingConfig(stMessagingConfigModel *MessagingConfigModel) error
+
+	// 记录一条没有发给原接收人的消息
+	AddSuppressedMessage(stSuppressedMessageModel *SuppressedMessageModel) error
+
+	// 查询没有发给原接收人的消息，按id降序，条件为空不过滤
+	GetSuppressedMessageList(channel string, scene string, uid int64, offset int, limit int) ([]SuppressedMessageModel, error)
+}
+
+// MessagingInterfaceImp 消息发送模式数据模型实现
+type MessagingInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpMessaging MessagingInterface = &MessagingInterfaceImp{}
+
+func (imp *MessagingInterfaceImp) GetMessagingConfig() (*MessagingConfigModel, error) {
+	var stMessagingConfigModel MessagingConfigModel
+	cli := db.Get()
+	err := cli.Table(messaging_config_tableName).Where("id = ?", messagingConfigId).First(&stMessagingConfigModel).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	}
+	return &stMessagingConfigModel, err
+}
+
+func (imp *MessagingInterfaceImp) SaveMessagingConfig(stMessagingConfigModel *MessagingConfigModel) error {
+	stMessagingConfigModel.ID = messagingConfigId
+	cli := db.Get()
+	return cli.Table(messaging_config_tableName).Save(stMessagingConfigModel).Error
+}
+
+func (imp *MessagingInterfaceImp) AddSuppressedMessage(stSuppressedMessageModel *SuppressedMessageModel) error {
+	cli := db.Get()
+	return cli.Table(suppressed_message_tableName).Create(stSuppressedMessageModel).Error
+}
+
+func (imp *MessagingInterfaceImp) GetSuppressedMessageList(channel string, scene string, uid int64, offset int, limit int) ([]SuppressedMessageModel, error) {
+	var vecSuppressedMessageModel []SuppressedMessageModel
+	cli := db.Get().Table(suppressed_message_tableName)
+	if channel != "" {
+		cli = cli.Where("channel = ?", channel)
+	}
+	if scene != "" {
+		cli = cli.Where("scene = ?", scene)
+	}
+	if uid > 0 {
+		cli = cli.Where("uid = ?", uid)
+	}
+	err := cli.Order("id DESC").Offset(offset).Limit(limit).Find(&vecSuppressedMessageModel).Error
+	return vecSuppressedMessageModel, err
+}
+
+// MessagingConfig 生效中的发送模式
+type MessagingConfig struct {
+	Mode              string   `json:"mode"`                 // 发送模式
+	VecRedirectOpenId []string `json:"vec_redirect_open_id"` // 测试接收人的小程序openid
+	VecRedirectPhone  []string `json:"vec_redirect_phone"`   // 测试接收人的手机号
+	IsDefault         bool     `json:"is_default"`           // 没有配置过，使用环境默认值
+}
+
+// defaultMessagingConfig 没有配置时，正式环境正常发送，其他环境只记录不发送
+func defaultMessagingConfig() MessagingConfig {
+	if comm.IsProd() {
+		return MessagingConfig{Mode: MessagingMode_Live, IsDefault: true}
+	}
+	return MessagingConfig{Mode: MessagingMode_DryRun, IsDefault: true}
+}
+
+func convertMessagingConfigModel(stMessagingConfigModel *MessagingConfigModel) (MessagingConfig, error) {
+	stMessagingConfig := MessagingConfig{Mode: stMessagingConfigModel.Mode}
+	if stMessagingConfigModel.RedirectOpenIds != "" {
+		if err := json.Unmarshal([]byte(stMessagingConfigModel.RedirectOpenIds), &stMessagingConfig.VecRedirectOpenId); err != nil {
+			return stMessagingConfig, err
+		}
+	}
+	if stMessagingConfigModel.RedirectPhones != "" {
+		if err := json.Unmarshal([]byte(stMessagingConfigModel.RedirectPhones), &stMessagingConfig.VecRedirectPhone); err != nil {
+			return stMessagingConfig, err
+		}
+	}
+	return stMessagingConfig, checkMessagingConfig(stMessagingConfig)
+}
+
+func checkMessagingConfig(stMessagingConfig MessagingConfig) error {
+	switch stMessagingConfig.Mode {
+	case MessagingMode_Live, MessagingMode_DryRun:
+	case MessagingMode_Redirect:
+		if len(stMessagingConfig.VecRedirectOpenId) == 0 && len(stMessagingConfig.VecRedirectPhone) == 0 {
+			return fmt.Errorf("redirect mode needs at least one test recipient")
+		}
+	default:
+		return fmt.Errorf("unknown messaging mode %s", stMessagingConfig.Mode)
+	}
+	if len(stMessagingConfig.VecRedirectOpenId) > messagingRedirectMaxCnt || len(stMessagingConfig.VecRedirectPhone) > messagingRedirectMaxCnt {
+		return fmt.Errorf("too many test recipients, max:%d", messagingRedirectMaxCnt)
+	}
+	for _, v := range append(append([]string{}, stMessagingConfig.VecRedirectOpenId...), stMessagingConfig.VecRedirectPhone...) {
+		if strings.TrimSpace(v) == "" {
+			return fmt.Errorf("empty test recipient")
+		}
+	}
+	return nil
+}
+
+// messagingConfigCache 发送模式缓存，定期从数据库刷新
+type messagingConfigCache struct {
+	mu     sync.Mutex
+	config *MessagingConfig
+	loadTs int64
+}
+
+var messagingConfig = &messagingConfigCache{}
+
+// get 获取生效中的发送模式，数据库读取失败时沿用上一次的结果，从没读到过时按环境默认值处理
+func (c *messagingConfigCache) get() MessagingConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	nowTs := time.Now().Unix()
+	if c.config != nil && nowTs-c.loadTs < messagingConfigReloadSec {
+		return *c.config
+	}
+	c.loadTs = nowTs
+	stMessagingConfigModel, err := ImpMessaging.GetMessagingConfig()
+	if err != nil {
+		Printf("[NotifyAlarm]GetMessagingConfig err, err:%+v\n", err)
+		if c.config == nil {
+			return defaultMessagingConfig()
+		}
+		return *c.config
+	}
+	stMessagingConfig := defaultMessagingConfig()
+	if stMessagingConfigModel != nil {
+		stMessagingConfig, err = convertMessagingConfigModel(stMessagingConfigModel)
+		if err != nil {
+			// 配置不合法时不发送，避免发到真实用户
+			Printf("[NotifyAlarm]messaging config invalid, use dry_run, err:%+v config:%+v\n", err, stMessagingConfigModel)
+			stMessagingConfig = MessagingConfig{Mode: MessagingMode_DryRun}
+		}
+	}
+	if c.config == nil || c.config.Mode != stMessagingConfig.Mode {
+		Printf("[Messaging]messaging mode:%s\n", stMessagingConfig.Mode)
+	}
+	c.config = &stMessagingConfig
+	return stMessagingConfig
+}
+
+// set 本实例修改后立即生效
+func (c *messagingConfigCache) set(stMessagingConfig MessagingConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config = &stMessagingConfig
+	c.loadTs = time.Now().Unix()
+}
+
+// captureSuppressedMessage 记录没有发给原接收人的消息，返回记录id，写入失败只打日志
+func captureSuppressedMessage(stSuppressedMessageModel *SuppressedMessageModel) int64 {
+	stSuppressedMessageModel.CreatedTs = time.Now().Unix()
+	if err := ImpMessaging.AddSuppressedMessage(stSuppressedMessageModel); err != nil {
+		Printf("[NotifyAlarm]AddSuppressedMessage err, err:%+v msg:%+v\n", err, stSuppressedMessageModel)
+		return 0
+	}
+	return stSuppressedMessageModel.ID
+}
+
+// sendWxMsg 按发送模式发送微信订阅消息，所有微信消息都要经过这里，返回实际生效的发送模式和发送结果说明
+func sendWxMsg(scene string, uid int64, stWxSendMsg2UserReq comm.WxSendMsg2UserReq) (string, string, error) {
+	stMessagingConfig := messagingConfig.get()
+	if stMessagingConfig.Mode == MessagingMode_Live {
+		return MessagingMode_Live, "ok", comm.SendMsg2User(uid, stWxSendMsg2UserReq)
+	}
+
+	payload, _ := json.Marshal(stWxSendMsg2UserReq.Data)
+	stSuppressedMessageModel := &SuppressedMessageModel{
+		Mode:       stMessagingConfig.Mode,
+		Scene:      scene,
+		Channel:    NotifyChannel_Wx,
+		Uid:        uid,
+		Recipient:  stWxSendMsg2UserReq.ToUser,
+		TemplateID: stWxSendMsg2UserReq.TemplateID,
+		Payload:    string(payload),
+	}
+	if stMessagingConfig.Mode == MessagingMode_DryRun || len(stMessagingConfig.VecRedirectOpenId) == 0 {
+		id := captureSuppressedMessage(stSuppressedMessageModel)
+		return MessagingMode_DryRun, fmt.Sprintf("%s, captured:%d", MessagingMode_DryRun, id), nil
+	}
+
+	stSuppressedMessageModel.RedirectTo = strings.Join(stMessagingConfig.VecRedirectOpenId, ",")
+	id := captureSuppressedMessage(stSuppressedMessageModel)
+	response, err := sendToRedirectRecipients(stMessagingConfig.VecRedirectOpenId, func(openId string) error {
+		stRedirectReq := stWxSendMsg2UserReq
+		stRedirectReq.ToUser = openId
+		return comm.SendMsg2User(uid, stRedirectReq)
+	})
+	return MessagingMode_Redirect, fmt.Sprintf("%s, captured:%d", response, id), err
+}
+
+// sendSmsMsg 按发送模式发送短信，所有短信都要经过这里，返回实际生效的发送模式和发送结果说明
+func sendSmsMsg(scene string, templateId string, uid int64, vecTemplateParam []string, phone string) (string, string, error) {
+	stMessagingConfig := messagingConfig.get()
+	if stMessagingConfig.Mode == MessagingMode_Live {
+		return MessagingMode_Live, "ok", comm.SendSmsMsg2User(templateId, uid, vecTemplateParam, phone)
+	}
+
+	payload, _ := json.Marshal(vecTemplateParam)
+	stSuppressedMessageModel := &SuppressedMessageModel{
+		Mode:       stMessagingConfig.Mode,
+		Scene:      scene,
+		Channel:    NotifyChannel_Sms,
+		Uid:        uid,
+		Recipient:  phone,
+		TemplateID: templateId,
+		Payload:    string(payload),
+	}
+	if stMessagingConfig.Mode == MessagingMode_DryRun || len(stMessagingConfig.VecRedirectPhone) == 0 {
+		id := captureSuppressedMessage(stSuppressedMessageModel)
+		return MessagingMode_DryRun, fmt.Sprintf("%s, captured:%d", MessagingMode_DryRun, id), nil
+	}
+
+	stSuppressedMessageModel.RedirectTo = strings.Join(stMessagingConfig.VecRedirectPhone, ",")
+	id := captureSuppressedMessage(stSuppressedMessageModel)
+	response, err := sendToRedirectRecipients(stMessagingConfig.VecRedirectPhone, func(redirectPhone string) error {
+		return comm.SendSmsMsg2User(templateId, uid, vecTemplateParam, redirectPhone)
+	})
+	return MessagingMode_Redirect, fmt.Sprintf("%s, captured:%d", response, id), err
+}
+
+// sendToRedirectRecipients 给每个测试接收人各发一次，返回合并后的结果说明
+// 只要有一个发送成功就不返回错误，避免重试时给已经收到的测试接收人重复发送；全部失败时返回第一个错误
+func sendToRedirectRecipients(vecRecipient []string, send func(recipient string) error) (string, error) {
+	var vecSucc, vecFailed []string
+	var firstErr error
+	for _, recipient := range vecRecipient {
+		if err := send(recipient); err != nil {
+			Printf("[Messaging]redirect send err, err:%+v recipient:%s\n", err, recipient)
+			vecFailed = append(vecFailed, fmt.Sprintf("%s(%s)", recipient, err.Error()))
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		vecSucc = append(vecSucc, recipient)
+	}
+	if len(vecSucc) == 0 {
+		return "", firstErr
+	}
+	response := fmt.Sprintf("%s to %s", MessagingMode_Redirect, strings.Join(vecSucc, ","))
+	if len(vecFailed) > 0 {
+		response += ", failed:" + strings.Join(vecFailed, ",")
+	}
+	return response, nil
+}
+
+type GetMessagingModeRsp struct {
+	Code     int             `json:"code"`
+	ErrorMsg string          `json:"errorMsg,omitempty"`
+	Config   MessagingConfig `json:"config"`               // 生效中的发送模式
+	UpdateBy string          `json:"updated_by,omitempty"` // 最后修改人
+	UpdateTs int64           `json:"updated_ts,omitempty"` // 最后修改时间
+}
+
+// GetMessagingModeHandler 查询当前的消息发送模式
+func GetMessagingModeHandler(w http.ResponseWriter, r *http.Request) {
+	rsp := &GetMessagingModeRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetMessagingModeHandler start\n")
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	stMessagingConfigModel, err := ImpMessaging.GetMessagingConfig()
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询发送模式失败"
+		Printf("GetMessagingModeHandler GetMessagingConfig err, err:%+v\n", err)
+		return
+	}
+	if stMessagingConfigModel != nil {
+		rsp.UpdateBy = stMessagingConfigModel.UpdatedBy
+		rsp.UpdateTs = stMessagingConfigModel.UpdatedTs
+	}
+	rsp.Config = messagingConfig.get()
+	rsp.Code = 0
+	return
+}
+
+type SetMessagingModeReq struct {
+	Mode              string   `json:"mode"`                 // 发送模式：live/redirect/dry_run
+	VecRedirectOpenId []string `json:"vec_redirect_open_id"` // redirect模式下微信消息的测试接收人openid
+	VecRedirectPhone  []string `json:"vec_redirect_phone"`   // redirect模式下短信的测试接收人手机号
+}
+
+type SetMessagingModeRsp struct {
+	Code     int    `json:"code"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+}
+
+func getSetMessagingModeReq(r *http.Request) (SetMessagingModeReq, error) {
+	req := SetMessagingModeReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// SetMessagingModeHandler 切换消息发送模式，所有实例在 messagingConfigReloadSec 内生效
+// redirect模式下某个渠道没有配置测试接收人时，该渠道的消息只记录不发送
+func SetMessagingModeHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getSetMessagingModeReq(r)
+	rsp := &SetMessagingModeRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("SetMessagingModeHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	stMessagingConfig := MessagingConfig{
+		Mode:              req.Mode,
+		VecRedirectOpenId: req.VecRedirectOpenId,
+		VecRedirectPhone:  req.VecRedirectPhone,
+	}
+	if err := checkMessagingConfig(stMessagingConfig); err != nil {
+		rsp.Code = -996
+		rsp.ErrorMsg = "发送模式配置不合法：" + err.Error()
+		return
+	}
+
+	before := messagingConfig.get()
+	openIds, _ := json.Marshal(stMessagingConfig.VecRedirectOpenId)
+	phones, _ := json.Marshal(stMessagingConfig.VecRedirectPhone)
+	stMessagingConfigModel := &MessagingConfigModel{
+		Mode:            stMessagingConfig.Mode,
+		RedirectOpenIds: string(openIds),
+		RedirectPhones:  string(phones),
+		UpdatedBy:       authResult.Operator,
+		UpdatedTs:       time.Now().Unix(),
+	}
+	if err := ImpMessaging.SaveMessagingConfig(stMessagingConfigModel); err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "保存发送模式失败"
+		Printf("SetMessagingModeHandler SaveMessagingConfig err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	messagingConfig.set(stMessagingConfig)
+	AddAuditChange(r, "messaging_mode", strconv.Itoa(messagingConfigId), before, stMessagingConfig)
+
+	rsp.Code = 0
+	Printf("SetMessagingModeHandler success, mode:%s operator:%s\n", req.Mode, authResult.Operator)
+	return
+}
+
+type GetSuppressedMessageListReq struct {
+	Channel  string `json:"channel"`   // 通知渠道，为空不过滤
+	Scene    string `json:"scene"`     // 通知场景，为空不过滤
+	Uid      int64  `json:"uid"`       // 用户id，为0不过滤
+	Passback string `json:"passback"`  // 翻页标记，首次请求传空字符串，后续传上次返回的passback
+	PageSize int    `json:"page_size"` // 每页数量
+}
+
+type GetSuppressedMessageListRsp struct {
+	Code     int                      `json:"code"`
+	ErrorMsg string                   `json:"errorMsg,omitempty"`
+	List     []SuppressedMessageModel `json:"list,omitempty"`
+	Passback string                   `json:"passback"` // 下一页的翻页标记，为空字符串表示没有更多数据
+}
+
+func getGetSuppressedMessageListReq(r *http.Request) (GetSuppressedMessageListReq, error) {
+	req := GetSuppressedMessageListReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// GetSuppressedMessageListHandler 查询 dry_run/redirect 模式下没有发给原接收人的消息
+func GetSuppressedMessageListHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getGetSuppressedMessageListReq(r)
+	rsp := &GetSuppressedMessageListRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetSuppressedMessageListHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	var offset int64
+	if len(req.Passback) > 0 {
+		offset, _ = strconv.ParseInt(req.Passback, 10, 64)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	pageSize := req.PageSize
+	if pageSize <= 0 {
+		pageSize = 20 // 默认每页20条
+	}
+	if pageSize > 100 {
+		pageSize = 100 // 最大每页100条
+	}
+
+	vecSuppressedMessageModel, err := ImpMessaging.GetSuppressedMessageList(req.Channel, req.Scene, req.Uid, int(offset), pageSize)
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询消息失败"
+		Printf("GetSuppressedMessageListHandler GetSuppressedMessageList err, err:%+v req:%+v\n", err, req)
+		return
+	}
+
+	rsp.List = vecSuppressedMessageModel
+	if len(vecSuppressedMessageModel) == pageSize {
+		rsp.Passback = strconv.FormatInt(offset+int64(pageSize), 10)
+	}
+	rsp.Code = 0
+	Printf("GetSuppressedMessageListHandler success, offset:%d count:%d\n", offset, len(rsp.List))
+	return
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/db/dao"
+)
+
+type GetNoShowDecisionListReq struct {
+	Uid      int64  `json:"uid"`       // 学员id，为0不过滤
+	Decision string `json:"decision"`  // 决定，为空不过滤，如 pending_approval 查询待审批的
+	Passback string `json:"passback"`  // 翻页标记，首次请求传空字符串，后续传上次返回的passback
+	PageSize int    `json:"page_size"` // 每页数量
+}
+
+type GetNoShowDecisionListRsp struct {
+	Code     int                    `json:"code"`
+	ErrorMsg string                 `json:"errorMsg,omitempty"`
+	List     []NoShowDecisionModel  `json:"list,omitempty"`
+	Block    *UserBookingBlockModel `json:"block,omitempty"` // 指定学员时返回该学员的预约暂停，没有暂停过为空
+	Passback string                 `json:"passback"`        // 下一页的翻页标记，为空字符串表示没有更多数据
+}
+
+func getGetNoShowDecisionListReq(r *http.Request) (GetNoShowDecisionListReq, error) {
+	req := GetNoShowDecisionListReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// GetNoShowDecisionListHandler 查询旷课课时归还的决定，顾问用来查看待审批的记录
+func GetNoShowDecisionListHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getGetNoShowDecisionListReq(r)
+	rsp := &GetNoShowDecisionListRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetNoShowDecisionListHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateConsultantOrAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	// 顾问只能查看分配门店的记录
+	scope, scopeResult := getTrialDataScope(authResult)
+	if !scopeResult.Success {
+		rsp.Code = scopeResult.Code
+		rsp.ErrorMsg = scopeResult.ErrorMsg
+		return
+	}
+
+	var offset int64
+	if len(req.Passback) > 0 {
+		offset, _ = strconv.ParseInt(req.Passback, 10, 64)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	pageSize := req.PageSize
+	if pageSize <= 0 {
+		pageSize = 20 // 默认每页20条
+	}
+	if pageSize > 100 {
+		pageSize = 100 // 最大每页100条
+	}
+
+	vecNoShowDecisionModel, err := ImpNoShow.GetNoShowDecisionList(req.Uid, req.Decision, scope.VecGymId, int(offset), pageSize)
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询旷课处罚记录失败"
+		Printf("GetNoShowDecisionListHandler GetNoShowDecisionList err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	if req.Uid > 0 {
+		stUserBookingBlockModel, err := ImpNoShow.GetUserBookingBlock(req.Uid)
+		if err != nil {
+			rsp.Code = -922
+			rsp.ErrorMsg = "查询学员预约暂停失败"
+			Printf("GetNoShowDecisionListHandler GetUserBookingBlock err, err:%+v req:%+v\n", err, req)
+			return
+		}
+		if stUserBookingBlockModel != nil && scope.checkGym(stUserBookingBlockModel.GymId).Success {
+			rsp.Block = stUserBookingBlockModel
+		}
+	}
+
+	rsp.List = vecNoShowDecisionModel
+	if len(vecNoShowDecisionModel) == pageSize {
+		rsp.Passback = strconv.FormatInt(offset+int64(pageSize), 10)
+	}
+	rsp.Code = 0
+	return
+}
+
+type ApproveNoShowDecisionReq struct {
+	ID      int64  `json:"id"`      // 决定id
+	Approve bool   `json:"approve"` // true=通过并归还课时，false=驳回不归还
+	Remark  string `json:"remark"`  // 审批备注
+}
+
+type ApproveNoShowDecisionRsp struct {
+	Code     int    `json:"code"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+	Decision string `json:"decision,omitempty"` // 审批后的决定，课程已通过旷课申诉处理时为closed
+}
+
+func getApproveNoShowDecisionReq(r *http.Request) (ApproveNoShowDecisionReq, error) {
+	req := ApproveNoShowDecisionReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// ApproveNoShowDecisionHandler 顾问审批多次旷课的课时返还，审批结果通知学员
+func ApproveNoShowDecisionHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getApproveNoShowDecisionReq(r)
+	rsp := &ApproveNoShowDecisionRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("ApproveNoShowDecisionHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateConsultantOrAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if req.ID <= 0 {
+		rsp.Code = -996
+		rsp.ErrorMsg = "id不能为空"
+		return
+	}
+	if len(req.Remark) > 512 {
+		rsp.Code = -996
+		rsp.ErrorMsg = "审批备注不超过512字节"
+		return
+	}
+
+	stNoShowDecisionModel, err := ImpNoShow.GetNoShowDecision(req.ID)
+	if gorm.IsRecordNotFoundError(err) {
+		rsp.Code = -996
+		rsp.ErrorMsg = "旷课处罚记录不存在"
+		return
+	}
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询旷课处罚记录失败"
+		Printf("ApproveNoShowDecisionHandler GetNoShowDecision err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	// 顾问只能审批分配门店的记录
+	scope, scopeResult := getTrialDataScope(authResult)
+	if !scopeResult.Success {
+		rsp.Code = scopeResult.Code
+		rsp.ErrorMsg = scopeResult.ErrorMsg
+		return
+	}
+	if !scope.checkGym(stNoShowDecisionModel.GymId).Success {
+		rsp.Code = ErrCode_ConsultantGymDenied
+		rsp.ErrorMsg = "无权操作该门店的旷课记录"
+		Printf("ApproveNoShowDecisionHandler gym denied, id:%d GymId:%d operator:%s\n", req.ID, stNoShowDecisionModel.GymId, authResult.Operator)
+		return
+	}
+	if stNoShowDecisionModel.Decision != NoShowDecision_PendingApproval {
+		rsp.Code = -996
+		rsp.ErrorMsg = "该记录不是待审批状态"
+		return
+	}
+
+	//通知生成失败不影响审批，只打日志
+	var vecNotifyOutboxModel []*NotifyOutboxModel
+	stLessonModel, err := dao.ImpCoursePackageSingleLesson.GetSingleLessonById(stNoShowDecisionModel.Uid, stNoShowDecisionModel.LessonID)
+	if err != nil {
+		Printf("ApproveNoShowDecisionHandler GetSingleLessonById err, err:%+v decision:%+v\n", err, stNoShowDecisionModel)
+	} else {
+		remark := "顾问审核未通过，课时不予返还"
+		if req.Approve {
+			remark = "顾问审核通过，课时已返还"
+		}
+		stWxOutbox, err := newNoShowNotify(NotifyScene_NoShowApproval, *stLessonModel, remark)
+		if err != nil {
+			Printf("ApproveNoShowDecisionHandler newNoShowNotify err, err:%+v decision:%+v\n", err, stNoShowDecisionModel)
+		} else {
+			vecNotifyOutboxModel = append(vecNotifyOutboxModel, stWxOutbox)
+		}
+	}
+
+	decision, err := ImpNoShow.ResolveNoShowDecision(req.ID, req.Approve, authResult.Operator, req.Remark, vecNotifyOutboxModel)
+	if err == errStateChanged {
+		rsp.Code = -996
+		rsp.ErrorMsg = "该记录不是待审批状态"
+		return
+	}
+	if err != nil {
+		rsp.Code = -922
+		rsp.ErrorMsg = "审批旷课课时返还失败"
+		Printf("ApproveNoShowDecisionHandler ResolveNoShowDecision err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	AddAuditChange(r, "noshow_decision", strconv.FormatInt(req.ID, 10),
+		map[string]interface{}{"decision": stNoShowDecisionModel.Decision},
+		map[string]interface{}{"decision": decision, "remark": req.Remark})
+
+	rsp.Decision = decision
+	rsp.Code = 0
+	Printf("ApproveNoShowDecisionHandler success, id:%d decision:%s operator:%s\n", req.ID, decision, authResult.Operator)
+	return
+}
+
+type LiftBookingBlockReq struct {
+	Uid int64 `json:"uid"` // 学员id
+}
+
+type LiftBookingBlockRsp struct {
+	Code     int    `json:"code"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+}
+
+func getLiftBookingBlockReq(r *http.Request) (LiftBookingBlockReq, error) {
+	req := LiftBookingBlockReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// LiftBookingBlockHandler 提前解除学员因多次旷课被暂停的预约
+func LiftBookingBlockHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getLiftBookingBlockReq(r)
+	rsp := &LiftBookingBlockRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("LiftBookingBlockHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateConsultantOrAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if req.Uid <= 0 {
+		rsp.Code = -996
+		rsp.ErrorMsg = "用户id不能为空"
+		return
+	}
+
+	stUserBookingBlockModel, err := ImpNoShow.GetUserBookingBlock(req.Uid)
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询学员预约暂停失败"
+		Printf("LiftBookingBlockHandler GetUserBookingBlock err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	if stUserBookingBlockModel == nil {
+		rsp.Code = -996
+		rsp.ErrorMsg = "学员当前没有暂停预约"
+		return
+	}
+	// 顾问只能解除分配门店触发的暂停
+	scope, scopeResult := getTrialDataScope(authResult)
+	if !scopeResult.Success {
+		rsp.Code = scopeResult.Code
+		rsp.ErrorMsg = scopeResult.ErrorMsg
+		return
+	}
+	if !scope.checkGym(stUserBookingBlockModel.GymId).Success {
+		rsp.Code = ErrCode_ConsultantGymDenied
+		rsp.ErrorMsg = "无权操作该门店的旷课记录"
+		Printf("LiftBookingBlockHandler gym denied, uid:%d GymId:%d operator:%s\n", req.Uid, stUserBookingBlockModel.GymId, authResult.Operator)
+		return
+	}
+	lifted, err := ImpNoShow.LiftUserBookingBlock(req.Uid, authResult.Operator)
+	if err != nil {
+		rsp.Code = -922
+		rsp.ErrorMsg = "解除预约暂停失败"
+		Printf("LiftBookingBlockHandler LiftUserBookingBlock err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	if !lifted {
+		rsp.Code = -996
+		rsp.ErrorMsg = "学员当前没有暂停预约"
+		return
+	}
+	AddAuditChange(r, "user_booking_block", strconv.FormatInt(req.Uid, 10),
+		map[string]interface{}{"until_ts": stUserBookingBlockModel.UntilTs},
+		map[string]interface{}{"until_ts": time.Now().Unix()})
+
+	rsp.Code = 0
+	Printf("LiftBookingBlockHandler success, uid:%d operator:%s\n", req.Uid, authResult.Operator)
+	return
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/db"
+	"github.com/xionghengheng/ff_plib/db/dao"
+	"github.com/xionghengheng/ff_plib/db/model"
+)
+
+// 多次旷课的处罚方式，对应业务规则 noshow_action 的取值
+const (
+	NoShowAction_NoReturn     = 1 // 不再自动归还课时
+	NoShowAction_NeedApproval = 2 // 顾问审批通过后才归还课时
+	NoShowAction_BlockBooking = 3 // 照常归还课时，并暂停预约一段时间
+)
+
+// 旷课课时归还的决定
+const (
+	NoShowDecision_Returned        = "returned"         // 未达到处罚次数，照常归还
+	NoShowDecision_NoReturn        = "no_return"        // 不归还
+	NoShowDecision_PendingApproval = "pending_approval" // 等待顾问审批
+	NoShowDecision_Approved        = "approved"         // 审批通过，已归还
+	NoShowDecision_Rejected        = "rejected"         // 审批驳回，不归还
+	NoShowDecision_Closed          = "closed"           // 审批前课程已通过旷课申诉处理，无需审批
+	NoShowDecision_Blocked         = "blocked"          // 照常归还，并暂停预约
+)
+
+// NoShowDecisionModel 每节旷课课程在归还时间做出的决定，一节课一条，审批时更新
+type NoShowDecisionModel struct {
+	ID            int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`            // 主键ID
+	LessonID      string `json:"lesson_id" gorm:"type:varchar(128);unique_index"` // 课程id
+	PackageID     string `json:"package_id" gorm:"type:varchar(128)"`             // 课包id
+	Uid           int64  `json:"uid" gorm:"index"`                                // 学员id
+	GymId         int    `json:"gym_id"`                                          // 场地id
+	CourseID      int    `json:"course_id"`                                       // 课程id
+	MissedCnt     int    `json:"missed_cnt"`                                      // 窗口内的旷课次数（含本次，不含申诉免责的）
+	WindowDay     int64  `json:"window_day"`                                      // 统计窗口天数
+	Threshold     int64  `json:"threshold"`                                       // 处罚的次数阈值，0表示不处罚
+	Decision      string `json:"decision" gorm:"type:varchar(16);index"`          // 决定
+	Returned      bool   `json:"returned"`                                        // 是否已归还课时
+	BlockUntilTs  int64  `json:"block_until_ts"`                                  // 暂停预约到什么时间，不暂停为0
+	Approver      string `json:"approver" gorm:"type:varchar(64)"`                // 审批人
+	ApproveRemark string `json:"approve_remark" gorm:"type:varchar(512)"`         // 审批备注
+	ApproveTs     int64  `json:"approve_ts"`                                      // 审批时间
+	CreatedTs     int64  `json:"created_ts"`                                      // 创建时间
+	UpdatedTs     int64  `json:"updated_ts"`                                      // 更新时间
+}
+
+const noshow_decision_tableName = "noshow_decision"
+
+// UserBookingBlockModel 学员的预约暂停，每个学员一条，预约服务在约课前检查 until_ts
+type UserBookingBlockModel struct {
+	ID        int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"` // 主键ID
+	Uid       int64  `json:"uid" gorm:"unique_index"`              // 学员id
+	UntilTs   int64  `json:"until_ts"`                             // 暂停预约到什么时间，当前时间小于该值时不能预约
+	LessonID  string `json:"lesson_id" gorm:"type:varchar(128)"`   // 触发暂停的旷课课程
+	GymId     int    `json:"gym_id"`                               // 触发暂停的旷课课程所在场地，顾问按场地范围查看和解除
+	Reason    string `json:"reason" gorm:"type:varchar(256)"`      // 暂停原因
+	LiftedBy  string `json:"lifted_by" gorm:"type:varchar(64)"`    // 提前解除的操作人
+	LiftedTs  int64  `json:"lifted_ts"`                            // 提前解除的时间
+	UpdatedTs int64  `json:"updated_ts"`                           // 更新时间
+}
+
+const user_booking_block_tableName = "user_booking_block"
+
+// NoShowInterface 旷课处罚数据模型接口
+type NoShowInterface interface {
+	// 统计学员在[begTs, endTs]内结束的旷课课程数，不含通过申诉免责的
+	CountUserNoShow(uid int64, begTs int64, endTs int64) (int, error)
+
+	// 在同一个事务里按决定归还课时、暂停预约、写入决定和通知
+	// 课程已经不是未归还的旷课状态时返回 errStateChanged
+	ApplyNoShowDecision(v model.CoursePackageSingleLessonModel, stNoShowDecisionModel *NoShowDecisionModel, vecNotifyOutboxModel []*NotifyOutboxModel) error
+
+	// 审批等待中的决定，返回审批后的决定；课程已通过申诉处理时决定改为closed且不发通知
+	// 决定已经不是等待审批时返回 errStateChanged
+	ResolveNoShowDecision(id int64, approve bool, approver string, remark string, vecNotifyOutboxModel []*NotifyOutboxModel) (string, error)
+
+	// 根据id获取决定
+	GetNoShowDecision(id int64) (*NoShowDecisionModel, error)
+
+	// 查询决定，按id降序，条件为空不过滤；vecGymId不为空时只查这些场地的
+	GetNoShowDecisionList(uid int64, decision string, vecGymId []int, offset int, limit int) ([]NoShowDecisionModel, error)
+
+	// 获取学员的预约暂停，没有时返回nil
+	GetUserBookingBlock(uid int64) (*UserBookingBlockModel, error)
+
+	// 提前解除学员的预约暂停，返回是否解除
+	LiftUserBookingBlock(uid int64, operator string) (bool, error)
+}
+
+// NoShowInterfaceImp 旷课处罚数据模型实现
+type NoShowInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpNoShow NoShowInterface = &NoShowInterfaceImp{}
+
+func (imp *NoShowInterfaceImp) CountUserNoShow(uid int64, begTs int64, endTs int64) (int, error) {
+	var cnt int
+	cli := db.Get()
+	err := cli.Table(course_package_single_lesson_tableName).
+		Where("uid = ? AND status = ? AND schedule_end_ts >= ? AND schedule_end_ts <= ?", uid, model.En_LessonStatusMissed, begTs, endTs).
+		Where("NOT EXISTS (SELECT 1 FROM "+lesson_appeal_tableName+" a WHERE a.lesson_id = "+course_package_single_lesson_tableName+".lesson_id AND a.action = ?)", LessonAppeal_Excused).
+		Count(&cnt).Error
+	return cnt, err
+}
+
+// lockMissedLesson 锁住旷课课程，已经不是未归还的旷课状态时返回 errStateChanged
+func lockMissedLesson(tx *gorm.DB, uid int64, lessonId string) error {
+	var stLessonModel model.CoursePackageSingleLessonModel
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Table(course_package_single_lesson_tableName).
+		Where("uid = ? AND lesson_id = ?", uid, lessonId).First(&stLessonModel).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return errStateChanged
+	}
+	if err != nil {
+		return err
+	}
+	if stLessonModel.Status != model.En_LessonStatusMissed || stLessonModel.WriteOffMissedReturnCnt {
+		return errStateChanged
+	}
+	return nil
+}
+
+// returnMissedLessonCntTx 在事务里标记已归还并给课包加回一次课时
+func returnMissedLessonCntTx(tx *gorm.DB, uid int64, lessonId string, packageId string) error {
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["write_off_missed_return_cnt"] = true
+	result := tx.Table(course_package_single_lesson_tableName).Model(&model.CoursePackageSingleLessonModel{}).
+		Where("uid = ? AND lesson_id = ? AND status = ? AND write_off_missed_return_cnt = false", uid, lessonId, model.En_LessonStatusMissed).
+		Updates(mapUpdates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errStateChanged
+	}
+
+	result = tx.Table(course_package_tableName).Model(&model.CoursePackageModel{}).Where("package_id = ?", packageId).
+		UpdateColumn("remain_cnt", gorm.Expr("remain_cnt + ?", 1))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("course package not found, package_id:%s", packageId)
+	}
+	return nil
+}
+
+func (imp *NoShowInterfaceImp) ApplyNoShowDecision(v model.CoursePackageSingleLessonModel, stNoShowDecisionModel *NoShowDecisionModel, vecNotifyOutboxModel []*NotifyOutboxModel) error {
+	return db.Get().Transaction(func(tx *gorm.DB) error {
+		if stNoShowDecisionModel.Returned {
+			if err := returnMissedLessonCntTx(tx, v.Uid, v.LessonID, v.PackageID); err != nil {
+				return err
+			}
+		} else if err := lockMissedLesson(tx, v.Uid, v.LessonID); err != nil {
+			return err
+		}
+
+		if stNoShowDecisionModel.BlockUntilTs > 0 {
+			var stBlock UserBookingBlockModel
+			err := tx.Set("gorm:query_option", "FOR UPDATE").Table(user_booking_block_tableName).Where("uid = ?", v.Uid).First(&stBlock).Error
+			if err != nil && !gorm.IsRecordNotFoundError(err) {
+				return err
+			}
+			// 已经在更长的暂停期内时不缩短
+			if stBlock.UntilTs < stNoShowDecisionModel.BlockUntilTs {
+				stBlock.Uid = v.Uid
+				stBlock.UntilTs = stNoShowDecisionModel.BlockUntilTs
+				stBlock.LessonID = v.LessonID
+				stBlock.GymId = v.GymId
+				stBlock.Reason = fmt.Sprintf("%d天内旷课%d次", stNoShowDecisionModel.WindowDay, stNoShowDecisionModel.MissedCnt)
+				stBlock.LiftedBy = ""
+				stBlock.LiftedTs = 0
+				stBlock.UpdatedTs = stNoShowDecisionModel.CreatedTs
+				if err := tx.Table(user_booking_block_tableName).Save(&stBlock).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := tx.Table(noshow_decision_tableName).Create(stNoShowDecisionModel).Error; err != nil {
+			return err
+		}
+		return ImpNotifyOutbox.AddNotifyOutboxList(tx, vecNotifyOutboxModel)
+	})
+}
+
+func (imp *NoShowInterfaceImp) ResolveNoShowDecision(id int64, approve bool, approver string, remark string, vecNotifyOutboxModel []*NotifyOutboxModel) (string, error) {
+	var decision string
+	err := db.Get().Transaction(func(tx *gorm.DB) error {
+		var stNoShowDecisionModel NoShowDecisionModel
+		err := tx.Set("gorm:query_option", "FOR UPDATE").Table(noshow_decision_tableName).Where("id = ?", id).First(&stNoShowDecisionModel).Error
+		if err != nil {
+			return err
+		}
+		if stNoShowDecisionModel.Decision != NoShowDecision_PendingApproval {
+			return errStateChanged
+		}
+
+		nowTs := time.Now().Unix()
+		mapUpdates := make(map[string]interface{})
+		mapUpdates["approver"] = approver
+		mapUpdates["approve_remark"] = remark
+		mapUpdates["approve_ts"] = nowTs
+		mapUpdates["updated_ts"] = nowTs
+
+		// 等待审批期间课程可能已经通过旷课申诉补核销或免责归还
+		errLesson := lockMissedLesson(tx, stNoShowDecisionModel.Uid, stNoShowDecisionModel.LessonID)
+		if errLesson != nil && errLesson != errStateChanged {
+			return errLesson
+		}
+		if errLesson == errStateChanged {
+			decision = NoShowDecision_Closed
+			mapUpdates["decision"] = decision
+			return tx.Table(noshow_decision_tableName).Where("id = ?", id).Updates(mapUpdates).Error
+		}
+
+		decision = NoShowDecision_Rejected
+		if approve {
+			decision = NoShowDecision_Approved
+			mapUpdates["returned"] = true
+			if err := returnMissedLessonCntTx(tx, stNoShowDecisionModel.Uid, stNoShowDecisionModel.LessonID, stNoShowDecisionModel.PackageID); err != nil {
+				return err
+			}
+		}
+		mapUpdates["decision"] = decision
+		if err := tx.Table(noshow_decision_tableName).Where("id = ?", id).Updates(mapUpdates).Error; err != nil {
+			return err
+		}
+		return ImpNotifyOutbox.AddNotifyOutboxList(tx, vecNotifyOutboxModel)
+	})
+	return decision, err
+}
+
+func (imp *NoShowInterfaceImp) GetNoShowDecision(id int64) (*NoShowDecisionModel, error) {
+	var stNoShowDecisionModel NoShowDecisionModel
+	cli := db.Get()
+	err := cli.Table(noshow_decision_tableName).Where("id = ?", id).First(&stNoShowDecisionModel).Error
+	if err != nil {
+		return nil, err
+	}
+	return &stNoShowDecisionModel, nil
+}
+
+func (imp *NoShowInterfaceImp) GetNoShowDecisionList(uid int64, decision string, vecGymId []int, offset int, limit int) ([]NoShowDecisionModel, error) {
+	var vecNoShowDecisionModel []NoShowDecisionModel
+	cli := db.Get().Table(noshow_decision_tableName)
+	if uid > 0 {
+		cli = cli.Where("uid = ?", uid)
+	}
+	if decision != "" {
+		cli = cli.Where("decision = ?", decision)
+	}
+	if len(vecGymId) > 0 {
+		cli = cli.Where("gym_id IN (?)", vecGymId)
+	}
+	err := cli.Order("id DESC").Offset(offset).Limit(limit).Find(&vecNoShowDecisionModel).Error
+	return vecNoShowDecisionModel, err
+}
+
+func (imp *NoShowInterfaceImp) GetUserBookingBlock(uid int64) (*UserBookingBlockModel, error) {
+	var stUserBookingBlockModel UserBookingBlockModel
+	cli := db.Get()
+	err := cli.Table(user_booking_block_tableName).Where("uid = ?", uid).First(&stUserBookingBlockModel).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &stUserBookingBlockModel, nil
+}
+
+func (imp *NoShowInterfaceImp) LiftUserBookingBlock(uid int64, operator string) (bool, error) {
+	nowTs := time.Now().Unix()
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["until_ts"] = nowTs
+	mapUpdates["lifted_by"] = operator
+	mapUpdates["lifted_ts"] = nowTs
+	mapUpdates["updated_ts"] = nowTs
+	cli := db.Get()
+	result := cli.Table(user_booking_block_tableName).Model(&UserBookingBlockModel{}).
+		Where("uid = ? AND until_ts > ?", uid, nowTs).Updates(mapUpdates)
+	return result.RowsAffected > 0, result.Error
+}
+
+// newNoShowNotify 生成旷课处罚或审批结果的通知，复用旷课通知的微信模板
+func newNoShowNotify(scene string, v model.CoursePackageSingleLessonModel, remark string) (*NotifyOutboxModel, error) {
+	stUserModel, err := dao.ImpUser.GetUser(v.Uid)
+	if err != nil {
+		Printf("newNoShowNotify GetUser err, err:%+v uid:%d LessonID:%s\n", err, v.Uid, v.LessonID)
+		return nil, err
+	}
+	stGymInfoModel, err := dao.ImpGym.GetGymInfoByGymId(v.GymId)
+	if err != nil {
+		Printf("newNoShowNotify GetGymInfoByGymId err, err:%+v uid:%d LessonID:%s\n", err, v.Uid, v.LessonID)
+		return nil, err
+	}
+	stCourseModel, err := dao.ImpCourse.GetCourseById(v.CourseID)
+	if err != nil {
+		Printf("newNoShowNotify GetCourseById err, err:%+v uid:%d LessonID:%s\n", err, v.Uid, v.LessonID)
+		return nil, err
+	}
+	mapParam := genLessonNotifyParams(v.ScheduleBegTs, v.ScheduleEndTs)
+	mapParam[NotifyParam_CourseName] = stCourseModel.Name
+	mapParam[NotifyParam_GymName] = stGymInfoModel.LocName
+	mapParam[NotifyParam_NoShowRemark] = remark
+	return newWxNotifyOutbox(scene, NotifyTemplate_NoShowPenalty, v.Uid, stUserModel.WechatID, v.LessonID, v.PackageID, mapParam)
+}
+
+// decideNoShow 按旷课处罚规则决定旷课课程是否归还课时，达到处罚次数时同时生成通知
+func decideNoShow(rules *BusinessRules, v model.CoursePackageSingleLessonModel) (*NoShowDecisionModel, []*NotifyOutboxModel, error) {
+	nowTs := time.Now().Unix()
+	stNoShowDecisionModel := &NoShowDecisionModel{
+		LessonID:  v.LessonID,
+		PackageID: v.PackageID,
+		Uid:       v.Uid,
+		GymId:     v.GymId,
+		CourseID:  v.CourseID,
+		WindowDay: rules.lesson(BizRule_NoShowWindowDay, v.GymId, v.CourseID),
+		Threshold: rules.lesson(BizRule_NoShowThreshold, v.GymId, v.CourseID),
+		Decision:  NoShowDecision_Returned,
+		Returned:  true,
+		CreatedTs: nowTs,
+		UpdatedTs: nowTs,
+	}
+	if stNoShowDecisionModel.Threshold == 0 {
+		return stNoShowDecisionModel, nil, nil
+	}
+
+	missedCnt, err := ImpNoShow.CountUserNoShow(v.Uid, v.ScheduleEndTs-stNoShowDecisionModel.WindowDay*86400, v.ScheduleEndTs)
+	if err != nil {
+		return nil, nil, err
+	}
+	stNoShowDecisionModel.MissedCnt = missedCnt
+	if int64(missedCnt) < stNoShowDecisionModel.Threshold {
+		return stNoShowDecisionModel, nil, nil
+	}
+
+	var remark string
+	switch rules.lesson(BizRule_NoShowAction, v.GymId, v.CourseID) {
+	case NoShowAction_NeedApproval:
+		stNoShowDecisionModel.Decision = NoShowDecision_PendingApproval
+		stNoShowDecisionModel.Returned = false
+		remark = "多次旷课，课时返还需顾问审核"
+	case NoShowAction_BlockBooking:
+		stNoShowDecisionModel.Decision = NoShowDecision_Blocked
+		stNoShowDecisionModel.BlockUntilTs = nowTs + rules.lesson(BizRule_NoShowBlockDay, v.GymId, v.CourseID)*86400
+		remark = "多次旷课，暂停预约至" + time.Unix(stNoShowDecisionModel.BlockUntilTs, 0).In(notifyLocation).Format("01月02日")
+	default:
+		stNoShowDecisionModel.Decision = NoShowDecision_NoReturn
+		stNoShowDecisionModel.Returned = false
+		remark = "近期多次旷课，本节课时不予返还"
+	}
+	stWxOutbox, err := newNoShowNotify(NotifyScene_NoShowPenalty, v, remark)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stNoShowDecisionModel, []*NotifyOutboxModel{stWxOutbox}, nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/db"
+	"github.com/xionghengheng/ff_plib/db/dao"
+)
+
+// 单次发送的结果
+const (
+	NotifyAttemptResult_Succ     = "succ"
+	NotifyAttemptResult_Failed   = "failed"
+	NotifyAttemptResult_DryRun   = "dry_run"  // dry_run 模式下只记录没有发送
+	NotifyAttemptResult_Redirect = "redirect" // redirect 模式下改发给了测试接收人
+)
+
+// NotifyAttemptModel 每一次微信/短信的发送记录，用于客服查询是否给用户发过通知
+type NotifyAttemptModel struct {
+	ID           int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`      // 主键ID
+	OutboxID     int64  `json:"outbox_id" gorm:"index"`                    // 对应的发件箱记录，不经过发件箱直接发送的为0
+	Scene        string `json:"scene" gorm:"type:varchar(32)"`             // 通知场景
+	Channel      string `json:"channel" gorm:"type:varchar(8)"`            // 通知渠道
+	TemplateName string `json:"template_name" gorm:"type:varchar(64)"`     // 模板逻辑名
+	TemplateID   string `json:"template_id" gorm:"type:varchar(64)"`       // 微信模板id或短信模板id
+	Uid          int64  `json:"uid" gorm:"index"`                          // 业务关联的用户id
+	Phone        string `json:"phone" gorm:"type:varchar(32);index"`       // 短信接收号码
+	LessonID     string `json:"lesson_id" gorm:"type:varchar(128);index"`  // 关联的课程
+	PackageID    string `json:"package_id" gorm:"type:varchar(128);index"` // 关联的课包
+	Payload      string `json:"payload" gorm:"type:text"`                  // 渲染后的消息内容
+	TryNo        int    `json:"try_no"`                                    // 第几次发送
+	Result       string `json:"result" gorm:"type:varchar(16)"`            // 发送结果
+	ErrType      string `json:"err_type" gorm:"type:varchar(16)"`          // 失败时的错误类型
+	Response     string `json:"response" gorm:"type:varchar(1024)"`        // 渠道返回，失败时为错误信息
+	CostMs       int64  `json:"cost_ms"`                                   // 调用渠道的耗时
+	AttemptTs    int64  `json:"attempt_ts" gorm:"index"`                   // 发送时间
+}
+
+const notify_attempt_tableName = "notify_attempt"
+
+// NotifyAttemptInterface 通知发送记录数据模型接口
+type NotifyAttemptInterface interface {
+	// 写入一次发送记录
+	AddNotifyAttempt(stNotifyAttemptModel *NotifyAttemptModel) error
+
+	// 查询发送记录，按id降序；uid和phone同时传时按“用户本人或发到该号码”查询，其他条件为空不过滤
+	GetNotifyAttemptList(uid int64, phone string, lessonId string, packageId string, offset int, limit int) ([]NotifyAttemptModel, error)
+
+	// 统计手机号从begTs起真实发送成功的短信条数，dry_run 和 redirect 模式下的记录不计入
+	CountSuccSmsByPhone(phone string, begTs int64) (int, error)
+}
+
+// NotifyAttemptInterfaceImp 通知发送记录数据模型实现
+type NotifyAttemptInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpNotifyAttempt NotifyAttemptInterface = &NotifyAttemptInterfaceImp{}
+
+func (imp *NotifyAttemptInterfaceImp) AddNotifyAttempt(stNotifyAttemptModel *NotifyAttemptModel) error {
+	cli := db.Get()
+	return cli.Table(notify_attempt_tableName).Create(stNotifyAttemptModel).Error
+}
+
+func (imp *NotifyAttemptInterfaceImp) GetNotifyAttemptList(uid int64, phone string, lessonId string, packageId string, offset int, limit int) ([]NotifyAttemptModel, error) {
+	var vecNotifyAttemptModel []NotifyAttemptModel
+	cli := db.Get().Table(notify_attempt_tableName)
+	if uid > 0 && phone != "" {
+		cli = cli.Where("(uid = ? OR phone = ?)", uid, phone)
+	} else if uid > 0 {
+		cli = cli.Where("uid = ?", uid)
+	} else if phone != "" {
+		cli = cli.Where("phone = ?", phone)
+	}
+	if lessonId != "" {
+		cli = cli.Where("lesson_id = ?", lessonId)
+	}
+	if packageId != "" {
+		cli = cli.Where("package_id = ?", packageId)
+	}
+	err := cli.Order("id DESC").Offset(offset).Limit(limit).Find(&vecNotifyAttemptModel).Error
+	return vecNotifyAttemptModel, err
+}
+
+func (imp *NotifyAttemptInterfaceImp) CountSuccSmsByPhone(phone string, begTs int64) (int, error) {
+	var cnt int
+	cli := db.Get()
+	err := cli.Table(notify_attempt_tableName).Where("phone = ? AND channel = ? AND result = ? AND attempt_ts >= ?",
+		phone, NotifyChannel_Sms, NotifyAttemptResult_Succ, begTs).Count(&cnt).Error
+	return cnt, err
+}
+
+// recordNotifyAttempt 记录一次发送，写入失败只打日志，不影响发送流程
+// 非 live 模式下成功的记录单独标记，不算作发给了原接收人
+func recordNotifyAttempt(stNotifyAttemptModel *NotifyAttemptModel, mode string, response string, errSend error) {
+	switch mode {
+	case MessagingMode_DryRun:
+		stNotifyAttemptModel.Result = NotifyAttemptResult_DryRun
+	case MessagingMode_Redirect:
+		stNotifyAttemptModel.Result = NotifyAttemptResult_Redirect
+	default:
+		stNotifyAttemptModel.Result = NotifyAttemptResult_Succ
+	}
+	stNotifyAttemptModel.Response = response
+	if errSend != nil {
+		stNotifyAttemptModel.Result = NotifyAttemptResult_Failed
+		stNotifyAttemptModel.Response = errSend.Error()
+		if len(stNotifyAttemptModel.Response) > 1000 {
+			stNotifyAttemptModel.Response = stNotifyAttemptModel.Response[:1000]
+		}
+	}
+	if err := ImpNotifyAttempt.AddNotifyAttempt(stNotifyAttemptModel); err != nil {
+		Printf("recordNotifyAttempt AddNotifyAttempt err, err:%+v attempt:%+v\n", err, stNotifyAttemptModel)
+	}
+}
+
+// newNotifyAttemptFromOutbox 发件箱投递时的发送记录
+func newNotifyAttemptFromOutbox(stNotifyOutboxModel *NotifyOutboxModel, tryNo int, begTime time.Time) *NotifyAttemptModel {
+	return &NotifyAttemptModel{
+		OutboxID:     stNotifyOutboxModel.ID,
+		Scene:        stNotifyOutboxModel.Scene,
+		Channel:      stNotifyOutboxModel.Channel,
+		TemplateName: stNotifyOutboxModel.TemplateName,
+		TemplateID:   stNotifyOutboxModel.TemplateID,
+		Uid:          stNotifyOutboxModel.Uid,
+		Phone:        stNotifyOutboxModel.Phone,
+		LessonID:     stNotifyOutboxModel.LessonID,
+		PackageID:    stNotifyOutboxModel.PackageID,
+		Payload:      stNotifyOutboxModel.Payload,
+		TryNo:        tryNo,
+		CostMs:       time.Since(begTime).Milliseconds(),
+		AttemptTs:    begTime.Unix(),
+	}
+}
+
+type GetNotificationHistoryReq struct {
+	PhoneNumber string `json:"phone_number"` // 用户手机号，会同时查询该用户的通知和发到该号码的短信
+	Uid         int64  `json:"uid"`          // 用户id
+	LessonID    string `json:"lesson_id"`    // 课程id
+	PackageID   string `json:"package_id"`   // 课包id
+	Passback    string `json:"passback"`     // 翻页标记，首次请求传空字符串，后续传上次返回的passback
+	PageSize    int    `json:"page_size"`    // 每页数量
+}
+
+type GetNotificationHistoryRsp struct {
+	Code     int                  `json:"code"`
+	ErrorMsg string               `json:"errorMsg,omitempty"`
+	List     []NotifyAttemptModel `json:"list,omitempty"`
+	Passback string               `json:"passback"` // 下一页的翻页标记，为空字符串表示没有更多数据
+}
+
+func getGetNotificationHistoryReq(r *http.Request) (GetNotificationHistoryReq, error) {
+	req := GetNotificationHistoryReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// GetNotificationHistoryHandler 按手机号、用户、课程或课包查询通知发送记录
+func GetNotificationHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getGetNotificationHistoryReq(r)
+	rsp := &GetNotificationHistoryRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetNotificationHistoryHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if req.PhoneNumber == "" && req.Uid <= 0 && req.LessonID == "" && req.PackageID == "" {
+		rsp.Code = -996
+		rsp.ErrorMsg = "手机号、用户id、课程id、课包id至少填写一个"
+		return
+	}
+
+	// 手机号先查出用户，学员的微信通知按uid记录，发给教练的短信按号码记录
+	uid := req.Uid
+	if req.PhoneNumber != "" {
+		stUserInfoModel, err := dao.ImpUser.GetUserByPhone(req.PhoneNumber)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			rsp.Code = -911
+			rsp.ErrorMsg = "通过手机号拉取用户信息失败"
+			Printf("GetNotificationHistoryHandler GetUserByPhone err, err:%+v PhoneNumber:%s\n", err, req.PhoneNumber)
+			return
+		}
+		if err == nil {
+			if uid > 0 && uid != stUserInfoModel.UserID {
+				rsp.Code = -996
+				rsp.ErrorMsg = "手机号和用户id不是同一个用户"
+				return
+			}
+			uid = stUserInfoModel.UserID
+		}
+	}
+
+	var offset int64
+	if len(req.Passback) > 0 {
+		offset, _ = strconv.ParseInt(req.Passback, 10, 64)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	pageSize := req.PageSize
+	if pageSize <= 0 {
+		pageSize = 20 // 默认每页20条
+	}
+	if pageSize > 100 {
+		pageSize = 100 // 最大每页100条
+	}
+
+	vecNotifyAttemptModel, err := ImpNotifyAttempt.GetNotifyAttemptList(uid, req.PhoneNumber, req.LessonID, req.PackageID, int(offset), pageSize)
+	if err != nil {
+		rsp.Code = -922
+		rsp.ErrorMsg = "查询通知记录失败"
+		Printf("GetNotificationHistoryHandler GetNotifyAttemptList err, err:%+v req:%+v\n", err, req)
+		return
+	}
+
+	rsp.List = vecNotifyAttemptModel
+	if len(vecNotifyAttemptModel) == pageSize {
+		rsp.Passback = strconv.FormatInt(offset+int64(pageSize), 10)
+	}
+	rsp.Code = 0
+	Printf("GetNotificationHistoryHandler success, uid:%d offset:%d count:%d\n", uid, offset, len(rsp.List))
+	return
+}
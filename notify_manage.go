@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type GetNotifyOutboxListReq struct {
+	Status   string `json:"status"`    // 投递状态（pending/sent/dead/skipped/standby/canceled），为空不过滤
+	Scene    string `json:"scene"`     // 通知场景，为空不过滤
+	Uid      int64  `json:"uid"`       // 用户id，为0不过滤
+	LessonID string `json:"lesson_id"` // 课程id，为空不过滤
+	Passback string `json:"passback"`  // 翻页标记，首次请求传空字符串，后续传上次返回的passback
+	PageSize int    `json:"page_size"` // 每页数量
+}
+
+type GetNotifyOutboxListRsp struct {
+	Code     int                 `json:"code"`
+	ErrorMsg string              `json:"errorMsg,omitempty"`
+	List     []NotifyOutboxModel `json:"list,omitempty"`
+	Passback string              `json:"passback"` // 下一页的翻页标记，为空字符串表示没有更多数据
+}
+
+func getGetNotifyOutboxListReq(r *http.Request) (GetNotifyOutboxListReq, error) {
+	req := GetNotifyOutboxListReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// GetNotifyOutboxListHandler 查询通知发件箱，排查发送失败和死信
+func GetNotifyOutboxListHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getGetNotifyOutboxListReq(r)
+	rsp := &GetNotifyOutboxListRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetNotifyOutboxListHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	switch req.Status {
+	case "", NotifyStatus_Pending, NotifyStatus_Sent, NotifyStatus_Dead, NotifyStatus_Skipped, NotifyStatus_Standby, NotifyStatus_Canceled:
+	default:
+		rsp.Code = -996
+		rsp.ErrorMsg = "投递状态不合法"
+		return
+	}
+
+	var offset int64
+	if len(req.Passback) > 0 {
+		offset, _ = strconv.ParseInt(req.Passback, 10, 64)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	pageSize := req.PageSize
+	if pageSize <= 0 {
+		pageSize = 20 // 默认每页20条
+	}
+	if pageSize > 100 {
+		pageSize = 100 // 最大每页100条
+	}
+
+	vecNotifyOutboxModel, err := ImpNotifyOutbox.GetNotifyOutboxList(req.Status, req.Scene, req.Uid, req.LessonID, int(offset), pageSize)
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询通知失败"
+		Printf("GetNotifyOutboxListHandler GetNotifyOutboxList err, err:%+v req:%+v\n", err, req)
+		return
+	}
+
+	rsp.List = vecNotifyOutboxModel
+	if len(vecNotifyOutboxModel) == pageSize {
+		rsp.Passback = strconv.FormatInt(offset+int64(pageSize), 10)
+	}
+	rsp.Code = 0
+	Printf("GetNotifyOutboxListHandler success, offset:%d count:%d\n", offset, len(rsp.List))
+	return
+}
+
+// 单次最多重放的通知数
+const replayNotifyMaxCnt = 100
+
+type ReplayNotifyOutboxReq struct {
+	VecId []int64 `json:"vec_id"` // 要重放的通知id，只有死信会被重放
+}
+
+type ReplayNotifyOutboxRsp struct {
+	Code      int    `json:"code"`
+	ErrorMsg  string `json:"errorMsg,omitempty"`
+	ReplayCnt int64  `json:"replay_cnt"` // 实际重放的条数，不是死信的会被忽略
+}
+
+func getReplayNotifyOutboxReq(r *http.Request) (ReplayNotifyOutboxReq, error) {
+	req := ReplayNotifyOutboxReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// ReplayNotifyOutboxHandler 重放死信：重新放回待发送并清零重试次数，由投递任务立即发送
+func ReplayNotifyOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getReplayNotifyOutboxReq(r)
+	rsp := &ReplayNotifyOutboxRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("ReplayNotifyOutboxHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if len(req.VecId) == 0 || len(req.VecId) > replayNotifyMaxCnt {
+		rsp.Code = -996
+		rsp.ErrorMsg = fmt.Sprintf("通知id数量需在1到%d之间", replayNotifyMaxCnt)
+		return
+	}
+
+	rsp.ReplayCnt, err = ImpNotifyOutbox.ReplayDeadNotifyOutbox(req.VecId, authResult.Operator)
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "重放通知失败"
+		Printf("ReplayNotifyOutboxHandler ReplayDeadNotifyOutbox err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	AddAuditChange(r, "notify_outbox", fmt.Sprintf("%v", req.VecId), nil, map[string]interface{}{"replay_cnt": rsp.ReplayCnt})
+
+	rsp.Code = 0
+	Printf("ReplayNotifyOutboxHandler success, vecId:%v replayCnt:%d operator:%s\n", req.VecId, rsp.ReplayCnt, authResult.Operator)
+	return
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/comm"
+	"github.com/xionghengheng/ff_plib/db"
+)
+
+// 通知渠道
+const (
+	NotifyChannel_Wx  = "wx"  // 小程序订阅消息
+	NotifyChannel_Sms = "sms" // 短信
+)
+
+// 通知场景
+const (
+	NotifyScene_LessonMissed             = "lesson_missed"               // 旷课通知学员
+	NotifyScene_LessonMissedCoach        = "lesson_missed_coach"         // 旷课提醒教练补核销
+	NotifyScene_LessonStartRemind        = "lesson_start_remind"         // 私教课开课前提醒
+	NotifyScene_LessonCommentRemind      = "lesson_comment_remind"       // 私教课结束后提醒评价
+	NotifyScene_TrialExpire              = "trial_expire"                // 体验课包即将过期
+	NotifyScene_PassCardStartRemind      = "pass_card_start_remind"      // 通卡锻炼前提醒
+	NotifyScene_PassCardLessonOverdue    = "pass_card_lesson_overdue"    // 通卡课程超时自动结束
+	NotifyScene_CoachAvailableTimeRemind = "coach_available_time_remind" // 提醒教练设置可约时间
+	NotifyScene_NoShowPenalty            = "noshow_penalty"              // 多次旷课的处罚通知学员
+	NotifyScene_NoShowApproval           = "noshow_approval"             // 旷课课时返还的审批结果通知学员
+)
+
+// 通知的投递状态
+const (
+	NotifyStatus_Pending  = "pending"  // 待发送（含等待重试）
+	NotifyStatus_Sent     = "sent"     // 已发送
+	NotifyStatus_Dead     = "dead"     // 死信：永久性错误或重试次数用完，不再自动重试，可由管理员重放
+	NotifyStatus_Skipped  = "skipped"  // 接收人的偏好关闭了该渠道或短信达到当天上限，不发送
+	NotifyStatus_Standby  = "standby"  // 备用的短信，微信发不出去时转为待发送
+	NotifyStatus_Canceled = "canceled" // 备用的短信，微信已发送成功，不再发送
+)
+
+// 发送失败的错误类型
+const (
+	NotifyErrType_Transient = "transient" // 临时错误，退避后重试
+	NotifyErrType_Permanent = "permanent" // 永久错误，重试也不会成功，直接进入死信
+)
+
+// 投递参数：第n次失败后等待 notifyRetryBaseSec*2^(n-1) 秒再重试，最长 notifyRetryMaxSec
+const (
+	notifyOutboxBatchSize = 100
+	notifyOutboxMaxTryCnt = 8
+	notifyRetryBaseSec    = 30
+	notifyRetryMaxSec     = 3600
+)
+
+// NotifyOutboxModel 待发送的通知，和业务状态在同一个事务里写入，由投递任务异步发送
+type NotifyOutboxModel struct {
+	ID               int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`                        // 主键ID
+	BizKey           string `json:"biz_key" gorm:"type:varchar(191);unique_index"`               // 业务唯一键，同一条业务消息只写入一次
+	Scene            string `json:"scene" gorm:"type:varchar(32)"`                               // 通知场景
+	Channel          string `json:"channel" gorm:"type:varchar(8)"`                              // 通知渠道
+	Uid              int64  `json:"uid" gorm:"index"`                                            // 业务关联的用户id
+	RecipientType    string `json:"recipient_type" gorm:"type:varchar(16)"`                      // 接收人类型，按接收人的偏好发送
+	RecipientID      int64  `json:"recipient_id"`                                                // 接收人id
+	Phone            string `json:"phone" gorm:"type:varchar(32)"`                               // 短信接收号码
+	TemplateName     string `json:"template_name" gorm:"type:varchar(64)"`                       // 模板逻辑名
+	TemplateID       string `json:"template_id" gorm:"type:varchar(64)"`                         // 微信模板id或短信模板id
+	Payload          string `json:"payload" gorm:"type:text"`                                    // 微信为WxSendMsg2UserReq，短信为模板参数数组，均为JSON
+	LessonID         string `json:"lesson_id" gorm:"type:varchar(128);index"`                    // 关联的课程
+	PackageID        string `json:"package_id" gorm:"type:varchar(128)"`                         // 关联的课包
+	FallbackOf       string `json:"fallback_of" gorm:"type:varchar(191);index"`                  // 备用短信对应的微信通知的业务唯一键
+	DeliveredChannel string `json:"delivered_channel" gorm:"type:varchar(8)"`                    // 实际送达的渠道，微信通知由备用短信送达时为sms
+	Status           string `json:"status" gorm:"type:varchar(16);index:idx_status_next_try_ts"` // 投递状态
+	NextTryTs        int64  `json:"next_try_ts" gorm:"index:idx_status_next_try_ts"`             // 下一次可以发送的时间
+	TryCnt           int    `json:"try_cnt"`                                                     // 已发送次数（重放后清零）
+	DeferCnt         int    `json:"defer_cnt"`                                                   // 因免打扰推迟发送的次数
+	LastError        string `json:"last_error" gorm:"type:varchar(512)"`                         // 最后一次发送失败的原因
+	LastErrType      string `json:"last_err_type" gorm:"type:varchar(16)"`                       // 最后一次发送失败的错误类型
+	DeadTs           int64  `json:"dead_ts"`                                                     // 进入死信的时间
+	ReplayCnt        int    `json:"replay_cnt"`                                                  // 被管理员重放的次数
+	LastReplayBy     string `json:"last_replay_by" gorm:"type:varchar(64)"`                      // 最后一次重放的操作人
+	CreatedTs        int64  `json:"created_ts"`                                                  // 创建时间
+	SentTs           int64  `json:"sent_ts"`                                                     // 发送成功时间
+	UpdatedTs        int64  `json:"updated_ts"`                                                  // 更新时间
+}
+
+const notify_outbox_tableName = "notify_outbox"
+
+// NotifyOutboxInterface 通知发件箱数据模型接口
+type NotifyOutboxInterface interface {
+	// 在业务事务中写入通知
+	AddNotifyOutboxList(tx *gorm.DB, vecNotifyOutboxModel []*NotifyOutboxModel) error
+
+	// 不依附业务状态写入通知，业务唯一键已存在时不重复写入，返回是否写入
+	AddNotifyOutboxIfAbsent(stNotifyOutboxModel *NotifyOutboxModel) (bool, error)
+
+	// 业务唯一键是否已经写入过通知
+	HasNotifyOutbox(bizKey string) (bool, error)
+
+	// 按id升序获取已到重试时间的待发送通知
+	GetDueNotifyOutboxList(nowTs int64, begId int64, limit int) ([]NotifyOutboxModel, error)
+
+	// 更新待发送的通知，已经不是待发送状态时返回false
+	UpdatePendingNotifyOutbox(id int64, mapUpdates map[string]interface{}) (bool, error)
+
+	// 查询通知，按id降序，条件为空不过滤
+	GetNotifyOutboxList(status string, scene string, uid int64, lessonId string, offset int, limit int) ([]NotifyOutboxModel, error)
+
+	// 把死信重新放回待发送，返回实际重放的条数
+	ReplayDeadNotifyOutbox(vecId []int64, operator string) (int64, error)
+
+	// 更新某条微信通知的备用短信，只更新处于fromStatus的，返回更新的条数
+	UpdateFallbackNotifyOutbox(fallbackOf string, fromStatus string, mapUpdates map[string]interface{}) (int64, error)
+
+	// 按业务唯一键更新通知
+	UpdateNotifyOutboxByBizKey(bizKey string, mapUpdates map[string]interface{}) error
+}
+
+// NotifyOutboxInterfaceImp 通知发件箱数据模型实现
+type NotifyOutboxInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpNotifyOutbox NotifyOutboxInterface = &NotifyOutboxInterfaceImp{}
+
+func (imp *NotifyOutboxInterfaceImp) AddNotifyOutboxList(tx *gorm.DB, vecNotifyOutboxModel []*NotifyOutboxModel) error {
+	for _, v := range vecNotifyOutboxModel {
+		if v == nil {
+			continue
+		}
+		if err := tx.Table(notify_outbox_tableName).Create(v).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (imp *NotifyOutboxInterfaceImp) AddNotifyOutboxIfAbsent(stNotifyOutboxModel *NotifyOutboxModel) (bool, error) {
+	var count int
+	cli := db.Get()
+	if err := cli.Table(notify_outbox_tableName).Where("biz_key = ?", stNotifyOutboxModel.BizKey).Count(&count).Error; err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+	if err := cli.Table(notify_outbox_tableName).Create(stNotifyOutboxModel).Error; err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (imp *NotifyOutboxInterfaceImp) HasNotifyOutbox(bizKey string) (bool, error) {
+	var count int
+	cli := db.Get()
+	err := cli.Table(notify_outbox_tableName).Where("biz_key = ?", bizKey).Count(&count).Error
+	return count > 0, err
+}
+
+func (imp *NotifyOutboxInterfaceImp) GetDueNotifyOutboxList(nowTs int64, begId int64, limit int) ([]NotifyOutboxModel, error) {
+	var vecNotifyOutboxModel []NotifyOutboxModel
+	cli := db.Get()
+	err := cli.Table(notify_outbox_tableName).Where("status = ? AND next_try_ts <= ? AND id > ?", NotifyStatus_Pending, nowTs, begId).
+		Order("id ASC").Limit(limit).Find(&vecNotifyOutboxModel).Error
+	return vecNotifyOutboxModel, err
+}
+
+func (imp *NotifyOutboxInterfaceImp) UpdatePendingNotifyOutbox(id int64, mapUpdates map[string]interface{}) (bool, error) {
+	cli := db.Get()
+	result := cli.Table(notify_outbox_tableName).Model(&NotifyOutboxModel{}).
+		Where("id = ? AND status = ?", id, NotifyStatus_Pending).Updates(mapUpdates)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (imp *NotifyOutboxInterfaceImp) GetNotifyOutboxList(status string, scene string, uid int64, lessonId string, offset int, limit int) ([]NotifyOutboxModel, error) {
+	var vecNotifyOutboxModel []NotifyOutboxModel
+	cli := db.Get().Table(notify_outbox_tableName)
+	if status != "" {
+		cli = cli.Where("status = ?", status)
+	}
+	if scene != "" {
+		cli = cli.Where("scene = ?", scene)
+	}
+	if uid > 0 {
+		cli = cli.Where("uid = ?", uid)
+	}
+	if lessonId != "" {
+		cli = cli.Where("lesson_id = ?", lessonId)
+	}
+	err := cli.Order("id DESC").Offset(offset).Limit(limit).Find(&vecNotifyOutboxModel).Error
+	return vecNotifyOutboxModel, err
+}
+
+func (imp *NotifyOutboxInterfaceImp) ReplayDeadNotifyOutbox(vecId []int64, operator string) (int64, error) {
+	nowTs := time.Now().Unix()
+	cli := db.Get()
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["status"] = NotifyStatus_Pending
+	mapUpdates["next_try_ts"] = nowTs
+	mapUpdates["try_cnt"] = 0
+	mapUpdates["replay_cnt"] = gorm.Expr("replay_cnt + 1")
+	mapUpdates["last_replay_by"] = operator
+	mapUpdates["updated_ts"] = nowTs
+	result := cli.Table(notify_outbox_tableName).Model(&NotifyOutboxModel{}).
+		Where("id IN (?) AND status = ?", vecId, NotifyStatus_Dead).Updates(mapUpdates)
+	return result.RowsAffected, result.Error
+}
+
+func (imp *NotifyOutboxInterfaceImp) UpdateFallbackNotifyOutbox(fallbackOf string, fromStatus string, mapUpdates map[string]interface{}) (int64, error) {
+	cli := db.Get()
+	result := cli.Table(notify_outbox_tableName).Model(&NotifyOutboxModel{}).
+		Where("fallback_of = ? AND status = ?", fallbackOf, fromStatus).Updates(mapUpdates)
+	return result.RowsAffected, result.Error
+}
+
+func (imp *NotifyOutboxInterfaceImp) UpdateNotifyOutboxByBizKey(bizKey string, mapUpdates map[string]interface{}) error {
+	cli := db.Get()
+	return cli.Table(notify_outbox_tableName).Model(&NotifyOutboxModel{}).
+		Where("biz_key = ?", bizKey).Updates(mapUpdates).Error
+}
+
+// errStateChanged 业务记录已被其他流程修改（例如教练补核销），本次不再处理
+var errStateChanged = errors.New("state changed")
+
+// saveStateWithNotify 在同一个事务里按条件更新业务记录并写入通知，条件不满足时返回 errStateChanged
+func saveStateWithNotify(tableName string, value interface{}, mapUpdates map[string]interface{}, vecNotifyOutboxModel []*NotifyOutboxModel, query string, args ...interface{}) error {
+	return db.Get().Transaction(func(tx *gorm.DB) error {
+		result := tx.Table(tableName).Model(value).Where(query, args...).Updates(mapUpdates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errStateChanged
+		}
+		return ImpNotifyOutbox.AddNotifyOutboxList(tx, vecNotifyOutboxModel)
+	})
+}
+
+// genNotifyBizKey 同一个场景、渠道下，每节课（没有课程时按课包）只发一条
+func genNotifyBizKey(scene string, channel string, lessonId string, packageId string) string {
+	bizId := lessonId
+	if bizId == "" {
+		bizId = packageId
+	}
+	return fmt.Sprintf("%s:%s:%s", scene, channel, bizId)
+}
+
+// newWxNotifyOutbox 按模板生成一条小程序订阅消息
+// 模板渲染或校验失败的消息直接记为死信，不影响业务状态的写入，修正模板后可以从发件箱里查到
+func newWxNotifyOutbox(scene string, templateName string, uid int64, toUser string, lessonId string, packageId string, mapParam map[string]string) (*NotifyOutboxModel, error) {
+	stWxSendMsg2UserReq, errRender := renderWxNotify(templateName, toUser, mapParam)
+	payload, err := json.Marshal(stWxSendMsg2UserReq)
+	if err != nil {
+		return nil, err
+	}
+	nowTs := time.Now().Unix()
+	stNotifyOutboxModel := &NotifyOutboxModel{
+		BizKey:        genNotifyBizKey(scene, NotifyChannel_Wx, lessonId, packageId),
+		Scene:         scene,
+		Channel:       NotifyChannel_Wx,
+		Uid:           uid,
+		RecipientType: NotifyRecipient_User,
+		RecipientID:   uid,
+		TemplateName:  templateName,
+		TemplateID:    stWxSendMsg2UserReq.TemplateID,
+		Payload:       string(payload),
+		LessonID:      lessonId,
+		PackageID:     packageId,
+		Status:        NotifyStatus_Pending,
+		NextTryTs:     nowTs,
+		CreatedTs:     nowTs,
+		UpdatedTs:     nowTs,
+	}
+	if errRender != nil {
+		markNotifyOutboxInvalid(stNotifyOutboxModel, errRender)
+	}
+	return stNotifyOutboxModel, nil
+}
+
+// newSmsNotifyOutbox 按模板生成一条短信，渲染失败的处理同 newWxNotifyOutbox
+func newSmsNotifyOutbox(scene string, templateName string, uid int64, phone string, lessonId string, packageId string, mapParam map[string]string) (*NotifyOutboxModel, error) {
+	templateId, vecTemplateParam, errRender := renderSmsNotify(templateName, mapParam)
+	payload, err := json.Marshal(vecTemplateParam)
+	if err != nil {
+		return nil, err
+	}
+	nowTs := time.Now().Unix()
+	stNotifyOutboxModel := &NotifyOutboxModel{
+		BizKey:        genNotifyBizKey(scene, NotifyChannel_Sms, lessonId, packageId),
+		Scene:         scene,
+		Channel:       NotifyChannel_Sms,
+		Uid:           uid,
+		RecipientType: NotifyRecipient_User,
+		RecipientID:   uid,
+		Phone:         phone,
+		TemplateName:  templateName,
+		TemplateID:    templateId,
+		Payload:       string(payload),
+		LessonID:      lessonId,
+		PackageID:     packageId,
+		Status:        NotifyStatus_Pending,
+		NextTryTs:     nowTs,
+		CreatedTs:     nowTs,
+		UpdatedTs:     nowTs,
+	}
+	if errRender != nil {
+		markNotifyOutboxInvalid(stNotifyOutboxModel, errRender)
+	}
+	return stNotifyOutboxModel, nil
+}
+
+// markNotifyOutboxInvalid 模板不合法的消息直接进入死信
+func markNotifyOutboxInvalid(stNotifyOutboxModel *NotifyOutboxModel, errRender error) {
+	stNotifyOutboxModel.Status = NotifyStatus_Dead
+	stNotifyOutboxModel.DeadTs = stNotifyOutboxModel.CreatedTs
+	stNotifyOutboxModel.LastError = errRender.Error()
+	if len(stNotifyOutboxModel.LastError) > 500 {
+		stNotifyOutboxModel.LastError = stNotifyOutboxModel.LastError[:500]
+	}
+	stNotifyOutboxModel.LastErrType = NotifyErrType_Permanent
+	Printf("[NotifyAlarm]notify template invalid, err:%+v scene:%s channel:%s uid:%d LessonID:%s PackageID:%s\n", errRender,
+		stNotifyOutboxModel.Scene, stNotifyOutboxModel.Channel, stNotifyOutboxModel.Uid, stNotifyOutboxModel.LessonID, stNotifyOutboxModel.PackageID)
+}
+
+// permanentNotifyErr 本地就能确定重试也不会成功的错误，例如缺少接收人
+type permanentNotifyErr struct {
+	msg string
+}
+
+func (e *permanentNotifyErr) Error() string {
+	return e.msg
+}
+
+// 微信订阅消息中重试也不会成功的错误码
+var mapWxPermanentErrCode = map[int]bool{
+	40003: true, // touser不合法
+	40037: true, // 模板id不正确
+	41030: true, // page路径不正确
+	43101: true, // 用户拒绝接受消息（未订阅或订阅次数用完）
+	47003: true, // 模板参数不准确
+}
+
+// 短信中重试也不会成功的错误码
+var vecSmsPermanentErrCode = []string{
+	"InvalidParameterValue.IncorrectPhoneNumber",
+	"InvalidParameterValue.TemplateParameterFormatError",
+	"InvalidParameterValue.TemplateParameterLengthLimit",
+	"FailedOperation.PhoneNumberInBlacklist",
+	"FailedOperation.TemplateIncorrectOrUnapproved",
+	"UnsupportedOperation.ContainDomesticAndInternationalPhoneNumber",
+}
+
+var regWxErrCode = regexp.MustCompile(`code:(-?\d+)`)
+
+// classifyNotifyErr 判断发送失败是临时错误还是永久错误，无法识别的按临时错误处理
+func classifyNotifyErr(channel string, err error) string {
+	var permanentErr *permanentNotifyErr
+	if errors.As(err, &permanentErr) {
+		return NotifyErrType_Permanent
+	}
+	switch channel {
+	case NotifyChannel_Wx:
+		if vecMatch := regWxErrCode.FindStringSubmatch(err.Error()); len(vecMatch) == 2 {
+			if code, errConv := strconv.Atoi(vecMatch[1]); errConv == nil && mapWxPermanentErrCode[code] {
+				return NotifyErrType_Permanent
+			}
+		}
+	case NotifyChannel_Sms:
+		for _, code := range vecSmsPermanentErrCode {
+			if strings.Contains(err.Error(), code) {
+				return NotifyErrType_Permanent
+			}
+		}
+	}
+	return NotifyErrType_Transient
+}
+
+// calcNotifyRetryTs 第tryCnt次失败后的下一次重试时间
+func calcNotifyRetryTs(nowTs int64, tryCnt int) int64 {
+	delaySec := int64(notifyRetryBaseSec)
+	for i := 1; i < tryCnt && delaySec < notifyRetryMaxSec; i++ {
+		delaySec *= 2
+	}
+	if delaySec > notifyRetryMaxSec {
+		delaySec = notifyRetryMaxSec
+	}
+	return nowTs + delaySec
+}
+
+// sendNotifyOutbox 按渠道发送一条通知，返回实际生效的发送模式和发送结果说明
+func sendNotifyOutbox(stNotifyOutboxModel *NotifyOutboxModel) (string, string, error) {
+	switch stNotifyOutboxModel.Channel {
+	case NotifyChannel_Wx:
+		var stWxSendMsg2UserReq comm.WxSendMsg2UserReq
+		if err := json.Unmarshal([]byte(stNotifyOutboxModel.Payload), &stWxSendMsg2UserReq); err != nil {
+			return "", "", &permanentNotifyErr{msg: "invalid payload: " + err.Error()}
+		}
+		if stWxSendMsg2UserReq.ToUser == "" {
+			return "", "", &permanentNotifyErr{msg: "empty touser"}
+		}
+		if err := validateWxMsgData(stWxSendMsg2UserReq.Data); err != nil {
+			return "", "", &permanentNotifyErr{msg: err.Error()}
+		}
+		return sendWxMsg(stNotifyOutboxModel.Scene, stNotifyOutboxModel.Uid, stWxSendMsg2UserReq)
+	case NotifyChannel_Sms:
+		var vecTemplateParam []string
+		if err := json.Unmarshal([]byte(stNotifyOutboxModel.Payload), &vecTemplateParam); err != nil {
+			return "", "", &permanentNotifyErr{msg: "invalid payload: " + err.Error()}
+		}
+		if stNotifyOutboxModel.Phone == "" {
+			return "", "", &permanentNotifyErr{msg: "empty phone"}
+		}
+		return sendSmsMsg(stNotifyOutboxModel.Scene, stNotifyOutboxModel.TemplateID, stNotifyOutboxModel.Uid, vecTemplateParam, stNotifyOutboxModel.Phone)
+	}
+	return "", "", &permanentNotifyErr{msg: "unknown channel " + stNotifyOutboxModel.Channel}
+}
+
+// DeliverNotifyOutbox 投递任务：按id顺序发送已到重试时间的通知
+// 临时错误按指数退避重试，永久错误或重试次数用完后进入死信
+func DeliverNotifyOutbox(ctx context.Context) {
+	stat := getJobRunStat(ctx)
+	nowTs := time.Now().Unix()
+	preferenceLoader := newNotifyPreferenceLoader()
+	var begId int64
+	for ctx.Err() == nil {
+		vecNotifyOutboxModel, err := ImpNotifyOutbox.GetDueNotifyOutboxList(nowTs, begId, notifyOutboxBatchSize)
+		if err != nil {
+			Printf("DeliverNotifyOutbox GetDueNotifyOutboxList err, err:%+v begId:%d\n", err, begId)
+			stat.Fail(err)
+			return
+		}
+		for i := range vecNotifyOutboxModel {
+			if ctx.Err() != nil {
+				break
+			}
+			v := &vecNotifyOutboxModel[i]
+			begId = v.ID
+			stat.AddExamined(1)
+			if checkNotifyPreference(stat, preferenceLoader, v) && checkNotifySmsCap(stat, v) {
+				deliverOneNotify(stat, v)
+			}
+		}
+		if len(vecNotifyOutboxModel) < notifyOutboxBatchSize {
+			break
+		}
+	}
+}
+
+// checkNotifyPreference 按接收人的偏好检查能否现在发送，不能发送时更新通知状态并返回false
+// 关闭了渠道的不发送，免打扰时段内的推迟到时段结束，不计入重试次数；开课前提醒这类有时效的场景不受免打扰限制
+func checkNotifyPreference(stat *JobRunStat, preferenceLoader *notifyPreferenceLoader, stNotifyOutboxModel *NotifyOutboxModel) bool {
+	stPreference, err := preferenceLoader.get(stNotifyOutboxModel.RecipientType, stNotifyOutboxModel.RecipientID)
+	if err != nil {
+		// 查不到偏好时本次不发送，下次投递再试
+		Printf("[NotifyOutbox]get preference err, err:%+v id:%d recipient:%s:%d\n", err, stNotifyOutboxModel.ID, stNotifyOutboxModel.RecipientType, stNotifyOutboxModel.RecipientID)
+		stat.AddError(err)
+		return false
+	}
+
+	nowTs := time.Now().Unix()
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["updated_ts"] = nowTs
+	if allowed, reason := checkChannelAllowed(stPreference, stNotifyOutboxModel.Channel); !allowed {
+		mapUpdates["status"] = NotifyStatus_Skipped
+		mapUpdates["last_error"] = reason
+		Printf("[NotifyOutbox]skip by preference, reason:%s id:%d scene:%s channel:%s recipient:%s:%d\n", reason,
+			stNotifyOutboxModel.ID, stNotifyOutboxModel.Scene, stNotifyOutboxModel.Channel, stNotifyOutboxModel.RecipientType, stNotifyOutboxModel.RecipientID)
+	} else if mapQuietExemptScene[stNotifyOutboxModel.Scene] {
+		return true
+	} else if quietEndTs, inQuiet := calcQuietEndTs(stPreference, time.Unix(nowTs, 0)); inQuiet {
+		mapUpdates["next_try_ts"] = quietEndTs
+		mapUpdates["defer_cnt"] = stNotifyOutboxModel.DeferCnt + 1
+		Printf("[NotifyOutbox]defer by quiet hours, id:%d scene:%s channel:%s recipient:%s:%d nextTryTs:%d\n",
+			stNotifyOutboxModel.ID, stNotifyOutboxModel.Scene, stNotifyOutboxModel.Channel, stNotifyOutboxModel.RecipientType, stNotifyOutboxModel.RecipientID, quietEndTs)
+	} else {
+		return true
+	}
+
+	updated, err := ImpNotifyOutbox.UpdatePendingNotifyOutbox(stNotifyOutboxModel.ID, mapUpdates)
+	if err != nil {
+		Printf("[NotifyOutbox]UpdatePendingNotifyOutbox err, err:%+v id:%d\n", err, stNotifyOutboxModel.ID)
+		stat.AddError(err)
+		return false
+	}
+	// 接收人关闭了微信时改发备用短信
+	if updated && mapUpdates["status"] == NotifyStatus_Skipped {
+		activateFallbackNotify(stat, stNotifyOutboxModel)
+	}
+	return false
+}
+
+// checkNotifySmsCap 学员手机号当天的短信达到上限时不再发送，返回false
+// 只限制发给学员的短信，教练的旷课补核销提醒等工作短信不受限制
+func checkNotifySmsCap(stat *JobRunStat, stNotifyOutboxModel *NotifyOutboxModel) bool {
+	if stNotifyOutboxModel.Channel != NotifyChannel_Sms || stNotifyOutboxModel.RecipientType != NotifyRecipient_User {
+		return true
+	}
+	allowed, err := checkSmsDailyCap(stNotifyOutboxModel.Phone, time.Now())
+	if err != nil {
+		// 查不到当天的发送量时本次不发送，下次投递再试
+		Printf("[NotifyOutbox]count sms err, err:%+v id:%d\n", err, stNotifyOutboxModel.ID)
+		stat.AddError(err)
+		return false
+	}
+	if allowed {
+		return true
+	}
+
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["status"] = NotifyStatus_Skipped
+	mapUpdates["last_error"] = "daily sms cap reached"
+	mapUpdates["updated_ts"] = time.Now().Unix()
+	Printf("[NotifyOutbox]skip by daily sms cap, id:%d scene:%s uid:%d phone:%s\n",
+		stNotifyOutboxModel.ID, stNotifyOutboxModel.Scene, stNotifyOutboxModel.Uid, stNotifyOutboxModel.Phone)
+	if _, err := ImpNotifyOutbox.UpdatePendingNotifyOutbox(stNotifyOutboxModel.ID, mapUpdates); err != nil {
+		Printf("[NotifyOutbox]UpdatePendingNotifyOutbox err, err:%+v id:%d\n", err, stNotifyOutboxModel.ID)
+		stat.AddError(err)
+	}
+	return false
+}
+
+func deliverOneNotify(stat *JobRunStat, stNotifyOutboxModel *NotifyOutboxModel) {
+	begTime := time.Now()
+	nowTs := begTime.Unix()
+	tryCnt := stNotifyOutboxModel.TryCnt + 1
+	mode, response, errSend := sendNotifyOutbox(stNotifyOutboxModel)
+	stNotifyAttemptModel := newNotifyAttemptFromOutbox(stNotifyOutboxModel, tryCnt, begTime)
+
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["try_cnt"] = tryCnt
+	mapUpdates["updated_ts"] = nowTs
+	if errSend == nil {
+		mapUpdates["status"] = NotifyStatus_Sent
+		mapUpdates["sent_ts"] = nowTs
+		mapUpdates["delivered_channel"] = stNotifyOutboxModel.Channel
+		stat.AddNotified(1)
+		Printf("[NotifyOutbox]send succ, id:%d scene:%s channel:%s uid:%d LessonID:%s\n",
+			stNotifyOutboxModel.ID, stNotifyOutboxModel.Scene, stNotifyOutboxModel.Channel, stNotifyOutboxModel.Uid, stNotifyOutboxModel.LessonID)
+	} else {
+		errType := classifyNotifyErr(stNotifyOutboxModel.Channel, errSend)
+		lastError := errSend.Error()
+		if len(lastError) > 500 {
+			lastError = lastError[:500]
+		}
+		mapUpdates["last_error"] = lastError
+		mapUpdates["last_err_type"] = errType
+		stNotifyAttemptModel.ErrType = errType
+		if errType == NotifyErrType_Permanent || tryCnt >= notifyOutboxMaxTryCnt {
+			mapUpdates["status"] = NotifyStatus_Dead
+			mapUpdates["dead_ts"] = nowTs
+			Printf("[NotifyAlarm]notify dead, err:%+v errType:%s id:%d scene:%s channel:%s uid:%d LessonID:%s tryCnt:%d\n",
+				errSend, errType, stNotifyOutboxModel.ID, stNotifyOutboxModel.Scene, stNotifyOutboxModel.Channel, stNotifyOutboxModel.Uid, stNotifyOutboxModel.LessonID, tryCnt)
+		} else {
+			mapUpdates["next_try_ts"] = calcNotifyRetryTs(nowTs, tryCnt)
+			Printf("[NotifyOutbox]send err, will retry, err:%+v id:%d scene:%s channel:%s uid:%d LessonID:%s tryCnt:%d\n",
+				errSend, stNotifyOutboxModel.ID, stNotifyOutboxModel.Scene, stNotifyOutboxModel.Channel, stNotifyOutboxModel.Uid, stNotifyOutboxModel.LessonID, tryCnt)
+		}
+		stat.AddError(errSend)
+	}
+
+	recordNotifyAttempt(stNotifyAttemptModel, mode, response, errSend)
+
+	// 微信第一次被永久拒绝就启用备用短信，不依赖通知状态是否更新成功
+	permanentRejected := errSend != nil && stNotifyAttemptModel.ErrType == NotifyErrType_Permanent
+	if permanentRejected {
+		activateFallbackNotify(stat, stNotifyOutboxModel)
+	}
+
+	updated, err := ImpNotifyOutbox.UpdatePendingNotifyOutbox(stNotifyOutboxModel.ID, mapUpdates)
+	if err != nil {
+		Printf("[NotifyOutbox]UpdatePendingNotifyOutbox err, err:%+v id:%d\n", err, stNotifyOutboxModel.ID)
+		stat.AddError(err)
+		return
+	}
+	if !updated {
+		return
+	}
+	switch mapUpdates["status"] {
+	case NotifyStatus_Sent:
+		cancelFallbackNotify(stat, stNotifyOutboxModel)
+		// 备用短信送达后，在微信通知上记录实际送达的渠道
+		if stNotifyOutboxModel.FallbackOf != "" {
+			mapPrimaryUpdates := make(map[string]interface{})
+			mapPrimaryUpdates["delivered_channel"] = stNotifyOutboxModel.Channel
+			if err := ImpNotifyOutbox.UpdateNotifyOutboxByBizKey(stNotifyOutboxModel.FallbackOf, mapPrimaryUpdates); err != nil {
+				Printf("[NotifyOutbox]UpdateNotifyOutboxByBizKey err, err:%+v BizKey:%s\n", err, stNotifyOutboxModel.FallbackOf)
+				stat.AddError(err)
+			}
+		}
+	case NotifyStatus_Dead:
+		if !permanentRejected {
+			activateFallbackNotify(stat, stNotifyOutboxModel)
+		}
+	}
+}
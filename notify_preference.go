@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/db"
+	"github.com/xionghengheng/ff_plib/db/dao"
+)
+
+// 通知接收人类型，偏好按接收人设置
+const (
+	NotifyRecipient_Default = "default" // 全局默认偏好，没有单独设置的接收人使用，owner_id固定为0
+	NotifyRecipient_User    = "user"    // 学员，owner_id为uid
+	NotifyRecipient_Coach   = "coach"   // 教练，owner_id为教练id
+)
+
+// 内置默认偏好的免打扰时段：22:00到次日08:00，内置默认偏好不开启免打扰，只作为展示的默认时段
+const (
+	defaultNotifyQuietBegMin = 22 * 60
+	defaultNotifyQuietEndMin = 8 * 60
+)
+
+// 免打扰时段按北京时间计算，和服务器所在时区无关
+var notifyLocation = loadNotifyLocation()
+
+func loadNotifyLocation() *time.Location {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// NotifyPreferenceModel 通知接收人的偏好
+type NotifyPreferenceModel struct {
+	ID           int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`                       // 主键ID
+	OwnerType    string `json:"owner_type" gorm:"type:varchar(16);unique_index:uniq_owner"` // 接收人类型
+	OwnerID      int64  `json:"owner_id" gorm:"unique_index:uniq_owner"`                    // 接收人id
+	WxEnabled    bool   `json:"wx_enabled"`                                                 // 接收小程序订阅消息
+	SmsEnabled   bool   `json:"sms_enabled"`                                                // 接收短信
+	SmsOptOut    bool   `json:"sms_opt_out"`                                                // 本人退订了短信，和渠道开关分开记录，便于区分原因
+	QuietEnabled bool   `json:"quiet_enabled"`                                              // 是否开启免打扰
+	QuietBegMin  int    `json:"quiet_beg_min"`                                              // 免打扰开始时间，当天的第几分钟
+	QuietEndMin  int    `json:"quiet_end_min"`                                              // 免打扰结束时间，小于开始时间表示跨天
+	UpdatedBy    string `json:"updated_by" gorm:"type:varchar(64)"`                         // 最后修改人
+	UpdatedTs    int64  `json:"updated_ts"`                                                 // 最后修改时间
+}
+
+const notify_preference_tableName = "notify_preference"
+
+// NotifyPreferenceInterface 通知偏好数据模型接口
+type NotifyPreferenceInterface interface {
+	// 获取接收人的偏好，没有设置时返回nil
+	GetNotifyPreference(ownerType string, ownerId int64) (*NotifyPreferenceModel, error)
+
+	// 保存接收人的偏好，已存在时覆盖
+	SaveNotifyPreference(stNotifyPreferenceModel *NotifyPreferenceModel) error
+
+	// 查询设置过的偏好，按id升序，条件为空不过滤
+	GetNotifyPreferenceList(ownerType string, offset int, limit int) ([]NotifyPreferenceModel, error)
+}
+
+// NotifyPreferenceInterfaceImp 通知偏好数据模型实现
+type NotifyPreferenceInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpNotifyPreference NotifyPreferenceInterface = &NotifyPreferenceInterfaceImp{}
+
+func (imp *NotifyPreferenceInterfaceImp) GetNotifyPreference(ownerType string, ownerId int64) (*NotifyPreferenceModel, error) {
+	var stNotifyPreferenceModel NotifyPreferenceModel
+	cli := db.Get()
+	err := cli.Table(notify_preference_tableName).Where("owner_type = ? AND owner_id = ?", ownerType, ownerId).First(&stNotifyPreferenceModel).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &stNotifyPreferenceModel, nil
+}
+
+func (imp *NotifyPreferenceInterfaceImp) SaveNotifyPreference(stNotifyPreferenceModel *NotifyPreferenceModel) error {
+	cli := db.Get()
+	return cli.Table(notify_preference_tableName).Save(stNotifyPreferenceModel).Error
+}
+
+func (imp *NotifyPreferenceInterfaceImp) GetNotifyPreferenceList(ownerType string, offset int, limit int) ([]NotifyPreferenceModel, error) {
+	var vecNotifyPreferenceModel []NotifyPreferenceModel
+	cli := db.Get().Table(notify_preference_tableName)
+	if ownerType != "" {
+		cli = cli.Where("owner_type = ?", ownerType)
+	}
+	err := cli.Order("id ASC").Offset(offset).Limit(limit).Find(&vecNotifyPreferenceModel).Error
+	return vecNotifyPreferenceModel, err
+}
+
+// builtinNotifyPreference 没有任何设置时的偏好：所有渠道都接收，不开启免打扰，和上线前的发送行为一致
+func builtinNotifyPreference() NotifyPreferenceModel {
+	return NotifyPreferenceModel{
+		OwnerType:    NotifyRecipient_Default,
+		WxEnabled:    true,
+		SmsEnabled:   true,
+		QuietEnabled: false,
+		QuietBegMin:  defaultNotifyQuietBegMin,
+		QuietEndMin:  defaultNotifyQuietEndMin,
+	}
+}
+
+// getEffectiveNotifyPreference 接收人生效的偏好：本人设置 > 全局默认设置 > 内置默认值
+func getEffectiveNotifyPreference(ownerType string, ownerId int64) (NotifyPreferenceModel, error) {
+	if ownerType != "" && ownerType != NotifyRecipient_Default && ownerId > 0 {
+		stNotifyPreferenceModel, err := ImpNotifyPreference.GetNotifyPreference(ownerType, ownerId)
+		if err != nil {
+			return NotifyPreferenceModel{}, err
+		}
+		if stNotifyPreferenceModel != nil {
+			return *stNotifyPreferenceModel, nil
+		}
+	}
+	stNotifyPreferenceModel, err := ImpNotifyPreference.GetNotifyPreference(NotifyRecipient_Default, 0)
+	if err != nil {
+		return NotifyPreferenceModel{}, err
+	}
+	if stNotifyPreferenceModel != nil {
+		return *stNotifyPreferenceModel, nil
+	}
+	return builtinNotifyPreference(), nil
+}
+
+// mapQuietExemptScene 不受免打扰限制的场景：开课前的提醒推迟到时段结束后课程可能已经开始，推迟没有意义
+var mapQuietExemptScene = map[string]bool{
+	NotifyScene_LessonStartRemind:   true,
+	NotifyScene_PassCardStartRemind: true,
+}
+
+// calcQuietEndTs 当前时间在免打扰时段内时，返回时段结束的时间
+func calcQuietEndTs(stPreference NotifyPreferenceModel, now time.Time) (int64, bool) {
+	if !stPreference.QuietEnabled || stPreference.QuietBegMin == stPreference.QuietEndMin {
+		return 0, false
+	}
+	t := now.In(notifyLocation)
+	nowMin := t.Hour()*60 + t.Minute()
+	begMin, endMin := stPreference.QuietBegMin, stPreference.QuietEndMin
+	var inQuiet bool
+	if begMin < endMin {
+		inQuiet = nowMin >= begMin && nowMin < endMin
+	} else {
+		inQuiet = nowMin >= begMin || nowMin < endMin
+	}
+	if !inQuiet {
+		return 0, false
+	}
+	endTime := time.Date(t.Year(), t.Month(), t.Day(), endMin/60, endMin%60, 0, 0, notifyLocation)
+	if !endTime.After(t) {
+		endTime = endTime.AddDate(0, 0, 1)
+	}
+	return endTime.Unix(), true
+}
+
+// checkChannelAllowed 接收人是否接收该渠道的通知，不接收时返回原因
+func checkChannelAllowed(stPreference NotifyPreferenceModel, channel string) (bool, string) {
+	switch channel {
+	case NotifyChannel_Wx:
+		if !stPreference.WxEnabled {
+			return false, "wx disabled by preference"
+		}
+	case NotifyChannel_Sms:
+		if stPreference.SmsOptOut {
+			return false, "sms opt-out"
+		}
+		if !stPreference.SmsEnabled {
+			return false, "sms disabled by preference"
+		}
+	}
+	return true, ""
+}
+
+// notifyPreferenceLoader 一次投递内缓存接收人的偏好，避免同一个人的多条通知重复查库
+type notifyPreferenceLoader struct {
+	mapPreference map[string]NotifyPreferenceModel
+}
+
+func newNotifyPreferenceLoader() *notifyPreferenceLoader {
+	return &notifyPreferenceLoader{mapPreference: make(map[string]NotifyPreferenceModel)}
+}
+
+func (l *notifyPreferenceLoader) get(ownerType string, ownerId int64) (NotifyPreferenceModel, error) {
+	key := fmt.Sprintf("%s:%d", ownerType, ownerId)
+	if stPreference, ok := l.mapPreference[key]; ok {
+		return stPreference, nil
+	}
+	stPreference, err := getEffectiveNotifyPreference(ownerType, ownerId)
+	if err != nil {
+		return stPreference, err
+	}
+	l.mapPreference[key] = stPreference
+	return stPreference, nil
+}
+
+// parseQuietTime 解析 HH:MM 格式的时间，返回当天的第几分钟
+func parseQuietTime(str string) (int, error) {
+	t, err := time.Parse("15:04", str)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func formatQuietTime(minute int) string {
+	return fmt.Sprintf("%02d:%02d", minute/60, minute%60)
+}
+
+// NotifyPreferenceItem 通知偏好
+type NotifyPreferenceItem struct {
+	OwnerType    string `json:"owner_type"`    // 接收人类型：default/user/coach
+	OwnerID      int64  `json:"owner_id"`      // 接收人id，default为0
+	WxEnabled    bool   `json:"wx_enabled"`    // 接收小程序订阅消息
+	SmsEnabled   bool   `json:"sms_enabled"`   // 接收短信
+	SmsOptOut    bool   `json:"sms_opt_out"`   // 本人退订了短信
+	QuietEnabled bool   `json:"quiet_enabled"` // 是否开启免打扰，免打扰时段内的通知推迟到时段结束后发送
+	QuietBeg     string `json:"quiet_beg"`     // 免打扰开始时间，如 22:00
+	QuietEnd     string `json:"quiet_end"`     // 免打扰结束时间，如 08:00，小于开始时间表示跨天
+	UpdatedBy    string `json:"updated_by"`    // 最后修改人
+	UpdatedTs    int64  `json:"updated_ts"`    // 最后修改时间
+}
+
+func convertNotifyPreference2Item(stNotifyPreferenceModel NotifyPreferenceModel) NotifyPreferenceItem {
+	return NotifyPreferenceItem{
+		OwnerType:    stNotifyPreferenceModel.OwnerType,
+		OwnerID:      stNotifyPreferenceModel.OwnerID,
+		WxEnabled:    stNotifyPreferenceModel.WxEnabled,
+		SmsEnabled:   stNotifyPreferenceModel.SmsEnabled,
+		SmsOptOut:    stNotifyPreferenceModel.SmsOptOut,
+		QuietEnabled: stNotifyPreferenceModel.QuietEnabled,
+		QuietBeg:     formatQuietTime(stNotifyPreferenceModel.QuietBegMin),
+		QuietEnd:     formatQuietTime(stNotifyPreferenceModel.QuietEndMin),
+		UpdatedBy:    stNotifyPreferenceModel.UpdatedBy,
+		UpdatedTs:    stNotifyPreferenceModel.UpdatedTs,
+	}
+}
+
+type GetNotifyPreferenceListReq struct {
+	OwnerType string `json:"owner_type"` // 接收人类型，为空不过滤
+	OwnerID   int64  `json:"owner_id"`   // 接收人id，和owner_type一起传时返回该接收人生效的偏好
+	Passback  string `json:"passback"`   // 翻页标记，首次请求传空字符串，后续传上次返回的passback
+	PageSize  int    `json:"page_size"`  // 每页数量
+}
+
+type GetNotifyPreferenceListRsp struct {
+	Code      int                    `json:"code"`
+	ErrorMsg  string                 `json:"errorMsg,omitempty"`
+	List      []NotifyPreferenceItem `json:"list,omitempty"`      // 设置过的偏好
+	Effective *NotifyPreferenceItem  `json:"effective,omitempty"` // 指定接收人时，该接收人生效的偏好
+	Passback  string                 `json:"passback"`            // 下一页的翻页标记，为空字符串表示没有更多数据
+}
+
+func getGetNotifyPreferenceListReq(r *http.Request) (GetNotifyPreferenceListReq, error) {
+	req := GetNotifyPreferenceListReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// GetNotifyPreferenceListHandler 查询通知偏好，指定接收人时同时返回生效的偏好
+func GetNotifyPreferenceListHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getGetNotifyPreferenceListReq(r)
+	rsp := &GetNotifyPreferenceListRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetNotifyPreferenceListHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if req.OwnerType != "" && req.OwnerID > 0 {
+		stPreference, err := getEffectiveNotifyPreference(req.OwnerType, req.OwnerID)
+		if err != nil {
+			rsp.Code = -911
+			rsp.ErrorMsg = "查询通知偏好失败"
+			Printf("GetNotifyPreferenceListHandler getEffectiveNotifyPreference err, err:%+v req:%+v\n", err, req)
+			return
+		}
+		stItem := convertNotifyPreference2Item(stPreference)
+		rsp.Effective = &stItem
+	}
+
+	var offset int64
+	if len(req.Passback) > 0 {
+		offset, _ = strconv.ParseInt(req.Passback, 10, 64)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	pageSize := req.PageSize
+	if pageSize <= 0 {
+		pageSize = 20 // 默认每页20条
+	}
+	if pageSize > 100 {
+		pageSize = 100 // 最大每页100条
+	}
+
+	vecNotifyPreferenceModel, err := ImpNotifyPreference.GetNotifyPreferenceList(req.OwnerType, int(offset), pageSize)
+	if err != nil {
+		rsp.Code = -922
+		rsp.ErrorMsg = "查询通知偏好失败"
+		Printf("GetNotifyPreferenceListHandler GetNotifyPreferenceList err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	for _, v := range vecNotifyPreferenceModel {
+		rsp.List = append(rsp.List, convertNotifyPreference2Item(v))
+	}
+	if len(vecNotifyPreferenceModel) == pageSize {
+		rsp.Passback = strconv.FormatInt(offset+int64(pageSize), 10)
+	}
+	rsp.Code = 0
+	Printf("GetNotifyPreferenceListHandler success, offset:%d count:%d\n", offset, len(rsp.List))
+	return
+}
+
+type SetNotifyPreferenceReq struct {
+	OwnerType    string `json:"owner_type"`    // 接收人类型：default/user/coach
+	OwnerID      int64  `json:"owner_id"`      // 接收人id，default传0
+	WxEnabled    bool   `json:"wx_enabled"`    // 接收小程序订阅消息
+	SmsEnabled   bool   `json:"sms_enabled"`   // 接收短信
+	SmsOptOut    bool   `json:"sms_opt_out"`   // 本人退订了短信
+	QuietEnabled bool   `json:"quiet_enabled"` // 是否开启免打扰
+	QuietBeg     string `json:"quiet_beg"`     // 免打扰开始时间，HH:MM
+	QuietEnd     string `json:"quiet_end"`     // 免打扰结束时间，HH:MM
+}
+
+type SetNotifyPreferenceRsp struct {
+	Code     int    `json:"code"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+}
+
+func getSetNotifyPreferenceReq(r *http.Request) (SetNotifyPreferenceReq, error) {
+	req := SetNotifyPreferenceReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// SetNotifyPreferenceHandler 设置接收人或全局默认的通知偏好，下一次投递时生效
+func SetNotifyPreferenceHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getSetNotifyPreferenceReq(r)
+	rsp := &SetNotifyPreferenceRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("SetNotifyPreferenceHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	switch req.OwnerType {
+	case NotifyRecipient_Default:
+		if req.OwnerID != 0 {
+			rsp.Code = -996
+			rsp.ErrorMsg = "全局默认偏好的接收人id必须为0"
+			return
+		}
+	case NotifyRecipient_User:
+		if req.OwnerID <= 0 {
+			rsp.Code = -996
+			rsp.ErrorMsg = "用户id不合法"
+			return
+		}
+		if _, err := dao.ImpUser.GetUser(req.OwnerID); err != nil {
+			rsp.Code = -911
+			rsp.ErrorMsg = "用户不存在"
+			Printf("SetNotifyPreferenceHandler GetUser err, err:%+v uid:%d\n", err, req.OwnerID)
+			return
+		}
+	case NotifyRecipient_Coach:
+		if req.OwnerID <= 0 {
+			rsp.Code = -996
+			rsp.ErrorMsg = "教练id不合法"
+			return
+		}
+		if _, err := dao.ImpCoach.GetCoachById(int(req.OwnerID)); err != nil {
+			rsp.Code = -911
+			rsp.ErrorMsg = "教练不存在"
+			Printf("SetNotifyPreferenceHandler GetCoachById err, err:%+v coachId:%d\n", err, req.OwnerID)
+			return
+		}
+	default:
+		rsp.Code = -996
+		rsp.ErrorMsg = "接收人类型不合法"
+		return
+	}
+
+	stNotifyPreferenceModel := &NotifyPreferenceModel{
+		OwnerType:    req.OwnerType,
+		OwnerID:      req.OwnerID,
+		WxEnabled:    req.WxEnabled,
+		SmsEnabled:   req.SmsEnabled,
+		SmsOptOut:    req.SmsOptOut,
+		QuietEnabled: req.QuietEnabled,
+		UpdatedBy:    authResult.Operator,
+		UpdatedTs:    time.Now().Unix(),
+	}
+	if req.QuietEnabled {
+		stNotifyPreferenceModel.QuietBegMin, err = parseQuietTime(req.QuietBeg)
+		if err == nil {
+			stNotifyPreferenceModel.QuietEndMin, err = parseQuietTime(req.QuietEnd)
+		}
+		if err != nil || stNotifyPreferenceModel.QuietBegMin == stNotifyPreferenceModel.QuietEndMin {
+			rsp.Code = -996
+			rsp.ErrorMsg = "免打扰时段不合法，格式为HH:MM，开始和结束时间不能相同"
+			return
+		}
+	}
+
+	before, err := ImpNotifyPreference.GetNotifyPreference(req.OwnerType, req.OwnerID)
+	if err != nil {
+		rsp.Code = -922
+		rsp.ErrorMsg = "查询通知偏好失败"
+		Printf("SetNotifyPreferenceHandler GetNotifyPreference err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	if before != nil {
+		stNotifyPreferenceModel.ID = before.ID
+	}
+	if err := ImpNotifyPreference.SaveNotifyPreference(stNotifyPreferenceModel); err != nil {
+		rsp.Code = -933
+		rsp.ErrorMsg = "保存通知偏好失败"
+		Printf("SetNotifyPreferenceHandler SaveNotifyPreference err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	AddAuditChange(r, "notify_preference", fmt.Sprintf("%s:%d", req.OwnerType, req.OwnerID), before, stNotifyPreferenceModel)
+
+	rsp.Code = 0
+	Printf("SetNotifyPreferenceHandler success, req:%+v operator:%s\n", req, authResult.Operator)
+	return
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/db"
+)
+
+// 通知的发送渠道策略
+const (
+	NotifyRoute_WxOnly  = "wx_only"  // 只发微信
+	NotifyRoute_WxFirst = "wx_first" // 先发微信，微信被拒绝（如未订阅）或被偏好关闭时改发短信
+	NotifyRoute_Both    = "both"     // 微信和短信都发
+	NotifyRoute_SmsOnly = "sms_only" // 只发短信
+)
+
+// 各场景内置的发送渠道策略，没有列出的场景只发微信；数据库 notify_route_policy 里有同场景的配置时以数据库为准
+// 开课前提醒一直是微信和短信都发，保持不变；通卡锻炼提醒复用开课前提醒的短信模板，微信发不出去时改发短信
+// 评价提醒在 comm 中没有合适的短信模板，默认只发微信，在数据库 notify_template 中配置短信模板后才能改为发短信
+var mapDefaultNotifyRoute = map[string]string{
+	NotifyScene_LessonStartRemind:   NotifyRoute_Both,
+	NotifyScene_PassCardStartRemind: NotifyRoute_WxFirst,
+}
+
+// 可配置策略的场景对应的短信模板，策略需要发短信时模板必须存在
+// 评价提醒的短信模板没有内置定义，需要先在数据库 notify_template 中配置
+var mapRouteSmsTemplate = map[string]string{
+	NotifyScene_LessonStartRemind:   NotifyTemplate_LessonStartRemindSms,
+	NotifyScene_LessonCommentRemind: NotifyTemplate_LessonCommentRemindSms,
+	NotifyScene_PassCardStartRemind: NotifyTemplate_PassCardStartRemindSms,
+}
+
+// 可以配置策略的场景，发给学员、同时有微信和短信模板的场景才有意义
+var vecRoutableNotifyScene = []string{
+	NotifyScene_LessonStartRemind,
+	NotifyScene_LessonCommentRemind,
+	NotifyScene_PassCardStartRemind,
+}
+
+// 策略缓存的刷新间隔
+const notifyRouteReloadSec = 60
+
+// 默认每个手机号每天最多发送的短信条数，可通过环境变量 NOTIFY_SMS_DAILY_CAP 配置
+const defaultNotifySmsDailyCap = 5
+
+// getNotifySmsDailyCap 每个手机号每天最多发送的短信条数，超出的短信不再发送
+func getNotifySmsDailyCap() int {
+	strCap := os.Getenv("NOTIFY_SMS_DAILY_CAP")
+	if strCap == "" {
+		return defaultNotifySmsDailyCap
+	}
+	smsCap, err := strconv.Atoi(strCap)
+	if err != nil || smsCap < 0 {
+		Printf("getNotifySmsDailyCap invalid NOTIFY_SMS_DAILY_CAP:%s, use default\n", strCap)
+		return defaultNotifySmsDailyCap
+	}
+	return smsCap
+}
+
+// NotifyRoutePolicyModel 场景的发送渠道策略配置
+type NotifyRoutePolicyModel struct {
+	ID        int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`       // 主键ID
+	Scene     string `json:"scene" gorm:"type:varchar(32);unique_index"` // 通知场景
+	Policy    string `json:"policy" gorm:"type:varchar(16)"`             // 发送渠道策略
+	UpdatedBy string `json:"updated_by" gorm:"type:varchar(64)"`         // 最后修改人
+	UpdatedTs int64  `json:"updated_ts"`                                 // 最后修改时间
+}
+
+const notify_route_policy_tableName = "notify_route_policy"
+
+// NotifyRoutePolicyInterface 发送渠道策略数据模型接口
+type NotifyRoutePolicyInterface interface {
+	// 获取全部场景的策略配置
+	GetAllNotifyRoutePolicy() ([]NotifyRoutePolicyModel, error)
+
+	// 获取场景的策略配置，没有配置时返回nil
+	GetNotifyRoutePolicy(scene string) (*NotifyRoutePolicyModel, error)
+
+	// 保存场景的策略配置，已存在时覆盖
+	SaveNotifyRoutePolicy(stNotifyRoutePolicyModel *NotifyRoutePolicyModel) error
+}
+
+// NotifyRoutePolicyInterfaceImp 发送渠道策略数据模型实现
+type NotifyRoutePolicyInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpNotifyRoutePolicy NotifyRoutePolicyInterface = &NotifyRoutePolicyInterfaceImp{}
+
+func (imp *NotifyRoutePolicyInterfaceImp) GetAllNotifyRoutePolicy() ([]NotifyRoutePolicyModel, error) {
+	var vecNotifyRoutePolicyModel []NotifyRoutePolicyModel
+	cli := db.Get()
+	err := cli.Table(notify_route_policy_tableName).Find(&vecNotifyRoutePolicyModel).Error
+	return vecNotifyRoutePolicyModel, err
+}
+
+func (imp *NotifyRoutePolicyInterfaceImp) GetNotifyRoutePolicy(scene string) (*NotifyRoutePolicyModel, error) {
+	var stNotifyRoutePolicyModel NotifyRoutePolicyModel
+	cli := db.Get()
+	err := cli.Table(notify_route_policy_tableName).Where("scene = ?", scene).First(&stNotifyRoutePolicyModel).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &stNotifyRoutePolicyModel, nil
+}
+
+func (imp *NotifyRoutePolicyInterfaceImp) SaveNotifyRoutePolicy(stNotifyRoutePolicyModel *NotifyRoutePolicyModel) error {
+	cli := db.Get()
+	return cli.Table(notify_route_policy_tableName).Save(stNotifyRoutePolicyModel).Error
+}
+
+func isValidNotifyRoute(policy string) bool {
+	switch policy {
+	case NotifyRoute_WxOnly, NotifyRoute_WxFirst, NotifyRoute_Both, NotifyRoute_SmsOnly:
+		return true
+	}
+	return false
+}
+
+func isRoutableNotifyScene(scene string) bool {
+	for _, v := range vecRoutableNotifyScene {
+		if v == scene {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotifyRoutePolicy 策略需要发短信时，场景必须有短信模板
+func checkNotifyRoutePolicy(scene string, policy string) error {
+	if !isValidNotifyRoute(policy) {
+		return fmt.Errorf("invalid policy %s", policy)
+	}
+	if policy == NotifyRoute_WxOnly {
+		return nil
+	}
+	if templateName := mapRouteSmsTemplate[scene]; templateName == "" || !notifyTemplates.has(templateName) {
+		return fmt.Errorf("scene %s has no sms template for policy %s", scene, policy)
+	}
+	return nil
+}
+
+// CheckNotifyRoutes 启动时检查内置和数据库中的策略，需要发短信但没有短信模板的拒绝启动
+func CheckNotifyRoutes() error {
+	mapPolicy := make(map[string]string)
+	for k, v := range mapDefaultNotifyRoute {
+		mapPolicy[k] = v
+	}
+	vecNotifyRoutePolicyModel, err := ImpNotifyRoutePolicy.GetAllNotifyRoutePolicy()
+	if err != nil {
+		return err
+	}
+	for _, v := range vecNotifyRoutePolicyModel {
+		mapPolicy[v.Scene] = v.Policy
+	}
+	for scene, policy := range mapPolicy {
+		if err := checkNotifyRoutePolicy(scene, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyRouteRegistry 发送渠道策略：内置策略叠加数据库配置，定期刷新
+type notifyRouteRegistry struct {
+	mu        sync.Mutex
+	mapPolicy map[string]string
+	loadTs    int64
+}
+
+var notifyRoutes = &notifyRouteRegistry{}
+
+// get 场景生效的策略，数据库读取失败时沿用上一次的结果
+func (r *notifyRouteRegistry) get(scene string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	nowTs := time.Now().Unix()
+	if r.mapPolicy == nil || nowTs-r.loadTs >= notifyRouteReloadSec {
+		r.loadTs = nowTs
+		vecNotifyRoutePolicyModel, err := ImpNotifyRoutePolicy.GetAllNotifyRoutePolicy()
+		if err != nil {
+			Printf("[NotifyAlarm]GetAllNotifyRoutePolicy err, keep last policies, err:%+v\n", err)
+		}
+		if err == nil || r.mapPolicy == nil {
+			mapPolicy := make(map[string]string)
+			for k, v := range mapDefaultNotifyRoute {
+				mapPolicy[k] = v
+			}
+			for _, v := range vecNotifyRoutePolicyModel {
+				if err := checkNotifyRoutePolicy(v.Scene, v.Policy); err != nil {
+					Printf("[NotifyAlarm]notify route policy invalid, ignored, err:%+v scene:%s policy:%s\n", err, v.Scene, v.Policy)
+					continue
+				}
+				mapPolicy[v.Scene] = v.Policy
+			}
+			r.mapPolicy = mapPolicy
+		}
+	}
+	if policy, ok := r.mapPolicy[scene]; ok {
+		return policy
+	}
+	return NotifyRoute_WxOnly
+}
+
+// invalidate 本实例修改策略后立即生效
+func (r *notifyRouteRegistry) invalidate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mapPolicy = nil
+}
+
+// routeNotifyOutbox 按场景的策略决定同一条通知的微信和短信怎么发，返回要写入发件箱的通知
+// 微信或短信为nil表示没有这个渠道（例如用户没有手机号、没有短信模板），此时只能发另一个渠道
+// wx_first 的短信先以备用状态写入，微信被拒绝或被偏好关闭时由投递任务启用
+func routeNotifyOutbox(scene string, stWxOutbox *NotifyOutboxModel, stSmsOutbox *NotifyOutboxModel) []*NotifyOutboxModel {
+	if stWxOutbox == nil || stSmsOutbox == nil {
+		return []*NotifyOutboxModel{stWxOutbox, stSmsOutbox}
+	}
+	switch notifyRoutes.get(scene) {
+	case NotifyRoute_Both:
+		return []*NotifyOutboxModel{stWxOutbox, stSmsOutbox}
+	case NotifyRoute_SmsOnly:
+		return []*NotifyOutboxModel{stSmsOutbox}
+	case NotifyRoute_WxFirst:
+		stSmsOutbox.FallbackOf = stWxOutbox.BizKey
+		// 微信模板不合法时已经是死信，短信直接发送
+		if stWxOutbox.Status != NotifyStatus_Dead && stSmsOutbox.Status == NotifyStatus_Pending {
+			stSmsOutbox.Status = NotifyStatus_Standby
+		}
+		return []*NotifyOutboxModel{stWxOutbox, stSmsOutbox}
+	}
+	return []*NotifyOutboxModel{stWxOutbox}
+}
+
+// newRouteSmsNotifyOutbox 生成和微信配对的短信，只发微信、没有手机号或没有配置短信模板时返回nil
+func newRouteSmsNotifyOutbox(scene string, templateName string, uid int64, phone *string, lessonId string, packageId string, mapParam map[string]string) (*NotifyOutboxModel, error) {
+	if notifyRoutes.get(scene) == NotifyRoute_WxOnly || phone == nil || *phone == "" || !notifyTemplates.has(templateName) {
+		return nil, nil
+	}
+	return newSmsNotifyOutbox(scene, templateName, uid, *phone, lessonId, packageId, mapParam)
+}
+
+// activateFallbackNotify 微信发不出去时启用备用的短信：第一次被永久拒绝（如43101未订阅、47003模板参数不准确）、重试次数用完或被偏好关闭
+func activateFallbackNotify(stat *JobRunStat, stNotifyOutboxModel *NotifyOutboxModel) {
+	if stNotifyOutboxModel.Channel != NotifyChannel_Wx {
+		return
+	}
+	nowTs := time.Now().Unix()
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["status"] = NotifyStatus_Pending
+	mapUpdates["next_try_ts"] = nowTs
+	mapUpdates["updated_ts"] = nowTs
+	cnt, err := ImpNotifyOutbox.UpdateFallbackNotifyOutbox(stNotifyOutboxModel.BizKey, NotifyStatus_Standby, mapUpdates)
+	if err != nil {
+		Printf("[NotifyOutbox]activate fallback err, err:%+v id:%d BizKey:%s\n", err, stNotifyOutboxModel.ID, stNotifyOutboxModel.BizKey)
+		stat.AddError(err)
+		return
+	}
+	if cnt > 0 {
+		Printf("[NotifyOutbox]activate sms fallback, id:%d scene:%s uid:%d LessonID:%s\n",
+			stNotifyOutboxModel.ID, stNotifyOutboxModel.Scene, stNotifyOutboxModel.Uid, stNotifyOutboxModel.LessonID)
+	}
+}
+
+// cancelFallbackNotify 微信发送成功后取消备用的短信
+func cancelFallbackNotify(stat *JobRunStat, stNotifyOutboxModel *NotifyOutboxModel) {
+	if stNotifyOutboxModel.Channel != NotifyChannel_Wx {
+		return
+	}
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["status"] = NotifyStatus_Canceled
+	mapUpdates["updated_ts"] = time.Now().Unix()
+	if _, err := ImpNotifyOutbox.UpdateFallbackNotifyOutbox(stNotifyOutboxModel.BizKey, NotifyStatus_Standby, mapUpdates); err != nil {
+		Printf("[NotifyOutbox]cancel fallback err, err:%+v id:%d BizKey:%s\n", err, stNotifyOutboxModel.ID, stNotifyOutboxModel.BizKey)
+		stat.AddError(err)
+	}
+}
+
+// checkSmsDailyCap 手机号当天发送成功的短信达到上限时返回false
+func checkSmsDailyCap(phone string, now time.Time) (bool, error) {
+	smsCap := getNotifySmsDailyCap()
+	t := now.In(notifyLocation)
+	dayBegTs := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, notifyLocation).Unix()
+	cnt, err := ImpNotifyAttempt.CountSuccSmsByPhone(phone, dayBegTs)
+	if err != nil {
+		return false, err
+	}
+	return cnt < smsCap, nil
+}
+
+// NotifyRoutePolicyItem 场景的发送渠道策略
+type NotifyRoutePolicyItem struct {
+	Scene     string `json:"scene"`      // 通知场景
+	Policy    string `json:"policy"`     // 生效的策略
+	IsDefault bool   `json:"is_default"` // 没有配置过，使用内置策略
+	UpdatedBy string `json:"updated_by"` // 最后修改人
+	UpdatedTs int64  `json:"updated_ts"` // 最后修改时间
+}
+
+type GetNotifyRoutePolicyListRsp struct {
+	Code        int                     `json:"code"`
+	ErrorMsg    string                  `json:"errorMsg,omitempty"`
+	List        []NotifyRoutePolicyItem `json:"list,omitempty"`
+	SmsDailyCap int                     `json:"sms_daily_cap"` // 每个手机号每天最多发送的短信条数
+}
+
+// GetNotifyRoutePolicyListHandler 查询各场景的发送渠道策略
+func GetNotifyRoutePolicyListHandler(w http.ResponseWriter, r *http.Request) {
+	rsp := &GetNotifyRoutePolicyListRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetNotifyRoutePolicyListHandler start\n")
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	vecNotifyRoutePolicyModel, err := ImpNotifyRoutePolicy.GetAllNotifyRoutePolicy()
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询发送渠道策略失败"
+		Printf("GetNotifyRoutePolicyListHandler GetAllNotifyRoutePolicy err, err:%+v\n", err)
+		return
+	}
+	mapNotifyRoutePolicyModel := make(map[string]NotifyRoutePolicyModel)
+	for _, v := range vecNotifyRoutePolicyModel {
+		mapNotifyRoutePolicyModel[v.Scene] = v
+	}
+	for _, scene := range vecRoutableNotifyScene {
+		stItem := NotifyRoutePolicyItem{Scene: scene, Policy: mapDefaultNotifyRoute[scene], IsDefault: true}
+		if stItem.Policy == "" {
+			stItem.Policy = NotifyRoute_WxOnly
+		}
+		if v, ok := mapNotifyRoutePolicyModel[scene]; ok && checkNotifyRoutePolicy(scene, v.Policy) == nil {
+			stItem.Policy = v.Policy
+			stItem.IsDefault = false
+			stItem.UpdatedBy = v.UpdatedBy
+			stItem.UpdatedTs = v.UpdatedTs
+		}
+		rsp.List = append(rsp.List, stItem)
+	}
+	sort.Slice(rsp.List, func(i, j int) bool {
+		return rsp.List[i].Scene < rsp.List[j].Scene
+	})
+	rsp.SmsDailyCap = getNotifySmsDailyCap()
+	rsp.Code = 0
+	return
+}
+
+type SetNotifyRoutePolicyReq struct {
+	Scene  string `json:"scene"`  // 通知场景
+	Policy string `json:"policy"` // 发送渠道策略：wx_only/wx_first/both/sms_only
+}
+
+type SetNotifyRoutePolicyRsp struct {
+	Code     int    `json:"code"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+}
+
+func getSetNotifyRoutePolicyReq(r *http.Request) (SetNotifyRoutePolicyReq, error) {
+	req := SetNotifyRoutePolicyReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// SetNotifyRoutePolicyHandler 设置场景的发送渠道策略，对之后写入发件箱的通知生效
+func SetNotifyRoutePolicyHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getSetNotifyRoutePolicyReq(r)
+	rsp := &SetNotifyRoutePolicyRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("SetNotifyRoutePolicyHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if !isRoutableNotifyScene(req.Scene) {
+		rsp.Code = -996
+		rsp.ErrorMsg = "该场景不支持配置发送渠道"
+		return
+	}
+	if !isValidNotifyRoute(req.Policy) {
+		rsp.Code = -996
+		rsp.ErrorMsg = "发送渠道策略不合法"
+		return
+	}
+	if err := checkNotifyRoutePolicy(req.Scene, req.Policy); err != nil {
+		rsp.Code = -996
+		rsp.ErrorMsg = "该场景没有配置短信模板，只能只发微信"
+		return
+	}
+
+	before, err := ImpNotifyRoutePolicy.GetNotifyRoutePolicy(req.Scene)
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询发送渠道策略失败"
+		Printf("SetNotifyRoutePolicyHandler GetNotifyRoutePolicy err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	stNotifyRoutePolicyModel := &NotifyRoutePolicyModel{
+		Scene:     req.Scene,
+		Policy:    req.Policy,
+		UpdatedBy: authResult.Operator,
+		UpdatedTs: time.Now().Unix(),
+	}
+	if before != nil {
+		stNotifyRoutePolicyModel.ID = before.ID
+	}
+	if err := ImpNotifyRoutePolicy.SaveNotifyRoutePolicy(stNotifyRoutePolicyModel); err != nil {
+		rsp.Code = -922
+		rsp.ErrorMsg = "保存发送渠道策略失败"
+		Printf("SetNotifyRoutePolicyHandler SaveNotifyRoutePolicy err, err:%+v req:%+v\n", err, req)
+		return
+	}
+	notifyRoutes.invalidate()
+	AddAuditChange(r, "notify_route_policy", req.Scene, before, stNotifyRoutePolicyModel)
+
+	rsp.Code = 0
+	Printf("SetNotifyRoutePolicyHandler success, req:%+v operator:%s\n", req, authResult.Operator)
+	return
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/xionghengheng/ff_plib/comm"
+	"github.com/xionghengheng/ff_plib/db"
+)
+
+// 通知模板的逻辑名，扫描任务按逻辑名发送，不直接引用微信/短信的模板id
+const (
+	NotifyTemplate_LessonMissed             = "LessonMissed"             // 旷课通知学员（微信）
+	NotifyTemplate_LessonMissedCoachSms     = "LessonMissedCoachSms"     // 旷课提醒教练补核销（短信）
+	NotifyTemplate_LessonStartRemind        = "LessonStartRemind"        // 私教课开课前提醒（微信）
+	NotifyTemplate_LessonStartRemindSms     = "LessonStartRemindSms"     // 私教课开课前提醒（短信）
+	NotifyTemplate_LessonCommentRemind      = "LessonCommentRemind"      // 私教课结束后提醒评价（微信）
+	NotifyTemplate_LessonCommentRemindSms   = "LessonCommentRemindSms"   // 私教课结束后提醒评价（短信），comm 中没有合适的短信模板，没有内置定义，需在数据库中配置
+	NotifyTemplate_TrialExpire              = "TrialExpire"              // 体验课包即将过期（微信）
+	NotifyTemplate_PassCardStartRemind      = "PassCardStartRemind"      // 通卡锻炼前提醒（微信）
+	NotifyTemplate_PassCardStartRemindSms   = "PassCardStartRemindSms"   // 通卡锻炼前提醒（短信），复用私教课开课前提醒的短信模板
+	NotifyTemplate_PassCardLessonOverdue    = "PassCardLessonOverdue"    // 通卡课程超时自动核销（微信）
+	NotifyTemplate_CoachAvailableTimeRemind = "CoachAvailableTimeRemind" // 提醒教练设置可约时间（微信）
+	NotifyTemplate_NoShowPenalty            = "NoShowPenalty"            // 多次旷课的处罚和审批结果（微信），复用旷课通知的模板
+)
+
+// 模板字段取值用的业务参数名
+const (
+	NotifyParam_CourseName    = "course_name"     // 课程名称
+	NotifyParam_GymName       = "gym_name"        // 门店名称
+	NotifyParam_GymSimpleName = "gym_simple_name" // 门店简称
+	NotifyParam_CoachName     = "coach_name"      // 教练名称
+	NotifyParam_UserNick      = "user_nick"       // 学员昵称
+	NotifyParam_LessonTime    = "lesson_time"     // 上课时间，如 2024年01月02日 15:04
+	NotifyParam_LessonMonth   = "lesson_month"    // 上课月份
+	NotifyParam_LessonDay     = "lesson_day"      // 上课日期
+	NotifyParam_LessonBegHm   = "lesson_beg_hm"   // 上课开始时分，如 15:04
+	NotifyParam_LessonEndHm   = "lesson_end_hm"   // 上课结束时分
+	NotifyParam_RemainCnt     = "remain_cnt"      // 剩余课时
+	NotifyParam_RemainMinutes = "remain_minutes"  // 距离开始的分钟数
+	NotifyParam_ExpireTime    = "expire_time"     // 到期时间
+	NotifyParam_ExpireRemark  = "expire_remark"   // 到期提醒的备注，如 体验课有效期还剩余7天，请预约上课吧！
+	NotifyParam_NoShowRemark  = "noshow_remark"   // 旷课处罚的说明，如 近期多次旷课，本节课时不予返还
+	NotifyParam_WriteOffTime  = "write_off_time"  // 核销时间
+)
+
+// 模板定义缓存的刷新间隔，改了数据库里的模板后最多这么久生效
+const notifyTemplateReloadSec = 60
+
+const notifyTimeLayout = "2006年01月02日 15:04"
+
+// NotifyTemplateField 模板字段
+type NotifyTemplateField struct {
+	Key      string `json:"key"`      // 微信为模板字段名（如thing3、time4），短信按顺序对应模板参数，仅作说明
+	Param    string `json:"param"`    // 取值的业务参数，见 NotifyParam_*
+	Value    string `json:"value"`    // 固定文案（如温馨提示），Param为空时使用
+	Required bool   `json:"required"` // 必填，取值为空时不发送
+}
+
+// NotifyTemplate 通知模板定义
+type NotifyTemplate struct {
+	Name       string                `json:"name"`        // 逻辑名
+	Channel    string                `json:"channel"`     // 通知渠道
+	TemplateID string                `json:"template_id"` // 微信模板id或短信模板id
+	Page       string                `json:"page"`        // 微信点击消息跳转的小程序页面
+	Fields     []NotifyTemplateField `json:"fields"`      // 模板字段，短信按顺序生成模板参数
+}
+
+// 内置的模板定义，数据库 notify_template 里有同名模板时以数据库为准
+var vecDefaultNotifyTemplate = []NotifyTemplate{
+	{
+		Name:       NotifyTemplate_LessonMissed,
+		Channel:    NotifyChannel_Wx,
+		TemplateID: "xAnZb8sc8dbKNtD0vXiKcjubzGbM1ZtAOKCz6KBQzBw",
+		Page:       "pages/home/index/index",
+		Fields: []NotifyTemplateField{
+			{Key: "time1", Param: NotifyParam_LessonTime, Required: true},  //上课时间
+			{Key: "thing2", Param: NotifyParam_CourseName, Required: true}, //课程名称
+			{Key: "thing4", Param: NotifyParam_GymName, Required: true},    //上课地点
+			{Key: "thing5", Value: "如由于忘记核销导致的已旷课，请及时补核销", Required: true}, //温馨提示
+		},
+	},
+	{
+		//您的学员{1}已旷课，原上课时间:{2}月{3}日{4}~{5}，上课地点:{6}，课程类型:{7)，若忘记核销课程，请您尽快补核销，超时将自动返还课时给用户!
+		Name:       NotifyTemplate_LessonMissedCoachSms,
+		Channel:    NotifyChannel_Sms,
+		TemplateID: comm.SmsTemplateId_LessonMissedRemindCoach,
+		Fields: []NotifyTemplateField{
+			{Key: "1", Param: NotifyParam_UserNick, Required: true},
+			{Key: "2", Param: NotifyParam_LessonMonth, Required: true},
+			{Key: "3", Param: NotifyParam_LessonDay, Required: true},
+			{Key: "4", Param: NotifyParam_LessonBegHm, Required: true},
+			{Key: "5", Param: NotifyParam_LessonEndHm, Required: true},
+			{Key: "6", Param: NotifyParam_GymSimpleName, Required: true},
+			{Key: "7", Param: NotifyParam_CourseName, Required: true},
+		},
+	},
+	{
+		Name:       NotifyTemplate_LessonStartRemind,
+		Channel:    NotifyChannel_Wx,
+		TemplateID: "kENL0EQdSD5gvtUAPh58n923AwBEio7tec6e1bC2sb0",
+		Page:       "pages/home/index/index",
+		Fields: []NotifyTemplateField{
+			{Key: "thing1", Param: NotifyParam_CourseName, Required: true}, //课程名称
+			{Key: "date2", Param: NotifyParam_LessonTime, Required: true},  //上课时间
+			{Key: "thing3", Param: NotifyParam_GymName, Required: true},    //上课地点
+			{Key: "thing4", Value: "课程即将开始，现在可以前往场地热身了哦！", Required: true}, //温馨提示
+		},
+	},
+	{
+		//您预约的{1}月{2}日{3}~{4}课程即将开始，场地：{5}，授课教练：{6}，现在可以前往场地热身了哦！
+		Name:       NotifyTemplate_LessonStartRemindSms,
+		Channel:    NotifyChannel_Sms,
+		TemplateID: comm.SmsTemplateId_LessonStartRemind,
+		Fields: []NotifyTemplateField{
+			{Key: "1", Param: NotifyParam_LessonMonth, Required: true},
+			{Key: "2", Param: NotifyParam_LessonDay, Required: true},
+			{Key: "3", Param: NotifyParam_LessonBegHm, Required: true},
+			{Key: "4", Param: NotifyParam_LessonEndHm, Required: true},
+			{Key: "5", Param: NotifyParam_GymSimpleName, Required: true},
+			{Key: "6", Param: NotifyParam_CoachName, Required: true},
+		},
+	},
+	{
+		Name:       NotifyTemplate_LessonCommentRemind,
+		Channel:    NotifyChannel_Wx,
+		TemplateID: "vrqe-O7w5ZmAAPT5MNciEqceSiVDRLJSkw6RKJXaMpo",
+		Page:       "pages/home/index/index",
+		Fields: []NotifyTemplateField{
+			{Key: "thing1", Param: NotifyParam_CourseName, Required: true}, //课程名称
+			{Key: "thing2", Param: NotifyParam_CoachName, Required: true},  //课程教练
+			{Key: "time3", Param: NotifyParam_LessonTime, Required: true},  //上课时间
+			{Key: "thing4", Value: "您完成了今天的私教课，期待您的评价！", Required: true},   //温馨提示
+		},
+	},
+	{
+		Name:       NotifyTemplate_TrialExpire,
+		Channel:    NotifyChannel_Wx,
+		TemplateID: "aeCItcVr9A9iVnoujFbA0jGyopFKAujrCCPVhtvM3FM",
+		Page:       "pages/home/index/index",
+		Fields: []NotifyTemplateField{
+			{Key: "thing3", Param: NotifyParam_CourseName, Required: true},   //课程名称
+			{Key: "number1", Param: NotifyParam_RemainCnt, Required: true},   //剩余课时
+			{Key: "time4", Param: NotifyParam_ExpireTime, Required: true},    //到期时间
+			{Key: "thing2", Param: NotifyParam_ExpireRemark, Required: true}, //备注
+		},
+	},
+	{
+		Name:       NotifyTemplate_PassCardStartRemind,
+		Channel:    NotifyChannel_Wx,
+		TemplateID: "jg1jkbScPaO-Ng6o5f3zpMpjn_GbRqKcNqRVHgaTYvY",
+		Page:       "pages/home/index/index",
+		Fields: []NotifyTemplateField{
+			{Key: "thing2", Param: NotifyParam_GymName, Required: true},        //门店
+			{Key: "time3", Param: NotifyParam_LessonTime, Required: true},      //预约上课时间
+			{Key: "number4", Param: NotifyParam_RemainMinutes, Required: true}, //剩余分钟
+			{Key: "thing5", Value: "您的锻炼预约即将开始，请准时前往~", Required: true},        //温馨提示
+		},
+	},
+	{
+		//您预约的{1}月{2}日{3}~{4}课程即将开始，场地：{5}，授课教练：{6}，现在可以前往场地热身了哦！
+		//通卡锻炼没有教练，{6}填固定文案
+		Name:       NotifyTemplate_PassCardStartRemindSms,
+		Channel:    NotifyChannel_Sms,
+		TemplateID: comm.SmsTemplateId_LessonStartRemind,
+		Fields: []NotifyTemplateField{
+			{Key: "1", Param: NotifyParam_LessonMonth, Required: true},
+			{Key: "2", Param: NotifyParam_LessonDay, Required: true},
+			{Key: "3", Param: NotifyParam_LessonBegHm, Required: true},
+			{Key: "4", Param: NotifyParam_LessonEndHm, Required: true},
+			{Key: "5", Param: NotifyParam_GymSimpleName, Required: true},
+			{Key: "6", Value: "无需教练", Required: true},
+		},
+	},
+	{
+		Name:       NotifyTemplate_PassCardLessonOverdue,
+		Channel:    NotifyChannel_Wx,
+		TemplateID: "B-iUFIzB8HgpvgoVYC7lVM5FSHgVrkG9yLvn0DFK1yc",
+		Page:       "pages/home/index/index",
+		Fields: []NotifyTemplateField{
+			{Key: "thing6", Param: NotifyParam_GymName, Required: true},     //门店
+			{Key: "time15", Param: NotifyParam_LessonTime, Required: true},  //预约上课时间
+			{Key: "time5", Param: NotifyParam_WriteOffTime, Required: true}, //核销时间
+		},
+	},
+	{
+		Name:       NotifyTemplate_CoachAvailableTimeRemind,
+		Channel:    NotifyChannel_Wx,
+		TemplateID: "r5pEmo4PPkXIZVhBhY9mv6yTvKFENg62x0phoAMYKM4",
+		Page:       "pages/home/index/index",
+		Fields: []NotifyTemplateField{
+			{Key: "thing3", Param: NotifyParam_GymName, Required: true}, //上课地点名称
+			{Key: "thing4", Value: "您未设置近期的可约时间，请及时设置", Required: true}, //课程名称
+		},
+	},
+	{
+		Name:       NotifyTemplate_NoShowPenalty,
+		Channel:    NotifyChannel_Wx,
+		TemplateID: "xAnZb8sc8dbKNtD0vXiKcjubzGbM1ZtAOKCz6KBQzBw",
+		Page:       "pages/home/index/index",
+		Fields: []NotifyTemplateField{
+			{Key: "time1", Param: NotifyParam_LessonTime, Required: true},    //上课时间
+			{Key: "thing2", Param: NotifyParam_CourseName, Required: true},   //课程名称
+			{Key: "thing4", Param: NotifyParam_GymName, Required: true},      //上课地点
+			{Key: "thing5", Param: NotifyParam_NoShowRemark, Required: true}, //温馨提示
+		},
+	},
+}
+
+// NotifyTemplateModel 数据库中的模板定义，用于不发版修改模板id、跳转页面和文案
+type NotifyTemplateModel struct {
+	ID         int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`      // 主键ID
+	Name       string `json:"name" gorm:"type:varchar(64);unique_index"` // 模板逻辑名
+	Channel    string `json:"channel" gorm:"type:varchar(8)"`            // 通知渠道
+	TemplateID string `json:"template_id" gorm:"type:varchar(64)"`       // 微信模板id或短信模板id
+	Page       string `json:"page" gorm:"type:varchar(128)"`             // 微信点击消息跳转的小程序页面
+	Fields     string `json:"fields" gorm:"type:text"`                   // 模板字段，NotifyTemplateField数组的JSON
+	UpdatedBy  string `json:"updated_by" gorm:"type:varchar(64)"`        // 最后修改人
+	UpdatedTs  int64  `json:"updated_ts"`                                // 最后修改时间
+}
+
+const notify_template_tableName = "notify_template"
+
+// NotifyTemplateInterface 通知模板数据模型接口
+type NotifyTemplateInterface interface {
+	// 获取数据库中的全部模板定义
+	GetAllNotifyTemplate() ([]NotifyTemplateModel, error)
+}
+
+// NotifyTemplateInterfaceImp 通知模板数据模型实现
+type NotifyTemplateInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpNotifyTemplate NotifyTemplateInterface = &NotifyTemplateInterfaceImp{}
+
+func (imp *NotifyTemplateInterfaceImp) GetAllNotifyTemplate() ([]NotifyTemplateModel, error) {
+	var vecNotifyTemplateModel []NotifyTemplateModel
+	cli := db.Get()
+	err := cli.Table(notify_template_tableName).Find(&vecNotifyTemplateModel).Error
+	return vecNotifyTemplateModel, err
+}
+
+// 微信订阅消息各类型字段的长度上限（字符数），没有列出的类型不限制长度
+// 参考文档：https://developers.weixin.qq.com/miniprogram/dev/OpenApiDoc/mp-message-management/subscribe-message/sendMessage.html
+var mapWxFieldMaxLen = map[string]int{
+	"thing":            20,
+	"character_string": 32,
+	"number":           32,
+	"letter":           32,
+	"symbol":           5,
+	"phrase":           5,
+	"car_number":       8,
+	"name":             10, // 纯字母或符号时放宽到20，见 checkWxFieldValue
+}
+
+// 微信订阅消息支持的字段类型
+var mapWxFieldKind = map[string]bool{
+	"thing": true, "character_string": true, "number": true, "letter": true, "symbol": true,
+	"phrase": true, "car_number": true, "name": true, "time": true, "date": true, "amount": true,
+	"phone_number": true,
+}
+
+// wxFieldKind 微信模板字段名去掉末尾的序号就是字段类型，例如 thing3 -> thing
+func wxFieldKind(key string) string {
+	return strings.TrimRight(key, "0123456789")
+}
+
+// checkWxFieldValue 校验微信模板字段的取值长度
+func checkWxFieldValue(key string, value string) error {
+	kind := wxFieldKind(key)
+	maxLen, ok := mapWxFieldMaxLen[kind]
+	if !ok {
+		return nil
+	}
+	if kind == "name" && len(value) == utf8.RuneCountInString(value) {
+		maxLen = 20
+	}
+	if cnt := utf8.RuneCountInString(value); cnt > maxLen {
+		return fmt.Errorf("field %s too long, len:%d max:%d value:%s", key, cnt, maxLen, value)
+	}
+	return nil
+}
+
+// validateWxMsgData 发送前校验微信消息内容，不合法的消息重试也不会成功
+func validateWxMsgData(mapData map[string]comm.MsgDataField) error {
+	for key, field := range mapData {
+		if err := checkWxFieldValue(key, field.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNotifyTemplate 校验模板定义本身，固定文案也要满足长度限制
+func checkNotifyTemplate(stTemplate NotifyTemplate) error {
+	if stTemplate.Name == "" || stTemplate.TemplateID == "" {
+		return fmt.Errorf("template name or template_id empty")
+	}
+	if stTemplate.Channel != NotifyChannel_Wx && stTemplate.Channel != NotifyChannel_Sms {
+		return fmt.Errorf("unknown channel %s", stTemplate.Channel)
+	}
+	if len(stTemplate.Fields) == 0 {
+		return fmt.Errorf("template has no field")
+	}
+	mapKey := make(map[string]bool)
+	for _, field := range stTemplate.Fields {
+		if field.Key == "" || mapKey[field.Key] {
+			return fmt.Errorf("field key empty or duplicated, key:%s", field.Key)
+		}
+		mapKey[field.Key] = true
+		if field.Param == "" && field.Value == "" && field.Required {
+			return fmt.Errorf("required field %s has neither param nor value", field.Key)
+		}
+		if stTemplate.Channel != NotifyChannel_Wx {
+			continue
+		}
+		if !mapWxFieldKind[wxFieldKind(field.Key)] {
+			return fmt.Errorf("unknown wx field kind, key:%s", field.Key)
+		}
+		if field.Param == "" {
+			if err := checkWxFieldValue(field.Key, field.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// notifyTemplateRegistry 模板定义：内置定义叠加数据库中的同名覆盖，定期刷新
+type notifyTemplateRegistry struct {
+	mu          sync.Mutex
+	mapTemplate map[string]NotifyTemplate
+	loadTs      int64
+}
+
+var notifyTemplates = &notifyTemplateRegistry{}
+
+// get 按逻辑名获取模板，缓存过期时重新加载
+func (r *notifyTemplateRegistry) get(name string) (NotifyTemplate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	nowTs := time.Now().Unix()
+	if r.mapTemplate == nil || nowTs-r.loadTs >= notifyTemplateReloadSec {
+		r.load(nowTs)
+	}
+	stTemplate, ok := r.mapTemplate[name]
+	if !ok {
+		return stTemplate, fmt.Errorf("notify template %s not found", name)
+	}
+	return stTemplate, nil
+}
+
+// has 是否有该逻辑名的模板，用于可选的模板（例如需要在数据库中配置的短信模板）
+func (r *notifyTemplateRegistry) has(name string) bool {
+	_, err := r.get(name)
+	return err == nil
+}
+
+// load 加载模板定义，数据库读取失败时沿用上一次的结果，数据库中不合法的定义忽略并告警
+func (r *notifyTemplateRegistry) load(nowTs int64) {
+	r.loadTs = nowTs
+	vecNotifyTemplateModel, err := ImpNotifyTemplate.GetAllNotifyTemplate()
+	if err != nil {
+		Printf("[NotifyAlarm]GetAllNotifyTemplate err, keep last templates, err:%+v\n", err)
+		if r.mapTemplate != nil {
+			return
+		}
+	}
+
+	mapTemplate := make(map[string]NotifyTemplate)
+	for _, v := range vecDefaultNotifyTemplate {
+		mapTemplate[v.Name] = v
+	}
+	for _, v := range vecNotifyTemplateModel {
+		stTemplate := NotifyTemplate{
+			Name:       v.Name,
+			Channel:    v.Channel,
+			TemplateID: v.TemplateID,
+			Page:       v.Page,
+		}
+		if err := json.Unmarshal([]byte(v.Fields), &stTemplate.Fields); err != nil {
+			Printf("[NotifyAlarm]notify template fields invalid, ignored, err:%+v name:%s\n", err, v.Name)
+			continue
+		}
+		if err := checkNotifyTemplate(stTemplate); err != nil {
+			Printf("[NotifyAlarm]notify template invalid, ignored, err:%+v name:%s\n", err, v.Name)
+			continue
+		}
+		mapTemplate[v.Name] = stTemplate
+	}
+	r.mapTemplate = mapTemplate
+}
+
+// renderNotifyFields 按模板字段取值，校验必填
+func renderNotifyFields(stTemplate NotifyTemplate, mapParam map[string]string) ([]string, error) {
+	vecValue := make([]string, 0, len(stTemplate.Fields))
+	for _, field := range stTemplate.Fields {
+		value := field.Value
+		if field.Param != "" {
+			value = mapParam[field.Param]
+		}
+		if value == "" && field.Required {
+			return nil, fmt.Errorf("template %s field %s(%s) required", stTemplate.Name, field.Key, field.Param)
+		}
+		vecValue = append(vecValue, value)
+	}
+	return vecValue, nil
+}
+
+// renderWxNotify 按模板生成小程序订阅消息，发送前校验必填和长度
+func renderWxNotify(name string, toUser string, mapParam map[string]string) (comm.WxSendMsg2UserReq, error) {
+	stWxSendMsg2UserReq := comm.WxSendMsg2UserReq{
+		ToUser:           toUser,
+		MiniprogramState: os.Getenv("MiniprogramState"),
+		Lang:             "zh_CN",
+	}
+	stTemplate, err := notifyTemplates.get(name)
+	if err != nil {
+		return stWxSendMsg2UserReq, err
+	}
+	if stTemplate.Channel != NotifyChannel_Wx {
+		return stWxSendMsg2UserReq, fmt.Errorf("notify template %s is not wx template", name)
+	}
+	stWxSendMsg2UserReq.TemplateID = stTemplate.TemplateID
+	stWxSendMsg2UserReq.Page = stTemplate.Page
+	vecValue, err := renderNotifyFields(stTemplate, mapParam)
+	if err != nil {
+		return stWxSendMsg2UserReq, err
+	}
+	stWxSendMsg2UserReq.Data = make(map[string]comm.MsgDataField)
+	for i, field := range stTemplate.Fields {
+		if vecValue[i] == "" {
+			continue
+		}
+		stWxSendMsg2UserReq.Data[field.Key] = comm.MsgDataField{Value: vecValue[i]}
+	}
+	if err := validateWxMsgData(stWxSendMsg2UserReq.Data); err != nil {
+		return stWxSendMsg2UserReq, fmt.Errorf("template %s %s", name, err.Error())
+	}
+	return stWxSendMsg2UserReq, nil
+}
+
+// renderSmsNotify 按模板生成短信模板id和参数
+func renderSmsNotify(name string, mapParam map[string]string) (string, []string, error) {
+	stTemplate, err := notifyTemplates.get(name)
+	if err != nil {
+		return "", nil, err
+	}
+	if stTemplate.Channel != NotifyChannel_Sms {
+		return "", nil, fmt.Errorf("notify template %s is not sms template", name)
+	}
+	vecTemplateParam, err := renderNotifyFields(stTemplate, mapParam)
+	return stTemplate.TemplateID, vecTemplateParam, err
+}
+
+// genLessonNotifyParams 课程时间相关的模板参数
+func genLessonNotifyParams(scheduleBegTs int64, scheduleEndTs int64) map[string]string {
+	t := time.Unix(scheduleBegTs, 0)
+	tEnd := time.Unix(scheduleEndTs, 0)
+	mapParam := make(map[string]string)
+	mapParam[NotifyParam_LessonTime] = t.Format(notifyTimeLayout)
+	mapParam[NotifyParam_LessonMonth] = strconv.Itoa(int(t.Month()))
+	mapParam[NotifyParam_LessonDay] = strconv.Itoa(t.Day())
+	mapParam[NotifyParam_LessonBegHm] = t.Format("15:04")
+	mapParam[NotifyParam_LessonEndHm] = tEnd.Format("15:04")
+	return mapParam
+}
+
+func init() {
+	for _, v := range vecDefaultNotifyTemplate {
+		if err := checkNotifyTemplate(v); err != nil {
+			panic(fmt.Sprintf("default notify template %s invalid, err:%+v", v.Name, err))
+		}
+	}
+}
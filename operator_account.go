@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xionghengheng/ff_plib/db"
+)
+
+// OperatorAccountModel 后台操作员账号，每个人一个账号，密码只保存哈希
+type OperatorAccountModel struct {
+	ID           int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`          // 主键ID
+	Username     string `json:"username" gorm:"type:varchar(64);unique_index"` // 登录名
+	Nick         string `json:"nick"`                                          // 显示名称
+	PasswordHash string `json:"-" gorm:"type:varchar(256)"`                    // 密码哈希（pbkdf2_sha256$迭代次数$盐$哈希）
+	Role         string `json:"role" gorm:"type:varchar(32)"`                  // 角色（参考 OperatorRole_）
+	Disabled     bool   `json:"disabled"`                                      // 是否已停用
+	CreatedBy    string `json:"created_by"`                                    // 创建人
+	CreatedTs    int64  `json:"created_ts"`                                    // 创建时间
+	UpdatedTs    int64  `json:"updated_ts"`                                    // 更新时间
+}
+
+const operator_account_tableName = "operator_account"
+
+// OperatorAccountInterface 操作员账号数据模型接口
+type OperatorAccountInterface interface {
+	// 添加账号，登录名重复时返回错误
+	AddOperator(stOperatorAccountModel *OperatorAccountModel) error
+
+	// 根据登录名获取账号
+	GetOperatorByUsername(username string) (*OperatorAccountModel, error)
+
+	// 获取全部账号
+	GetAllOperator() ([]OperatorAccountModel, error)
+
+	// 更新账号信息
+	UpdateOperator(username string, mapUpdates map[string]interface{}) error
+
+	// 统计账号数量（含已停用的）
+	CountOperator() (int, error)
+}
+
+// OperatorAccountInterfaceImp 操作员账号数据模型实现
+type OperatorAccountInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpOperatorAccount OperatorAccountInterface = &OperatorAccountInterfaceImp{}
+
+func (imp *OperatorAccountInterfaceImp) AddOperator(stOperatorAccountModel *OperatorAccountModel) error {
+	cli := db.Get()
+	return cli.Table(operator_account_tableName).Create(stOperatorAccountModel).Error
+}
+
+func (imp *OperatorAccountInterfaceImp) GetOperatorByUsername(username string) (*OperatorAccountModel, error) {
+	var account = new(OperatorAccountModel)
+	cli := db.Get()
+	err := cli.Table(operator_account_tableName).Where("username = ?", username).First(account).Error
+	return account, err
+}
+
+func (imp *OperatorAccountInterfaceImp) GetAllOperator() ([]OperatorAccountModel, error) {
+	var vecOperatorAccountModel []OperatorAccountModel
+	cli := db.Get()
+	err := cli.Table(operator_account_tableName).Order("id ASC").Find(&vecOperatorAccountModel).Error
+	return vecOperatorAccountModel, err
+}
+
+func (imp *OperatorAccountInterfaceImp) UpdateOperator(username string, mapUpdates map[string]interface{}) error {
+	cli := db.Get()
+	return cli.Table(operator_account_tableName).Model(&OperatorAccountModel{}).Where("username = ?", username).Updates(mapUpdates).Error
+}
+
+func (imp *OperatorAccountInterfaceImp) CountOperator() (int, error) {
+	var count int
+	cli := db.Get()
+	err := cli.Table(operator_account_tableName).Count(&count).Error
+	return count, err
+}
+
+// 密码哈希参数
+const (
+	passwordHashPrefix = "pbkdf2_sha256"
+	passwordHashIter   = 60000
+	passwordSaltLen    = 16
+	passwordKeyLen     = 32
+)
+
+// HashPassword 生成密码哈希，每次使用随机盐
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2Sha256([]byte(password), salt, passwordHashIter, passwordKeyLen)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashPrefix, passwordHashIter,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword 校验密码和哈希是否匹配
+func CheckPassword(password string, passwordHash string) bool {
+	vecPart := strings.Split(passwordHash, "$")
+	if len(vecPart) != 4 || vecPart[0] != passwordHashPrefix {
+		return false
+	}
+	iter, err := strconv.Atoi(vecPart[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(vecPart[2])
+	if err != nil {
+		return false
+	}
+	expectKey, err := base64.RawStdEncoding.DecodeString(vecPart[3])
+	if err != nil || len(expectKey) == 0 {
+		return false
+	}
+	key := pbkdf2Sha256([]byte(password), salt, iter, len(expectKey))
+	return subtle.ConstantTimeCompare(key, expectKey) == 1
+}
+
+// pbkdf2Sha256 PBKDF2-HMAC-SHA256（RFC 8018）
+func pbkdf2Sha256(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:4])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
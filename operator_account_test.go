@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestPbkdf2Sha256(t *testing.T) {
+	// RFC 7914 第11节的 PBKDF2-HMAC-SHA256 测试向量，以及常用的短输出向量
+	vecCase := []struct {
+		name     string
+		password string
+		salt     string
+		iter     int
+		keyLen   int
+		wantKey  string
+	}{
+		{name: "rfc7914 c=1", password: "passwd", salt: "salt", iter: 1, keyLen: 64,
+			wantKey: "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{name: "rfc7914 c=80000", password: "Password", salt: "NaCl", iter: 80000, keyLen: 64,
+			wantKey: "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+		{name: "c=1 one block", password: "password", salt: "salt", iter: 1, keyLen: 32,
+			wantKey: "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{name: "c=2", password: "password", salt: "salt", iter: 2, keyLen: 32,
+			wantKey: "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{name: "c=4096", password: "password", salt: "salt", iter: 4096, keyLen: 32,
+			wantKey: "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{name: "truncated key", password: "password", salt: "salt", iter: 1, keyLen: 20,
+			wantKey: "120fb6cffcf8b32c43e7225256c4f837a86548c9"},
+	}
+	for _, c := range vecCase {
+		t.Run(c.name, func(t *testing.T) {
+			key := hex.EncodeToString(pbkdf2Sha256([]byte(c.password), []byte(c.salt), c.iter, c.keyLen))
+			if key != c.wantKey {
+				t.Fatalf("pbkdf2Sha256 got %s, want %s", key, c.wantKey)
+			}
+		})
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	passwordHash, err := HashPassword("s3cret")
+	if err != nil {
+		t.Fatalf("HashPassword err:%v", err)
+	}
+	vecCase := []struct {
+		name         string
+		password     string
+		passwordHash string
+		want         bool
+	}{
+		{name: "match", password: "s3cret", passwordHash: passwordHash, want: true},
+		{name: "wrong password", password: "s3cret!", passwordHash: passwordHash, want: false},
+		// passwd/salt/1 迭代的 RFC 7914 向量，按存储格式编码
+		{name: "known hash", password: "passwd", passwordHash: "pbkdf2_sha256$1$c2FsdA$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLw", want: true},
+		{name: "bad prefix", password: "s3cret", passwordHash: "md5$1$c2FsdA$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLw", want: false},
+		{name: "bad iter", password: "passwd", passwordHash: "pbkdf2_sha256$0$c2FsdA$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLw", want: false},
+		{name: "missing part", password: "passwd", passwordHash: "pbkdf2_sha256$1$c2FsdA", want: false},
+		{name: "empty", password: "", passwordHash: "", want: false},
+	}
+	for _, c := range vecCase {
+		t.Run(c.name, func(t *testing.T) {
+			if got := CheckPassword(c.password, c.passwordHash); got != c.want {
+				t.Fatalf("CheckPassword got %t, want %t", got, c.want)
+			}
+		})
+	}
+}
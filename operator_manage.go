@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// 密码最小长度
+const operatorPasswordMinLen = 8
+
+type AddOperatorReq struct {
+	Username string `json:"username"` // 登录名
+	Nick     string `json:"nick"`     // 显示名称
+	Password string `json:"password"` // 初始密码
+	Role     string `json:"role"`     // 角色
+}
+
+type AddOperatorRsp struct {
+	Code     int    `json:"code"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+}
+
+func getAddOperatorReq(r *http.Request) (AddOperatorReq, error) {
+	req := AddOperatorReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// AddOperatorHandler 添加操作员账号
+func AddOperatorHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getAddOperatorReq(r)
+	rsp := &AddOperatorRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕（不打印密码）
+	Printf("AddOperatorHandler start, username:%s nick:%s role:%s\n", req.Username, req.Nick, req.Role)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if req.Username == "" || len(req.Username) > 64 {
+		rsp.Code = -996
+		rsp.ErrorMsg = "登录名不能为空且不能超过64个字符"
+		return
+	}
+	if len(req.Password) < operatorPasswordMinLen {
+		rsp.Code = -996
+		rsp.ErrorMsg = fmt.Sprintf("密码不能少于%d位", operatorPasswordMinLen)
+		return
+	}
+	if !IsValidOperatorRole(req.Role) {
+		rsp.Code = -996
+		rsp.ErrorMsg = "角色不合法"
+		Printf("AddOperatorHandler invalid role:%s\n", req.Role)
+		return
+	}
+
+	passwordHash, err := HashPassword(req.Password)
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "生成密码哈希失败"
+		Printf("AddOperatorHandler HashPassword err, err:%+v\n", err)
+		return
+	}
+
+	// 操作人没有账号说明是用环境变量配置的超级管理员在初始化，创建第一个账号后撤销其会话
+	_, errOperator := ImpOperatorAccount.GetOperatorByUsername(authResult.Operator)
+	isBootstrapAdmin := gorm.IsRecordNotFoundError(errOperator)
+
+	nowTs := time.Now().Unix()
+	stOperatorAccountModel := &OperatorAccountModel{
+		Username:     req.Username,
+		Nick:         req.Nick,
+		PasswordHash: passwordHash,
+		Role:         req.Role,
+		CreatedBy:    authResult.Operator,
+		CreatedTs:    nowTs,
+		UpdatedTs:    nowTs,
+	}
+	if err = ImpOperatorAccount.AddOperator(stOperatorAccountModel); err != nil {
+		rsp.Code = -922
+		rsp.ErrorMsg = "添加账号失败，登录名可能已存在"
+		Printf("AddOperatorHandler AddOperator err, err:%+v username:%s\n", err, req.Username)
+		return
+	}
+
+	AddAuditChange(r, "operator", req.Username, nil, stOperatorAccountModel)
+	if isBootstrapAdmin {
+		if err = ImpOperatorSession.RevokeOperatorSessions(authResult.Operator, "bootstrap_done"); err != nil {
+			Printf("AddOperatorHandler RevokeOperatorSessions err, err:%+v operator:%s\n", err, authResult.Operator)
+		}
+	}
+	rsp.Code = 0
+	Printf("AddOperatorHandler success, username:%s role:%s operator:%s\n", req.Username, req.Role, authResult.Operator)
+	return
+}
+
+type UpdateOperatorReq struct {
+	Username string `json:"username"` // 登录名
+	Nick     string `json:"nick"`     // 显示名称，为空不修改
+	Password string `json:"password"` // 新密码，为空不修改
+	Role     string `json:"role"`     // 角色，为空不修改
+	Disabled *bool  `json:"disabled"` // 是否停用，不传不修改
+}
+
+type UpdateOperatorRsp struct {
+	Code     int    `json:"code"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+}
+
+func getUpdateOperatorReq(r *http.Request) (UpdateOperatorReq, error) {
+	req := UpdateOperatorReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// UpdateOperatorHandler 修改操作员账号（重置密码、修改角色、停用）
+func UpdateOperatorHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getUpdateOperatorReq(r)
+	rsp := &UpdateOperatorRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕（不打印密码）
+	Printf("UpdateOperatorHandler start, username:%s nick:%s role:%s disabled:%v\n", req.Username, req.Nick, req.Role, req.Disabled)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if req.Username == "" {
+		rsp.Code = -996
+		rsp.ErrorMsg = "登录名不能为空"
+		return
+	}
+
+	stOperatorAccountModel, err := ImpOperatorAccount.GetOperatorByUsername(req.Username)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			rsp.Code = -911
+			rsp.ErrorMsg = "账号不存在"
+		} else {
+			rsp.Code = -922
+			rsp.ErrorMsg = "查询账号失败"
+		}
+		Printf("UpdateOperatorHandler GetOperatorByUsername err, err:%+v username:%s\n", err, req.Username)
+		return
+	}
+
+	mapUpdates := make(map[string]interface{})
+	if len(req.Nick) > 0 {
+		mapUpdates["nick"] = req.Nick
+	}
+	if len(req.Password) > 0 {
+		if len(req.Password) < operatorPasswordMinLen {
+			rsp.Code = -996
+			rsp.ErrorMsg = fmt.Sprintf("密码不能少于%d位", operatorPasswordMinLen)
+			return
+		}
+		passwordHash, err := HashPassword(req.Password)
+		if err != nil {
+			rsp.Code = -933
+			rsp.ErrorMsg = "生成密码哈希失败"
+			Printf("UpdateOperatorHandler HashPassword err, err:%+v\n", err)
+			return
+		}
+		mapUpdates["password_hash"] = passwordHash
+	}
+	if len(req.Role) > 0 {
+		if !IsValidOperatorRole(req.Role) {
+			rsp.Code = -996
+			rsp.ErrorMsg = "角色不合法"
+			Printf("UpdateOperatorHandler invalid role:%s\n", req.Role)
+			return
+		}
+		mapUpdates["role"] = req.Role
+	}
+	if req.Disabled != nil {
+		if *req.Disabled && req.Username == authResult.Operator {
+			rsp.Code = -996
+			rsp.ErrorMsg = "不能停用自己的账号"
+			return
+		}
+		mapUpdates["disabled"] = *req.Disabled
+	}
+	if len(mapUpdates) == 0 {
+		rsp.Code = 0
+		return
+	}
+	mapUpdates["updated_ts"] = time.Now().Unix()
+
+	if err = ImpOperatorAccount.UpdateOperator(req.Username, mapUpdates); err != nil {
+		rsp.Code = -944
+		rsp.ErrorMsg = "更新账号失败"
+		Printf("UpdateOperatorHandler UpdateOperator err, err:%+v username:%s\n", err, req.Username)
+		return
+	}
+
+	AddAuditChange(r, "operator", req.Username, stOperatorAccountModel, mapUpdates)
+
+	// 修改密码、角色或停用账号后，已登录的会话全部失效，需重新登录
+	if len(req.Password) > 0 || len(req.Role) > 0 || (req.Disabled != nil && *req.Disabled) {
+		if err = ImpOperatorSession.RevokeOperatorSessions(req.Username, authResult.Operator); err != nil {
+			Printf("UpdateOperatorHandler RevokeOperatorSessions err, err:%+v username:%s\n", err, req.Username)
+		}
+	}
+
+	rsp.Code = 0
+	Printf("UpdateOperatorHandler success, username:%s operator:%s\n", req.Username, authResult.Operator)
+	return
+}
+
+type GetOperatorListRsp struct {
+	Code     int                    `json:"code"`
+	ErrorMsg string                 `json:"errorMsg,omitempty"`
+	List     []OperatorAccountModel `json:"list"`
+}
+
+// GetOperatorListHandler 获取全部操作员账号
+func GetOperatorListHandler(w http.ResponseWriter, r *http.Request) {
+	rsp := &GetOperatorListRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetOperatorListHandler start\n")
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	vecOperatorAccountModel, err := ImpOperatorAccount.GetAllOperator()
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询账号列表失败"
+		Printf("GetOperatorListHandler GetAllOperator err, err:%+v\n", err)
+		return
+	}
+
+	rsp.Code = 0
+	rsp.List = vecOperatorAccountModel
+	return
+}
+
+type UnlockOperatorReq struct {
+	Username string `json:"username"`  // 要解锁的登录名，为空不解锁
+	ClientIP string `json:"client_ip"` // 要解锁的IP，为空不解锁
+}
+
+type UnlockOperatorRsp struct {
+	Code     int    `json:"code"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+}
+
+func getUnlockOperatorReq(r *http.Request) (UnlockOperatorReq, error) {
+	req := UnlockOperatorReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// UnlockOperatorHandler 解除登录名或IP因密码错误过多导致的锁定
+func UnlockOperatorHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getUnlockOperatorReq(r)
+	rsp := &UnlockOperatorRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("UnlockOperatorHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if req.Username == "" && req.ClientIP == "" {
+		rsp.Code = -996
+		rsp.ErrorMsg = "登录名和IP不能同时为空"
+		return
+	}
+
+	if req.Username != "" {
+		if err = ImpAuthThrottle.ResetThrottle(AuthThrottleScope_User, req.Username); err != nil {
+			rsp.Code = -911
+			rsp.ErrorMsg = "解锁失败"
+			Printf("UnlockOperatorHandler ResetThrottle err, err:%+v username:%s\n", err, req.Username)
+			return
+		}
+		AddAuditChange(r, "auth_throttle", AuthThrottleScope_User+":"+req.Username, nil, map[string]interface{}{"unlock": true})
+	}
+	if req.ClientIP != "" {
+		if err = ImpAuthThrottle.ResetThrottle(AuthThrottleScope_IP, req.ClientIP); err != nil {
+			rsp.Code = -922
+			rsp.ErrorMsg = "解锁失败"
+			Printf("UnlockOperatorHandler ResetThrottle err, err:%+v ip:%s\n", err, req.ClientIP)
+			return
+		}
+		AddAuditChange(r, "auth_throttle", AuthThrottleScope_IP+":"+req.ClientIP, nil, map[string]interface{}{"unlock": true})
+	}
+	addSecurityEvent(SecurityEvent_Unlock, req.Username, req.ClientIP, "", authResult.Operator)
+
+	rsp.Code = 0
+	Printf("UnlockOperatorHandler success, username:%s ip:%s operator:%s\n", req.Username, req.ClientIP, authResult.Operator)
+	return
+}
+
+type GetSecurityEventListReq struct {
+	Username string `json:"username"`  // 登录名，为空查询全部
+	Passback string `json:"passback"`  // 翻页标记，首次请求传空字符串，后续传上次返回的passback
+	PageSize int    `json:"page_size"` // 每页数量
+}
+
+type GetSecurityEventListRsp struct {
+	Code     int                  `json:"code"`
+	ErrorMsg string               `json:"errorMsg,omitempty"`
+	List     []SecurityEventModel `json:"list,omitempty"`
+	Passback string               `json:"passback"` // 下一页的翻页标记，为空字符串表示没有更多数据
+}
+
+func getGetSecurityEventListReq(r *http.Request) (GetSecurityEventListReq, error) {
+	req := GetSecurityEventListReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// GetSecurityEventListHandler 查询密码错误、锁定、解锁等安全事件
+func GetSecurityEventListHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getGetSecurityEventListReq(r)
+	rsp := &GetSecurityEventListRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetSecurityEventListHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	var offset int64
+	if len(req.Passback) > 0 {
+		offset, _ = strconv.ParseInt(req.Passback, 10, 64)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	pageSize := req.PageSize
+	if pageSize <= 0 {
+		pageSize = 20 // 默认每页20条
+	}
+	if pageSize > 100 {
+		pageSize = 100 // 最大每页100条
+	}
+
+	vecSecurityEventModel, err := ImpAuthThrottle.GetSecurityEventList(req.Username, int(offset), pageSize)
+	if err != nil {
+		rsp.Code = -911
+		rsp.ErrorMsg = "查询安全事件失败"
+		Printf("GetSecurityEventListHandler GetSecurityEventList err, err:%+v username:%s\n", err, req.Username)
+		return
+	}
+
+	rsp.List = vecSecurityEventModel
+	if len(vecSecurityEventModel) == pageSize {
+		rsp.Passback = strconv.FormatInt(offset+int64(pageSize), 10)
+	}
+	rsp.Code = 0
+	return
+}
@@ -1,180 +1,214 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"os"
 	"time"
 
-	"github.com/xionghengheng/ff_plib/comm"
 	"github.com/xionghengheng/ff_plib/db/dao"
 	"github.com/xionghengheng/ff_plib/db/pass_card_dao"
 	"github.com/xionghengheng/ff_plib/db/pass_card_model"
 )
 
 // 扫描所有单次课程，处理旷课以及旷课退回的情况
-func ScanAllPassCardLesson() {
+func ScanAllPassCardLesson(ctx context.Context) {
 	Printf("scan start, beg_time:%s", time.Now().Format("2006-01-02 15:04:05"))
-	err := doPassCardLessonScan()
+	// 单次执行的时间预算，用完后停止翻页，剩余的留到下一次执行
+	ctx, cancel := context.WithTimeout(ctx, lessonScanBudget)
+	defer cancel()
+	err := doPassCardLessonScan(ctx)
 	if err != nil {
 		Printf("doPassCardLessonScan err, err:%+v", err)
+		getJobRunStat(ctx).Fail(err)
 		return
 	}
 	Printf("scan end, end_time:%s", time.Now().Format("2006-01-02 15:04:05"))
 }
 
-func doPassCardLessonScan() error {
+func doPassCardLessonScan(ctx context.Context) error {
 
 	//每5分钟处理一次
-	handlePassCardLessonMissed()
+	handlePassCardLessonMissed(ctx)
 
 	//锻炼时间前2小时，发送消息通知用户
-	handleSendPassCardMsgBeforeLessonStart()
+	handleSendPassCardMsgBeforeLessonStart(ctx)
 
 	return nil
 }
 
 // 处理已经超过课程结束时间的已预约课程
-func handlePassCardLessonMissed() {
+func handlePassCardLessonMissed(ctx context.Context) {
+	stat := getJobRunStat(ctx)
 	nowTs := time.Now().Unix()
 
-	vecNotFinishLesson, err := pass_card_dao.ImpPassCardLesson.GetLessonListNotFinish(time.Now().Unix(), 100)
-	if err != nil {
-		Printf("GetSingleLessonListNotFinish err, err:%+v", err)
+	//按游标翻页处理全部已过结束时间还没核销的课程
+	var cursor LessonScanCursor
+	for ctx.Err() == nil {
+		vecNotFinishLesson, err := ImpLessonScan.GetPassCardLessonNotFinishPage(nowTs, cursor, lessonScanPageSize)
+		if err != nil {
+			Printf("GetPassCardLessonNotFinishPage err, err:%+v cursor:%+v", err, cursor)
+			stat.Fail(err)
+			return
+		}
+		Printf("GetPassCardLessonNotFinishPage succ, vecNotFinishLesson.len:%d cursor:%+v", len(vecNotFinishLesson), cursor)
+		for _, v := range vecNotFinishLesson {
+			if ctx.Err() != nil {
+				break
+			}
+			cursor.advance(v.ScheduleEndTs, v.LessonID)
+			stat.AddExamined(1)
+			markPassCardLessonMissed(stat, nowTs, v)
+		}
+		if len(vecNotFinishLesson) < lessonScanPageSize {
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		reportLessonScanBacklog(stat, "PassCardLessonMissed", func() (int, error) {
+			return ImpLessonScan.CountPassCardLessonNotFinish(nowTs, cursor)
+		})
+	}
+	return
+}
+
+// 将已经超过课程结束时间的课程设置为已迟到，并通知用户
+func markPassCardLessonMissed(stat *JobRunStat, nowTs int64, v pass_card_model.LessonModel) {
+	//当前时间已经超过课程结束时间
+	if nowTs <= v.ScheduleEndTs {
 		return
 	}
-	Printf("GetSingleLessonListNotFinish succ, vecNotFinishLesson.len:%d", len(vecNotFinishLesson))
 
-	for _, v := range vecNotFinishLesson {
-		//当前时间已经超过课程结束时间
-		if nowTs <= v.ScheduleEndTs {
-			continue
-		}
+	stWxOutbox, err := newWriteOffSuccNotify(v.Uid, v)
+	if err != nil {
+		stat.AddError(err)
+		return
+	}
 
-		mapUpdates := make(map[string]interface{})
-		mapUpdates["status"] = pass_card_model.En_LessonStatus_Missed
-		mapUpdates["update_ts"] = nowTs
-		err = pass_card_dao.ImpPassCardLesson.UpdateLesson(v.Uid, v.LessonID, mapUpdates)
-		if err != nil {
-			Printf("UpdateSingleLesson2StatusMissed err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
-			continue
-		}
-		Printf("UpdateSingleLesson2StatusMissed succ, uid:%d LessonID:%s", v.Uid, v.LessonID)
-		sendWriteOffSuccMsg(v.Uid, v)
+	//状态和通知在同一个事务里写入，通知由投递任务发送，失败会重试
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["status"] = pass_card_model.En_LessonStatus_Missed
+	mapUpdates["update_ts"] = nowTs
+	err = saveStateWithNotify(pass_card_lesson_tableName, &pass_card_model.LessonModel{}, mapUpdates, []*NotifyOutboxModel{stWxOutbox},
+		"uid = ? AND lesson_id = ? AND status = ?", v.Uid, v.LessonID, pass_card_model.En_LessonStatus_Scheduled)
+	if err == errStateChanged {
+		return
 	}
-	return
+	if err != nil {
+		Printf("UpdateSingleLesson2StatusMissed err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+		stat.AddError(err)
+		return
+	}
+	stat.AddChanged(1)
+	Printf("UpdateSingleLesson2StatusMissed succ, uid:%d LessonID:%s", v.Uid, v.LessonID)
 }
 
 // 处理锻炼时间前2小时发送提醒消息
-func handleSendPassCardMsgBeforeLessonStart() {
+func handleSendPassCardMsgBeforeLessonStart(ctx context.Context) {
+	stat := getJobRunStat(ctx)
 	nowTs := time.Now().Unix()
-	// 查询未完成的课程，时间范围设置为未来3小时内（确保能覆盖2小时前的课程）
-	vecNotFinishAndNotSengGoMsgLesson, err := pass_card_dao.ImpPassCardLesson.GetLessonListNotFinishAndNotSendGoMsg(nowTs+10800, 1000)
+	//每次执行读取一次业务规则，执行过程中不变
+	rules := loadBusinessRules()
+	// 查询未完成的课程，时间范围设置为提醒窗口开始再往后1小时（默认未来3小时内，确保能覆盖2小时前的课程）
+	vecNotFinishAndNotSengGoMsgLesson, err := pass_card_dao.ImpPassCardLesson.GetLessonListNotFinishAndNotSendGoMsg(nowTs+rules.maxValue(BizRule_PassCardRemindBegSec)+3600, 1000)
 	if err != nil {
 		Printf("GetLessonListNotFinishAndNotSendGoMsg err, err:%+v", err)
+		stat.Fail(err)
 		return
 	}
+	stat.AddExamined(len(vecNotFinishAndNotSengGoMsgLesson))
 
 	for _, v := range vecNotFinishAndNotSengGoMsgLesson {
 		if v.ScheduleBegTs == 0 {
 			continue
 		}
 
-		// 锻炼时间前2小时（7200秒），发送消息通知用户
-		// 使用时间窗口（2小时前到1小时50分前）来避免重复发送
+		// 锻炼时间前2小时（7200秒，可按通卡场地配置），发送消息通知用户
+		// 使用时间窗口（默认2小时前到1小时50分前）来避免重复发送
 		// 这样即使扫描多次，也只会在这个窗口内发送一次
-		if nowTs >= v.ScheduleBegTs-7200 && nowTs < v.ScheduleBegTs-6600 {
+		remindBegSec, remindEndSec := rules.passCardRemindWindow(v.GymId)
+		if nowTs >= v.ScheduleBegTs-remindBegSec && nowTs < v.ScheduleBegTs-remindEndSec {
+
+			vecNotifyOutboxModel, err := newPassCardLessonRemindNotify(v.Uid, v)
+			if err != nil {
+				stat.AddError(err)
+				continue
+			}
 
+			//已发送标记和通知在同一个事务里写入，通知由投递任务发送，失败会重试
 			mapUpdates := make(map[string]interface{})
 			mapUpdates["send_msg_go_lesson"] = true
 			mapUpdates["update_ts"] = nowTs
-			err = pass_card_dao.ImpPassCardLesson.UpdateLesson(v.Uid, v.LessonID, mapUpdates)
+			err = saveStateWithNotify(pass_card_lesson_tableName, &pass_card_model.LessonModel{}, mapUpdates, vecNotifyOutboxModel,
+				"uid = ? AND lesson_id = ? AND send_msg_go_lesson = false", v.Uid, v.LessonID)
+			if err == errStateChanged {
+				continue
+			}
 			if err != nil {
 				Printf("Update send_msg_go_lesson err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+				stat.AddError(err)
 				continue
 			}
+			stat.AddChanged(1)
 			Printf("Update send_msg_go_lesson succ, uid:%d LessonID:%s", v.Uid, v.LessonID)
-			sendPassCardLessonRemindMsg(v.Uid, v)
 		}
 	}
 	return
 }
 
-// 发送通卡课程锻炼时间前2小时提醒消息
-func sendPassCardLessonRemindMsg(uid int64, stLessonModel pass_card_model.LessonModel) {
+// 生成通卡课程锻炼时间前2小时提醒消息，按场景的发送渠道策略决定是否发短信
+func newPassCardLessonRemindNotify(uid int64, stLessonModel pass_card_model.LessonModel) ([]*NotifyOutboxModel, error) {
 	stUserModel, err := dao.ImpUser.GetUser(uid)
 	if err != nil {
-		Printf("sendPassCardLessonRemindMsg GetUser err, err:%+v uid:%d LessonID:%s\n", err, uid, stLessonModel.LessonID)
-		return
+		Printf("newPassCardLessonRemindNotify GetUser err, err:%+v uid:%d LessonID:%s\n", err, uid, stLessonModel.LessonID)
+		return nil, err
 	}
 
 	stGymModel, err := pass_card_dao.ImpGym.GetGymInfoByGymId(stLessonModel.GymId)
 	if err != nil {
-		Printf("sendPassCardLessonRemindMsg GetGymInfoByGymId err, err:%+v gymId:%d uid:%d LessonID:%s\n", err, stLessonModel.GymId, uid, stLessonModel.LessonID)
-		return
+		Printf("newPassCardLessonRemindNotify GetGymInfoByGymId err, err:%+v gymId:%d uid:%d LessonID:%s\n", err, stLessonModel.GymId, uid, stLessonModel.LessonID)
+		return nil, err
 	}
 
-	t := time.Unix(stLessonModel.ScheduleBegTs, 0)
 	tNow := time.Now()
 	// 计算剩余分钟数
-	remainingMinutes := (stLessonModel.ScheduleBegTs - tNow.Unix()) / 60
 	remainingMinutesStr := ""
-	if remainingMinutes > 0 {
+	if remainingMinutes := (stLessonModel.ScheduleBegTs - tNow.Unix()) / 60; remainingMinutes > 0 {
 		remainingMinutesStr = fmt.Sprintf("%d", remainingMinutes)
 	}
 
-	stWxSendMsg2UserReq := comm.WxSendMsg2UserReq{
-		ToUser:           stUserModel.WechatID,
-		TemplateID:       "jg1jkbScPaO-Ng6o5f3zpMpjn_GbRqKcNqRVHgaTYvY",
-		Page:             "pages/home/index/index",
-		MiniprogramState: os.Getenv("MiniprogramState"),
-		Lang:             "zh_CN",
-		Data: map[string]comm.MsgDataField{
-			"thing2":  {Value: stGymModel.LocName},            //门店
-			"time3":   {Value: t.Format("2006年01月02日 15:04")}, //预约上课时间
-			"number4": {Value: remainingMinutesStr},           //剩余分钟
-			"thing5":  {Value: "您的锻炼预约即将开始，请准时前往~"},           //温馨提示
-		},
-	}
-	err = comm.SendMsg2User(uid, stWxSendMsg2UserReq)
+	mapParam := genLessonNotifyParams(stLessonModel.ScheduleBegTs, stLessonModel.ScheduleEndTs)
+	mapParam[NotifyParam_GymName] = stGymModel.LocName
+	mapParam[NotifyParam_GymSimpleName] = stGymModel.LocSimpleName
+	mapParam[NotifyParam_RemainMinutes] = remainingMinutesStr
+	stWxOutbox, err := newWxNotifyOutbox(NotifyScene_PassCardStartRemind, NotifyTemplate_PassCardStartRemind, uid, stUserModel.WechatID, stLessonModel.LessonID, "", mapParam)
 	if err != nil {
-		Printf("sendPassCardLessonRemindMsg sendMsg2User err, err:%+v uid:%d LessonID:%s\n", err, uid, stLessonModel.LessonID)
-	} else {
-		Printf("sendPassCardLessonRemindMsg sendMsg2User succ, uid:%d LessonID:%s\n", uid, stLessonModel.LessonID)
+		Printf("newPassCardLessonRemindNotify newWxNotifyOutbox err, err:%+v uid:%d LessonID:%s\n", err, uid, stLessonModel.LessonID)
+		return nil, err
 	}
+	stSmsOutbox, err := newRouteSmsNotifyOutbox(NotifyScene_PassCardStartRemind, NotifyTemplate_PassCardStartRemindSms, uid, stUserModel.PhoneNumber, stLessonModel.LessonID, "", mapParam)
+	if err != nil {
+		Printf("newPassCardLessonRemindNotify newRouteSmsNotifyOutbox err, err:%+v uid:%d LessonID:%s\n", err, uid, stLessonModel.LessonID)
+		return nil, err
+	}
+	return routeNotifyOutbox(NotifyScene_PassCardStartRemind, stWxOutbox, stSmsOutbox), nil
 }
 
-// 给用户发通知，告知核销成功
-func sendWriteOffSuccMsg(uid int64, stLessonModel pass_card_model.LessonModel) {
+// 生成给用户的通知，告知核销成功
+func newWriteOffSuccNotify(uid int64, stLessonModel pass_card_model.LessonModel) (*NotifyOutboxModel, error) {
 	stUserModel, err := dao.ImpUser.GetUser(uid)
 	if err != nil {
-		Printf("sendWriteOffSuccMsg GetUser err, err:%+v uid:%d LessonID:%s\n", err, uid, stLessonModel.LessonID)
-		return
+		Printf("newWriteOffSuccNotify GetUser err, err:%+v uid:%d LessonID:%s\n", err, uid, stLessonModel.LessonID)
+		return nil, err
 	}
 
 	stGymModel, err := pass_card_dao.ImpGym.GetGymInfoByGymId(stLessonModel.GymId)
 	if err != nil {
-		Printf("sendWriteOffSuccMsg GetGymInfoByGymId err, err:%+v gymId:%d uid:%d LessonID:%s\n", err, stLessonModel.GymId, uid, stLessonModel.LessonID)
-		return
+		Printf("newWriteOffSuccNotify GetGymInfoByGymId err, err:%+v gymId:%d uid:%d LessonID:%s\n", err, stLessonModel.GymId, uid, stLessonModel.LessonID)
+		return nil, err
 	}
 
-	t := time.Unix(stLessonModel.ScheduleBegTs, 0)
-	tNow := time.Now()
-	stWxSendMsg2UserReq := comm.WxSendMsg2UserReq{
-		ToUser:           stUserModel.WechatID,
-		TemplateID:       "B-iUFIzB8HgpvgoVYC7lVM5FSHgVrkG9yLvn0DFK1yc",
-		Page:             "pages/home/index/index",
-		MiniprogramState: os.Getenv("MiniprogramState"),
-		Lang:             "zh_CN",
-		Data: map[string]comm.MsgDataField{
-			"thing6": {Value: stGymModel.LocName},               //门店
-			"time15": {Value: t.Format("2006年01月02日 15:04")},    //预约上课时间
-			"time5":  {Value: tNow.Format("2006年01月02日 15:04")}, //核销时间
-		},
-	}
-	err = comm.SendMsg2User(uid, stWxSendMsg2UserReq)
-	if err != nil {
-		Printf("sendWriteOffSuccMsg sendMsg2User err, err:%+v uid:%d LessonID:%s\n", err, uid, stLessonModel.LessonID)
-	} else {
-		Printf("sendWriteOffSuccMsg sendMsg2User succ, uid:%d LessonID:%s\n", uid, stLessonModel.LessonID)
-	}
+	mapParam := genLessonNotifyParams(stLessonModel.ScheduleBegTs, stLessonModel.ScheduleEndTs)
+	mapParam[NotifyParam_GymName] = stGymModel.LocName
+	mapParam[NotifyParam_WriteOffTime] = time.Now().Format(notifyTimeLayout)
+	return newWxNotifyOutbox(NotifyScene_PassCardLessonOverdue, NotifyTemplate_PassCardLessonOverdue, uid, stUserModel.WechatID, stLessonModel.LessonID, "", mapParam)
 }
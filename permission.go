@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// 操作员角色
+const (
+	OperatorRole_Admin      = "admin"      // 超级管理员，拥有全部权限，负责管理账号
+	OperatorRole_Finance    = "finance"    // 财务，负责退款
+	OperatorRole_CoachOps   = "coach_ops"  // 教练运营，负责教练信息维护
+	OperatorRole_Consultant = "consultant" // 顾问，负责体验课，可以发起退款申请（需管理员审批）（小程序内通过OpenID识别的顾问也是该角色）
+	OperatorRole_Analyst    = "analyst"    // 数据分析，只读统计数据
+)
+
+// 接口权限
+const (
+	Perm_BaseRead       = "base_read"       // 读取场地、课程、教练列表等基础信息
+	Perm_StatisticRead  = "statistic_read"  // 读取统计数据
+	Perm_CoachRead      = "coach_read"      // 读取教练画像
+	Perm_CoachWrite     = "coach_write"     // 修改教练信息、绑定教练
+	Perm_RefundRead     = "refund_read"     // 查询付费课包、退款试算、退款审批列表
+	Perm_RefundWrite    = "refund_write"    // 发起退款
+	Perm_RefundApprove  = "refund_approve"  // 审批退款
+	Perm_TrialManage    = "trial_manage"    // 管理预体验课
+	Perm_OperatorManage = "operator_manage" // 管理操作员账号
+	Perm_AuditRead      = "audit_read"      // 查询审计日志
+	Perm_JobManage      = "job_manage"      // 查看和操作后台任务（暂停、恢复、手动触发）
+	Perm_NotifyManage   = "notify_manage"   // 查看和重放通知
+	Perm_NotifyRead     = "notify_read"     // 查询给用户的通知发送记录
+	Perm_RuleManage     = "rule_manage"     // 查看和修改旷课、提醒等业务规则
+	Perm_LessonAppeal   = "lesson_appeal"   // 处理旷课申诉（补核销、免责归还课时、登记争议）
+	Perm_NoShowApprove  = "noshow_approve"  // 查看多次旷课的处罚记录，审批课时返还，解除预约暂停
+	Perm_Authenticated  = "authenticated"   // 只要求已登录，不限角色
+)
+
+// mapRolePermission 各角色拥有的权限，超级管理员不在此配置，默认拥有全部权限
+var mapRolePermission = map[string][]string{
+	OperatorRole_Finance:    {Perm_BaseRead, Perm_StatisticRead, Perm_RefundRead, Perm_RefundWrite, Perm_RefundApprove},
+	OperatorRole_CoachOps:   {Perm_BaseRead, Perm_StatisticRead, Perm_CoachRead, Perm_CoachWrite, Perm_TrialManage, Perm_NotifyRead, Perm_RuleManage, Perm_LessonAppeal, Perm_NoShowApprove},
+	OperatorRole_Consultant: {Perm_BaseRead, Perm_TrialManage, Perm_RefundWrite, Perm_NoShowApprove},
+	OperatorRole_Analyst:    {Perm_BaseRead, Perm_StatisticRead},
+}
+
+// IsValidOperatorRole 是否为合法的角色
+func IsValidOperatorRole(role string) bool {
+	if role == OperatorRole_Admin {
+		return true
+	}
+	_, ok := mapRolePermission[role]
+	return ok
+}
+
+// RoleHasPermission 角色是否拥有某个权限
+func RoleHasPermission(role string, perm string) bool {
+	if role == OperatorRole_Admin || perm == Perm_Authenticated {
+		return true
+	}
+	for _, v := range mapRolePermission[role] {
+		if v == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// OperatorIdentity 已通过身份验证的操作员
+type OperatorIdentity struct {
+	Operator       string // 操作人标识（账号为登录名，小程序顾问为OpenID）
+	Role           string // 角色
+	IsConsultant   bool   // 是否为小程序内通过OpenID识别的顾问
+	ConsultantNick string // 顾问昵称（顾问身份时有值）
+}
+
+type operatorIdentityCtxKey struct{}
+
+// getOperatorIdentity 获取身份验证中间件已验证的身份，未经过中间件时返回nil
+func getOperatorIdentity(r *http.Request) *OperatorIdentity {
+	identity, _ := r.Context().Value(operatorIdentityCtxKey{}).(*OperatorIdentity)
+	return identity
+}
+
+// Policy_Public 公开路由的策略，不需要登录，必须在 vecPublicRoute 中显式列出
+const Policy_Public = "public"
+
+// vecPublicRoute 允许公开访问的路由白名单
+var vecPublicRoute = []string{
+	"/api/login",
+	"/api/refreshToken",
+}
+
+// apiRouter 所有接口统一从这里注册，注册时必须声明权限，请求进入handler前统一做身份验证和权限检查
+type apiRouter struct {
+	mux            *http.ServeMux
+	vecPattern     []string          // 已注册的路由
+	mapRoutePolicy map[string]string // 路由声明的策略（权限或 Policy_Public）
+	mapAuditRoute  map[string]bool   // 需要记录审计日志的路由
+}
+
+func newApiRouter() *apiRouter {
+	return &apiRouter{
+		mux:            http.NewServeMux(),
+		mapRoutePolicy: make(map[string]string),
+		mapAuditRoute:  make(map[string]bool),
+	}
+}
+
+// Handle 注册需要登录的路由，并声明所需权限
+func (rt *apiRouter) Handle(pattern string, perm string, handler http.HandlerFunc) {
+	rt.vecPattern = append(rt.vecPattern, pattern)
+	rt.mapRoutePolicy[pattern] = perm
+	rt.mux.HandleFunc(pattern, handler)
+}
+
+// HandleAudited 注册需要登录且记录审计日志的路由，用于管理后台的写操作
+func (rt *apiRouter) HandleAudited(pattern string, perm string, handler http.HandlerFunc) {
+	rt.Handle(pattern, perm, handler)
+	rt.mapAuditRoute[pattern] = true
+}
+
+// HandlePublic 注册公开路由，路由必须在 vecPublicRoute 白名单中
+func (rt *apiRouter) HandlePublic(pattern string, handler http.HandlerFunc) {
+	rt.Handle(pattern, Policy_Public, handler)
+}
+
+// HandleFunc 未声明权限的注册方式，启动检查会拒绝启动，请使用 Handle 或 HandlePublic
+func (rt *apiRouter) HandleFunc(pattern string, handler http.HandlerFunc) {
+	rt.vecPattern = append(rt.vecPattern, pattern)
+	rt.mux.HandleFunc(pattern, handler)
+}
+
+// CheckPolicy 启动检查：每个路由都要声明策略，公开路由必须在白名单中，权限必须是已定义的权限
+func (rt *apiRouter) CheckPolicy() error {
+	mapPublic := make(map[string]bool)
+	for _, v := range vecPublicRoute {
+		mapPublic[v] = true
+	}
+	for _, pattern := range rt.vecPattern {
+		policy, ok := rt.mapRoutePolicy[pattern]
+		if !ok || policy == "" {
+			return fmt.Errorf("route %s has no auth policy", pattern)
+		}
+		if policy == Policy_Public {
+			if !mapPublic[pattern] {
+				return fmt.Errorf("route %s is public but not in public allowlist", pattern)
+			}
+			continue
+		}
+		if !isKnownPermission(policy) {
+			return fmt.Errorf("route %s declares unknown permission %s", pattern, policy)
+		}
+	}
+	return nil
+}
+
+// ServeHTTP 统一的身份验证中间件，通过后把身份放入请求上下文，handler内的身份校验直接复用
+func (rt *apiRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, pattern := rt.mux.Handler(r)
+	if pattern == "" {
+		// 未注册的路由，交给mux返回404
+		rt.mux.ServeHTTP(w, r)
+		return
+	}
+
+	policy := rt.mapRoutePolicy[pattern]
+	if policy == Policy_Public {
+		rt.mux.ServeHTTP(w, r)
+		return
+	}
+	if policy == "" {
+		Printf("apiRouter route has no auth policy, path:%s pattern:%s\n", r.URL.Path, pattern)
+		writePermissionDenied(w, -993, "没有该接口的访问权限")
+		return
+	}
+
+	authResult := authenticateOperator(r)
+	if !authResult.Success {
+		writePermissionDenied(w, authResult.Code, authResult.ErrorMsg)
+		return
+	}
+	if !RoleHasPermission(authResult.Role, policy) {
+		Printf("apiRouter permission denied, path:%s operator:%s role:%s perm:%s\n", r.URL.Path, authResult.Operator, authResult.Role, policy)
+		writePermissionDenied(w, -993, "没有该接口的访问权限")
+		return
+	}
+	identity := &OperatorIdentity{
+		Operator:       authResult.Operator,
+		Role:           authResult.Role,
+		IsConsultant:   authResult.IsConsultant,
+		ConsultantNick: authResult.ConsultantNick,
+	}
+	r = r.WithContext(context.WithValue(r.Context(), operatorIdentityCtxKey{}, identity))
+	if rt.mapAuditRoute[pattern] {
+		serveWithAudit(rt.mux, w, r, pattern)
+		return
+	}
+	rt.mux.ServeHTTP(w, r)
+}
+
+// isKnownPermission 是否为已定义的权限
+func isKnownPermission(perm string) bool {
+	switch perm {
+	case Perm_BaseRead, Perm_StatisticRead, Perm_CoachRead, Perm_CoachWrite, Perm_RefundRead, Perm_RefundWrite,
+		Perm_RefundApprove, Perm_TrialManage, Perm_OperatorManage, Perm_AuditRead, Perm_JobManage, Perm_NotifyManage, Perm_NotifyRead, Perm_RuleManage, Perm_LessonAppeal, Perm_NoShowApprove, Perm_Authenticated:
+		return true
+	}
+	return false
+}
+
+type permissionDeniedRsp struct {
+	Code     int    `json:"code"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+}
+
+func writePermissionDenied(w http.ResponseWriter, code int, errorMsg string) {
+	msg, _ := json.Marshal(permissionDeniedRsp{Code: code, ErrorMsg: errorMsg})
+	w.Header().Set("content-type", "application/json")
+	w.Write(msg)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/xionghengheng/ff_plib/comm"
@@ -77,9 +78,6 @@ func CreatePreTrialLessonHandler(w http.ResponseWriter, r *http.Request) {
 		rsp.ErrorMsg = authResult.ErrorMsg
 		return
 	}
-	if authResult.IsConsultant {
-		req.CreatedBy = authResult.ConsultantNick
-	}
 
 	if err != nil {
 		rsp.Code = -998
@@ -87,6 +85,23 @@ func CreatePreTrialLessonHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 顾问只能在分配的门店创建，创建人固定为顾问本人
+	scope, scopeResult := getTrialDataScope(authResult)
+	if !scopeResult.Success {
+		rsp.Code = scopeResult.Code
+		rsp.ErrorMsg = scopeResult.ErrorMsg
+		return
+	}
+	if !scope.Global {
+		if scopeResult = scope.checkGym(req.GymId); !scopeResult.Success {
+			rsp.Code = scopeResult.Code
+			rsp.ErrorMsg = scopeResult.ErrorMsg
+			Printf("CreatePreTrialLessonHandler gym denied, operator:%s gymId:%d\n", authResult.Operator, req.GymId)
+			return
+		}
+		req.CreatedBy = scope.Creator
+	}
+
 	// 参数校验（包含课程价格校验）
 	checkParamResult := checkCreatePreTrialLessonParam(&req)
 	if !checkParamResult.Success {
@@ -148,6 +163,8 @@ func CreatePreTrialLessonHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	Printf("UpdateToken succ, id:%d h5Token:%s\n", preTrialLesson.ID, h5Token)
+	preTrialLesson.LinkToken = h5Token
+	AddAuditChange(r, "pre_trial_lesson", strconv.FormatInt(preTrialLesson.ID, 10), nil, preTrialLesson)
 
 	// 构建响应
 	rsp.Code = 0
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/xionghengheng/ff_plib/comm"
@@ -94,6 +95,28 @@ func UpdatePreTrialLessonHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 顾问只能修改分配门店内自己创建的记录，也不能改到未分配的门店
+	scope, scopeResult := getTrialDataScope(authResult)
+	if !scopeResult.Success {
+		rsp.Code = scopeResult.Code
+		rsp.ErrorMsg = scopeResult.ErrorMsg
+		return
+	}
+	if scopeResult = scope.checkRecord(preTrialLesson); !scopeResult.Success {
+		rsp.Code = scopeResult.Code
+		rsp.ErrorMsg = scopeResult.ErrorMsg
+		Printf("UpdatePreTrialLessonHandler record denied, operator:%s record:%+v\n", authResult.Operator, preTrialLesson)
+		return
+	}
+	if req.GymId > 0 {
+		if scopeResult = scope.checkGym(req.GymId); !scopeResult.Success {
+			rsp.Code = scopeResult.Code
+			rsp.ErrorMsg = scopeResult.ErrorMsg
+			Printf("UpdatePreTrialLessonHandler gym denied, operator:%s gymId:%d\n", authResult.Operator, req.GymId)
+			return
+		}
+	}
+
 	// 检查状态：已过期、已取消和已完成（已使用）的不支持更新
 	// 同时需要检查是否实时过期（待使用状态但已超过24小时）
 	linkStatus := comm.GetRealLinkStatus(preTrialLesson.LinkStatus, preTrialLesson.CreatedTs)
@@ -174,6 +197,7 @@ func UpdatePreTrialLessonHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	AddAuditChange(r, "pre_trial_lesson", strconv.FormatInt(req.Id, 10), preTrialLesson, mapUpdates)
 	rsp.Code = 0
 	Printf("UpdatePreTrialLessonHandler success, id:%d\n", req.Id)
 }
@@ -107,8 +107,21 @@ func GetPreTrialLessonListHandler(w http.ResponseWriter, r *http.Request) {
 		pageSize = 100 // 最大每页100条
 	}
 
+	// 顾问只能看到分配门店内自己创建的记录，管理员看全部
+	scope, scopeResult := getTrialDataScope(authResult)
+	if !scopeResult.Success {
+		rsp.Code = scopeResult.Code
+		rsp.ErrorMsg = scopeResult.ErrorMsg
+		return
+	}
+
 	// 查询预体验课列表（passback作为offset使用）
-	list, err := dao.ImpPreTrailManage.GetTrailManageList(int(offset), pageSize)
+	var list []model.PreTrailManageModel
+	if scope.Global {
+		list, err = dao.ImpPreTrailManage.GetTrailManageList(int(offset), pageSize)
+	} else {
+		list, err = ImpConsultantScope.GetTrailManageListByScope(scope.VecGymId, scope.Creator, int(offset), pageSize)
+	}
 	if err != nil {
 		rsp.Code = -2002
 		rsp.ErrorMsg = fmt.Sprintf("查询预体验课列表失败: %v", err)
@@ -2,9 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/db"
+	"github.com/xionghengheng/ff_plib/db/dao"
+	"github.com/xionghengheng/ff_plib/db/model"
 )
 
 type RefundReq struct {
@@ -12,13 +18,19 @@ type RefundReq struct {
 	OutTradeNo      string `json:"out_trade_no"`      // 退款人订单号
 	RefundCourseCnt int    `json:"refund_course_cnt"` // 已退课程节数
 	RefundAmount    int    `json:"refund_amount"`     // 退款金额(单位元)
+	IdempotencyKey  string `json:"idempotency_key"`   // 幂等key，由管理后台每次发起退款时生成，重试时沿用同一个
 }
 
 type RefundRsp struct {
 	Code     int    `json:"errcode"`
 	ErrorMsg string `json:"errmsg,omitempty"`
+	RefundNo string `json:"refund_no,omitempty"` // 业务退款单号
+	Status   int    `json:"status,omitempty"`    // 退款状态（参考 Enum_Refund_Status）
 }
 
+// 提交支付渠道后超过该时间仍未完成的退款，允许用相同幂等key重新提交（支付渠道按退款单号去重，不会重复退款）
+const refundSubmitStaleSec = 60
+
 func getRefundReq(r *http.Request) (RefundReq, error) {
 	req := RefundReq{}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -46,37 +58,11 @@ func RefundPackagePhoneHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write(msg)
 	}()
 
-	// 验证用户名和密码
-	adminUserName := os.Getenv("ADMIN_USER_NAME")
-	adminPasswd := os.Getenv("ADMIN_PASSWD")
-	if len(adminUserName) == 0 || len(adminPasswd) == 0 {
-		rsp.Code = -900
-		rsp.ErrorMsg = "后台配置错误"
-		Printf("conf err, adminUserName:%s adminPasswd:%s\n", adminUserName, adminPasswd)
-		return
-	}
-
-	// 从header中提取用户名和密码进行校验
-	username := r.Header.Get("X-Username")
-	if username == "" {
-		rsp.Code = -995
-		rsp.ErrorMsg = "缺少X-Username header"
-		Printf("RefundPackagePhoneHandler missing X-Username header\n")
-		return
-	}
-
-	password := r.Header.Get("X-Password")
-	if password == "" {
-		rsp.Code = -995
-		rsp.ErrorMsg = "缺少X-Password header"
-		Printf("RefundPackagePhoneHandler missing X-Password header\n")
-		return
-	}
-
-	if username != adminUserName || password != adminPasswd {
-		rsp.Code = -994
-		rsp.ErrorMsg = "用户名或密码错误"
-		Printf("RefundPackagePhoneHandler auth failed, username:%s\n", username)
+	// 验证身份，顾问只能发起退款申请，需管理员审批后才会执行
+	authResult := ValidateConsultantOrAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
 		return
 	}
 
@@ -108,14 +94,429 @@ func RefundPackagePhoneHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: 实现退款逻辑
-	// 1. 查询订单信息
-	// 2. 验证订单状态
-	// 3. 调用微信退款接口
-	// 4. 更新数据库状态
+	if req.RefundCourseCnt <= 0 {
+		rsp.Code = -996
+		rsp.ErrorMsg = "退课节数必须大于0"
+		Printf("RefundPackagePhoneHandler invalid refund_course_cnt:%d\n", req.RefundCourseCnt)
+		return
+	}
 
-	rsp.Code = 0
-	Printf("RefundPackagePhoneHandler success, pay_uid:%d out_trade_no:%s refund_amount:%d\n", 
-		req.PayUid, req.OutTradeNo, req.RefundAmount)
+	if req.IdempotencyKey == "" || len(req.IdempotencyKey) > 64 {
+		rsp.Code = -996
+		rsp.ErrorMsg = "幂等key不能为空且不能超过64个字符"
+		Printf("RefundPackagePhoneHandler invalid idempotency_key:%s\n", req.IdempotencyKey)
+		return
+	}
+
+	// 相同幂等key的重复请求，直接返回已记录的结果
+	stRefundLedgerModel, err := ImpRefundLedger.GetRefundLedgerByKey(req.IdempotencyKey)
+	if err == nil {
+		Printf("RefundPackagePhoneHandler dup idempotency_key, req:%+v ledger:%+v\n", req, stRefundLedgerModel)
+		handleDupRefundReq(&req, stRefundLedgerModel, rsp)
+		return
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		rsp.Code = -977
+		rsp.ErrorMsg = "查询退款流水失败"
+		Printf("RefundPackagePhoneHandler GetRefundLedgerByKey err, err:%+v idempotency_key:%s\n", err, req.IdempotencyKey)
+		return
+	}
+
+	// 查询订单信息
+	stPaymentOrderModel, err := dao.ImpPaymentOrder.GetOrderById(req.OutTradeNo, req.PayUid)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			rsp.Code = -911
+			rsp.ErrorMsg = "订单不存在"
+		} else {
+			rsp.Code = -922
+			rsp.ErrorMsg = "查询订单失败"
+		}
+		Printf("RefundPackagePhoneHandler GetOrderById err, err:%+v out_trade_no:%s pay_uid:%d\n", err, req.OutTradeNo, req.PayUid)
+		return
+	}
+
+	// 查询课包信息
+	stCoursePackageModel, err := dao.ImpCoursePackage.GetCoursePackageById(stPaymentOrderModel.PackageID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			rsp.Code = -933
+			rsp.ErrorMsg = "订单对应的课包不存在"
+		} else {
+			rsp.Code = -944
+			rsp.ErrorMsg = "查询课包失败"
+		}
+		Printf("RefundPackagePhoneHandler GetCoursePackageById err, err:%+v PackageID:%s\n", err, stPaymentOrderModel.PackageID)
+		return
+	}
+
+	// 顾问发起或金额超过审批阈值的退款，先记录为待审批，由另一位管理员审批后再执行
+	status := Enum_Refund_Status_Requested
+	if authResult.IsConsultant || req.RefundAmount > getRefundApprovalThreshold() {
+		status = Enum_Refund_Status_PendingApproval
+	}
+
+	// 校验订单状态、退课节数和退款金额（扣除同一订单、课包下进行中的退款）并记录退款流水
+	// 订单和课包加锁保证并发的退款逐个校验，幂等key唯一索引保证并发的重复请求只有一个能写入
+	nowTs := time.Now().Unix()
+	stRefundLedgerModel = &RefundLedgerModel{
+		IdempotencyKey:       req.IdempotencyKey,
+		RefundNo:             genRefundNo(stPaymentOrderModel.OrderID, nowTs),
+		PayUid:               req.PayUid,
+		OutTradeNo:           stPaymentOrderModel.OrderID,
+		PackageID:            stCoursePackageModel.PackageID,
+		RefundCourseCnt:      req.RefundCourseCnt,
+		RefundFee:            req.RefundAmount * 100,
+		Status:               status,
+		Operator:             authResult.Operator,
+		OperatorIsConsultant: authResult.IsConsultant,
+		CreatedTs:            nowTs,
+		UpdatedTs:            nowTs,
+	}
+	checkResult, err := createRefundLedger(stRefundLedgerModel)
+	if err == nil && !checkResult.Success {
+		rsp.Code = checkResult.Code
+		rsp.ErrorMsg = checkResult.ErrorMsg
+		Printf("RefundPackagePhoneHandler checkRefundParam fail, req:%+v checkResult:%+v\n", req, checkResult)
+		return
+	}
+	if err != nil {
+		if stDupLedger, errGet := ImpRefundLedger.GetRefundLedgerByKey(req.IdempotencyKey); errGet == nil {
+			Printf("RefundPackagePhoneHandler concurrent dup idempotency_key, req:%+v ledger:%+v\n", req, stDupLedger)
+			handleDupRefundReq(&req, stDupLedger, rsp)
+			return
+		}
+		rsp.Code = -977
+		rsp.ErrorMsg = "记录退款流水失败"
+		Printf("RefundPackagePhoneHandler AddRefundLedger err, err:%+v ledger:%+v\n", err, stRefundLedgerModel)
+		return
+	}
+	Printf("RefundPackagePhoneHandler AddRefundLedger succ, ledger:%+v\n", stRefundLedgerModel)
+	defer func() {
+		AddAuditChange(r, "refund_ledger", stRefundLedgerModel.RefundNo, nil, stRefundLedgerModel)
+	}()
+
+	if stRefundLedgerModel.Status == Enum_Refund_Status_PendingApproval {
+		fillRefundRspByLedger(stRefundLedgerModel, rsp)
+		return
+	}
+	executeRefund(stRefundLedgerModel, rsp)
 	return
 }
+
+// handleDupRefundReq 处理幂等key重复的请求：参数一致则返回已记录的结果，未完成且已超时的退款继续执行
+func handleDupRefundReq(req *RefundReq, ledger *RefundLedgerModel, rsp *RefundRsp) {
+	if ledger.PayUid != req.PayUid || ledger.OutTradeNo != req.OutTradeNo ||
+		ledger.RefundCourseCnt != req.RefundCourseCnt || ledger.RefundFee != req.RefundAmount*100 {
+		rsp.Code = -1105
+		rsp.ErrorMsg = "幂等key已被其他退款请求使用"
+		return
+	}
+
+	if ledger.Status == Enum_Refund_Status_Requested || ledger.Status == Enum_Refund_Status_Submitted {
+		if time.Now().Unix()-ledger.UpdatedTs > refundSubmitStaleSec {
+			executeRefund(ledger, rsp)
+			return
+		}
+	}
+	fillRefundRspByLedger(ledger, rsp)
+}
+
+// executeRefund 按退款流水调用支付渠道退款，并推进流水状态
+func executeRefund(ledger *RefundLedgerModel, rsp *RefundRsp) {
+	// 抢占流水，保证同一时刻只有一个请求在提交退款
+	nowTs := time.Now().Unix()
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["status"] = Enum_Refund_Status_Submitted
+	mapUpdates["updated_ts"] = nowTs
+	ok, err := ImpRefundLedger.UpdateRefundLedgerStatus(ledger.ID, ledger.Status, ledger.UpdatedTs, mapUpdates)
+	if err != nil || !ok {
+		rsp.Code = -1106
+		rsp.ErrorMsg = "退款处理中，请稍后重试"
+		rsp.RefundNo = ledger.RefundNo
+		rsp.Status = ledger.Status
+		Printf("executeRefund UpdateRefundLedgerStatus to submitted fail, ok:%t err:%+v ledger:%+v\n", ok, err, ledger)
+		return
+	}
+	ledger.Status = Enum_Refund_Status_Submitted
+	ledger.UpdatedTs = nowTs
+
+	stPaymentOrderModel, err := dao.ImpPaymentOrder.GetOrderById(ledger.OutTradeNo, ledger.PayUid)
+	if err != nil {
+		rsp.Code = -922
+		rsp.ErrorMsg = "查询订单失败"
+		Printf("executeRefund GetOrderById err, err:%+v ledger:%+v\n", err, ledger)
+		return
+	}
+
+	// 调用微信退款接口，退款单号在流水创建时生成，重试时保持不变
+	stRefundClientReq := RefundClientReq{
+		OutTradeNo:  ledger.OutTradeNo,
+		OutRefundNo: ledger.RefundNo,
+		TotalFee:    getOrderPaidFee(stPaymentOrderModel),
+		RefundFee:   ledger.RefundFee,
+	}
+	stRefundClientRsp, err := refundClient.Refund(stRefundClientReq)
+	if err != nil {
+		var rejectErr *RefundRejectedError
+		if !errors.As(err, &rejectErr) {
+			// 网络错误等，退款结果未知，流水保持已提交，之后用相同幂等key重试
+			rsp.Code = -955
+			rsp.ErrorMsg = "支付退款结果未知，请稍后使用相同幂等key重试"
+			rsp.RefundNo = ledger.RefundNo
+			rsp.Status = ledger.Status
+			Printf("[RefundAlarm]executeRefund Refund unknown err, err:%+v stRefundClientReq:%+v\n", err, stRefundClientReq)
+			return
+		}
+
+		mapUpdates := make(map[string]interface{})
+		mapUpdates["status"] = Enum_Refund_Status_Failed
+		mapUpdates["err_code"] = -956
+		mapUpdates["err_msg"] = "支付渠道拒绝退款：" + rejectErr.Error()
+		mapUpdates["updated_ts"] = time.Now().Unix()
+		if err := ImpRefundLedger.FailRefundLedger(ledger, mapUpdates); err != nil {
+			Printf("executeRefund FailRefundLedger err, err:%+v ledger:%+v\n", err, ledger)
+		}
+		ledger.Status = Enum_Refund_Status_Failed
+		ledger.ErrCode = mapUpdates["err_code"].(int)
+		ledger.ErrMsg = mapUpdates["err_msg"].(string)
+		fillRefundRspByLedger(ledger, rsp)
+		Printf("executeRefund Refund rejected, err:%+v stRefundClientReq:%+v\n", err, stRefundClientReq)
+		return
+	}
+	Printf("executeRefund Refund succ, stRefundClientReq:%+v stRefundClientRsp:%+v\n", stRefundClientReq, stRefundClientRsp)
+
+	// 更新数据库状态
+	err = saveRefundResult(ledger, stRefundClientRsp.RefundId, time.Now().Unix())
+	if err != nil {
+		// 钱已经退了但是落库失败，流水保持已提交，需要人工介入核对
+		rsp.Code = -966
+		rsp.ErrorMsg = "退款成功但更新课包失败，请联系开发核对"
+		rsp.RefundNo = ledger.RefundNo
+		rsp.Status = ledger.Status
+		Printf("[RefundAlarm]executeRefund saveRefundResult err, err:%+v ledger:%+v\n", err, ledger)
+		return
+	}
+	ledger.Status = Enum_Refund_Status_Succeeded
+	ledger.WxRefundId = stRefundClientRsp.RefundId
+	fillRefundRspByLedger(ledger, rsp)
+	Printf("executeRefund success, ledger:%+v\n", ledger)
+}
+
+// fillRefundRspByLedger 根据退款流水的状态填充回包
+func fillRefundRspByLedger(ledger *RefundLedgerModel, rsp *RefundRsp) {
+	rsp.RefundNo = ledger.RefundNo
+	rsp.Status = ledger.Status
+	switch ledger.Status {
+	case Enum_Refund_Status_Succeeded:
+		rsp.Code = 0
+	case Enum_Refund_Status_Failed:
+		rsp.Code = ledger.ErrCode
+		rsp.ErrorMsg = ledger.ErrMsg
+	case Enum_Refund_Status_PendingApproval:
+		rsp.Code = -1107
+		rsp.ErrorMsg = "退款已提交，等待其他管理员审批"
+	case Enum_Refund_Status_Rejected:
+		rsp.Code = -1108
+		rsp.ErrorMsg = "退款审批被驳回：" + ledger.ApproveRemark
+	default:
+		rsp.Code = -1106
+		rsp.ErrorMsg = "退款处理中，请稍后重试"
+	}
+}
+
+// checkRefundParam 校验订单状态，以及退课节数、退款金额（单位分）扣除进行中的退款后是否超出剩余课时和已支付金额
+func checkRefundParam(payUid int64, refundCourseCnt int, refundFee int, order *model.PaymentOrderModel, coursePackage *model.CoursePackageModel, inflight RefundInflight) CheckParamResult {
+	if order.OrderStatus != model.Enum_Pay_Status_Paid {
+		return CheckParamResult{Success: false, Code: -1101, ErrorMsg: fmt.Sprintf("订单状态不支持退款，order_status:%d", order.OrderStatus)}
+	}
+
+	if coursePackage.Uid != payUid || coursePackage.PackageType != model.Enum_PackageType_PaidPackage {
+		return CheckParamResult{Success: false, Code: -1102, ErrorMsg: "订单对应的课包不是该用户的付费课包"}
+	}
+
+	remainCnt := coursePackage.RemainCnt - inflight.PackageCnt
+	if refundCourseCnt > remainCnt {
+		return CheckParamResult{Success: false, Code: -1103, ErrorMsg: fmt.Sprintf("退课节数超过剩余课时（已扣除处理中的退款），剩余课时：%d", remainCnt)}
+	}
+
+	remainFee := getOrderPaidFee(order) - order.RefundAmount - inflight.OrderFee
+	if refundFee > remainFee {
+		return CheckParamResult{Success: false, Code: -1104, ErrorMsg: fmt.Sprintf("退款金额超过可退金额，可退金额：%d元", remainFee/100)}
+	}
+
+	return CheckParamResult{Success: true}
+}
+
+// lockRefundOrderAndPackage 在事务里锁住退款对应的订单和课包，同一订单、课包的退款校验和写入串行执行
+func lockRefundOrderAndPackage(tx *gorm.DB, payUid int64, outTradeNo string, packageId string) (*model.PaymentOrderModel, *model.CoursePackageModel, error) {
+	var order model.PaymentOrderModel
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Table(payment_order_tableName).
+		Where("order_id = ? AND payer_uid = ?", outTradeNo, payUid).First(&order).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	var coursePackage model.CoursePackageModel
+	err = tx.Set("gorm:query_option", "FOR UPDATE").Table(course_package_tableName).
+		Where("package_id = ?", packageId).First(&coursePackage).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	return &order, &coursePackage, nil
+}
+
+// createRefundLedger 锁住订单和课包，扣除进行中的退款后校验，通过后写入退款流水
+// 校验不通过时返回的 CheckParamResult.Success 为false，不写入流水
+func createRefundLedger(ledger *RefundLedgerModel) (CheckParamResult, error) {
+	var checkResult CheckParamResult
+	err := db.Get().Transaction(func(tx *gorm.DB) error {
+		order, coursePackage, err := lockRefundOrderAndPackage(tx, ledger.PayUid, ledger.OutTradeNo, ledger.PackageID)
+		if err != nil {
+			return err
+		}
+		inflight, err := sumRefundInflight(tx, ledger.OutTradeNo, ledger.PackageID, 0)
+		if err != nil {
+			return err
+		}
+		checkResult = checkRefundParam(ledger.PayUid, ledger.RefundCourseCnt, ledger.RefundFee, order, coursePackage, inflight)
+		if !checkResult.Success {
+			return nil
+		}
+		// 直接执行的退款写入时就预扣课时，避免提交支付渠道期间课时被约走导致钱退了课包却扣不了
+		if ledger.Status == Enum_Refund_Status_Requested {
+			if err := reserveRefundCnt(tx, ledger); err != nil {
+				return err
+			}
+			ledger.CntReserved = true
+		}
+		return tx.Table(refund_ledger_tableName).Create(ledger).Error
+	})
+	if err != nil {
+		ledger.CntReserved = false
+	}
+	return checkResult, err
+}
+
+// approveRefundLedger 审批通过：锁住订单和课包重新校验（排除自己），通过后把流水从待审批推进为已申请
+// 流水已经不是待审批时返回 errStateChanged
+func approveRefundLedger(ledger *RefundLedgerModel, mapUpdates map[string]interface{}) (CheckParamResult, error) {
+	var checkResult CheckParamResult
+	err := db.Get().Transaction(func(tx *gorm.DB) error {
+		order, coursePackage, err := lockRefundOrderAndPackage(tx, ledger.PayUid, ledger.OutTradeNo, ledger.PackageID)
+		if err != nil {
+			return err
+		}
+		inflight, err := sumRefundInflight(tx, ledger.OutTradeNo, ledger.PackageID, ledger.ID)
+		if err != nil {
+			return err
+		}
+		checkResult = checkRefundParam(ledger.PayUid, ledger.RefundCourseCnt, ledger.RefundFee, order, coursePackage, inflight)
+		if !checkResult.Success {
+			return nil
+		}
+		if err := reserveRefundCnt(tx, ledger); err != nil {
+			return err
+		}
+		mapUpdates["cnt_reserved"] = true
+		ok, err := updateRefundLedgerStatus(tx, ledger.ID, Enum_Refund_Status_PendingApproval, 0, mapUpdates)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errStateChanged
+		}
+		return nil
+	})
+	if err == nil && checkResult.Success {
+		ledger.CntReserved = true
+	}
+	return checkResult, err
+}
+
+// reserveRefundCnt 在事务里从课包剩余课时预扣退课节数
+func reserveRefundCnt(tx *gorm.DB, ledger *RefundLedgerModel) error {
+	result := tx.Table(course_package_tableName).Model(&model.CoursePackageModel{}).
+		Where("package_id = ? AND remain_cnt >= ?", ledger.PackageID, ledger.RefundCourseCnt).
+		UpdateColumn("remain_cnt", gorm.Expr("remain_cnt - ?", ledger.RefundCourseCnt))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("remain_cnt not enough, package_id:%s refund_course_cnt:%d", ledger.PackageID, ledger.RefundCourseCnt)
+	}
+	return nil
+}
+
+// getOrderPaidFee 订单实际支付金额，单位分
+func getOrderPaidFee(order *model.PaymentOrderModel) int {
+	if order.PaymentAmount > 0 {
+		return order.PaymentAmount
+	}
+	return order.Price * 100
+}
+
+// genRefundNo 生成业务退款单号
+func genRefundNo(orderId string, ts int64) string {
+	return fmt.Sprintf("%s_rf_%d", orderId, ts)
+}
+
+// genOrderRefundUpdates 退款成功后订单需要更新的字段，累计退款金额达到实付金额时订单才标记为已退款，部分退款保持已支付
+func genOrderRefundUpdates(order *model.PaymentOrderModel, ledger *RefundLedgerModel, nowTs int64) map[string]interface{} {
+	mapOrderUpdates := make(map[string]interface{})
+	mapOrderUpdates["refund_time"] = nowTs
+	mapOrderUpdates["refund_course_cnt"] = order.RefundCourseCnt + ledger.RefundCourseCnt
+	mapOrderUpdates["refund_amount"] = order.RefundAmount + ledger.RefundFee
+	if order.RefundAmount+ledger.RefundFee >= getOrderPaidFee(order) {
+		mapOrderUpdates["order_status"] = model.Enum_Pay_Status_Refunded
+	}
+	return mapOrderUpdates
+}
+
+// saveRefundResult 同一个事务里推进退款流水为成功、更新订单和课包的退款信息，并扣减课包剩余课时
+func saveRefundResult(ledger *RefundLedgerModel, wxRefundId string, nowTs int64) error {
+	return db.Get().Transaction(func(tx *gorm.DB) error {
+		mapLedgerUpdates := make(map[string]interface{})
+		mapLedgerUpdates["status"] = Enum_Refund_Status_Succeeded
+		mapLedgerUpdates["wx_refund_id"] = wxRefundId
+		mapLedgerUpdates["updated_ts"] = nowTs
+		ok, err := updateRefundLedgerStatus(tx, ledger.ID, Enum_Refund_Status_Submitted, 0, mapLedgerUpdates)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("refund ledger not submitted, id:%d", ledger.ID)
+		}
+
+		var order model.PaymentOrderModel
+		err = tx.Set("gorm:query_option", "FOR UPDATE").Table(payment_order_tableName).
+			Where("order_id = ? AND payer_uid = ?", ledger.OutTradeNo, ledger.PayUid).First(&order).Error
+		if err != nil {
+			return err
+		}
+
+		mapOrderUpdates := genOrderRefundUpdates(&order, ledger, nowTs)
+		err = tx.Table(payment_order_tableName).Model(&model.PaymentOrderModel{}).
+			Where("order_id = ? AND payer_uid = ?", ledger.OutTradeNo, ledger.PayUid).Updates(mapOrderUpdates).Error
+		if err != nil {
+			return err
+		}
+
+		// 课时在进入已申请时已经预扣，这里只记录退课信息；预扣之前创建的流水仍在这里扣减
+		mapPackageUpdates := make(map[string]interface{})
+		mapPackageUpdates["refund_ts"] = nowTs
+		mapPackageUpdates["refund_lesson_cnt"] = gorm.Expr("refund_lesson_cnt + ?", ledger.RefundCourseCnt)
+		cli := tx.Table(course_package_tableName).Model(&model.CoursePackageModel{}).Where("package_id = ?", ledger.PackageID)
+		if !ledger.CntReserved {
+			mapPackageUpdates["remain_cnt"] = gorm.Expr("remain_cnt - ?", ledger.RefundCourseCnt)
+			cli = cli.Where("remain_cnt >= ?", ledger.RefundCourseCnt)
+		}
+		result := cli.Updates(mapPackageUpdates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("remain_cnt not enough, package_id:%s refund_course_cnt:%d", ledger.PackageID, ledger.RefundCourseCnt)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/db/dao"
+)
+
+// 默认退款审批阈值，单位元，可通过环境变量 REFUND_APPROVAL_THRESHOLD 配置
+const defaultRefundApprovalThreshold = 500
+
+// getRefundApprovalThreshold 超过该金额（单位元）的退款需要另一位管理员审批
+func getRefundApprovalThreshold() int {
+	strThreshold := os.Getenv("REFUND_APPROVAL_THRESHOLD")
+	if strThreshold == "" {
+		return defaultRefundApprovalThreshold
+	}
+	threshold, err := strconv.Atoi(strThreshold)
+	if err != nil || threshold < 0 {
+		Printf("getRefundApprovalThreshold invalid REFUND_APPROVAL_THRESHOLD:%s, use default\n", strThreshold)
+		return defaultRefundApprovalThreshold
+	}
+	return threshold
+}
+
+// RefundApprovalItem 退款审批列表项
+type RefundApprovalItem struct {
+	RefundRecordItem
+	PayUid               int64  `json:"pay_uid"`                // 退款人uid
+	UserName             string `json:"user_name"`              // 退款人昵称
+	PhoneNumber          string `json:"phone_number"`           // 退款人手机号
+	PackageID            string `json:"package_id"`             // 课包id
+	OperatorIsConsultant bool   `json:"operator_is_consultant"` // 发起人是否为顾问
+}
+
+type ApproveRefundReq struct {
+	RefundNo string `json:"refund_no"` // 业务退款单号
+	Approve  bool   `json:"approve"`   // true-通过，false-驳回
+	Remark   string `json:"remark"`    // 审批备注，驳回时必填
+}
+
+func getApproveRefundReq(r *http.Request) (ApproveRefundReq, error) {
+	req := ApproveRefundReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// ApproveRefundHandler 审批退款，审批人必须是管理员且不能是发起人，通过后立即执行退款
+func ApproveRefundHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getApproveRefundReq(r)
+	rsp := &RefundRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("ApproveRefundHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	// 验证用户名和密码
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+	approver := authResult.Operator
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if req.RefundNo == "" {
+		rsp.Code = -996
+		rsp.ErrorMsg = "退款单号不能为空"
+		Printf("ApproveRefundHandler refund_no is empty\n")
+		return
+	}
+	if !req.Approve && req.Remark == "" {
+		rsp.Code = -996
+		rsp.ErrorMsg = "驳回时必须填写原因"
+		Printf("ApproveRefundHandler reject without remark, refund_no:%s\n", req.RefundNo)
+		return
+	}
+
+	stRefundLedgerModel, err := ImpRefundLedger.GetRefundLedgerByRefundNo(req.RefundNo)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			rsp.Code = -911
+			rsp.ErrorMsg = "退款单不存在"
+		} else {
+			rsp.Code = -922
+			rsp.ErrorMsg = "查询退款单失败"
+		}
+		Printf("ApproveRefundHandler GetRefundLedgerByRefundNo err, err:%+v refund_no:%s\n", err, req.RefundNo)
+		return
+	}
+
+	if stRefundLedgerModel.Status != Enum_Refund_Status_PendingApproval {
+		rsp.Code = -1109
+		rsp.ErrorMsg = fmt.Sprintf("退款单当前状态不可审批，状态：%s", GetRefundStatusText(stRefundLedgerModel.Status))
+		rsp.RefundNo = stRefundLedgerModel.RefundNo
+		rsp.Status = stRefundLedgerModel.Status
+		Printf("ApproveRefundHandler status not pending, ledger:%+v\n", stRefundLedgerModel)
+		return
+	}
+
+	// 发起人和审批人不能是同一个人
+	if !stRefundLedgerModel.OperatorIsConsultant && stRefundLedgerModel.Operator == approver {
+		rsp.Code = -1110
+		rsp.ErrorMsg = "不能审批自己发起的退款，需由其他管理员审批"
+		Printf("ApproveRefundHandler approver is operator, approver:%s ledger:%+v\n", approver, stRefundLedgerModel)
+		return
+	}
+
+	stBeforeLedger := *stRefundLedgerModel
+	defer func() {
+		AddAuditChange(r, "refund_ledger", stRefundLedgerModel.RefundNo, stBeforeLedger, stRefundLedgerModel)
+	}()
+
+	nowTs := time.Now().Unix()
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["approver"] = approver
+	mapUpdates["approve_ts"] = nowTs
+	mapUpdates["approve_remark"] = req.Remark
+	mapUpdates["updated_ts"] = nowTs
+
+	if !req.Approve {
+		mapUpdates["status"] = Enum_Refund_Status_Rejected
+		ok, err := ImpRefundLedger.UpdateRefundLedgerStatus(stRefundLedgerModel.ID, Enum_Refund_Status_PendingApproval, 0, mapUpdates)
+		if err != nil || !ok {
+			rsp.Code = -933
+			rsp.ErrorMsg = "驳回失败，退款单状态已变更"
+			Printf("ApproveRefundHandler reject fail, ok:%t err:%+v ledger:%+v\n", ok, err, stRefundLedgerModel)
+			return
+		}
+		stRefundLedgerModel.Status = Enum_Refund_Status_Rejected
+		stRefundLedgerModel.Approver = approver
+		stRefundLedgerModel.ApproveTs = nowTs
+		stRefundLedgerModel.ApproveRemark = req.Remark
+		stRefundLedgerModel.UpdatedTs = nowTs
+		rsp.Code = 0
+		rsp.RefundNo = stRefundLedgerModel.RefundNo
+		rsp.Status = Enum_Refund_Status_Rejected
+		Printf("ApproveRefundHandler reject succ, approver:%s ledger:%+v\n", approver, stRefundLedgerModel)
+		return
+	}
+
+	// 审批期间课包可能已经上课或退款，推进状态前在事务里重新校验
+	mapUpdates["status"] = Enum_Refund_Status_Requested
+	checkResult, err := approveRefundLedger(stRefundLedgerModel, mapUpdates)
+	if err == nil && !checkResult.Success {
+		rsp.Code = checkResult.Code
+		rsp.ErrorMsg = checkResult.ErrorMsg + "，请驳回后重新发起"
+		Printf("ApproveRefundHandler checkRefundParam fail, ledger:%+v checkResult:%+v\n", stRefundLedgerModel, checkResult)
+		return
+	}
+	if err == errStateChanged {
+		rsp.Code = -933
+		rsp.ErrorMsg = "审批失败，退款单状态已变更"
+		Printf("ApproveRefundHandler approve fail, state changed, ledger:%+v\n", stRefundLedgerModel)
+		return
+	}
+	if err != nil {
+		rsp.Code = -922
+		rsp.ErrorMsg = "审批失败"
+		Printf("ApproveRefundHandler approveRefundLedger err, err:%+v ledger:%+v\n", err, stRefundLedgerModel)
+		return
+	}
+	stRefundLedgerModel.Status = Enum_Refund_Status_Requested
+	stRefundLedgerModel.Approver = approver
+	stRefundLedgerModel.ApproveTs = nowTs
+	stRefundLedgerModel.ApproveRemark = req.Remark
+	stRefundLedgerModel.UpdatedTs = nowTs
+	Printf("ApproveRefundHandler approve succ, approver:%s ledger:%+v\n", approver, stRefundLedgerModel)
+
+	executeRefund(stRefundLedgerModel, rsp)
+	return
+}
+
+type GetRefundApprovalListReq struct {
+	Status   int    `json:"status"`    // 退款状态，不传默认查询待审批
+	Passback string `json:"passback"`  // 翻页标记，首次请求传空字符串，后续传上次返回的passback
+	PageSize int    `json:"page_size"` // 每页数量
+}
+
+type GetRefundApprovalListRsp struct {
+	Code     int                  `json:"code"`
+	ErrorMsg string               `json:"errorMsg,omitempty"`
+	List     []RefundApprovalItem `json:"list,omitempty"`
+	Passback string               `json:"passback"` // 下一页的翻页标记，为空字符串表示没有更多数据
+}
+
+func getGetRefundApprovalListReq(r *http.Request) (GetRefundApprovalListReq, error) {
+	req := GetRefundApprovalListReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// GetRefundApprovalListHandler 获取退款审批列表
+func GetRefundApprovalListHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getGetRefundApprovalListReq(r)
+	rsp := &GetRefundApprovalListRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetRefundApprovalListHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateConsultantOrAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	status := req.Status
+	if status == 0 {
+		status = Enum_Refund_Status_PendingApproval
+	}
+
+	var offset int64
+	if len(req.Passback) > 0 {
+		offset, _ = strconv.ParseInt(req.Passback, 10, 64)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	pageSize := req.PageSize
+	if pageSize <= 0 {
+		pageSize = 20 // 默认每页20条
+	}
+	if pageSize > 100 {
+		pageSize = 100 // 最大每页100条
+	}
+
+	vecRefundLedgerModel, err := ImpRefundLedger.GetRefundLedgerListByStatus(status, int(offset), pageSize)
+	if err != nil {
+		rsp.Code = -922
+		rsp.ErrorMsg = "查询退款审批列表失败"
+		Printf("GetRefundApprovalListHandler GetRefundLedgerListByStatus err, err:%+v status:%d\n", err, status)
+		return
+	}
+
+	for _, v := range vecRefundLedgerModel {
+		rsp.List = append(rsp.List, convertRefundLedger2ApprovalItem(v))
+	}
+
+	if len(vecRefundLedgerModel) == pageSize {
+		rsp.Passback = strconv.FormatInt(offset+int64(pageSize), 10)
+	}
+	rsp.Code = 0
+	Printf("GetRefundApprovalListHandler success, status:%d offset:%d count:%d\n", status, offset, len(rsp.List))
+	return
+}
+
+type GetRefundApprovalDetailReq struct {
+	RefundNo string `json:"refund_no"` // 业务退款单号
+}
+
+type GetRefundApprovalDetailRsp struct {
+	Code              int                `json:"code"`
+	ErrorMsg          string             `json:"errorMsg,omitempty"`
+	Item              RefundApprovalItem `json:"item"`
+	OrderPaidAmount   int                `json:"order_paid_amount"`   // 订单实付金额，单位元
+	OrderRefundAmount int                `json:"order_refund_amount"` // 订单已退款金额，单位元
+	RemainCnt         int                `json:"remain_cnt"`          // 课包当前剩余课时
+	TotalCnt          int                `json:"total_cnt"`           // 课包总课时
+}
+
+func getGetRefundApprovalDetailReq(r *http.Request) (GetRefundApprovalDetailReq, error) {
+	req := GetRefundApprovalDetailReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// GetRefundApprovalDetailHandler 获取退款审批详情，附带订单和课包的当前情况供审批人核对
+func GetRefundApprovalDetailHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getGetRefundApprovalDetailReq(r)
+	rsp := &GetRefundApprovalDetailRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("GetRefundApprovalDetailHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	authResult := ValidateConsultantOrAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if req.RefundNo == "" {
+		rsp.Code = -996
+		rsp.ErrorMsg = "退款单号不能为空"
+		Printf("GetRefundApprovalDetailHandler refund_no is empty\n")
+		return
+	}
+
+	stRefundLedgerModel, err := ImpRefundLedger.GetRefundLedgerByRefundNo(req.RefundNo)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			rsp.Code = -911
+			rsp.ErrorMsg = "退款单不存在"
+		} else {
+			rsp.Code = -922
+			rsp.ErrorMsg = "查询退款单失败"
+		}
+		Printf("GetRefundApprovalDetailHandler GetRefundLedgerByRefundNo err, err:%+v refund_no:%s\n", err, req.RefundNo)
+		return
+	}
+	rsp.Item = convertRefundLedger2ApprovalItem(*stRefundLedgerModel)
+
+	stPaymentOrderModel, err := dao.ImpPaymentOrder.GetOrderById(stRefundLedgerModel.OutTradeNo, stRefundLedgerModel.PayUid)
+	if err != nil {
+		rsp.Code = -933
+		rsp.ErrorMsg = "查询订单失败"
+		Printf("GetRefundApprovalDetailHandler GetOrderById err, err:%+v ledger:%+v\n", err, stRefundLedgerModel)
+		return
+	}
+	rsp.OrderPaidAmount = getOrderPaidFee(stPaymentOrderModel) / 100
+	rsp.OrderRefundAmount = stPaymentOrderModel.RefundAmount / 100
+
+	stCoursePackageModel, err := dao.ImpCoursePackage.GetCoursePackageById(stRefundLedgerModel.PackageID)
+	if err != nil {
+		rsp.Code = -944
+		rsp.ErrorMsg = "查询课包失败"
+		Printf("GetRefundApprovalDetailHandler GetCoursePackageById err, err:%+v ledger:%+v\n", err, stRefundLedgerModel)
+		return
+	}
+	rsp.RemainCnt = stCoursePackageModel.RemainCnt
+	rsp.TotalCnt = stCoursePackageModel.TotalCnt
+
+	rsp.Code = 0
+	Printf("GetRefundApprovalDetailHandler success, rsp:%+v\n", rsp)
+	return
+}
+
+// convertRefundLedger2ApprovalItem 退款流水转换为审批列表项
+func convertRefundLedger2ApprovalItem(ledger RefundLedgerModel) RefundApprovalItem {
+	item := RefundApprovalItem{
+		RefundRecordItem:     ConvertRefundLedger2RecordItem(ledger),
+		PayUid:               ledger.PayUid,
+		PackageID:            ledger.PackageID,
+		OperatorIsConsultant: ledger.OperatorIsConsultant,
+	}
+	stUserInfoModel, err := dao.ImpUser.GetUser(ledger.PayUid)
+	if err != nil {
+		Printf("convertRefundLedger2ApprovalItem GetUser err, err:%+v uid:%d\n", err, ledger.PayUid)
+		return item
+	}
+	item.UserName = stUserInfoModel.Nick
+	if stUserInfoModel.PhoneNumber != nil {
+		item.PhoneNumber = *stUserInfoModel.PhoneNumber
+	}
+	return item
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// RefundClientReq 发起支付退款的请求
+type RefundClientReq struct {
+	OutTradeNo  string // 业务支付订单号（对应PaymentOrderModel.OrderID）
+	OutRefundNo string // 业务退款单号，同一个退款单号重复提交不会重复退款
+	TotalFee    int    // 订单总金额，单位分
+	RefundFee   int    // 本次退款金额，单位分
+}
+
+// RefundClientRsp 支付退款结果
+type RefundClientRsp struct {
+	RefundId string // 支付渠道侧的退款单号
+}
+
+// RefundClient 支付退款客户端
+type RefundClient interface {
+	Refund(req RefundClientReq) (RefundClientRsp, error)
+}
+
+// RefundRejectedError 支付渠道明确拒绝退款（如余额不足、订单状态不允许），与网络错误等结果未知的情况区分开
+type RefundRejectedError struct {
+	Reason string
+}
+
+func (e *RefundRejectedError) Error() string {
+	return e.Reason
+}
+
+// 退款客户端实例，REFUND_CLIENT_MODE=fake 时使用本地假实现（测试环境联调用，不会真的退款）
+var refundClient RefundClient = newRefundClient()
+
+func newRefundClient() RefundClient {
+	if os.Getenv("REFUND_CLIENT_MODE") == "fake" {
+		return &fakeRefundClient{}
+	}
+	return &wxPayRefundClient{}
+}
+
+// wxPayRefundClient 通过云托管开放接口调用微信支付退款
+// 参考文档：https://developers.weixin.qq.com/miniprogram/dev/wxcloudrun/src/development/pay/callback/refund.html
+type wxPayRefundClient struct{}
+
+type wxPayRefundReq struct {
+	OutTradeNo   string `json:"out_trade_no"`
+	OutRefundNo  string `json:"out_refund_no"`
+	TotalFee     int    `json:"total_fee"`
+	RefundFee    int    `json:"refund_fee"`
+	SubMchId     string `json:"sub_mch_id"`
+	EnvId        string `json:"env_id"`
+	CallbackType int    `json:"callback_type"`
+}
+
+type wxPayRefundRsp struct {
+	Errcode  int    `json:"errcode"`
+	Errmsg   string `json:"errmsg"`
+	Respdata struct {
+		ReturnCode string `json:"return_code"`
+		ReturnMsg  string `json:"return_msg"`
+		ResultCode string `json:"result_code"`
+		ErrCode    string `json:"err_code"`
+		ErrCodeDes string `json:"err_code_des"`
+		RefundId   string `json:"refund_id"`
+	} `json:"respdata"`
+}
+
+func (c *wxPayRefundClient) Refund(req RefundClientReq) (RefundClientRsp, error) {
+	var rsp RefundClientRsp
+	subMchId := os.Getenv("WX_PAY_SUB_MCH_ID")
+	envId := os.Getenv("WX_CLOUD_ENV_ID")
+	if len(subMchId) == 0 || len(envId) == 0 {
+		return rsp, errors.New("WX_PAY_SUB_MCH_ID or WX_CLOUD_ENV_ID not set")
+	}
+
+	jsonData, err := json.Marshal(wxPayRefundReq{
+		OutTradeNo:   req.OutTradeNo,
+		OutRefundNo:  req.OutRefundNo,
+		TotalFee:     req.TotalFee,
+		RefundFee:    req.RefundFee,
+		SubMchId:     subMchId,
+		EnvId:        envId,
+		CallbackType: 2,
+	})
+	if err != nil {
+		return rsp, err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post("http://api.weixin.qq.com/_/pay/refund", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		Printf("http.Post wxPayRefund err, out_trade_no:%s err:%+v\n", req.OutTradeNo, err)
+		return rsp, err
+	}
+	defer resp.Body.Close()
+
+	rspBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		Printf("http.Post wxPayRefund ReadAll err, out_trade_no:%s err:%+v\n", req.OutTradeNo, err)
+		return rsp, err
+	}
+	Printf("http.Post wxPayRefund succ, req:%+v rsp:%s\n", req, rspBody)
+
+	var wxRsp wxPayRefundRsp
+	if err = json.Unmarshal(rspBody, &wxRsp); err != nil {
+		return rsp, err
+	}
+	if err = checkWxPayRefundRsp(&wxRsp); err != nil {
+		return rsp, err
+	}
+	rsp.RefundId = wxRsp.Respdata.RefundId
+	return rsp, nil
+}
+
+// 微信支付明确拒绝、重试也不会成功的错误码，退款流水直接失败并释放锁定的课时
+// 其他错误码（如 SYSTEMERROR、BIZERR_NEED_RETRY、FREQUENCY_LIMITED）结果未知，流水保持已提交，用同一个退款单号重试
+var mapWxPayRefundRejectCode = map[string]bool{
+	"NOTENOUGH":             true, // 商户余额不足
+	"USER_ACCOUNT_ABNORMAL": true, // 用户账户注销或冻结
+	"INVALID_REQ_TOO_MUCH":  true, // 无效请求过多
+	"ERROR":                 true, // 业务错误，如订单已全额退款、超过退款期限
+	"INVALID_TRANSACTIONID": true, // 无效的支付单号
+	"ORDERNOTEXIST":         true, // 订单不存在
+}
+
+// checkWxPayRefundRsp 检查微信支付的退款结果，明确拒绝时返回 *RefundRejectedError
+func checkWxPayRefundRsp(wxRsp *wxPayRefundRsp) error {
+	if wxRsp.Errcode != 0 {
+		return fmt.Errorf("wxPayRefund err, code:%d msg:%s", wxRsp.Errcode, wxRsp.Errmsg)
+	}
+	if wxRsp.Respdata.ReturnCode == "SUCCESS" && wxRsp.Respdata.ResultCode == "FAIL" && mapWxPayRefundRejectCode[wxRsp.Respdata.ErrCode] {
+		return &RefundRejectedError{Reason: fmt.Sprintf("%s(%s)", wxRsp.Respdata.ErrCodeDes, wxRsp.Respdata.ErrCode)}
+	}
+	if wxRsp.Respdata.ReturnCode != "SUCCESS" || wxRsp.Respdata.ResultCode != "SUCCESS" {
+		return fmt.Errorf("wxPayRefund fail, return_msg:%s err_code:%s err_code_des:%s",
+			wxRsp.Respdata.ReturnMsg, wxRsp.Respdata.ErrCode, wxRsp.Respdata.ErrCodeDes)
+	}
+	return nil
+}
+
+// fakeRefundClient 本地假实现，只记录调用，不发生真实资金变动
+type fakeRefundClient struct {
+	mu      sync.Mutex
+	VecReq  []RefundClientReq // 收到的全部退款请求
+	FailErr error             // 非空时每次调用都返回该错误，用于模拟退款失败（*RefundRejectedError 模拟渠道拒绝）
+}
+
+func (c *fakeRefundClient) Refund(req RefundClientReq) (RefundClientRsp, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.VecReq = append(c.VecReq, req)
+	if c.FailErr != nil {
+		return RefundClientRsp{}, c.FailErr
+	}
+	Printf("fakeRefundClient Refund, req:%+v\n", req)
+	return RefundClientRsp{RefundId: "fake_" + req.OutRefundNo}, nil
+}
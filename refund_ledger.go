@@ -0,0 +1,193 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/db"
+	"github.com/xionghengheng/ff_plib/db/model"
+)
+
+// RefundLedgerModel 退款流水，每次退款请求一条记录，通过调用方传入的幂等key去重
+type RefundLedgerModel struct {
+	ID                   int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`                 // 主键ID
+	IdempotencyKey       string `json:"idempotency_key" gorm:"type:varchar(64);unique_index"` // 调用方传入的幂等key
+	RefundNo             string `json:"refund_no" gorm:"type:varchar(128);index"`             // 业务退款单号（传给支付渠道的out_refund_no）
+	PayUid               int64  `json:"pay_uid"`                                              // 退款人uid
+	OutTradeNo           string `json:"out_trade_no" gorm:"type:varchar(128);index"`          // 退款订单号
+	PackageID            string `json:"package_id" gorm:"type:varchar(128);index"`            // 课包id
+	RefundCourseCnt      int    `json:"refund_course_cnt"`                                    // 退课节数
+	RefundFee            int    `json:"refund_fee"`                                           // 退款金额，单位分
+	Status               int    `json:"status"`                                               // 退款状态（参考 Enum_Refund_Status）
+	WxRefundId           string `json:"wx_refund_id"`                                         // 支付渠道侧的退款单号
+	ErrCode              int    `json:"err_code"`                                             // 失败时的错误码
+	ErrMsg               string `json:"err_msg" gorm:"type:varchar(512)"`                     // 失败时的错误信息
+	Operator             string `json:"operator"`                                             // 发起人（管理员为登录名，顾问为OpenID）
+	OperatorIsConsultant bool   `json:"operator_is_consultant"`                               // 发起人是否为顾问
+	Approver             string `json:"approver"`                                             // 审批人
+	ApproveTs            int64  `json:"approve_ts"`                                           // 审批时间
+	ApproveRemark        string `json:"approve_remark" gorm:"type:varchar(512)"`              // 审批备注（驳回原因）
+	CntReserved          bool   `json:"cnt_reserved"`                                         // 退课节数是否已从课包剩余课时预扣（进入已申请时预扣，退款失败时归还）
+	CreatedTs            int64  `json:"created_ts"`                                           // 创建时间
+	UpdatedTs            int64  `json:"updated_ts"`                                           // 更新时间
+}
+
+// 退款状态流转：已申请->已提交支付渠道->退款成功/退款失败
+// 顾问发起或超过审批阈值的退款：待审批->已申请->...，或 待审批->已驳回
+const (
+	Enum_Refund_Status_Requested       int = iota + 1 // 1 = 已申请
+	Enum_Refund_Status_Submitted                      // 2 = 已提交支付渠道
+	Enum_Refund_Status_Succeeded                      // 3 = 退款成功
+	Enum_Refund_Status_Failed                         // 4 = 退款失败
+	Enum_Refund_Status_PendingApproval                // 5 = 待审批
+	Enum_Refund_Status_Rejected                       // 6 = 审批驳回
+)
+
+const refund_ledger_tableName = "refund_ledger"
+
+// RefundLedgerInterface 退款流水数据模型接口
+type RefundLedgerInterface interface {
+	// 添加退款流水，幂等key重复时返回错误
+	AddRefundLedger(stRefundLedgerModel *RefundLedgerModel) error
+
+	// 根据幂等key获取退款流水
+	GetRefundLedgerByKey(idempotencyKey string) (*RefundLedgerModel, error)
+
+	// 根据退款单号获取退款流水
+	GetRefundLedgerByRefundNo(refundNo string) (*RefundLedgerModel, error)
+
+	// 根据状态分页获取退款流水，按创建时间降序
+	GetRefundLedgerListByStatus(status int, offset int, limit int) ([]RefundLedgerModel, error)
+
+	// 根据课包id获取退款流水，按创建时间降序
+	GetRefundLedgerListByPackageId(packageId string) ([]RefundLedgerModel, error)
+
+	// 状态为fromStatus（且fromUpdatedTs非0时更新时间也一致）才更新，返回是否更新成功，用于保证状态只流转一次
+	UpdateRefundLedgerStatus(id int64, fromStatus int, fromUpdatedTs int64, mapUpdates map[string]interface{}) (bool, error)
+
+	// 支付渠道拒绝退款：流水从已提交推进为失败，并归还预扣的课时
+	FailRefundLedger(ledger *RefundLedgerModel, mapUpdates map[string]interface{}) error
+}
+
+// RefundLedgerInterfaceImp 退款流水数据模型实现
+type RefundLedgerInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpRefundLedger RefundLedgerInterface = &RefundLedgerInterfaceImp{}
+
+func (imp *RefundLedgerInterfaceImp) AddRefundLedger(stRefundLedgerModel *RefundLedgerModel) error {
+	cli := db.Get()
+	return cli.Table(refund_ledger_tableName).Create(stRefundLedgerModel).Error
+}
+
+func (imp *RefundLedgerInterfaceImp) GetRefundLedgerByKey(idempotencyKey string) (*RefundLedgerModel, error) {
+	var ledger = new(RefundLedgerModel)
+	cli := db.Get()
+	err := cli.Table(refund_ledger_tableName).Where("idempotency_key = ?", idempotencyKey).First(ledger).Error
+	return ledger, err
+}
+
+func (imp *RefundLedgerInterfaceImp) GetRefundLedgerByRefundNo(refundNo string) (*RefundLedgerModel, error) {
+	var ledger = new(RefundLedgerModel)
+	cli := db.Get()
+	err := cli.Table(refund_ledger_tableName).Where("refund_no = ?", refundNo).First(ledger).Error
+	return ledger, err
+}
+
+func (imp *RefundLedgerInterfaceImp) GetRefundLedgerListByStatus(status int, offset int, limit int) ([]RefundLedgerModel, error) {
+	var vecRefundLedgerModel []RefundLedgerModel
+	cli := db.Get()
+	err := cli.Table(refund_ledger_tableName).Where("status = ?", status).Order("created_ts DESC").Offset(offset).Limit(limit).Find(&vecRefundLedgerModel).Error
+	return vecRefundLedgerModel, err
+}
+
+func (imp *RefundLedgerInterfaceImp) GetRefundLedgerListByPackageId(packageId string) ([]RefundLedgerModel, error) {
+	var vecRefundLedgerModel []RefundLedgerModel
+	cli := db.Get()
+	err := cli.Table(refund_ledger_tableName).Where("package_id = ?", packageId).Order("created_ts DESC").Find(&vecRefundLedgerModel).Error
+	return vecRefundLedgerModel, err
+}
+
+func (imp *RefundLedgerInterfaceImp) UpdateRefundLedgerStatus(id int64, fromStatus int, fromUpdatedTs int64, mapUpdates map[string]interface{}) (bool, error) {
+	return updateRefundLedgerStatus(db.Get(), id, fromStatus, fromUpdatedTs, mapUpdates)
+}
+
+func (imp *RefundLedgerInterfaceImp) FailRefundLedger(ledger *RefundLedgerModel, mapUpdates map[string]interface{}) error {
+	return db.Get().Transaction(func(tx *gorm.DB) error {
+		ok, err := updateRefundLedgerStatus(tx, ledger.ID, Enum_Refund_Status_Submitted, 0, mapUpdates)
+		if err != nil || !ok || !ledger.CntReserved {
+			return err
+		}
+		return tx.Table(course_package_tableName).Model(&model.CoursePackageModel{}).Where("package_id = ?", ledger.PackageID).
+			UpdateColumn("remain_cnt", gorm.Expr("remain_cnt + ?", ledger.RefundCourseCnt)).Error
+	})
+}
+
+// updateRefundLedgerStatus 支持在事务里调用
+func updateRefundLedgerStatus(cli *gorm.DB, id int64, fromStatus int, fromUpdatedTs int64, mapUpdates map[string]interface{}) (bool, error) {
+	cli = cli.Table(refund_ledger_tableName).Model(&RefundLedgerModel{}).Where("id = ? AND status = ?", id, fromStatus)
+	if fromUpdatedTs != 0 {
+		cli = cli.Where("updated_ts = ?", fromUpdatedTs)
+	}
+	result := cli.Updates(mapUpdates)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// RefundInflight 同一订单、课包下还没有结束的退款（待审批、已申请、已提交），校验可退金额和课时时需要扣除
+type RefundInflight struct {
+	OrderFee   int // 订单下进行中的退款金额，单位分
+	PackageCnt int // 课包下进行中的退课节数
+}
+
+// sumRefundInflight 在事务里统计订单、课包下进行中的退款，excludeId 非0时不统计该条流水（审批时排除自己）
+func sumRefundInflight(tx *gorm.DB, outTradeNo string, packageId string, excludeId int64) (RefundInflight, error) {
+	var inflight RefundInflight
+	vecInflightStatus := []int{Enum_Refund_Status_PendingApproval, Enum_Refund_Status_Requested, Enum_Refund_Status_Submitted}
+	err := tx.Table(refund_ledger_tableName).Select("COALESCE(SUM(refund_fee), 0)").
+		Where("out_trade_no = ? AND status IN (?) AND id <> ?", outTradeNo, vecInflightStatus, excludeId).Row().Scan(&inflight.OrderFee)
+	if err != nil {
+		return inflight, err
+	}
+	err = tx.Table(refund_ledger_tableName).Select("COALESCE(SUM(refund_course_cnt), 0)").
+		Where("package_id = ? AND status IN (?) AND cnt_reserved = false AND id <> ?", packageId, vecInflightStatus, excludeId).Row().Scan(&inflight.PackageCnt)
+	return inflight, err
+}
+
+// GetRefundStatusText 退款状态描述
+func GetRefundStatusText(status int) string {
+	switch status {
+	case Enum_Refund_Status_Requested:
+		return "已申请"
+	case Enum_Refund_Status_Submitted:
+		return "退款中"
+	case Enum_Refund_Status_Succeeded:
+		return "退款成功"
+	case Enum_Refund_Status_Failed:
+		return "退款失败"
+	case Enum_Refund_Status_PendingApproval:
+		return "待审批"
+	case Enum_Refund_Status_Rejected:
+		return "审批驳回"
+	}
+	return "未知"
+}
+
+// ConvertRefundLedger2RecordItem 退款流水转换为课包详情中的退款记录
+func ConvertRefundLedger2RecordItem(ledger RefundLedgerModel) RefundRecordItem {
+	return RefundRecordItem{
+		RefundNo:        ledger.RefundNo,
+		OutTradeNo:      ledger.OutTradeNo,
+		RefundCourseCnt: ledger.RefundCourseCnt,
+		RefundAmount:    ledger.RefundFee / 100,
+		Status:          ledger.Status,
+		StatusText:      GetRefundStatusText(ledger.Status),
+		ErrMsg:          ledger.ErrMsg,
+		Operator:        ledger.Operator,
+		Approver:        ledger.Approver,
+		ApproveTs:       ledger.ApproveTs,
+		ApproveRemark:   ledger.ApproveRemark,
+		CreatedTs:       ledger.CreatedTs,
+		UpdatedTs:       ledger.UpdatedTs,
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/jinzhu/gorm"
+	"github.com/xionghengheng/ff_plib/db/dao"
+	"github.com/xionghengheng/ff_plib/db/model"
+)
+
+// 退款计算策略
+const (
+	RefundPolicy_ProRata           = "pro_rata"            // 按实付单价折算剩余课时
+	RefundPolicy_OriginalUnitPrice = "original_unit_price" // 已上课时按原价（折前单价）扣除，收回已上课时享受的优惠
+	RefundPolicy_FeeDeduction      = "fee_deduction"       // 按实付单价折算剩余课时后，再扣除一定比例的手续费
+)
+
+// 默认手续费比例（百分比），可通过环境变量 REFUND_FEE_RATE 配置
+const defaultRefundFeeRate = 10
+
+type QuoteRefundReq struct {
+	PackageID string `json:"package_id"` // 课包id
+	Policy    string `json:"policy"`     // 退款计算策略，不传时使用环境变量 REFUND_QUOTE_POLICY，默认 pro_rata
+}
+
+type QuoteRefundRsp struct {
+	Code     int    `json:"code"`
+	ErrorMsg string `json:"errorMsg,omitempty"`
+
+	PackageID        string                 `json:"package_id"`        // 课包id
+	PayUid           int64                  `json:"pay_uid"`           // 付款人uid
+	Policy           string                 `json:"policy"`            // 本次使用的退款计算策略
+	PaidCnt          int                    `json:"paid_cnt"`          // 购买的总课时（含续费）
+	PaidFee          int                    `json:"paid_fee"`          // 实付总金额，单位分
+	ListFee          int                    `json:"list_fee"`          // 折前总金额，单位分
+	RefundedFee      int                    `json:"refunded_fee"`      // 已退款金额，单位分
+	RefundedCnt      int                    `json:"refunded_cnt"`      // 已退课时
+	UnitFee          int                    `json:"unit_fee"`          // 折后单节课价格，单位分
+	ListUnitFee      int                    `json:"list_unit_fee"`     // 折前单节课价格，单位分
+	CompletedCnt     int                    `json:"completed_cnt"`     // 已核销课时
+	MissedCnt        int                    `json:"missed_cnt"`        // 旷课且未归还的课时
+	ScheduledCnt     int                    `json:"scheduled_cnt"`     // 已预约未上的课时（已从剩余课时扣除，如需退需先取消预约）
+	ConsumedCnt      int                    `json:"consumed_cnt"`      // 已消耗课时（已核销+旷课未归还）
+	ConsumedFee      int                    `json:"consumed_fee"`      // 已消耗价值，单位分
+	DeductFee        int                    `json:"deduct_fee"`        // 按策略额外扣除的金额（收回的优惠或手续费），单位分
+	RefundableCnt    int                    `json:"refundable_cnt"`    // 可退课时
+	RefundableFee    int                    `json:"refundable_fee"`    // 可退金额，单位分
+	RefundableAmount int                    `json:"refundable_amount"` // 可退金额，单位元（向下取整，可直接填入退款请求）
+	VecOrder         []QuoteRefundOrderItem `json:"vec_order"`         // 课包下的订单，退款时需要指定其中一个订单号
+}
+
+type QuoteRefundOrderItem struct {
+	OutTradeNo      string `json:"out_trade_no"`      // 订单号
+	OrderStatus     int    `json:"order_status"`      // 订单状态
+	CourseCnt       int    `json:"course_cnt"`        // 订单购买的课时
+	PaidFee         int    `json:"paid_fee"`          // 订单实付金额，单位分
+	RefundedFee     int    `json:"refunded_fee"`      // 订单已退款金额，单位分
+	RemainRefundFee int    `json:"remain_refund_fee"` // 订单剩余可退金额上限，单位分
+	OrderTime       int64  `json:"order_time"`        // 下单时间
+}
+
+func getQuoteRefundReq(r *http.Request) (QuoteRefundReq, error) {
+	req := QuoteRefundReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, err
+	}
+	defer r.Body.Close()
+	return req, nil
+}
+
+// QuoteRefundHandler 根据课包的付款、核销和剩余课时计算可退金额，供管理后台发起退款前参考
+func QuoteRefundHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getQuoteRefundReq(r)
+	rsp := &QuoteRefundRsp{}
+
+	//打日志要加换行，不然不会刷到屏幕
+	Printf("QuoteRefundHandler start, req:%+v\n", req)
+
+	defer func() {
+		msg, err := json.Marshal(rsp)
+		if err != nil {
+			fmt.Fprint(w, "内部错误")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(msg)
+	}()
+
+	// 验证用户名和密码
+	authResult := ValidateAdminAuth(r)
+	if !authResult.Success {
+		rsp.Code = authResult.Code
+		rsp.ErrorMsg = authResult.ErrorMsg
+		return
+	}
+
+	if err != nil {
+		rsp.Code = -998
+		rsp.ErrorMsg = err.Error()
+		return
+	}
+
+	if req.PackageID == "" {
+		rsp.Code = -996
+		rsp.ErrorMsg = "课包id不能为空"
+		Printf("QuoteRefundHandler package_id is empty\n")
+		return
+	}
+
+	policy := req.Policy
+	if policy == "" {
+		policy = os.Getenv("REFUND_QUOTE_POLICY")
+	}
+	if policy == "" {
+		policy = RefundPolicy_ProRata
+	}
+	if policy != RefundPolicy_ProRata && policy != RefundPolicy_OriginalUnitPrice && policy != RefundPolicy_FeeDeduction {
+		rsp.Code = -996
+		rsp.ErrorMsg = "不支持的退款计算策略"
+		Printf("QuoteRefundHandler invalid policy:%s\n", policy)
+		return
+	}
+
+	// 查询课包信息
+	stCoursePackageModel, err := dao.ImpCoursePackage.GetCoursePackageById(req.PackageID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			rsp.Code = -911
+			rsp.ErrorMsg = "课包不存在"
+		} else {
+			rsp.Code = -922
+			rsp.ErrorMsg = "查询课包失败"
+		}
+		Printf("QuoteRefundHandler GetCoursePackageById err, err:%+v PackageID:%s\n", err, req.PackageID)
+		return
+	}
+	if stCoursePackageModel.PackageType != model.Enum_PackageType_PaidPackage {
+		rsp.Code = -1102
+		rsp.ErrorMsg = "只有付费课包支持退款"
+		Printf("QuoteRefundHandler not paid package, PackageID:%s PackageType:%d\n", req.PackageID, stCoursePackageModel.PackageType)
+		return
+	}
+
+	// 查询课包对应的订单（含续费）
+	vecPaymentOrderModel, err := dao.ImpPaymentOrder.GetOrderByPackageId(stCoursePackageModel.Uid, stCoursePackageModel.PackageID)
+	if err != nil || len(vecPaymentOrderModel) == 0 {
+		rsp.Code = -933
+		rsp.ErrorMsg = "查询课包订单失败"
+		Printf("QuoteRefundHandler GetOrderByPackageId err, err:%+v PackageID:%s\n", err, req.PackageID)
+		return
+	}
+
+	// 查询课包下的单节课，统计核销和旷课情况
+	vecSingleLesson, err := dao.ImpCoursePackageSingleLesson.GetSingleLessonListByPackageId(stCoursePackageModel.Uid, stCoursePackageModel.PackageID)
+	if err != nil {
+		rsp.Code = -944
+		rsp.ErrorMsg = "查询课包上课记录失败"
+		Printf("QuoteRefundHandler GetSingleLessonListByPackageId err, err:%+v PackageID:%s\n", err, req.PackageID)
+		return
+	}
+
+	rsp.PackageID = stCoursePackageModel.PackageID
+	rsp.PayUid = stCoursePackageModel.Uid
+	rsp.Policy = policy
+	calcRefundQuote(rsp, stCoursePackageModel, vecPaymentOrderModel, vecSingleLesson, getRefundFeeRate())
+	rsp.Code = 0
+	Printf("QuoteRefundHandler success, rsp:%+v\n", rsp)
+	return
+}
+
+// getRefundFeeRate 手续费比例（百分比）
+func getRefundFeeRate() int {
+	strRate := os.Getenv("REFUND_FEE_RATE")
+	if strRate == "" {
+		return defaultRefundFeeRate
+	}
+	rate, err := strconv.Atoi(strRate)
+	if err != nil || rate < 0 || rate > 100 {
+		Printf("getRefundFeeRate invalid REFUND_FEE_RATE:%s, use default\n", strRate)
+		return defaultRefundFeeRate
+	}
+	return rate
+}
+
+// calcRefundQuote 按策略计算可退金额，金额统一按分计算避免精度丢失
+func calcRefundQuote(rsp *QuoteRefundRsp, coursePackage *model.CoursePackageModel, vecOrder []model.PaymentOrderModel,
+	vecSingleLesson []model.CoursePackageSingleLessonModel, feeRate int) {
+	for i := range vecOrder {
+		order := &vecOrder[i]
+		if order.OrderStatus != model.Enum_Pay_Status_Paid && order.OrderStatus != model.Enum_Pay_Status_Refunded {
+			continue
+		}
+		paidFee := getOrderPaidFee(order)
+		rsp.PaidCnt += order.CourseCnt
+		rsp.PaidFee += paidFee
+		rsp.ListFee += (order.Price + order.DiscountAmount) * 100
+		rsp.RefundedFee += order.RefundAmount
+		rsp.RefundedCnt += order.RefundCourseCnt
+
+		remainRefundFee := 0
+		if order.OrderStatus == model.Enum_Pay_Status_Paid && paidFee > order.RefundAmount {
+			remainRefundFee = paidFee - order.RefundAmount
+		}
+		rsp.VecOrder = append(rsp.VecOrder, QuoteRefundOrderItem{
+			OutTradeNo:      order.OrderID,
+			OrderStatus:     order.OrderStatus,
+			CourseCnt:       order.CourseCnt,
+			PaidFee:         paidFee,
+			RefundedFee:     order.RefundAmount,
+			RemainRefundFee: remainRefundFee,
+			OrderTime:       order.OrderTime,
+		})
+	}
+
+	for _, v := range vecSingleLesson {
+		switch v.Status {
+		case model.En_LessonStatusCompleted:
+			rsp.CompletedCnt++
+		case model.En_LessonStatusMissed:
+			if !v.WriteOffMissedReturnCnt {
+				rsp.MissedCnt++
+			}
+		case model.En_LessonStatus_Scheduled:
+			rsp.ScheduledCnt++
+		}
+	}
+	rsp.ConsumedCnt = rsp.CompletedCnt + rsp.MissedCnt
+
+	if rsp.PaidCnt > 0 {
+		rsp.UnitFee = rsp.PaidFee / rsp.PaidCnt
+		rsp.ListUnitFee = rsp.ListFee / rsp.PaidCnt
+	}
+	if rsp.ListUnitFee < rsp.UnitFee {
+		rsp.ListUnitFee = rsp.UnitFee
+	}
+
+	rsp.RefundableCnt = coursePackage.RemainCnt
+	if rsp.RefundableCnt < 0 {
+		rsp.RefundableCnt = 0
+	}
+	remainFee := rsp.RefundableCnt * rsp.UnitFee
+
+	switch rsp.Policy {
+	case RefundPolicy_ProRata:
+		rsp.ConsumedFee = rsp.ConsumedCnt * rsp.UnitFee
+	case RefundPolicy_OriginalUnitPrice:
+		rsp.ConsumedFee = rsp.ConsumedCnt * rsp.ListUnitFee
+		rsp.DeductFee = rsp.ConsumedCnt * (rsp.ListUnitFee - rsp.UnitFee)
+	case RefundPolicy_FeeDeduction:
+		rsp.ConsumedFee = rsp.ConsumedCnt * rsp.UnitFee
+		rsp.DeductFee = remainFee * feeRate / 100
+	}
+
+	rsp.RefundableFee = remainFee - rsp.DeductFee
+	if maxFee := rsp.PaidFee - rsp.RefundedFee; rsp.RefundableFee > maxFee {
+		rsp.RefundableFee = maxFee
+	}
+	if rsp.RefundableFee < 0 {
+		rsp.RefundableFee = 0
+	}
+	rsp.RefundableAmount = rsp.RefundableFee / 100
+}
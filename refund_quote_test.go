@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/xionghengheng/ff_plib/db/model"
+)
+
+func TestCalcRefundQuote(t *testing.T) {
+	// 10节课实付900元，折前1000元；待支付订单不计入
+	paidOrder := model.PaymentOrderModel{OrderID: "order_1", OrderStatus: model.Enum_Pay_Status_Paid, CourseCnt: 10, Price: 900, DiscountAmount: 100, PaymentAmount: 90000}
+	pendingOrder := model.PaymentOrderModel{OrderID: "order_2", OrderStatus: model.Enum_Pay_Status_Pending, CourseCnt: 10, Price: 900, PaymentAmount: 90000}
+	partRefundedOrder := paidOrder
+	partRefundedOrder.RefundAmount = 50000
+	partRefundedOrder.RefundCourseCnt = 5
+
+	// 已核销2节，旷课未归还1节，旷课已归还1节，已预约1节
+	vecSingleLesson := []model.CoursePackageSingleLessonModel{
+		{Status: model.En_LessonStatusCompleted},
+		{Status: model.En_LessonStatusCompleted},
+		{Status: model.En_LessonStatusMissed},
+		{Status: model.En_LessonStatusMissed, WriteOffMissedReturnCnt: true},
+		{Status: model.En_LessonStatus_Scheduled},
+	}
+
+	vecCase := []struct {
+		name              string
+		policy            string
+		remainCnt         int
+		vecOrder          []model.PaymentOrderModel
+		wantConsumedFee   int
+		wantDeductFee     int
+		wantRefundableCnt int
+		wantRefundableFee int
+		wantRemainRefund  int
+	}{
+		{name: "pro rata", policy: RefundPolicy_ProRata, remainCnt: 6, vecOrder: []model.PaymentOrderModel{paidOrder, pendingOrder},
+			wantConsumedFee: 27000, wantDeductFee: 0, wantRefundableCnt: 6, wantRefundableFee: 54000, wantRemainRefund: 90000},
+		{name: "original unit price", policy: RefundPolicy_OriginalUnitPrice, remainCnt: 6, vecOrder: []model.PaymentOrderModel{paidOrder, pendingOrder},
+			wantConsumedFee: 30000, wantDeductFee: 3000, wantRefundableCnt: 6, wantRefundableFee: 51000, wantRemainRefund: 90000},
+		{name: "fee deduction", policy: RefundPolicy_FeeDeduction, remainCnt: 6, vecOrder: []model.PaymentOrderModel{paidOrder, pendingOrder},
+			wantConsumedFee: 27000, wantDeductFee: 5400, wantRefundableCnt: 6, wantRefundableFee: 48600, wantRemainRefund: 90000},
+		{name: "capped by earlier refund", policy: RefundPolicy_ProRata, remainCnt: 6, vecOrder: []model.PaymentOrderModel{partRefundedOrder},
+			wantConsumedFee: 27000, wantDeductFee: 0, wantRefundableCnt: 6, wantRefundableFee: 40000, wantRemainRefund: 40000},
+		{name: "negative remain cnt", policy: RefundPolicy_ProRata, remainCnt: -1, vecOrder: []model.PaymentOrderModel{paidOrder},
+			wantConsumedFee: 27000, wantDeductFee: 0, wantRefundableCnt: 0, wantRefundableFee: 0, wantRemainRefund: 90000},
+		{name: "deduct over remain fee", policy: RefundPolicy_OriginalUnitPrice, remainCnt: 0, vecOrder: []model.PaymentOrderModel{paidOrder},
+			wantConsumedFee: 30000, wantDeductFee: 3000, wantRefundableCnt: 0, wantRefundableFee: 0, wantRemainRefund: 90000},
+	}
+	for _, c := range vecCase {
+		t.Run(c.name, func(t *testing.T) {
+			rsp := &QuoteRefundRsp{Policy: c.policy}
+			calcRefundQuote(rsp, &model.CoursePackageModel{RemainCnt: c.remainCnt}, c.vecOrder, vecSingleLesson, 10)
+			if rsp.PaidCnt != 10 || rsp.PaidFee != 90000 || rsp.UnitFee != 9000 || rsp.ListUnitFee != 10000 {
+				t.Fatalf("got paid cnt:%d fee:%d unit fee:%d list unit fee:%d, want 10/90000/9000/10000",
+					rsp.PaidCnt, rsp.PaidFee, rsp.UnitFee, rsp.ListUnitFee)
+			}
+			if rsp.CompletedCnt != 2 || rsp.MissedCnt != 1 || rsp.ScheduledCnt != 1 || rsp.ConsumedCnt != 3 {
+				t.Fatalf("got completed:%d missed:%d scheduled:%d consumed:%d, want 2/1/1/3",
+					rsp.CompletedCnt, rsp.MissedCnt, rsp.ScheduledCnt, rsp.ConsumedCnt)
+			}
+			if rsp.ConsumedFee != c.wantConsumedFee || rsp.DeductFee != c.wantDeductFee {
+				t.Fatalf("got consumed fee:%d deduct fee:%d, want %d/%d", rsp.ConsumedFee, rsp.DeductFee, c.wantConsumedFee, c.wantDeductFee)
+			}
+			if rsp.RefundableCnt != c.wantRefundableCnt || rsp.RefundableFee != c.wantRefundableFee || rsp.RefundableAmount != c.wantRefundableFee/100 {
+				t.Fatalf("got refundable cnt:%d fee:%d amount:%d, want %d/%d", rsp.RefundableCnt, rsp.RefundableFee, rsp.RefundableAmount,
+					c.wantRefundableCnt, c.wantRefundableFee)
+			}
+			if len(rsp.VecOrder) != 1 || rsp.VecOrder[0].RemainRefundFee != c.wantRemainRefund {
+				t.Fatalf("got orders %+v, want one order with remain refund fee %d", rsp.VecOrder, c.wantRemainRefund)
+			}
+		})
+	}
+}
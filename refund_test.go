@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xionghengheng/ff_plib/db/dao"
+	"github.com/xionghengheng/ff_plib/db/model"
+)
+
+// fakeRefundLedger 只记录状态变更的退款流水，其他方法未实现
+type fakeRefundLedger struct {
+	RefundLedgerInterface
+	vecUpdate []map[string]interface{}
+	vecFail   []map[string]interface{}
+}
+
+func (f *fakeRefundLedger) UpdateRefundLedgerStatus(id int64, fromStatus int, fromUpdatedTs int64, mapUpdates map[string]interface{}) (bool, error) {
+	f.vecUpdate = append(f.vecUpdate, mapUpdates)
+	return true, nil
+}
+
+func (f *fakeRefundLedger) FailRefundLedger(ledger *RefundLedgerModel, mapUpdates map[string]interface{}) error {
+	f.vecFail = append(f.vecFail, mapUpdates)
+	return nil
+}
+
+// fakePaymentOrder 固定返回同一个订单
+type fakePaymentOrder struct {
+	dao.PaymentOrderInterface
+	order *model.PaymentOrderModel
+}
+
+func (f *fakePaymentOrder) GetOrderById(orderId string, uid int64) (*model.PaymentOrderModel, error) {
+	return f.order, nil
+}
+
+// setupRefundFakes 替换退款流水、订单和支付退款客户端，测试结束后还原
+func setupRefundFakes(t *testing.T, failErr error) (*fakeRefundLedger, *fakeRefundClient) {
+	oldLedger, oldOrder, oldClient := ImpRefundLedger, dao.ImpPaymentOrder, refundClient
+	t.Cleanup(func() {
+		ImpRefundLedger, dao.ImpPaymentOrder, refundClient = oldLedger, oldOrder, oldClient
+	})
+	ledger := &fakeRefundLedger{}
+	client := &fakeRefundClient{FailErr: failErr}
+	ImpRefundLedger = ledger
+	dao.ImpPaymentOrder = &fakePaymentOrder{order: &model.PaymentOrderModel{OrderID: "order_1", PaymentAmount: 100000}}
+	refundClient = client
+	return ledger, client
+}
+
+func newTestRefundLedger(status int, updatedTs int64) *RefundLedgerModel {
+	return &RefundLedgerModel{
+		ID:              1,
+		IdempotencyKey:  "key_1",
+		RefundNo:        "order_1_rf_1",
+		PayUid:          10,
+		OutTradeNo:      "order_1",
+		PackageID:       "pkg_1",
+		RefundCourseCnt: 2,
+		RefundFee:       20000,
+		Status:          status,
+		UpdatedTs:       updatedTs,
+	}
+}
+
+func TestCheckRefundParam(t *testing.T) {
+	paidOrder := &model.PaymentOrderModel{OrderStatus: model.Enum_Pay_Status_Paid, PaymentAmount: 100000}
+	partRefundedOrder := &model.PaymentOrderModel{OrderStatus: model.Enum_Pay_Status_Paid, PaymentAmount: 100000, RefundAmount: 90000}
+	coursePackage := &model.CoursePackageModel{Uid: 10, PackageType: model.Enum_PackageType_PaidPackage, RemainCnt: 5}
+
+	vecCase := []struct {
+		name     string
+		cnt      int
+		fee      int
+		order    *model.PaymentOrderModel
+		pkg      *model.CoursePackageModel
+		inflight RefundInflight
+		wantCode int
+	}{
+		{name: "ok", cnt: 5, fee: 100000, order: paidOrder, pkg: coursePackage, wantCode: 0},
+		{name: "over remain cnt", cnt: 6, fee: 100, order: paidOrder, pkg: coursePackage, wantCode: -1103},
+		{name: "over paid fee", cnt: 1, fee: 100001, order: paidOrder, pkg: coursePackage, wantCode: -1104},
+		{name: "over fee after earlier refund", cnt: 1, fee: 10001, order: partRefundedOrder, pkg: coursePackage, wantCode: -1104},
+		{name: "over fee with inflight refund", cnt: 1, fee: 60000, order: paidOrder, pkg: coursePackage, inflight: RefundInflight{OrderFee: 50000}, wantCode: -1104},
+		{name: "over cnt with inflight refund", cnt: 3, fee: 100, order: paidOrder, pkg: coursePackage, inflight: RefundInflight{PackageCnt: 3}, wantCode: -1103},
+		{name: "order not paid", cnt: 1, fee: 100, order: &model.PaymentOrderModel{OrderStatus: model.Enum_Pay_Status_Refunded, PaymentAmount: 100000}, pkg: coursePackage, wantCode: -1101},
+		{name: "package of other user", cnt: 1, fee: 100, order: paidOrder, pkg: &model.CoursePackageModel{Uid: 11, PackageType: model.Enum_PackageType_PaidPackage, RemainCnt: 5}, wantCode: -1102},
+	}
+	for _, c := range vecCase {
+		t.Run(c.name, func(t *testing.T) {
+			result := checkRefundParam(10, c.cnt, c.fee, c.order, c.pkg, c.inflight)
+			if result.Code != c.wantCode || result.Success != (c.wantCode == 0) {
+				t.Fatalf("checkRefundParam got %+v, want code %d", result, c.wantCode)
+			}
+		})
+	}
+}
+
+func TestHandleDupRefundReq(t *testing.T) {
+	req := RefundReq{PayUid: 10, OutTradeNo: "order_1", RefundCourseCnt: 2, RefundAmount: 200, IdempotencyKey: "key_1"}
+	staleTs := time.Now().Unix() - refundSubmitStaleSec - 1
+
+	t.Run("same key different params", func(t *testing.T) {
+		_, client := setupRefundFakes(t, nil)
+		dupReq := req
+		dupReq.RefundAmount = 300
+		rsp := &RefundRsp{}
+		handleDupRefundReq(&dupReq, newTestRefundLedger(Enum_Refund_Status_Succeeded, staleTs), rsp)
+		if rsp.Code != -1105 || len(client.VecReq) != 0 {
+			t.Fatalf("got rsp %+v and %d refund calls, want -1105 and no call", rsp, len(client.VecReq))
+		}
+	})
+
+	t.Run("same key already succeeded", func(t *testing.T) {
+		_, client := setupRefundFakes(t, nil)
+		rsp := &RefundRsp{}
+		handleDupRefundReq(&req, newTestRefundLedger(Enum_Refund_Status_Succeeded, staleTs), rsp)
+		if rsp.Code != 0 || rsp.Status != Enum_Refund_Status_Succeeded || len(client.VecReq) != 0 {
+			t.Fatalf("got rsp %+v and %d refund calls, want recorded success and no call", rsp, len(client.VecReq))
+		}
+	})
+
+	t.Run("same key submitted recently", func(t *testing.T) {
+		_, client := setupRefundFakes(t, nil)
+		rsp := &RefundRsp{}
+		handleDupRefundReq(&req, newTestRefundLedger(Enum_Refund_Status_Submitted, time.Now().Unix()), rsp)
+		if rsp.Code != -1106 || len(client.VecReq) != 0 {
+			t.Fatalf("got rsp %+v and %d refund calls, want -1106 and no call", rsp, len(client.VecReq))
+		}
+	})
+
+	t.Run("same key submitted and stale resubmits same refund no", func(t *testing.T) {
+		_, client := setupRefundFakes(t, errors.New("timeout"))
+		ledger := newTestRefundLedger(Enum_Refund_Status_Submitted, staleTs)
+		rsp := &RefundRsp{}
+		handleDupRefundReq(&req, ledger, rsp)
+		if len(client.VecReq) != 1 || client.VecReq[0].OutRefundNo != ledger.RefundNo {
+			t.Fatalf("got refund calls %+v, want one call with refund no %s", client.VecReq, ledger.RefundNo)
+		}
+		if rsp.Code != -955 {
+			t.Fatalf("got rsp %+v, want -955", rsp)
+		}
+	})
+}
+
+func TestExecuteRefundClientErr(t *testing.T) {
+	t.Run("rejected", func(t *testing.T) {
+		fakeLedger, client := setupRefundFakes(t, &RefundRejectedError{Reason: "NOTENOUGH"})
+		ledger := newTestRefundLedger(Enum_Refund_Status_Requested, 0)
+		rsp := &RefundRsp{}
+		executeRefund(ledger, rsp)
+		if len(client.VecReq) != 1 {
+			t.Fatalf("got %d refund calls, want 1", len(client.VecReq))
+		}
+		if rsp.Code != -956 || rsp.Status != Enum_Refund_Status_Failed || ledger.Status != Enum_Refund_Status_Failed {
+			t.Fatalf("got rsp %+v ledger status %d, want -956 and failed", rsp, ledger.Status)
+		}
+		if len(fakeLedger.vecFail) != 1 || fakeLedger.vecFail[0]["status"] != Enum_Refund_Status_Failed {
+			t.Fatalf("got fail updates %+v, want one update to failed", fakeLedger.vecFail)
+		}
+	})
+
+	t.Run("unknown error", func(t *testing.T) {
+		fakeLedger, client := setupRefundFakes(t, errors.New("connection reset"))
+		ledger := newTestRefundLedger(Enum_Refund_Status_Requested, 0)
+		rsp := &RefundRsp{}
+		executeRefund(ledger, rsp)
+		if len(client.VecReq) != 1 {
+			t.Fatalf("got %d refund calls, want 1", len(client.VecReq))
+		}
+		if rsp.Code != -955 || rsp.Status != Enum_Refund_Status_Submitted || ledger.Status != Enum_Refund_Status_Submitted {
+			t.Fatalf("got rsp %+v ledger status %d, want -955 and submitted", rsp, ledger.Status)
+		}
+		if len(fakeLedger.vecFail) != 0 {
+			t.Fatalf("got fail updates %+v, want none", fakeLedger.vecFail)
+		}
+	})
+}
+
+func TestGenOrderRefundUpdates(t *testing.T) {
+	vecCase := []struct {
+		name       string
+		order      model.PaymentOrderModel
+		refundFee  int
+		wantAmount int
+		wantStatus bool
+	}{
+		{name: "partial refund keeps paid", order: model.PaymentOrderModel{PaymentAmount: 100000}, refundFee: 40000, wantAmount: 40000, wantStatus: false},
+		{name: "full refund", order: model.PaymentOrderModel{PaymentAmount: 100000}, refundFee: 100000, wantAmount: 100000, wantStatus: true},
+		{name: "second partial completes refund", order: model.PaymentOrderModel{PaymentAmount: 100000, RefundAmount: 60000}, refundFee: 40000, wantAmount: 100000, wantStatus: true},
+		{name: "paid fee falls back to price", order: model.PaymentOrderModel{Price: 1000}, refundFee: 50000, wantAmount: 50000, wantStatus: false},
+	}
+	for _, c := range vecCase {
+		t.Run(c.name, func(t *testing.T) {
+			ledger := &RefundLedgerModel{RefundFee: c.refundFee, RefundCourseCnt: 1}
+			mapUpdates := genOrderRefundUpdates(&c.order, ledger, 1700000000)
+			if mapUpdates["refund_amount"] != c.wantAmount {
+				t.Fatalf("refund_amount got %v, want %d", mapUpdates["refund_amount"], c.wantAmount)
+			}
+			status, ok := mapUpdates["order_status"]
+			if ok != c.wantStatus || (ok && status != model.Enum_Pay_Status_Refunded) {
+				t.Fatalf("order_status got %v (set:%t), want set:%t", status, ok, c.wantStatus)
+			}
+		})
+	}
+}
+
+func TestCheckWxPayRefundRsp(t *testing.T) {
+	vecCase := []struct {
+		name         string
+		errcode      int
+		returnCode   string
+		resultCode   string
+		errCode      string
+		wantErr      bool
+		wantRejected bool
+	}{
+		{name: "success", returnCode: "SUCCESS", resultCode: "SUCCESS"},
+		{name: "not enough", returnCode: "SUCCESS", resultCode: "FAIL", errCode: "NOTENOUGH", wantErr: true, wantRejected: true},
+		{name: "account abnormal", returnCode: "SUCCESS", resultCode: "FAIL", errCode: "USER_ACCOUNT_ABNORMAL", wantErr: true, wantRejected: true},
+		{name: "business error", returnCode: "SUCCESS", resultCode: "FAIL", errCode: "ERROR", wantErr: true, wantRejected: true},
+		{name: "system error", returnCode: "SUCCESS", resultCode: "FAIL", errCode: "SYSTEMERROR", wantErr: true},
+		{name: "need retry", returnCode: "SUCCESS", resultCode: "FAIL", errCode: "BIZERR_NEED_RETRY", wantErr: true},
+		{name: "frequency limited", returnCode: "SUCCESS", resultCode: "FAIL", errCode: "FREQUENCY_LIMITED", wantErr: true},
+		{name: "unknown code", returnCode: "SUCCESS", resultCode: "FAIL", errCode: "SOMETHING_NEW", wantErr: true},
+		{name: "return fail", returnCode: "FAIL", errCode: "NOTENOUGH", wantErr: true},
+		{name: "open api error", errcode: -1, wantErr: true},
+	}
+	for _, c := range vecCase {
+		t.Run(c.name, func(t *testing.T) {
+			wxRsp := &wxPayRefundRsp{Errcode: c.errcode}
+			wxRsp.Respdata.ReturnCode = c.returnCode
+			wxRsp.Respdata.ResultCode = c.resultCode
+			wxRsp.Respdata.ErrCode = c.errCode
+			err := checkWxPayRefundRsp(wxRsp)
+			var rejectedErr *RefundRejectedError
+			if (err != nil) != c.wantErr || errors.As(err, &rejectedErr) != c.wantRejected {
+				t.Fatalf("checkWxPayRefundRsp got %v, want err:%t rejected:%t", err, c.wantErr, c.wantRejected)
+			}
+		})
+	}
+}
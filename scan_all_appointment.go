@@ -1,25 +1,28 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/xionghengheng/ff_plib/comm"
 	"github.com/xionghengheng/ff_plib/db/dao"
 	"github.com/xionghengheng/ff_plib/db/model"
-	"os"
 	"time"
 )
 
 // 扫描所有预约，如果教练过去2天没设置预约，直接通知教练
-func ScanAllAppointments() {
+func ScanAllAppointments(ctx context.Context) {
 	Printf("scan start, beg_time:%s", time.Now().Format("2006-01-02 15:04:05"))
-	err := doAppointmentsScan()
+	err := doAppointmentsScan(ctx)
 	if err != nil {
 		Printf("doScan err, err:%+v", err)
+		getJobRunStat(ctx).Fail(err)
 		return
 	}
 	Printf("scan end, end_time:%s", time.Now().Format("2006-01-02 15:04:05"))
 }
 
-func doAppointmentsScan() error {
+func doAppointmentsScan(ctx context.Context) error {
+	stat := getJobRunStat(ctx)
 	unDayBegTs := GetYesterdayBegTs()
 
 	tmpMapCoach, err := comm.GetAllCoach()
@@ -33,6 +36,7 @@ func doAppointmentsScan() error {
 		mapCoach[k] = v
 	}
 
+	stat.AddExamined(len(mapCoach))
 	for _, v := range mapCoach {
 		vecCoachAppointmentModel, err := dao.ImpAppointment.GetAppointmentScheduleFromBegTs(v.GymID, v.CoachID, unDayBegTs)
 		if err != nil {
@@ -41,7 +45,11 @@ func doAppointmentsScan() error {
 		}
 		Printf("GetAppointmentScheduleFromBegTs succ, CoachId:%d unDayBegTs:%d vecCoachAppointmentModel:%+v\n", v.CoachID, unDayBegTs, vecCoachAppointmentModel)
 		if len(vecCoachAppointmentModel) == 0 {
-			sendRemindMsgSetLessonAvailiable2Coach(v.CoachID)
+			if err = sendRemindMsgSetLessonAvailiable2Coach(v.CoachID); err != nil {
+				stat.AddError(err)
+			} else {
+				stat.AddChanged(1)
+			}
 		}
 	}
 
@@ -57,25 +65,38 @@ func GetYesterdayBegTs() int64 {
 	return yesterdayMidnight.Unix()
 }
 
-func sendRemindMsgSetLessonAvailiable2Coach(coachId int) {
+// 提醒教练设置可约时间，写入发件箱，由投递任务按教练的偏好发送，每个教练每天只提醒一次
+func sendRemindMsgSetLessonAvailiable2Coach(coachId int) error {
 	stCoachUserModel, err := dao.ImpUser.GetUserByCoachId(coachId)
+	if err != nil {
+		Printf("sendMsg2Coach GetUserByCoachId err, err:%+v coachId:%d", err, coachId)
+		return err
+	}
 	stCoachModel, err := dao.ImpCoach.GetCoachById(coachId)
+	if err != nil {
+		Printf("sendMsg2Coach GetCoachById err, err:%+v coachId:%d", err, coachId)
+		return err
+	}
 	stGymModel, err := dao.ImpGym.GetGymInfoByGymId(stCoachModel.GymID)
-	stWxSendMsg2UserReq := comm.WxSendMsg2UserReq{
-		ToUser:           stCoachUserModel.WechatID,
-		TemplateID:       "r5pEmo4PPkXIZVhBhY9mv6yTvKFENg62x0phoAMYKM4",
-		Page:             "pages/home/index/index",
-		MiniprogramState: os.Getenv("MiniprogramState"),
-		Lang:             "zh_CN",
-		Data: map[string]comm.MsgDataField{
-			"thing3": {Value: stGymModel.LocName},  //上课地点名称
-			"thing4": {Value: "您未设置近期的可约时间，请及时设置"}, //课程名称
-		},
+	if err != nil {
+		Printf("sendMsg2Coach GetGymInfoByGymId err, err:%+v coachId:%d", err, coachId)
+		return err
+	}
+	mapParam := make(map[string]string)
+	mapParam[NotifyParam_GymName] = stGymModel.LocName
+	stWxOutbox, err := newWxNotifyOutbox(NotifyScene_CoachAvailableTimeRemind, NotifyTemplate_CoachAvailableTimeRemind, stCoachUserModel.UserID, stCoachUserModel.WechatID, "", "", mapParam)
+	if err != nil {
+		Printf("sendMsg2Coach newWxNotifyOutbox err, err:%+v coachId:%d", err, coachId)
+		return err
 	}
-	err = comm.SendMsg2User(stCoachUserModel.UserID, stWxSendMsg2UserReq)
+	stWxOutbox.BizKey = genNotifyBizKey(NotifyScene_CoachAvailableTimeRemind, NotifyChannel_Wx, "", fmt.Sprintf("coach_%d_%s", coachId, time.Now().In(notifyLocation).Format("20060102")))
+	stWxOutbox.RecipientType = NotifyRecipient_Coach
+	stWxOutbox.RecipientID = int64(coachId)
+	added, err := ImpNotifyOutbox.AddNotifyOutboxIfAbsent(stWxOutbox)
 	if err != nil {
-		Printf("sendMsg2Coach err, err:%+v coachId:%d uid:%d WechatID:%s", err, coachId, stCoachUserModel.UserID, stCoachUserModel.WechatID)
-	} else {
-		Printf("sendMsg2Coach succ, coachId:%d", coachId)
+		Printf("sendMsg2Coach AddNotifyOutboxIfAbsent err, err:%+v coachId:%d", err, coachId)
+		return err
 	}
+	Printf("sendMsg2Coach add notify succ, coachId:%d added:%t", coachId, added)
+	return nil
 }
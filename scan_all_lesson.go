@@ -1,262 +1,377 @@
 package main
 
 import (
-	"github.com/xionghengheng/ff_plib/comm"
+	"context"
 	"github.com/xionghengheng/ff_plib/db/dao"
 	"github.com/xionghengheng/ff_plib/db/model"
-	"os"
-	"strconv"
 	"time"
 )
 
 // 扫描所有单次课程，处理旷课以及旷课退回的情况
-func ScanAllCoursePackageSingleLesson() {
+func ScanAllCoursePackageSingleLesson(ctx context.Context) {
 	Printf("scan start, beg_time:%s", time.Now().Format("2006-01-02 15:04:05"))
-	err := doSingleLessonScan()
+	// 单次执行的时间预算，用完后停止翻页，剩余的留到下一次执行
+	ctx, cancel := context.WithTimeout(ctx, lessonScanBudget)
+	defer cancel()
+	err := doSingleLessonScan(ctx)
 	if err != nil {
 		Printf("doScan err, err:%+v", err)
+		getJobRunStat(ctx).Fail(err)
 		return
 	}
 	Printf("scan end, end_time:%s", time.Now().Format("2006-01-02 15:04:05"))
 }
 
 // 如果当前时间已经超过了课程终止时间，还没有核销，那么则认为用户旷课，或者是教练忘记核销了
-func doSingleLessonScan() error {
+func doSingleLessonScan(ctx context.Context) error {
+	stat := getJobRunStat(ctx)
 	now := time.Now()
+	//每次执行读取一次业务规则，执行过程中不变
+	rules := loadBusinessRules()
 
-	//如果当前时间超过晚上11点30分，则触发归还次数
-	// 创建一个表示当天晚上11点50分的时间对象
-	elevenFiftyPM := time.Date(now.Year(), now.Month(), now.Day(), 23, 30, 0, 0, now.Location())
-	if now.After(elevenFiftyPM) {
-		Printf("当前时间超过晚上11点30分, now:%d", now.Unix())
-		vecMissedLesson, err := dao.ImpCoursePackageSingleLesson.GetSingleLessonListMissed(100)
-		if err != nil {
-			Printf("GetSingleLessonListMissed err, err:%+v", err)
-			return err
-		}
-
-		for _, v := range vecMissedLesson {
-			mapUpdates := make(map[string]interface{})
-			mapUpdates["write_off_missed_return_cnt"] = true
-			err = dao.ImpCoursePackageSingleLesson.UpdateSingleLesson(v.Uid, v.LessonID, mapUpdates)
+	//如果当前时间超过归还时间（默认晚上11点30分），则触发归还次数
+	//场地、课程可以单独配置归还时间，最早的归还时间到了就开始扫描，每节课按自己的归还时间判断
+	nowMinute := minuteOfDay(now)
+	if nowMinute >= rules.minValue(BizRule_MissedReturnMinute) {
+		Printf("当前时间超过归还时间, now:%d", now.Unix())
+		// 按游标翻页处理全部待归还的课程，避免超过一页的部分错过当天23:30到24:00的归还窗口
+		var cursor LessonScanCursor
+		for ctx.Err() == nil {
+			vecMissedLesson, err := ImpLessonScan.GetSingleLessonMissedPage(cursor, lessonScanPageSize)
 			if err != nil {
-				Printf("UpdateSingleLesson2StatusMissed err, err:%+v uid:%d PackageID:%s LessonID:%s", err, v.Uid, v.PackageID, v.LessonID)
-				continue
+				Printf("GetSingleLessonMissedPage err, err:%+v cursor:%+v", err, cursor)
+				return err
 			}
-			Printf("UpdateSingleLesson2StatusMissed succ, uid:%d PackageID:%s LessonID:%s", v.Uid, v.PackageID, v.LessonID)
-
-			err = dao.ImpCoursePackage.AddRemainCourseCnt(v.PackageID, 1)
-			if err != nil {
-				Printf("ReturnCourseCnt err, err:%+v uid:%d PackageID:%s LessonID:%s", err, v.Uid, v.PackageID, v.LessonID)
-				continue
+			for _, v := range vecMissedLesson {
+				if ctx.Err() != nil {
+					break
+				}
+				cursor.advance(v.ScheduleEndTs, v.LessonID)
+				stat.AddExamined(1)
+				if nowMinute < rules.lesson(BizRule_MissedReturnMinute, v.GymId, v.CourseID) {
+					continue
+				}
+				if !isMissedLessonReturnable(rules, now, v) {
+					continue
+				}
+				returnMissedLessonCnt(stat, rules, v)
+			}
+			if len(vecMissedLesson) < lessonScanPageSize {
+				break
 			}
-			Printf("ReturnCourseCnt succ, uid:%d PackageID:%s LessonID:%s", v.Uid, v.PackageID, v.LessonID)
 		}
-		return nil
+		if ctx.Err() != nil {
+			reportLessonScanBacklog(stat, "SingleLessonMissedReturn", func() (int, error) {
+				return ImpLessonScan.CountSingleLessonMissed(cursor)
+			})
+		}
 	}
 
 	//每5分钟处理一次
-	handleLessonMissed()
+	handleLessonMissed(ctx, rules)
 
 	//开课前一小时，发信息通知学员去上课
-	handleSendMsgBeforeLessonStart()
+	handleSendMsgBeforeLessonStart(ctx, rules)
 
 	//课程完结后一小时，需要提醒用户去写评论
-	handleSendMsgWhenLessonComplete()
+	handleSendMsgWhenLessonComplete(ctx, rules)
 
 
 	return nil
 }
 
-// 处理旷课的情况
-func handleLessonMissed() {
-	nowTs := time.Now().Unix()
+// 旷课的课程要留给教练补核销的时间：前一天及更早结束的课可以归还，当天的课标记旷课后还要再过一个旷课宽限时间才归还
+// 标记旷课的时间是课程结束后一个旷课宽限时间，所以当天的课要在结束后两个宽限时间才归还
+func isMissedLessonReturnable(rules *BusinessRules, now time.Time, v model.CoursePackageSingleLessonModel) bool {
+	todayBegTs := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).Unix()
+	if v.ScheduleEndTs < todayBegTs {
+		return true
+	}
+	graceSec := rules.lesson(BizRule_MissedGraceSec, v.GymId, v.CourseID)
+	return now.Unix()-v.ScheduleEndTs >= 2*graceSec
+}
 
-	vecNotFinishLesson, err := dao.ImpCoursePackageSingleLesson.GetSingleLessonListNotFinish(time.Now().Unix(), 100)
+// 旷课的课程按旷课处罚规则决定是否归还课时，决定和通知与归还在同一个事务里
+func returnMissedLessonCnt(stat *JobRunStat, rules *BusinessRules, v model.CoursePackageSingleLessonModel) {
+	stNoShowDecisionModel, vecNotifyOutboxModel, err := decideNoShow(rules, v)
 	if err != nil {
-		Printf("GetSingleLessonListNotFinish err, err:%+v", err)
+		Printf("decideNoShow err, err:%+v uid:%d PackageID:%s LessonID:%s", err, v.Uid, v.PackageID, v.LessonID)
+		stat.AddError(err)
+		return
+	}
+	err = ImpNoShow.ApplyNoShowDecision(v, stNoShowDecisionModel, vecNotifyOutboxModel)
+	if err == errStateChanged {
+		Printf("ReturnCourseCnt skip, lesson state changed, uid:%d PackageID:%s LessonID:%s", v.Uid, v.PackageID, v.LessonID)
 		return
 	}
+	if err != nil {
+		Printf("ReturnCourseCnt err, err:%+v uid:%d PackageID:%s LessonID:%s", err, v.Uid, v.PackageID, v.LessonID)
+		stat.AddError(err)
+		return
+	}
+	stat.AddChanged(1)
+	stat.AddNotified(len(vecNotifyOutboxModel))
+	Printf("ReturnCourseCnt succ, uid:%d PackageID:%s LessonID:%s decision:%s missedCnt:%d", v.Uid, v.PackageID, v.LessonID, stNoShowDecisionModel.Decision, stNoShowDecisionModel.MissedCnt)
+}
 
-	//将用户课包里的单节课状态变成已旷课
-	for _, v := range vecNotFinishLesson {
-		//课程结束后的30分钟内，暂时先不设置旷课态，避免教练忘记核销
-		if nowTs > v.ScheduleEndTs && nowTs-v.ScheduleEndTs <= 1800 {
-			continue
-		}
+// 处理旷课的情况
+func handleLessonMissed(ctx context.Context, rules *BusinessRules) {
+	stat := getJobRunStat(ctx)
+	nowTs := time.Now().Unix()
 
-		mapUpdates := make(map[string]interface{})
-		mapUpdates["status"] = model.En_LessonStatusMissed
-		err = dao.ImpCoursePackageSingleLesson.UpdateSingleLesson(v.Uid, v.LessonID, mapUpdates)
+	//按游标翻页处理全部已过结束时间还没核销的课程
+	var cursor LessonScanCursor
+	for ctx.Err() == nil {
+		vecNotFinishLesson, err := ImpLessonScan.GetSingleLessonNotFinishPage(nowTs, cursor, lessonScanPageSize)
 		if err != nil {
-			Printf("UpdateSingleLesson2StatusMissed err, err:%+v uid:%d PackageID:%s LessonID:%s", err, v.Uid, v.PackageID, v.LessonID)
-			continue
+			Printf("GetSingleLessonNotFinishPage err, err:%+v cursor:%+v", err, cursor)
+			stat.Fail(err)
+			return
 		}
-		Printf("UpdateSingleLesson2StatusMissed succ, uid:%d PackageID:%s LessonID:%s", v.Uid, v.PackageID, v.LessonID)
-
-		stGymInfoModel, err := dao.ImpGym.GetGymInfoByGymId(v.GymId)
-		stCourseModel, err := dao.ImpCourse.GetCourseById(v.CourseID)
-		stUserModel, err := dao.ImpUser.GetUser(v.Uid)
-		stCoachModel, err := dao.ImpCoach.GetCoachById(v.CoachId)
-		t := time.Unix(v.ScheduleBegTs, 0)
-		tEnd := time.Unix(v.ScheduleEndTs, 0)
-		stWxSendMsg2UserReq := comm.WxSendMsg2UserReq{
-			ToUser:           stUserModel.WechatID,
-			TemplateID:       "xAnZb8sc8dbKNtD0vXiKcjubzGbM1ZtAOKCz6KBQzBw",
-			Page:             "pages/home/index/index",
-			MiniprogramState: os.Getenv("MiniprogramState"),
-			Lang:             "zh_CN",
-			Data: map[string]comm.MsgDataField{
-				"time1":  {Value: t.Format("2006年01月02日 15:04")}, //上课时间
-				"thing2": {Value: stCourseModel.Name},            //课程名称
-				"thing4": {Value: stGymInfoModel.LocName},        //上课地点
-				"thing5": {Value: "如由于忘记核销导致的已旷课，请及时补核销"},        //温馨提示
-			},
+		for _, v := range vecNotFinishLesson {
+			if ctx.Err() != nil {
+				break
+			}
+			cursor.advance(v.ScheduleEndTs, v.LessonID)
+			stat.AddExamined(1)
+			markLessonMissed(stat, rules, nowTs, v)
 		}
-		err = comm.SendMsg2User(v.Uid, stWxSendMsg2UserReq)
-		if err != nil {
-			Printf("[LessonMissNotify]sendMsg2User err, err:%+v uid:%d PackageID:%s LessonID:%s", err, v.Uid, v.PackageID, v.LessonID)
-		} else {
-			Printf("[LessonMissNotify]sendMsg2User succ, uid:%d PackageID:%s LessonID:%s", v.Uid, v.PackageID, v.LessonID)
+		if len(vecNotFinishLesson) < lessonScanPageSize {
+			break
 		}
+	}
+	if ctx.Err() != nil {
+		reportLessonScanBacklog(stat, "SingleLessonMissed", func() (int, error) {
+			return ImpLessonScan.CountSingleLessonNotFinish(nowTs, cursor)
+		})
+	}
+	return
+}
+
+// 将用户课包里的单节课状态变成已旷课，并通知学员和教练
+func markLessonMissed(stat *JobRunStat, rules *BusinessRules, nowTs int64, v model.CoursePackageSingleLessonModel) {
+	//课程结束后的30分钟内（可按场地、课程配置），暂时先不设置旷课态，避免教练忘记核销
+	if nowTs > v.ScheduleEndTs && nowTs-v.ScheduleEndTs <= rules.lesson(BizRule_MissedGraceSec, v.GymId, v.CourseID) {
+		return
+	}
 
-		//您的学员{1}已旷课，原上课时间:{2}月{3}日{4}~{5}，上课地点:{6}，课程类型:{7)，若忘记核销课程，请您尽快补核销，超时将自动返还课时给用户!
-		var vecTemplateParam []string
-		vecTemplateParam = append(vecTemplateParam, stUserModel.Nick)
-		vecTemplateParam = append(vecTemplateParam, strconv.Itoa(int(t.Month())))
-		vecTemplateParam = append(vecTemplateParam, strconv.Itoa(t.Day()))
-		vecTemplateParam = append(vecTemplateParam, t.Format("15:04"))
-		vecTemplateParam = append(vecTemplateParam, tEnd.Format("15:04"))
-		vecTemplateParam = append(vecTemplateParam, stGymInfoModel.LocSimpleName)
-		vecTemplateParam = append(vecTemplateParam, stCourseModel.Name)
-		err = comm.SendSmsMsg2User(comm.SmsTemplateId_LessonMissedRemindCoach, stUserModel.UserID, vecTemplateParam, stCoachModel.Phone)
+	//先查好通知需要的信息，查询失败时本次不处理，下次扫描再重试，保证状态和通知一起写入
+	stGymInfoModel, err := dao.ImpGym.GetGymInfoByGymId(v.GymId)
+	if err != nil {
+		Printf("markLessonMissed GetGymInfoByGymId err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+		stat.AddError(err)
+		return
+	}
+	stCourseModel, err := dao.ImpCourse.GetCourseById(v.CourseID)
+	if err != nil {
+		Printf("markLessonMissed GetCourseById err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+		stat.AddError(err)
+		return
+	}
+	stUserModel, err := dao.ImpUser.GetUser(v.Uid)
+	if err != nil {
+		Printf("markLessonMissed GetUser err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+		stat.AddError(err)
+		return
+	}
+	stCoachModel, err := dao.ImpCoach.GetCoachById(v.CoachId)
+	if err != nil {
+		Printf("markLessonMissed GetCoachById err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+		stat.AddError(err)
+		return
+	}
+	mapParam := genLessonNotifyParams(v.ScheduleBegTs, v.ScheduleEndTs)
+	mapParam[NotifyParam_CourseName] = stCourseModel.Name
+	mapParam[NotifyParam_GymName] = stGymInfoModel.LocName
+	mapParam[NotifyParam_GymSimpleName] = stGymInfoModel.LocSimpleName
+	mapParam[NotifyParam_UserNick] = stUserModel.Nick
+	stWxOutbox, err := newWxNotifyOutbox(NotifyScene_LessonMissed, NotifyTemplate_LessonMissed, v.Uid, stUserModel.WechatID, v.LessonID, v.PackageID, mapParam)
+	if err != nil {
+		Printf("markLessonMissed newWxNotifyOutbox err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+		stat.AddError(err)
+		return
+	}
+
+	var stSmsOutbox *NotifyOutboxModel
+	if stCoachModel.Phone != "" {
+		stSmsOutbox, err = newSmsNotifyOutbox(NotifyScene_LessonMissedCoach, NotifyTemplate_LessonMissedCoachSms, stUserModel.UserID, stCoachModel.Phone, v.LessonID, v.PackageID, mapParam)
 		if err != nil {
-			Printf("[MissedRemindToCoach]SendSmsMsg2User err, err:%+v traineeUid:%d PackageID:%s LessonID:%s vecTemplateParam:%+v", err, stUserModel.UserID, v.PackageID, v.LessonID, vecTemplateParam)
-		} else {
-			Printf("[MissedRemindToCoach]SendSmsMsg2User succ, traineeUid:%d PackageID:%s LessonID:%s vecTemplateParam:%+v", stUserModel.UserID, v.PackageID, v.LessonID, vecTemplateParam)
+			Printf("markLessonMissed newSmsNotifyOutbox err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+			stat.AddError(err)
+			return
 		}
+		// 短信发给教练，按教练的偏好发送
+		stSmsOutbox.RecipientType = NotifyRecipient_Coach
+		stSmsOutbox.RecipientID = int64(v.CoachId)
 	}
-	return
+
+	//旷课状态和通知在同一个事务里写入，通知由投递任务异步发送
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["status"] = model.En_LessonStatusMissed
+	err = saveStateWithNotify(course_package_single_lesson_tableName, &model.CoursePackageSingleLessonModel{}, mapUpdates,
+		[]*NotifyOutboxModel{stWxOutbox, stSmsOutbox}, "uid = ? AND lesson_id = ? AND status = ?", v.Uid, v.LessonID, model.En_LessonStatus_Scheduled)
+	if err == errStateChanged {
+		Printf("UpdateSingleLesson2StatusMissed skip, lesson state changed, uid:%d PackageID:%s LessonID:%s", v.Uid, v.PackageID, v.LessonID)
+		return
+	}
+	if err != nil {
+		Printf("UpdateSingleLesson2StatusMissed err, err:%+v uid:%d PackageID:%s LessonID:%s", err, v.Uid, v.PackageID, v.LessonID)
+		stat.AddError(err)
+		return
+	}
+	stat.AddChanged(1)
+	Printf("UpdateSingleLesson2StatusMissed succ, uid:%d PackageID:%s LessonID:%s", v.Uid, v.PackageID, v.LessonID)
 }
 
-func handleSendMsgBeforeLessonStart() {
+func handleSendMsgBeforeLessonStart(ctx context.Context, rules *BusinessRules) {
+	stat := getJobRunStat(ctx)
 	unNowTs := time.Now().Unix()
-	vecNotSendMsgLesson, err := dao.ImpCoursePackageSingleLesson.GetTodaySingleLessonListNotSendMsgGoLesson(unNowTs+4000, 1000)
+	//按配置的最大提前量多查一些，每节课再按自己的提前量判断
+	vecNotSendMsgLesson, err := dao.ImpCoursePackageSingleLesson.GetTodaySingleLessonListNotSendMsgGoLesson(unNowTs+rules.maxValue(BizRule_LessonStartRemindSec)+400, 1000)
 	if err != nil {
 		Printf("GetSingleLessonListNotFinish err, err:%+v", err)
+		stat.Fail(err)
 		return
 	}
+	stat.AddExamined(len(vecNotSendMsgLesson))
 
 	for _, v := range vecNotSendMsgLesson {
 		if v.ScheduleBegTs == 0 {
 			continue
 		}
 
-		//开课前一小时，发送消息通知用户上课
-		if unNowTs >= v.ScheduleBegTs-3600 {
-			mapUpdates := make(map[string]interface{})
-			mapUpdates["send_msg_go_lesson"] = true
-			err = dao.ImpCoursePackageSingleLesson.UpdateSingleLesson(v.Uid, v.LessonID, mapUpdates)
+		//开课前一小时（可按场地、课程配置），发送消息通知用户上课
+		if unNowTs >= v.ScheduleBegTs-rules.lesson(BizRule_LessonStartRemindSec, v.GymId, v.CourseID) {
+			//模板配置链接：https://mp.weixin.qq.com/wxamp/newtmpl/tmpldetail?type=2&pri_tmpl_id=kENL0EQdSD5gvtUAPh58n923AwBEio7tec6e1bC2sb0&flag=undefined&token=1034864027&lang=zh_CN
+			stGymInfoModel, err := dao.ImpGym.GetGymInfoByGymId(v.GymId)
 			if err != nil {
-				Printf("UpdateSingleLesson2StatusSendMsg err, err:%+v uid:%d PackageID:%s LessonID:%s", err, v.Uid, v.PackageID, v.LessonID)
+				Printf("GetGymInfoByGymId err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+				stat.AddError(err)
 				continue
 			}
-
-			//模板配置链接：https://mp.weixin.qq.com/wxamp/newtmpl/tmpldetail?type=2&pri_tmpl_id=kENL0EQdSD5gvtUAPh58n923AwBEio7tec6e1bC2sb0&flag=undefined&token=1034864027&lang=zh_CN
-			stGymInfoModel, err := dao.ImpGym.GetGymInfoByGymId(v.GymId)
 			stCourseModel, err := dao.ImpCourse.GetCourseById(v.CourseID)
+			if err != nil {
+				Printf("GetCourseById err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+				stat.AddError(err)
+				continue
+			}
 			stCoachModel, err := dao.ImpCoach.GetCoachById(v.CoachId)
+			if err != nil {
+				Printf("GetCoachById err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+				stat.AddError(err)
+				continue
+			}
 			stUserModel, err := dao.ImpUser.GetUser(v.Uid)
-			t := time.Unix(v.ScheduleBegTs, 0)
-			tEnd := time.Unix(v.ScheduleEndTs, 0)
-			stWxSendMsg2UserReq := comm.WxSendMsg2UserReq{
-				ToUser:           stUserModel.WechatID,
-				TemplateID:       "kENL0EQdSD5gvtUAPh58n923AwBEio7tec6e1bC2sb0",
-				Page:             "pages/home/index/index",
-				MiniprogramState: os.Getenv("MiniprogramState"),
-				Lang:             "zh_CN",
-				Data: map[string]comm.MsgDataField{
-					"thing1": {Value: stCourseModel.Name},            //课程名称
-					"date2":  {Value: t.Format("2006年01月02日 15:04")}, //上课时间
-					"thing3": {Value: stGymInfoModel.LocName},        //上课地点
-					"thing4": {Value: "课程即将开始，现在可以前往场地热身了哦！"},        //温馨提示
-				},
+			if err != nil {
+				Printf("GetUser err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+				stat.AddError(err)
+				continue
 			}
-			err = comm.SendMsg2User(v.Uid, stWxSendMsg2UserReq)
+			mapParam := genLessonNotifyParams(v.ScheduleBegTs, v.ScheduleEndTs)
+			mapParam[NotifyParam_CourseName] = stCourseModel.Name
+			mapParam[NotifyParam_GymName] = stGymInfoModel.LocName
+			mapParam[NotifyParam_GymSimpleName] = stGymInfoModel.LocSimpleName
+			mapParam[NotifyParam_CoachName] = stCoachModel.CoachName
+			stWxOutbox, err := newWxNotifyOutbox(NotifyScene_LessonStartRemind, NotifyTemplate_LessonStartRemind, v.Uid, stUserModel.WechatID, v.LessonID, v.PackageID, mapParam)
 			if err != nil {
-				Printf("sendMsg2User err, err:%+v uid:%d PackageID:%s LessonID:%s", err, v.Uid, v.PackageID, v.LessonID)
-			} else {
-				Printf("sendMsg2User succ, uid:%d PackageID:%s LessonID:%s", v.Uid, v.PackageID, v.LessonID)
+				Printf("newWxNotifyOutbox err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+				stat.AddError(err)
+				continue
 			}
-			Printf("UpdateSingleLesson2StatusSendMsg succ, uid:%d PackageID:%s LessonID:%s", v.Uid, v.PackageID, v.LessonID)
 
-			//开课前一小时，发送短信通知用户
-			if stUserModel.PhoneNumber != nil {
-				//您预约的{1}月{2}日{3}~{4}课程即将开始，场地：{5}，授课教练：{6}，现在可以前往场地热身了哦！
-				var vecTemplateParam []string
-				vecTemplateParam = append(vecTemplateParam, strconv.Itoa(int(t.Month())))
-				vecTemplateParam = append(vecTemplateParam, strconv.Itoa(t.Day()))
-				vecTemplateParam = append(vecTemplateParam, t.Format("15:04"))
-				vecTemplateParam = append(vecTemplateParam, tEnd.Format("15:04"))
-				vecTemplateParam = append(vecTemplateParam, stGymInfoModel.LocSimpleName)
-				vecTemplateParam = append(vecTemplateParam, stCoachModel.CoachName)
-				err := comm.SendSmsMsg2User(comm.SmsTemplateId_LessonStartRemind, stUserModel.UserID, vecTemplateParam, *stUserModel.PhoneNumber)
-				if err != nil {
-					Printf("SendSmsMsg2User err, err:%+v traineeUid:%d PackageID:%s LessonID:%s vecTemplateParam:%+v", err, stUserModel.UserID, v.PackageID, v.LessonID, vecTemplateParam)
-				} else {
-					Printf("SendSmsMsg2User succ, traineeUid:%d PackageID:%s LessonID:%s vecTemplateParam:%+v", stUserModel.UserID, v.PackageID, v.LessonID, vecTemplateParam)
-				}
+			//开课前一小时，按场景的发送渠道策略发送短信通知用户
+			stSmsOutbox, err := newRouteSmsNotifyOutbox(NotifyScene_LessonStartRemind, NotifyTemplate_LessonStartRemindSms, stUserModel.UserID, stUserModel.PhoneNumber, v.LessonID, v.PackageID, mapParam)
+			if err != nil {
+				Printf("newRouteSmsNotifyOutbox err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+				stat.AddError(err)
+				continue
+			}
+
+			//已发送标记和通知在同一个事务里写入，通知由投递任务发送，失败会重试
+			mapUpdates := make(map[string]interface{})
+			mapUpdates["send_msg_go_lesson"] = true
+			err = saveStateWithNotify(course_package_single_lesson_tableName, &model.CoursePackageSingleLessonModel{}, mapUpdates,
+				routeNotifyOutbox(NotifyScene_LessonStartRemind, stWxOutbox, stSmsOutbox), "uid = ? AND lesson_id = ? AND send_msg_go_lesson = false", v.Uid, v.LessonID)
+			if err == errStateChanged {
+				continue
+			}
+			if err != nil {
+				Printf("UpdateSingleLesson2StatusSendMsg err, err:%+v uid:%d PackageID:%s LessonID:%s", err, v.Uid, v.PackageID, v.LessonID)
+				stat.AddError(err)
+				continue
 			}
+			stat.AddChanged(1)
+			Printf("UpdateSingleLesson2StatusSendMsg succ, uid:%d PackageID:%s LessonID:%s", v.Uid, v.PackageID, v.LessonID)
 		}
 	}
 	return
 }
 
-func handleSendMsgWhenLessonComplete() {
+func handleSendMsgWhenLessonComplete(ctx context.Context, rules *BusinessRules) {
+	stat := getJobRunStat(ctx)
 	unNowTs := time.Now().Unix()
 	vecNotSendWriteCommentMsgCompleteLesson, err := dao.ImpCoursePackageSingleLesson.GetSingleLessonListFinishNotSendMsgWriteComment(unNowTs, 1000)
 	if err != nil {
 		Printf("GetSingleLessonListNotFinish err, err:%+v", err)
+		stat.Fail(err)
 		return
 	}
+	stat.AddExamined(len(vecNotSendWriteCommentMsgCompleteLesson))
 
 	for _, v := range vecNotSendWriteCommentMsgCompleteLesson {
-		//需要课程结束后1小时，才发提醒评论消息
-		if unNowTs <= v.ScheduleEndTs+3600 {
+		//需要课程结束后1小时（可按场地、课程配置），才发提醒评论消息
+		if unNowTs <= v.ScheduleEndTs+rules.lesson(BizRule_CommentRemindDelaySec, v.GymId, v.CourseID) {
 			continue
 		}
-		mapUpdates := make(map[string]interface{})
-		mapUpdates["send_msg_write_comment"] = true
-		err = dao.ImpCoursePackageSingleLesson.UpdateSingleLesson(v.Uid, v.LessonID, mapUpdates)
+
+		stCourseModel, err := dao.ImpCourse.GetCourseById(v.CourseID)
 		if err != nil {
-			Printf("UpdateSingleLesson2StatusSendMsg err, err:%+v uid:%d PackageID:%s LessonID:%s", err, v.Uid, v.PackageID, v.LessonID)
+			Printf("GetCourseById err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+			stat.AddError(err)
 			continue
 		}
-		Printf("UpdateSingleLesson2StatusSendMsg succ, uid:%d PackageID:%s LessonID:%s", v.Uid, v.PackageID, v.LessonID)
-
-		stCourseModel, err := dao.ImpCourse.GetCourseById(v.CourseID)
 		stCoachModel, err := dao.ImpCoach.GetCoachById(v.CoachId)
+		if err != nil {
+			Printf("GetCoachById err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+			stat.AddError(err)
+			continue
+		}
 		stUserModel, err := dao.ImpUser.GetUser(v.Uid)
-		t := time.Unix(v.ScheduleBegTs, 0)
-		stWxSendMsg2UserReq := comm.WxSendMsg2UserReq{
-			ToUser:           stUserModel.WechatID,
-			TemplateID:       "vrqe-O7w5ZmAAPT5MNciEqceSiVDRLJSkw6RKJXaMpo",
-			Page:             "pages/home/index/index",
-			MiniprogramState: os.Getenv("MiniprogramState"),
-			Lang:             "zh_CN",
-			Data: map[string]comm.MsgDataField{
-				"thing1": {Value: stCourseModel.Name},            //课程名称
-				"thing2": {Value: stCoachModel.CoachName},        //课程教练
-				"time3":  {Value: t.Format("2006年01月02日 15:04")}, //上课时间
-				"thing4": {Value: "您完成了今天的私教课，期待您的评价！"},     //温馨提示
-			},
+		if err != nil {
+			Printf("GetUser err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+			stat.AddError(err)
+			continue
+		}
+		mapParam := genLessonNotifyParams(v.ScheduleBegTs, v.ScheduleEndTs)
+		mapParam[NotifyParam_CourseName] = stCourseModel.Name
+		mapParam[NotifyParam_CoachName] = stCoachModel.CoachName
+		stWxOutbox, err := newWxNotifyOutbox(NotifyScene_LessonCommentRemind, NotifyTemplate_LessonCommentRemind, v.Uid, stUserModel.WechatID, v.LessonID, v.PackageID, mapParam)
+		if err != nil {
+			Printf("newWxNotifyOutbox err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+			stat.AddError(err)
+			continue
 		}
-		err = comm.SendMsg2User(v.Uid, stWxSendMsg2UserReq)
+		stSmsOutbox, err := newRouteSmsNotifyOutbox(NotifyScene_LessonCommentRemind, NotifyTemplate_LessonCommentRemindSms, stUserModel.UserID, stUserModel.PhoneNumber, v.LessonID, v.PackageID, mapParam)
 		if err != nil {
-			Printf("sendWxMsg2User err, err:%+v uid:%d PackageID:%s LessonID:%s", err, v.Uid, v.PackageID, v.LessonID)
-		} else {
-			Printf("sendWxMsg2User succ, uid:%d PackageID:%s LessonID:%s", v.Uid, v.PackageID, v.LessonID)
+			Printf("newRouteSmsNotifyOutbox err, err:%+v uid:%d LessonID:%s", err, v.Uid, v.LessonID)
+			stat.AddError(err)
+			continue
 		}
+
+		mapUpdates := make(map[string]interface{})
+		mapUpdates["send_msg_write_comment"] = true
+		err = saveStateWithNotify(course_package_single_lesson_tableName, &model.CoursePackageSingleLessonModel{}, mapUpdates,
+			routeNotifyOutbox(NotifyScene_LessonCommentRemind, stWxOutbox, stSmsOutbox), "uid = ? AND lesson_id = ? AND send_msg_write_comment = false", v.Uid, v.LessonID)
+		if err == errStateChanged {
+			continue
+		}
+		if err != nil {
+			Printf("UpdateSingleLesson2StatusSendMsg err, err:%+v uid:%d PackageID:%s LessonID:%s", err, v.Uid, v.PackageID, v.LessonID)
+			stat.AddError(err)
+			continue
+		}
+		stat.AddChanged(1)
+		Printf("UpdateSingleLesson2StatusSendMsg succ, uid:%d PackageID:%s LessonID:%s", v.Uid, v.PackageID, v.LessonID)
 	}
 
 }
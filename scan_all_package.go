@@ -1,75 +1,215 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"github.com/xionghengheng/ff_plib/comm"
 	"github.com/xionghengheng/ff_plib/db/dao"
 	"github.com/xionghengheng/ff_plib/db/model"
-	"os"
 	"time"
 )
 
-func ScanAllPackage() {
+func ScanAllPackage(ctx context.Context) {
 	Printf("scan start, beg_time:%s", time.Now().Format("2006-01-02 15:04:05"))
-	handleSendMsgWhenTrailPackageExpire()
+	// 单次执行的时间预算，用完后停止翻页，剩余的留到下一次执行
+	ctx, cancel := context.WithTimeout(ctx, trialPackageScanBudget)
+	defer cancel()
+	handleSendMsgWhenTrailPackageExpire(ctx)
 	Printf("scan end, end_time:%s", time.Now().Format("2006-01-02 15:04:05"))
 }
 
 
-func handleSendMsgWhenTrailPackageExpire() {
-	unNowTs := time.Now().Unix()
+// 体验课包的有效期：过期前7天、3天、1天分阶段提醒，到期后标记为过期
+// 按游标翻页处理还没有过期、或有效天数调长后可能恢复的体验课包，单个课包处理失败只记错误，不影响其它课包
+func handleSendMsgWhenTrailPackageExpire(ctx context.Context) {
+	stat := getJobRunStat(ctx)
+	//每次执行读取一次业务规则，执行过程中不变
+	rules := loadBusinessRules()
+
+	//有效天数最长的规则下仍可能没到期的已过期课包也要扫描，规则调长后恢复为有效
+	maxValidDay := rules.maxValue(BizRule_TrialValidDay)
+	if stDef, _ := getBizRuleDef(BizRule_TrialValidDay); stDef.Default > maxValidDay {
+		maxValidDay = stDef.Default
+	}
+	reactivateBegTs := time.Now().Unix() - maxValidDay*86400
 
-	var vecAllTrailPackageModel []model.CoursePackageModel
-	var turnPageTs int64
-	for i := 0; i <= 5000; i++ {
-		tmpVecAllTrailPackageModel, err := dao.ImpCoursePackage.GetAllTrailCoursePackageList(turnPageTs)
+	var cursor PackageScanCursor
+	for ctx.Err() == nil {
+		vecTrailPackageModel, err := ImpTrialPackage.GetTrialPackageScanPage(cursor, reactivateBegTs, trialPackageScanPageSize)
+		if err != nil {
+			Printf("[PackageExpire]GetTrialPackageScanPage err, err:%+v cursor:%+v\n", err, cursor)
+			stat.Fail(err)
+			return
+		}
+		vecPackageId := make([]string, 0, len(vecTrailPackageModel))
+		for _, v := range vecTrailPackageModel {
+			vecPackageId = append(vecPackageId, v.PackageID)
+		}
+		mapTrialPackageState, err := ImpTrialPackage.GetTrialPackageStateMap(vecPackageId)
 		if err != nil {
-			Printf("GetAllCoursePackageList err, i:%d err:%+v\n", i, err)
+			Printf("[PackageExpire]GetTrialPackageStateMap err, err:%+v cursor:%+v\n", err, cursor)
+			stat.Fail(err)
 			return
 		}
-		if len(tmpVecAllTrailPackageModel) == 0 {
-			Printf("GetAllCoursePackageList empty, i:%d vecAllPackageModel.len:%d\n", i, len(vecAllTrailPackageModel))
+		for _, v := range vecTrailPackageModel {
+			if ctx.Err() != nil {
+				break
+			}
+			cursor.advance(v.Ts, v.PackageID)
+			stat.AddExamined(1)
+			handleTrialPackageExpire(stat, rules, v, mapTrialPackageState[v.PackageID])
+		}
+		if len(vecTrailPackageModel) < trialPackageScanPageSize {
 			break
 		}
-		turnPageTs = tmpVecAllTrailPackageModel[len(tmpVecAllTrailPackageModel)-1].Ts
-		vecAllTrailPackageModel = append(vecAllTrailPackageModel, tmpVecAllTrailPackageModel...)
 	}
-
-	for _, v := range vecAllTrailPackageModel {
-		// 已经过期很久的存量课包，也不通知了
-		if v.RemainCnt == 0 || v.SendMsgTrailExpire || v.Ts > unNowTs || unNowTs-v.Ts < 7*86400 || unNowTs-v.Ts > 14*86400 {
-			continue
+	if ctx.Err() != nil {
+		backlogCnt, err := ImpTrialPackage.CountTrialPackageScan(cursor, reactivateBegTs)
+		if err != nil {
+			Printf("[PackageExpire]CountTrialPackageScan err, err:%+v cursor:%+v\n", err, cursor)
+			stat.AddError(err)
+			return
 		}
+		stat.AddBacklog(backlogCnt)
+		Printf("[SchedulerAlarm]package scan budget exhausted, backlog:%d\n", backlogCnt)
+	}
+}
+
+// handleTrialPackageExpire 处理单个体验课包：同步有效期状态，到期标记为过期，未到期时发送当前阶段的提醒
+func handleTrialPackageExpire(stat *JobRunStat, rules *BusinessRules, v model.CoursePackageModel, stTrialPackageStateModel *TrialPackageStateModel) {
+	unNowTs := time.Now().Unix()
+	remindDay, validDay := rules.trialExpireDays(v.GymId, v.CourseId)
+	expireTs := v.Ts + validDay*86400
 
-		mapUpdates := make(map[string]interface{})
-		mapUpdates["send_msg_trail_expire"] = true
-		err := dao.ImpCoursePackage.UpdateCoursePackage(v.Uid, v.PackageID, mapUpdates)
+	if stTrialPackageStateModel == nil {
+		//首次扫描到的课包创建有效期状态，之前只提醒一次的旧标记视为已发过第一阶段的提醒
+		stTrialPackageStateModel = &TrialPackageStateModel{
+			PackageID: v.PackageID,
+			Uid:       v.Uid,
+			ExpireTs:  expireTs,
+			Status:    TrialPackageStatus_Active,
+			Remind7d:  v.SendMsgTrailExpire,
+			CreatedTs: unNowTs,
+			UpdatedTs: unNowTs,
+		}
+		if err := ImpTrialPackage.AddTrialPackageState(stTrialPackageStateModel); err != nil {
+			Printf("[PackageExpire]AddTrialPackageState err, err:%+v uid:%d PackageID:%s\n", err, v.Uid, v.PackageID)
+			stat.AddError(err)
+			return
+		}
+	} else if stTrialPackageStateModel.Status == TrialPackageStatus_Expired {
+		//有效天数调长后还没到新的过期时间，恢复为有效，之后按新的过期时间提醒
+		if unNowTs >= expireTs {
+			return
+		}
+		reactivated, err := ImpTrialPackage.ReactivateTrialPackage(v.PackageID, expireTs, unNowTs)
 		if err != nil {
-			Printf("[send_msg_trail_expire]UpdateCoursePackage err, uid:%d PackageID:%s err:%+v\n", v.Uid, v.PackageID, err)
+			Printf("[PackageExpire]ReactivateTrialPackage err, err:%+v uid:%d PackageID:%s\n", err, v.Uid, v.PackageID)
+			stat.AddError(err)
 			return
 		}
-
-		t := time.Unix(v.Ts+14*86400, 0)
-		stCourseModel, err := dao.ImpCourse.GetCourseById(v.CourseId)
-		stUserModel, err := dao.ImpUser.GetUser(v.Uid)
-		stWxSendMsg2UserReq := comm.WxSendMsg2UserReq{
-			ToUser:           stUserModel.WechatID,
-			TemplateID:       "aeCItcVr9A9iVnoujFbA0jGyopFKAujrCCPVhtvM3FM",
-			Page:             "pages/home/index/index",
-			MiniprogramState: os.Getenv("MiniprogramState"),
-			Lang:             "zh_CN",
-			Data: map[string]comm.MsgDataField{
-				"thing3":  {Value: stCourseModel.Name},             //课程名称
-				"number1": {Value: fmt.Sprintf("%d", v.RemainCnt)}, //剩余课时
-				"time4":   {Value: t.Format("2006年01月02日 15:04")},  //到期时间
-				"thing2":  {Value: "体验课有效期还剩余7天，请预约上课吧！"},          //备注
-			},
+		if !reactivated {
+			return
 		}
-		err = comm.SendMsg2User(v.Uid, stWxSendMsg2UserReq)
+		stat.AddChanged(1)
+		Printf("[PackageExpire]package reactivated, uid:%d PackageID:%s expireTs:%d\n", v.Uid, v.PackageID, expireTs)
+		stTrialPackageStateModel = &TrialPackageStateModel{PackageID: v.PackageID, Uid: v.Uid, ExpireTs: expireTs, Status: TrialPackageStatus_Active}
+	} else if stTrialPackageStateModel.ExpireTs != expireTs {
+		if err := ImpTrialPackage.UpdateTrialPackageExpireTs(v.PackageID, expireTs); err != nil {
+			Printf("[PackageExpire]UpdateTrialPackageExpireTs err, err:%+v uid:%d PackageID:%s\n", err, v.Uid, v.PackageID)
+			stat.AddError(err)
+			return
+		}
+	}
+
+	//到期的课包标记为过期，之后不再扫描
+	if unNowTs >= expireTs {
+		expired, err := ImpTrialPackage.ExpireTrialPackage(v.PackageID, unNowTs)
 		if err != nil {
-			Printf("[PackageExpire]sendWxMsg2User err, err:%+v uid:%d PackageID:%s", err, v.Uid, v.PackageID)
-		} else {
-			Printf("[PackageExpire]sendWxMsg2User succ, uid:%d PackageID:%s", v.Uid, v.PackageID)
+			Printf("[PackageExpire]ExpireTrialPackage err, err:%+v uid:%d PackageID:%s\n", err, v.Uid, v.PackageID)
+			stat.AddError(err)
+			return
+		}
+		if expired {
+			stat.AddChanged(1)
+			Printf("[PackageExpire]package expired, uid:%d PackageID:%s expireTs:%d\n", v.Uid, v.PackageID, expireTs)
 		}
+		return
+	}
+
+	// 课时用完的不提醒，领取后没到开始提醒的天数（可按场地、课程配置）也不提醒
+	if v.RemainCnt <= 0 || v.Ts > unNowTs || unNowTs-v.Ts < remindDay*86400 {
+		return
+	}
+
+	//找到当前所处的提醒阶段，错过的阶段不补发
+	leftDay := (expireTs - unNowTs + 86399) / 86400
+	var pStage *TrialExpireRemindStage
+	for i := range vecTrialExpireRemindStage {
+		if leftDay <= vecTrialExpireRemindStage[i].Day {
+			pStage = &vecTrialExpireRemindStage[i]
+		}
+	}
+	if pStage == nil || stTrialPackageStateModel.reminded(*pStage) {
+		return
+	}
+
+	stCourseModel, err := dao.ImpCourse.GetCourseById(v.CourseId)
+	if err != nil {
+		Printf("[PackageExpire]GetCourseById err, err:%+v uid:%d PackageID:%s\n", err, v.Uid, v.PackageID)
+		stat.AddError(err)
+		return
+	}
+	stUserModel, err := dao.ImpUser.GetUser(v.Uid)
+	if err != nil {
+		Printf("[PackageExpire]GetUser err, err:%+v uid:%d PackageID:%s\n", err, v.Uid, v.PackageID)
+		stat.AddError(err)
+		return
+	}
+	mapParam := make(map[string]string)
+	mapParam[NotifyParam_CourseName] = stCourseModel.Name
+	mapParam[NotifyParam_RemainCnt] = fmt.Sprintf("%d", v.RemainCnt)
+	mapParam[NotifyParam_ExpireTime] = time.Unix(expireTs, 0).Format(notifyTimeLayout)
+	mapParam[NotifyParam_ExpireRemark] = fmt.Sprintf("体验课有效期还剩余%d天，请预约上课吧！", leftDay)
+	stWxOutbox, err := newWxNotifyOutbox(NotifyScene_TrialExpire, NotifyTemplate_TrialExpire, v.Uid, stUserModel.WechatID, "", v.PackageID, mapParam)
+	if err != nil {
+		Printf("[PackageExpire]newWxNotifyOutbox err, err:%+v uid:%d PackageID:%s\n", err, v.Uid, v.PackageID)
+		stat.AddError(err)
+		return
+	}
+	//每个有效期的每个阶段各发一条，业务唯一键带上阶段和过期时间，过期后恢复有效的课包按新的过期时间重新提醒
+	stWxOutbox.BizKey = fmt.Sprintf("%s:%dd:%d", stWxOutbox.BizKey, pStage.Day, expireTs)
+
+	//同一个业务唯一键已经写过通知的（例如恢复后的过期时间和之前相同），视为已提醒，只补上阶段标记
+	vecNotifyOutboxModel := []*NotifyOutboxModel{stWxOutbox}
+	exist, err := ImpNotifyOutbox.HasNotifyOutbox(stWxOutbox.BizKey)
+	if err != nil {
+		Printf("[PackageExpire]HasNotifyOutbox err, err:%+v uid:%d PackageID:%s BizKey:%s\n", err, v.Uid, v.PackageID, stWxOutbox.BizKey)
+		stat.AddError(err)
+		return
+	}
+	if exist {
+		vecNotifyOutboxModel = nil
+	}
+
+	//阶段标记和通知在同一个事务里写入，通知由投递任务发送，失败会重试
+	mapUpdates := make(map[string]interface{})
+	mapUpdates[pStage.Column] = true
+	mapUpdates["updated_ts"] = unNowTs
+	err = saveStateWithNotify(trial_package_state_tableName, &TrialPackageStateModel{}, mapUpdates, vecNotifyOutboxModel,
+		"package_id = ? AND status = ? AND "+pStage.Column+" = false", v.PackageID, TrialPackageStatus_Active)
+	if err == errStateChanged {
+		return
+	}
+	if err != nil {
+		Printf("[PackageExpire]save remind stage err, err:%+v uid:%d PackageID:%s stage:%d\n", err, v.Uid, v.PackageID, pStage.Day)
+		stat.AddError(err)
+		return
+	}
+	stat.AddChanged(1)
+	if exist {
+		Printf("[PackageExpire]notify already exist, mark reminded, uid:%d PackageID:%s stage:%d\n", v.Uid, v.PackageID, pStage.Day)
+		return
 	}
+	stat.AddNotified(1)
+	Printf("[PackageExpire]add notify succ, uid:%d PackageID:%s stage:%d\n", v.Uid, v.PackageID, pStage.Day)
 }
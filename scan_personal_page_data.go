@@ -1,52 +1,60 @@
 package main
 
 import (
+	"context"
 	"github.com/xionghengheng/ff_plib/db/dao"
 	"github.com/xionghengheng/ff_plib/db/model"
 	"time"
 )
 
 // 扫描生成教练端主页的计数信息
-func ScanCoachPersonalPageData() {
+func ScanCoachPersonalPageData(ctx context.Context) {
 	Printf("scan start, beg_time:%s", time.Now().Format("2006-01-02 15:04:05"))
-	err := doScan()
+	err := doScan(ctx)
 	if err != nil {
 		Printf("doScan err, err:%+v", err)
+		getJobRunStat(ctx).Fail(err)
 		return
 	}
 	Printf("scan end, end_time:%s", time.Now().Format("2006-01-02 15:04:05"))
 }
 
 // ScanCoachPersonalPageData 扫描生成教练端主页的计数信息
-func doScan() error {
+func doScan(ctx context.Context) error {
+	stat := getJobRunStat(ctx)
 	vecCoachModel, err := dao.ImpCoach.GetCoachAll()
 	if err != nil {
 		Printf("GetCoachAll err, err:%+v", err)
 		return err
 	}
 	unMonthBegTs := GetFirstOfMonthBegTimestamp()
+	stat.AddExamined(len(vecCoachModel))
 
 	for _,v := range vecCoachModel{
 		if v.CoachID > 0{
-			genCoachData(v.CoachID, unMonthBegTs)
+			if err = genCoachData(v.CoachID, unMonthBegTs); err != nil {
+				stat.AddError(err)
+			} else {
+				stat.AddChanged(1)
+			}
 		}
 	}
 	return nil
 }
 
-func genCoachData(coachId int, unMonthBegTs int64){
+func genCoachData(coachId int, unMonthBegTs int64) error {
 
 	//统计各个维度的计数
 	vecPaymentOrderModel, err := dao.ImpPaymentOrder.GetOrderListByCoachId(coachId, unMonthBegTs)
 	if err != nil{
 		Printf("GetOrderListByCoachId err, err:%+v coachId:%d", err, coachId)
-		return
+		return err
 	}
 
 	vecCoursePackageSingleLessonModel, err := dao.ImpCoursePackageSingleLesson.GetCompletedSingleLessonListByCoachId(coachId, unMonthBegTs)
 	if err != nil{
 		Printf("GetCompletedSingleLessonListByCoachId err, err:%+v coachId:%d", err, coachId)
-		return
+		return err
 	}
 
 
@@ -83,7 +91,8 @@ func genCoachData(coachId int, unMonthBegTs int64){
 	err = dao.ImpCoachClientMonthlyStatistic.AddItem(stCoachMonthlyStatisticModel)
 	if err != nil {
 		Printf("AddItem err, err:%+v coachId:%d", err, coachId)
-		return
+		return err
 	}
 	Printf("AddItem succ, coachId:%d stCoachMonthlyStatisticModel:%+v", coachId, stCoachMonthlyStatisticModel)
+	return nil
 }
\ No newline at end of file
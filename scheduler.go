@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // 内置时区数据，运行环境没有安装tzdata时也能解析 Asia/Shanghai
+)
+
+// 上一次执行还没结束时，到点的执行如何处理
+const (
+	JobOverlap_Skip  = 1 // 跳过本次
+	JobOverlap_Queue = 2 // 排队，上一次结束后立即补跑一次（最多排队一次）
+)
+
+// JobSchedule 任务的执行时间计划
+type JobSchedule interface {
+	// Next 返回t之后的下一个执行时间
+	Next(t time.Time) time.Time
+}
+
+// intervalSchedule 固定间隔执行
+type intervalSchedule struct {
+	interval time.Duration
+}
+
+func (s *intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(s.interval)
+}
+
+// cronSchedule 5段式cron表达式：分 时 日 月 周，支持 * , - / 写法
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 // 每一位表示该值是否命中
+	domStar, dowStar              bool
+	loc                           *time.Location
+}
+
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	t = t.In(s.loc).Truncate(time.Minute).Add(time.Minute)
+	// 最多找5年，表达式不可能命中时返回零值
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.loc)
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.loc)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// matchDay 日和周都指定时满足其一即可，和标准cron一致
+func (s *cronSchedule) matchDay(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// ParseJobSchedule 解析任务的执行计划，支持以下写法：
+//
+//	@every 5m                        每隔5分钟
+//	@daily 23:00 Asia/Shanghai       每天23:00（时区可省略，默认本地时区）
+//	0 23 * * *                       cron表达式
+//	TZ=Asia/Shanghai 0 23 * * *      指定时区的cron表达式
+func ParseJobSchedule(spec string) (JobSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval spec %q: %v", spec, err)
+		}
+		if interval < time.Second {
+			return nil, fmt.Errorf("interval too short in spec %q", spec)
+		}
+		return &intervalSchedule{interval: interval}, nil
+	}
+
+	if strings.HasPrefix(spec, "@daily ") {
+		vecField := strings.Fields(spec[len("@daily "):])
+		if len(vecField) == 0 || len(vecField) > 2 {
+			return nil, fmt.Errorf("invalid daily spec %q", spec)
+		}
+		clock, err := time.Parse("15:04", vecField[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid daily spec %q: %v", spec, err)
+		}
+		cronSpec := fmt.Sprintf("%d %d * * *", clock.Minute(), clock.Hour())
+		if len(vecField) == 2 {
+			cronSpec = "TZ=" + vecField[1] + " " + cronSpec
+		}
+		return ParseJobSchedule(cronSpec)
+	}
+
+	loc := time.Local
+	if strings.HasPrefix(spec, "TZ=") {
+		idx := strings.Index(spec, " ")
+		if idx < 0 {
+			return nil, fmt.Errorf("invalid cron spec %q", spec)
+		}
+		var err error
+		loc, err = time.LoadLocation(spec[len("TZ="):idx])
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone in spec %q: %v", spec, err)
+		}
+		spec = strings.TrimSpace(spec[idx+1:])
+	}
+
+	vecField := strings.Fields(spec)
+	if len(vecField) != 5 {
+		return nil, fmt.Errorf("cron spec %q must have 5 fields", spec)
+	}
+	s := &cronSchedule{loc: loc}
+	var err error
+	if s.minute, err = parseCronField(vecField[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseCronField(vecField[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseCronField(vecField[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseCronField(vecField[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseCronField(vecField[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// 周日可以写成0或7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = vecField[2] == "*"
+	s.dowStar = vecField[4] == "*"
+	return s, nil
+}
+
+// parseCronField 解析cron的一段，返回命中值的位图
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			n, err := strconv.Atoi(part[idx+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in cron field %q", field)
+			}
+			step = n
+			part = part[:idx]
+		}
+		beg, end := min, max
+		if part != "*" {
+			vecRange := strings.SplitN(part, "-", 2)
+			n, err := strconv.Atoi(vecRange[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid cron field %q", field)
+			}
+			beg, end = n, n
+			if len(vecRange) == 2 {
+				if end, err = strconv.Atoi(vecRange[1]); err != nil {
+					return 0, fmt.Errorf("invalid cron field %q", field)
+				}
+			} else if step > 1 {
+				end = max
+			}
+		}
+		if beg < min || end > max || beg > end {
+			return 0, fmt.Errorf("cron field %q out of range [%d,%d]", field, min, max)
+		}
+		for i := beg; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+// Job 定时任务
+type Job struct {
+	Name       string                    // 任务名，全局唯一
+	Spec       string                    // 执行计划，见 ParseJobSchedule
+	Overlap    int                       // 上一次没结束时的处理方式，默认跳过
+	RunOnStart bool                      // 启动后是否立即执行一次
+	Run        func(ctx context.Context) // 任务内容，ctx在服务停止时取消，耗时长的任务应检查ctx及时退出；执行计数通过 getJobRunStat(ctx) 累加
+}
+
+// jobEntry 已注册的任务及其运行状态
+type jobEntry struct {
+	job      Job
+	schedule JobSchedule
+	mu       sync.Mutex
+	running  bool // 是否正在执行
+	pending  bool // 是否有排队等待的执行
+	paused   bool // 是否被管理员暂停，由 job_control 表同步
+
+	pendingTrigger   string // 排队的执行的触发方式
+	pendingTriggerBy string // 排队的执行的手动触发人
+}
+
+// 同步 job_control 表（暂停状态、手动触发请求）的间隔
+const jobControlPollInterval = 10 * time.Second
+
+// JobInfo 已注册任务的基本信息
+type JobInfo struct {
+	Name       string `json:"name"`         // 任务名
+	Spec       string `json:"spec"`         // 执行计划
+	RunOnStart bool   `json:"run_on_start"` // 启动后是否立即执行一次
+}
+
+// Scheduler 定时任务调度器，负责按计划触发任务、捕获panic、处理重叠执行以及停服时等待任务结束
+type Scheduler struct {
+	mu          sync.Mutex
+	mapJob      map[string]*jobEntry
+	vecName     []string
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup  // 正在执行的任务
+	loopWg      sync.WaitGroup  // 各任务的调度循环
+	leaseKeeper *jobLeaseKeeper // 多实例部署时的任务租约，为nil时每个实例都执行
+	instanceId  string          // 本实例标识，写入执行记录
+	started     bool
+}
+
+func NewScheduler() *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{
+		mapJob:     make(map[string]*jobEntry),
+		ctx:        ctx,
+		cancel:     cancel,
+		instanceId: genInstanceId(),
+	}
+}
+
+// EnableClusterLease 启用任务租约，多实例部署时每个任务同一时间只在一个实例上执行，需要在 Start 之前调用
+func (s *Scheduler) EnableClusterLease() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leaseKeeper = newJobLeaseKeeper(s.instanceId)
+}
+
+// Register 注册任务，需要在 Start 之前调用
+func (s *Scheduler) Register(job Job) error {
+	if job.Name == "" || job.Run == nil {
+		return fmt.Errorf("job name and run func are required")
+	}
+	schedule, err := ParseJobSchedule(job.Spec)
+	if err != nil {
+		return fmt.Errorf("job %s: %v", job.Name, err)
+	}
+	if job.Overlap == 0 {
+		job.Overlap = JobOverlap_Skip
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return fmt.Errorf("job %s: scheduler already started", job.Name)
+	}
+	if _, ok := s.mapJob[job.Name]; ok {
+		return fmt.Errorf("job %s already registered", job.Name)
+	}
+	s.mapJob[job.Name] = &jobEntry{job: job, schedule: schedule}
+	s.vecName = append(s.vecName, job.Name)
+	return nil
+}
+
+// GetJobInfoList 返回已注册的任务，按注册顺序
+func (s *Scheduler) GetJobInfoList() []JobInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var vecJobInfo []JobInfo
+	for _, name := range s.vecName {
+		job := s.mapJob[name].job
+		vecJobInfo = append(vecJobInfo, JobInfo{Name: job.Name, Spec: job.Spec, RunOnStart: job.RunOnStart})
+	}
+	return vecJobInfo
+}
+
+// HasJob 任务是否已注册
+func (s *Scheduler) HasJob(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.mapJob[name]
+	return ok
+}
+
+// Start 启动所有任务的调度
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	if s.started {
+		s.mu.Unlock()
+		return
+	}
+	s.started = true
+	if s.leaseKeeper != nil {
+		s.leaseKeeper.vecJobName = s.vecName
+		s.leaseKeeper.start(s.ctx)
+	}
+	vecEntry := make([]*jobEntry, 0, len(s.vecName))
+	for _, name := range s.vecName {
+		vecEntry = append(vecEntry, s.mapJob[name])
+	}
+	s.mu.Unlock()
+
+	// 先同步一次暂停状态，避免被暂停的任务在启动时执行；syncJobControl 内部会加 s.mu，必须在释放后调用
+	// 启动后不能再注册任务，释放锁之后 vecName 和 mapJob 不会再变
+	s.syncJobControl()
+	s.loopWg.Add(1)
+	go s.controlLoop()
+	for _, entry := range vecEntry {
+		s.loopWg.Add(1)
+		go s.loop(entry)
+	}
+	Printf("Scheduler started, jobs:%v\n", s.vecName)
+}
+
+// Stop 停止调度并等待正在执行的任务结束，超过timeout不再等待，返回是否全部结束
+func (s *Scheduler) Stop(timeout time.Duration) bool {
+	s.cancel()
+	s.loopWg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	allDone := true
+	select {
+	case <-done:
+		Printf("Scheduler stopped, all jobs finished\n")
+	case <-time.After(timeout):
+		allDone = false
+		Printf("Scheduler stop timeout, some jobs still running, timeout:%s\n", timeout)
+	}
+	// 还有任务没结束时不释放租约，等租约自然过期，避免其他实例同时执行
+	if s.leaseKeeper != nil && allDone {
+		s.leaseKeeper.releaseAll()
+	}
+	return allDone
+}
+
+// loop 单个任务的调度循环
+func (s *Scheduler) loop(entry *jobEntry) {
+	defer s.loopWg.Done()
+
+	if entry.job.RunOnStart {
+		s.trigger(entry, JobTrigger_Start, "")
+	}
+	next := entry.schedule.Next(time.Now())
+	for !next.IsZero() {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.trigger(entry, JobTrigger_Schedule, "")
+		next = entry.schedule.Next(time.Now())
+	}
+	Printf("Scheduler job has no next run time, job:%s spec:%s\n", entry.job.Name, entry.job.Spec)
+}
+
+// controlLoop 定期同步 job_control 表，使管理员的暂停、恢复和手动触发在所有实例上生效
+func (s *Scheduler) controlLoop() {
+	defer s.loopWg.Done()
+	ticker := time.NewTicker(jobControlPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.syncJobControl()
+		}
+	}
+}
+
+// syncJobControl 更新本地的暂停状态，并领取手动触发请求；开启租约时只有持有者领取
+func (s *Scheduler) syncJobControl() {
+	vecJobControlModel, err := ImpJobRun.GetAllJobControl()
+	if err != nil {
+		// 数据库异常时保留上一次的暂停状态
+		Printf("Scheduler GetAllJobControl err, err:%+v\n", err)
+		return
+	}
+	for _, v := range vecJobControlModel {
+		s.mu.Lock()
+		entry, ok := s.mapJob[v.JobName]
+		s.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		entry.mu.Lock()
+		if entry.paused != v.Paused {
+			Printf("Scheduler job paused changed, job:%s paused:%t operator:%s\n", v.JobName, v.Paused, v.PausedBy)
+		}
+		entry.paused = v.Paused
+		entry.mu.Unlock()
+
+		if v.TriggerReqTs == 0 || s.ctx.Err() != nil {
+			continue
+		}
+		if s.leaseKeeper != nil && !s.leaseKeeper.isHolder(v.JobName) {
+			continue
+		}
+		claimed, err := ImpJobRun.ClaimJobTrigger(v.JobName, v.TriggerReqTs)
+		if err != nil {
+			Printf("Scheduler ClaimJobTrigger err, err:%+v job:%s\n", err, v.JobName)
+			continue
+		}
+		if claimed {
+			Printf("Scheduler job manual trigger claimed, job:%s operator:%s\n", v.JobName, v.TriggerBy)
+			s.trigger(entry, JobTrigger_Manual, v.TriggerBy)
+		}
+	}
+}
+
+// trigger 触发一次执行，上一次还在执行时按 Overlap 跳过或排队，手动触发总是排队
+func (s *Scheduler) trigger(entry *jobEntry, triggerType string, triggerBy string) {
+	entry.mu.Lock()
+	if entry.running {
+		if entry.job.Overlap == JobOverlap_Queue || triggerType == JobTrigger_Manual {
+			entry.pending = true
+			if entry.pendingTrigger != JobTrigger_Manual {
+				entry.pendingTrigger = triggerType
+				entry.pendingTriggerBy = triggerBy
+			}
+			Printf("Scheduler job still running, queued, job:%s\n", entry.job.Name)
+		} else {
+			Printf("Scheduler job still running, skipped, job:%s\n", entry.job.Name)
+		}
+		entry.mu.Unlock()
+		return
+	}
+	entry.running = true
+	entry.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			s.runOnce(entry, triggerType, triggerBy)
+
+			entry.mu.Lock()
+			if !entry.pending || s.ctx.Err() != nil {
+				entry.running = false
+				entry.pending = false
+				entry.pendingTrigger = ""
+				entry.pendingTriggerBy = ""
+				entry.mu.Unlock()
+				return
+			}
+			triggerType, triggerBy = entry.pendingTrigger, entry.pendingTriggerBy
+			entry.pending = false
+			entry.pendingTrigger = ""
+			entry.pendingTriggerBy = ""
+			entry.mu.Unlock()
+		}
+	}()
+}
+
+// runOnce 执行一次任务并记录执行结果，捕获panic避免整个服务退出
+func (s *Scheduler) runOnce(entry *jobEntry, triggerType string, triggerBy string) {
+	entry.mu.Lock()
+	paused := entry.paused
+	entry.mu.Unlock()
+	// 暂停期间只跳过按计划的执行，管理员手动触发的照常执行
+	if paused && triggerType != JobTrigger_Manual {
+		Printf("Scheduler job paused, skipped, job:%s\n", entry.job.Name)
+		return
+	}
+
+	ctx := s.ctx
+	if s.leaseKeeper != nil {
+		if !s.leaseKeeper.isHolder(entry.job.Name) {
+			Printf("Scheduler job lease held by other instance, skipped, job:%s\n", entry.job.Name)
+			return
+		}
+		// 执行期间租约被其他实例接管时取消本次执行
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(s.ctx)
+		s.leaseKeeper.bindRun(entry.job.Name, cancel)
+		defer func() {
+			s.leaseKeeper.unbindRun(entry.job.Name)
+			cancel()
+		}()
+	}
+
+	begTime := time.Now()
+	stat := &JobRunStat{}
+	runId := beginJobRun(entry.job.Name, s.instanceId, triggerType, triggerBy, begTime)
+	defer func() {
+		status := JobRunStatus_Succ
+		if r := recover(); r != nil {
+			status = JobRunStatus_Panic
+			stat.AddError(fmt.Errorf("panic: %v", r))
+			Printf("[SchedulerAlarm]job panic, job:%s panic:%v stack:%s\n", entry.job.Name, r, debug.Stack())
+		} else if ctx.Err() != nil {
+			status = JobRunStatus_Canceled
+		} else if stat.isFailed() {
+			status = JobRunStatus_Failed
+		}
+		finishJobRun(runId, entry.job.Name, status, stat, begTime)
+		Printf("Scheduler job finished, job:%s status:%s cost:%s\n", entry.job.Name, status, time.Since(begTime))
+	}()
+	Printf("Scheduler job start, job:%s trigger:%s\n", entry.job.Name, triggerType)
+	entry.job.Run(withJobRunStat(ctx, stat))
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeJobRun 返回固定的任务控制信息，记录执行记录和手动触发的领取，其他方法未实现
+type fakeJobRun struct {
+	JobRunInterface
+	mu            sync.Mutex
+	vecJobControl []JobControlModel
+	vecJobRun     []JobRunModel
+	vecClaim      []string
+}
+
+func (f *fakeJobRun) GetAllJobControl() ([]JobControlModel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]JobControlModel(nil), f.vecJobControl...), nil
+}
+
+func (f *fakeJobRun) ClaimJobTrigger(jobName string, triggerReqTs int64) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.vecJobControl {
+		if f.vecJobControl[i].JobName == jobName && f.vecJobControl[i].TriggerReqTs == triggerReqTs {
+			f.vecJobControl[i].TriggerReqTs = 0
+			f.vecClaim = append(f.vecClaim, jobName)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeJobRun) AddJobRun(stJobRunModel *JobRunModel) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stJobRunModel.ID = int64(len(f.vecJobRun) + 1)
+	f.vecJobRun = append(f.vecJobRun, *stJobRunModel)
+	return nil
+}
+
+func (f *fakeJobRun) UpdateJobRun(id int64, mapUpdates map[string]interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if status, ok := mapUpdates["status"].(string); ok {
+		f.vecJobRun[id-1].Status = status
+	}
+	return nil
+}
+
+// setupJobRunFake 替换任务执行记录的数据模型，测试结束后还原
+func setupJobRunFake(t *testing.T, vecJobControl []JobControlModel) *fakeJobRun {
+	oldJobRun := ImpJobRun
+	t.Cleanup(func() {
+		ImpJobRun = oldJobRun
+	})
+	fake := &fakeJobRun{vecJobControl: vecJobControl}
+	ImpJobRun = fake
+	return fake
+}
+
+// startWithTimeout 启动调度器，超时未返回说明 Start 卡住了
+func startWithTimeout(t *testing.T, s *Scheduler) {
+	done := make(chan struct{})
+	go func() {
+		s.Start()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Start deadlocked")
+	}
+}
+
+func TestParseJobSchedule(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatalf("LoadLocation err:%v", err)
+	}
+	vecCase := []struct {
+		name     string
+		spec     string
+		from     time.Time
+		wantNext time.Time
+		wantErr  bool
+	}{
+		{name: "every", spec: "@every 5m", from: time.Date(2024, 1, 1, 10, 7, 30, 0, time.UTC), wantNext: time.Date(2024, 1, 1, 10, 12, 30, 0, time.UTC)},
+		{name: "daily with zone before time", spec: "@daily 23:00 Asia/Shanghai", from: time.Date(2024, 1, 1, 14, 30, 0, 0, time.UTC), wantNext: time.Date(2024, 1, 1, 23, 0, 0, 0, shanghai)},
+		{name: "daily with zone after time", spec: "@daily 23:00 Asia/Shanghai", from: time.Date(2024, 1, 1, 16, 0, 0, 0, time.UTC), wantNext: time.Date(2024, 1, 2, 23, 0, 0, 0, shanghai)},
+		{name: "daily exactly at time", spec: "@daily 23:00 Asia/Shanghai", from: time.Date(2024, 1, 1, 23, 0, 0, 0, shanghai), wantNext: time.Date(2024, 1, 2, 23, 0, 0, 0, shanghai)},
+		{name: "daily local zone", spec: "@daily 06:30", from: time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local), wantNext: time.Date(2024, 1, 2, 6, 30, 0, 0, time.Local)},
+		{name: "cron with zone", spec: "TZ=UTC 0 23 * * *", from: time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC), wantNext: time.Date(2024, 1, 2, 23, 0, 0, 0, time.UTC)},
+		{name: "cron step", spec: "TZ=Asia/Shanghai */15 * * * *", from: time.Date(2024, 1, 1, 10, 7, 0, 0, time.UTC), wantNext: time.Date(2024, 1, 1, 10, 15, 0, 0, time.UTC)},
+		{name: "cron range step and list", spec: "TZ=UTC 30 8-12/2,20 * * *", from: time.Date(2024, 1, 1, 12, 31, 0, 0, time.UTC), wantNext: time.Date(2024, 1, 1, 20, 30, 0, 0, time.UTC)},
+		{name: "sunday written as 7", spec: "TZ=UTC 0 9 * * 7", from: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), wantNext: time.Date(2024, 1, 7, 9, 0, 0, 0, time.UTC)},
+		{name: "dom or dow", spec: "TZ=UTC 0 0 13 * 5", from: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), wantNext: time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{name: "month", spec: "TZ=UTC 0 0 1 3 *", from: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), wantNext: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "interval too short", spec: "@every 500ms", wantErr: true},
+		{name: "interval invalid", spec: "@every abc", wantErr: true},
+		{name: "daily hour out of range", spec: "@daily 25:00", wantErr: true},
+		{name: "daily unknown zone", spec: "@daily 23:00 Mars/Base", wantErr: true},
+		{name: "daily too many fields", spec: "@daily 23:00 Asia/Shanghai x", wantErr: true},
+		{name: "unknown zone", spec: "TZ=Mars/Base 0 23 * * *", wantErr: true},
+		{name: "zone without cron", spec: "TZ=Asia/Shanghai", wantErr: true},
+		{name: "too few fields", spec: "0 23 * *", wantErr: true},
+		{name: "minute out of range", spec: "60 * * * *", wantErr: true},
+		{name: "zero step", spec: "*/0 * * * *", wantErr: true},
+		{name: "reversed range", spec: "0 10-8 * * *", wantErr: true},
+		{name: "not a number", spec: "a b c d e", wantErr: true},
+	}
+	for _, c := range vecCase {
+		t.Run(c.name, func(t *testing.T) {
+			schedule, err := ParseJobSchedule(c.spec)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("ParseJobSchedule(%q) got nil err, want err", c.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseJobSchedule(%q) err:%v", c.spec, err)
+			}
+			if next := schedule.Next(c.from); !next.Equal(c.wantNext) {
+				t.Fatalf("ParseJobSchedule(%q).Next(%v) got %v, want %v", c.spec, c.from, next, c.wantNext)
+			}
+		})
+	}
+}
+
+func TestSchedulerTriggerOverlap(t *testing.T) {
+	vecCase := []struct {
+		name           string
+		overlap        int
+		pendingTrigger string
+		triggerType    string
+		triggerBy      string
+		wantPending    bool
+		wantTrigger    string
+		wantTriggerBy  string
+	}{
+		{name: "skip drops scheduled run", overlap: JobOverlap_Skip, triggerType: JobTrigger_Schedule, wantPending: false},
+		{name: "queue keeps scheduled run", overlap: JobOverlap_Queue, triggerType: JobTrigger_Schedule, wantPending: true, wantTrigger: JobTrigger_Schedule},
+		{name: "manual run queued even with skip", overlap: JobOverlap_Skip, triggerType: JobTrigger_Manual, triggerBy: "admin", wantPending: true, wantTrigger: JobTrigger_Manual, wantTriggerBy: "admin"},
+		{name: "scheduled run does not replace queued manual run", overlap: JobOverlap_Queue, pendingTrigger: JobTrigger_Manual, triggerType: JobTrigger_Schedule, wantPending: true, wantTrigger: JobTrigger_Manual, wantTriggerBy: "admin"},
+		{name: "manual run replaces queued scheduled run", overlap: JobOverlap_Queue, pendingTrigger: JobTrigger_Schedule, triggerType: JobTrigger_Manual, triggerBy: "admin", wantPending: true, wantTrigger: JobTrigger_Manual, wantTriggerBy: "admin"},
+	}
+	for _, c := range vecCase {
+		t.Run(c.name, func(t *testing.T) {
+			s := NewScheduler()
+			// 模拟上一次还在执行，trigger 只处理重叠，不会启动新的执行
+			entry := &jobEntry{job: Job{Name: "test_job", Overlap: c.overlap}, running: true}
+			if c.pendingTrigger != "" {
+				entry.pending = true
+				entry.pendingTrigger = c.pendingTrigger
+				if c.pendingTrigger == JobTrigger_Manual {
+					entry.pendingTriggerBy = "admin"
+				}
+			}
+			s.trigger(entry, c.triggerType, c.triggerBy)
+			if !entry.running {
+				t.Fatalf("running got false, want still running")
+			}
+			if entry.pending != c.wantPending || entry.pendingTrigger != c.wantTrigger || entry.pendingTriggerBy != c.wantTriggerBy {
+				t.Fatalf("got pending:%t trigger:%q by:%q, want pending:%t trigger:%q by:%q",
+					entry.pending, entry.pendingTrigger, entry.pendingTriggerBy, c.wantPending, c.wantTrigger, c.wantTriggerBy)
+			}
+		})
+	}
+}
+
+func TestSchedulerStartWithJobControl(t *testing.T) {
+	vecCase := []struct {
+		name        string
+		runOnStart  bool
+		control     *JobControlModel
+		wantRunCnt  int32
+		wantTrigger string
+		wantClaim   int
+	}{
+		{name: "no control row", runOnStart: true, wantRunCnt: 1, wantTrigger: JobTrigger_Start},
+		{name: "control row of other job", runOnStart: true, control: &JobControlModel{JobName: "other_job", Paused: true}, wantRunCnt: 1, wantTrigger: JobTrigger_Start},
+		{name: "paused skips run on start", runOnStart: true, control: &JobControlModel{JobName: "test_job", Paused: true}, wantRunCnt: 0},
+		{name: "manual trigger runs while paused", control: &JobControlModel{JobName: "test_job", Paused: true, TriggerReqTs: 1700000000, TriggerBy: "admin"}, wantRunCnt: 1, wantTrigger: JobTrigger_Manual, wantClaim: 1},
+	}
+	for _, c := range vecCase {
+		t.Run(c.name, func(t *testing.T) {
+			var vecJobControl []JobControlModel
+			if c.control != nil {
+				vecJobControl = append(vecJobControl, *c.control)
+			}
+			fake := setupJobRunFake(t, vecJobControl)
+
+			var runCnt int32
+			s := NewScheduler()
+			err := s.Register(Job{Name: "test_job", Spec: "@every 1h", RunOnStart: c.runOnStart, Run: func(ctx context.Context) {
+				atomic.AddInt32(&runCnt, 1)
+			}})
+			if err != nil {
+				t.Fatalf("Register err:%v", err)
+			}
+			startWithTimeout(t, s)
+			if !s.Stop(2 * time.Second) {
+				t.Fatalf("Stop got timeout, want all jobs finished")
+			}
+
+			if runCnt != c.wantRunCnt || len(fake.vecJobRun) != int(c.wantRunCnt) {
+				t.Fatalf("got %d runs and %d run records, want %d", runCnt, len(fake.vecJobRun), c.wantRunCnt)
+			}
+			if c.wantRunCnt > 0 && fake.vecJobRun[0].TriggerType != c.wantTrigger {
+				t.Fatalf("got trigger %q, want %q", fake.vecJobRun[0].TriggerType, c.wantTrigger)
+			}
+			if len(fake.vecClaim) != c.wantClaim {
+				t.Fatalf("got claims %v, want %d", fake.vecClaim, c.wantClaim)
+			}
+		})
+	}
+}
+
+func TestSchedulerStartStop(t *testing.T) {
+	t.Run("stop cancels running job", func(t *testing.T) {
+		fake := setupJobRunFake(t, nil)
+		started := make(chan struct{})
+		s := NewScheduler()
+		err := s.Register(Job{Name: "test_job", Spec: "@every 1h", RunOnStart: true, Run: func(ctx context.Context) {
+			close(started)
+			<-ctx.Done()
+		}})
+		if err != nil {
+			t.Fatalf("Register err:%v", err)
+		}
+		startWithTimeout(t, s)
+		// 重复启动不会再次启动调度循环
+		startWithTimeout(t, s)
+		<-started
+		if err := s.Register(Job{Name: "late_job", Spec: "@every 1h", Run: func(ctx context.Context) {}}); err == nil {
+			t.Fatalf("Register after Start got nil err, want err")
+		}
+		if !s.Stop(2 * time.Second) {
+			t.Fatalf("Stop got timeout, want job canceled and finished")
+		}
+		if len(fake.vecJobRun) != 1 || fake.vecJobRun[0].Status != JobRunStatus_Canceled {
+			t.Fatalf("got run records %+v, want one canceled run", fake.vecJobRun)
+		}
+	})
+
+	t.Run("stop times out when job ignores ctx", func(t *testing.T) {
+		fake := setupJobRunFake(t, nil)
+		started := make(chan struct{})
+		release := make(chan struct{})
+		s := NewScheduler()
+		err := s.Register(Job{Name: "test_job", Spec: "@every 1h", RunOnStart: true, Run: func(ctx context.Context) {
+			close(started)
+			<-release
+		}})
+		if err != nil {
+			t.Fatalf("Register err:%v", err)
+		}
+		startWithTimeout(t, s)
+		<-started
+		if s.Stop(50 * time.Millisecond) {
+			t.Fatalf("Stop got all finished, want timeout")
+		}
+		close(release)
+		s.wg.Wait()
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		if len(fake.vecJobRun) != 1 || fake.vecJobRun[0].Status != JobRunStatus_Canceled {
+			t.Fatalf("got run records %+v, want one canceled run", fake.vecJobRun)
+		}
+	})
+}
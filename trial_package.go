@@ -0,0 +1,197 @@
+package main
+
+import (
+	"time"
+
+	"github.com/xionghengheng/ff_plib/db"
+	"github.com/xionghengheng/ff_plib/db/model"
+)
+
+// 体验课包扫描的分页参数，扫描每10分钟执行一次，留出余量避免和下一次重叠
+const (
+	trialPackageScanPageSize = 200
+	trialPackageScanBudget   = 5 * time.Minute
+)
+
+// 体验课包的有效期状态
+const (
+	TrialPackageStatus_Active  = "active"  // 有效期内
+	TrialPackageStatus_Expired = "expired" // 已过期，预约服务不再允许使用该课包约课
+)
+
+// TrialExpireRemindStage 过期提醒的阶段：过期前几天提醒，以及记录是否已提醒的字段
+type TrialExpireRemindStage struct {
+	Day    int64
+	Column string
+}
+
+// vecTrialExpireRemindStage 过期前7天、3天、1天各提醒一次，按天数降序
+// 错过的阶段不补发，只发当前所处的阶段
+var vecTrialExpireRemindStage = []TrialExpireRemindStage{
+	{Day: 7, Column: "remind_7d"},
+	{Day: 3, Column: "remind_3d"},
+	{Day: 1, Column: "remind_1d"},
+}
+
+// TrialPackageStateModel 体验课包的有效期状态和各阶段的提醒标记，一个体验课包一条
+// 课包表在 ff_plib 中定义，过期状态和提醒标记记在这里，预约服务按 status 判断课包是否可用
+type TrialPackageStateModel struct {
+	ID        int64  `json:"id" gorm:"primary_key;AUTO_INCREMENT"`             // 主键ID
+	PackageID string `json:"package_id" gorm:"type:varchar(128);unique_index"` // 课包id
+	Uid       int64  `json:"uid" gorm:"index"`                                 // 学员id
+	ExpireTs  int64  `json:"expire_ts"`                                        // 过期时间，按当前的有效天数规则计算
+	Status    string `json:"status" gorm:"type:varchar(16);index"`             // 有效期状态
+	Remind7d  bool   `json:"remind_7d" gorm:"column:remind_7d"`                // 是否已发过期前7天的提醒
+	Remind3d  bool   `json:"remind_3d" gorm:"column:remind_3d"`                // 是否已发过期前3天的提醒
+	Remind1d  bool   `json:"remind_1d" gorm:"column:remind_1d"`                // 是否已发过期前1天的提醒
+	ExpiredTs int64  `json:"expired_ts"`                                       // 标记为过期的时间
+	CreatedTs int64  `json:"created_ts"`                                       // 创建时间
+	UpdatedTs int64  `json:"updated_ts"`                                       // 更新时间
+}
+
+const trial_package_state_tableName = "trial_package_state"
+
+// reminded 该阶段是否已经提醒过
+func (s *TrialPackageStateModel) reminded(stage TrialExpireRemindStage) bool {
+	switch stage.Column {
+	case "remind_7d":
+		return s.Remind7d
+	case "remind_3d":
+		return s.Remind3d
+	case "remind_1d":
+		return s.Remind1d
+	}
+	return false
+}
+
+// PackageScanCursor 课包扫描的游标，按 (ts, package_id) 升序翻页
+type PackageScanCursor struct {
+	Ts        int64
+	PackageID string
+}
+
+// advance 游标移动到刚处理的课包
+func (c *PackageScanCursor) advance(ts int64, packageId string) {
+	c.Ts = ts
+	c.PackageID = packageId
+}
+
+// 游标条件，游标为空时 ts 从0开始，等价于不过滤
+const packageScanCursorWhere = "(ts > ? OR (ts = ? AND package_id > ?))"
+
+// TrialPackageInterface 体验课包有效期数据模型接口
+type TrialPackageInterface interface {
+	// 分页查询需要扫描的体验课包：还没有标记为过期的，以及领取时间不早于reactivateBegTs的已过期课包
+	// 有效天数规则调长后，最近领取的已过期课包可能要恢复为有效，更早领取的不再扫描
+	GetTrialPackageScanPage(cursor PackageScanCursor, reactivateBegTs int64, limit int) ([]model.CoursePackageModel, error)
+	CountTrialPackageScan(cursor PackageScanCursor, reactivateBegTs int64) (int, error)
+
+	// 批量获取课包的有效期状态，没有记录的课包不在返回的map中
+	GetTrialPackageStateMap(vecPackageId []string) (map[string]*TrialPackageStateModel, error)
+
+	// 创建课包的有效期状态
+	AddTrialPackageState(stTrialPackageStateModel *TrialPackageStateModel) error
+
+	// 更新过期时间，有效天数规则调整后同步
+	UpdateTrialPackageExpireTs(packageId string, expireTs int64) error
+
+	// 标记为过期，已经是过期状态时返回false
+	ExpireTrialPackage(packageId string, nowTs int64) (bool, error)
+
+	// 已过期的课包按新的过期时间恢复为有效，并重置各阶段的提醒标记，不是过期状态时返回false
+	ReactivateTrialPackage(packageId string, expireTs int64, nowTs int64) (bool, error)
+}
+
+// TrialPackageInterfaceImp 体验课包有效期数据模型实现
+type TrialPackageInterfaceImp struct{}
+
+// Imp 实现实例
+var ImpTrialPackage TrialPackageInterface = &TrialPackageInterfaceImp{}
+
+func (imp *TrialPackageInterfaceImp) GetTrialPackageScanPage(cursor PackageScanCursor, reactivateBegTs int64, limit int) ([]model.CoursePackageModel, error) {
+	var vecCoursePackageModel []model.CoursePackageModel
+	cli := db.Get()
+	err := cli.Table(course_package_tableName).
+		Where("package_type = ?", model.Enum_PackageType_TrialFree).
+		Where("ts >= ? OR package_id NOT IN (?)", reactivateBegTs, cli.Table(trial_package_state_tableName).Select("package_id").Where("status = ?", TrialPackageStatus_Expired).SubQuery()).
+		Where(packageScanCursorWhere, cursor.Ts, cursor.Ts, cursor.PackageID).
+		Order("ts ASC, package_id ASC").Limit(limit).Find(&vecCoursePackageModel).Error
+	return vecCoursePackageModel, err
+}
+
+func (imp *TrialPackageInterfaceImp) CountTrialPackageScan(cursor PackageScanCursor, reactivateBegTs int64) (int, error) {
+	var count int
+	cli := db.Get()
+	err := cli.Table(course_package_tableName).
+		Where("package_type = ?", model.Enum_PackageType_TrialFree).
+		Where("ts >= ? OR package_id NOT IN (?)", reactivateBegTs, cli.Table(trial_package_state_tableName).Select("package_id").Where("status = ?", TrialPackageStatus_Expired).SubQuery()).
+		Where(packageScanCursorWhere, cursor.Ts, cursor.Ts, cursor.PackageID).Count(&count).Error
+	return count, err
+}
+
+func (imp *TrialPackageInterfaceImp) GetTrialPackageStateMap(vecPackageId []string) (map[string]*TrialPackageStateModel, error) {
+	mapTrialPackageState := make(map[string]*TrialPackageStateModel)
+	if len(vecPackageId) == 0 {
+		return mapTrialPackageState, nil
+	}
+	var vecTrialPackageStateModel []TrialPackageStateModel
+	cli := db.Get()
+	err := cli.Table(trial_package_state_tableName).Where("package_id IN (?)", vecPackageId).Find(&vecTrialPackageStateModel).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range vecTrialPackageStateModel {
+		mapTrialPackageState[vecTrialPackageStateModel[i].PackageID] = &vecTrialPackageStateModel[i]
+	}
+	return mapTrialPackageState, nil
+}
+
+func (imp *TrialPackageInterfaceImp) AddTrialPackageState(stTrialPackageStateModel *TrialPackageStateModel) error {
+	cli := db.Get()
+	return cli.Table(trial_package_state_tableName).Create(stTrialPackageStateModel).Error
+}
+
+func (imp *TrialPackageInterfaceImp) UpdateTrialPackageExpireTs(packageId string, expireTs int64) error {
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["expire_ts"] = expireTs
+	mapUpdates["updated_ts"] = time.Now().Unix()
+	cli := db.Get()
+	return cli.Table(trial_package_state_tableName).Model(&TrialPackageStateModel{}).
+		Where("package_id = ? AND status = ?", packageId, TrialPackageStatus_Active).Updates(mapUpdates).Error
+}
+
+func (imp *TrialPackageInterfaceImp) ExpireTrialPackage(packageId string, nowTs int64) (bool, error) {
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["status"] = TrialPackageStatus_Expired
+	mapUpdates["expired_ts"] = nowTs
+	mapUpdates["updated_ts"] = nowTs
+	cli := db.Get()
+	result := cli.Table(trial_package_state_tableName).Model(&TrialPackageStateModel{}).
+		Where("package_id = ? AND status = ?", packageId, TrialPackageStatus_Active).Updates(mapUpdates)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (imp *TrialPackageInterfaceImp) ReactivateTrialPackage(packageId string, expireTs int64, nowTs int64) (bool, error) {
+	mapUpdates := make(map[string]interface{})
+	mapUpdates["status"] = TrialPackageStatus_Active
+	mapUpdates["expire_ts"] = expireTs
+	mapUpdates["expired_ts"] = 0
+	for _, stage := range vecTrialExpireRemindStage {
+		mapUpdates[stage.Column] = false
+	}
+	mapUpdates["updated_ts"] = nowTs
+	cli := db.Get()
+	result := cli.Table(trial_package_state_tableName).Model(&TrialPackageStateModel{}).
+		Where("package_id = ? AND status = ?", packageId, TrialPackageStatus_Expired).Updates(mapUpdates)
+	return result.RowsAffected > 0, result.Error
+}
+
+// getTrialPackageStateMapForShow 展示课包列表时批量获取有效期状态，查询失败只打日志，不影响列表展示
+func getTrialPackageStateMapForShow(vecPackageId []string) map[string]*TrialPackageStateModel {
+	mapTrialPackageState, err := ImpTrialPackage.GetTrialPackageStateMap(vecPackageId)
+	if err != nil {
+		Printf("getTrialPackageStateMapForShow GetTrialPackageStateMap err, err:%+v count:%d\n", err, len(vecPackageId))
+		return make(map[string]*TrialPackageStateModel)
+	}
+	return mapTrialPackageState
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -9,6 +11,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/jinzhu/gorm"
 	"github.com/xionghengheng/ff_plib/db/dao"
 )
 
@@ -50,53 +53,150 @@ func GetFirstOfMonthBegTimestamp() int64 {
 	return firstOfMonth.Unix()
 }
 
+// getClientIP 获取请求来源IP，用于登录失败锁定和安全事件记录
+// X-Forwarded-For 前面的部分可以由客户端随意填写，只取云托管网关追加的最后一段；没有时使用连接的对端地址
+func getClientIP(r *http.Request) string {
+	if strForwarded := r.Header.Get("X-Forwarded-For"); strForwarded != "" {
+		vecForwarded := strings.Split(strForwarded, ",")
+		if strIp := strings.TrimSpace(vecForwarded[len(vecForwarded)-1]); strIp != "" {
+			return strIp
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // AdminAuthResult 管理员身份验证结果
 type AdminAuthResult struct {
 	Success  bool   // 验证是否成功
 	Code     int    // 错误码（验证失败时使用）
 	ErrorMsg string // 错误信息（验证失败时使用）
+	Operator string // 操作人登录名（验证成功时有值）
+	Role     string // 操作人角色（验证成功时有值）
 }
 
 // ValidateAdminAuth 验证管理员身份
-// 参数：r - HTTP请求，用于从header中提取用户名和密码
+// 参数：r - HTTP请求，用于从header中提取访问令牌
 // 返回：AdminAuthResult - 验证结果
 func ValidateAdminAuth(r *http.Request) AdminAuthResult {
-	// 验证管理员用户名和密码配置
-	adminUserName := os.Getenv("ADMIN_USER_NAME")
-	adminPasswd := os.Getenv("ADMIN_PASSWD")
-	if len(adminUserName) == 0 || len(adminPasswd) == 0 {
-		Printf("ValidateAdminAuth conf err, adminUserName:%s adminPasswd:%s\n", adminUserName, adminPasswd)
+	// 已经过路由权限中间件验证的请求直接复用验证结果
+	if identity := getOperatorIdentity(r); identity != nil {
+		if identity.IsConsultant {
+			return AdminAuthResult{
+				Success:  false,
+				Code:     -996,
+				ErrorMsg: "顾问无权操作",
+			}
+		}
 		return AdminAuthResult{
-			Success:  false,
-			Code:     -900,
-			ErrorMsg: "后台配置错误",
+			Success:  true,
+			Operator: identity.Operator,
+			Role:     identity.Role,
 		}
 	}
+	return validateOperatorCredential(r)
+}
 
-	// 从header中提取用户名进行校验
-	username := r.Header.Get("X-Username")
-	if username == "" {
-		Printf("ValidateAdminAuth missing X-Username header\n")
+// validateOperatorCredential 验证操作员身份，只接受 Authorization: Bearer 令牌，令牌通过 /api/login 用账号密码换取
+func validateOperatorCredential(r *http.Request) AdminAuthResult {
+	if token := getBearerToken(r); token != "" {
+		claims, err := validateAccessToken(token)
+		if err != nil {
+			Printf("ValidateAdminAuth validateAccessToken err, err:%+v\n", err)
+			if errors.Is(err, errTokenSecretNotSet) {
+				return AdminAuthResult{
+					Success:  false,
+					Code:     -900,
+					ErrorMsg: "后台配置错误",
+				}
+			}
+			return AdminAuthResult{
+				Success:  false,
+				Code:     -991,
+				ErrorMsg: "登录已失效，请重新登录",
+			}
+		}
+		return AdminAuthResult{
+			Success:  true,
+			Operator: claims.Operator,
+			Role:     claims.Role,
+		}
+	}
+
+	// 账号密码只在 /api/login 接收，其他接口必须携带访问令牌
+	Printf("ValidateAdminAuth missing Authorization header\n")
+	return AdminAuthResult{
+		Success:  false,
+		Code:     -995,
+		ErrorMsg: "缺少登录令牌，请先登录",
+	}
+}
+
+// checkOperatorPassword 校验操作员账号密码，登录名或IP连续错误过多时锁定一段时间
+func checkOperatorPassword(username string, password string, clientIP string) AdminAuthResult {
+	if remainSec := checkAuthLocked(username, clientIP); remainSec > 0 {
+		addSecurityEvent(SecurityEvent_LockedReject, username, clientIP, "", "")
+		Printf("ValidateAdminAuth locked, username:%s ip:%s remainSec:%d\n", username, clientIP, remainSec)
 		return AdminAuthResult{
 			Success:  false,
-			Code:     -995,
-			ErrorMsg: "缺少X-Username header",
+			Code:     -990,
+			ErrorMsg: fmt.Sprintf("密码错误次数过多，请%d秒后再试", remainSec),
 		}
 	}
 
-	// 从header中提取密码进行校验
-	password := r.Header.Get("X-Password")
-	if password == "" {
-		Printf("ValidateAdminAuth missing X-Password header\n")
+	authResult := verifyOperatorPassword(username, password)
+	if authResult.Success {
+		resetAuthFail(username)
+	} else if authResult.Code == -994 {
+		recordAuthFail(username, clientIP)
+	}
+	return authResult
+}
+
+// verifyOperatorPassword 校验操作员账号密码
+// 账号表为空时，允许使用环境变量 ADMIN_USER_NAME/ADMIN_PASSWD 配置的超级管理员登录，只用于创建第一个账号
+// 账号表中有任何账号后，环境变量配置的账号密码不再生效
+func verifyOperatorPassword(username string, password string) AdminAuthResult {
+	stOperatorAccountModel, err := ImpOperatorAccount.GetOperatorByUsername(username)
+	if err == nil {
+		if stOperatorAccountModel.Disabled {
+			Printf("ValidateAdminAuth account disabled, username:%s\n", username)
+			return AdminAuthResult{
+				Success:  false,
+				Code:     -992,
+				ErrorMsg: "账号已停用",
+			}
+		}
+		if !CheckPassword(password, stOperatorAccountModel.PasswordHash) {
+			Printf("ValidateAdminAuth auth failed, username:%s\n", username)
+			return AdminAuthResult{
+				Success:  false,
+				Code:     -994,
+				ErrorMsg: "用户名或密码错误",
+			}
+		}
+		return AdminAuthResult{
+			Success:  true,
+			Operator: stOperatorAccountModel.Username,
+			Role:     stOperatorAccountModel.Role,
+		}
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		Printf("ValidateAdminAuth GetOperatorByUsername err, err:%+v username:%s\n", err, username)
 		return AdminAuthResult{
 			Success:  false,
-			Code:     -995,
-			ErrorMsg: "缺少X-Password header",
+			Code:     -900,
+			ErrorMsg: "查询账号失败",
 		}
 	}
 
-	// 校验用户名和密码
-	if username != adminUserName || password != adminPasswd {
+	// 验证环境变量配置的超级管理员，只在还没有任何账号时生效
+	adminUserName := os.Getenv("ADMIN_USER_NAME")
+	adminPasswd := os.Getenv("ADMIN_PASSWD")
+	if len(adminUserName) == 0 || len(adminPasswd) == 0 || username != adminUserName || password != adminPasswd {
 		Printf("ValidateAdminAuth auth failed, username:%s\n", username)
 		return AdminAuthResult{
 			Success:  false,
@@ -104,24 +204,60 @@ func ValidateAdminAuth(r *http.Request) AdminAuthResult {
 			ErrorMsg: "用户名或密码错误",
 		}
 	}
+	operatorCnt, err := ImpOperatorAccount.CountOperator()
+	if err != nil {
+		Printf("ValidateAdminAuth CountOperator err, err:%+v username:%s\n", err, username)
+		return AdminAuthResult{
+			Success:  false,
+			Code:     -900,
+			ErrorMsg: "查询账号失败",
+		}
+	}
+	if operatorCnt > 0 {
+		Printf("[AuthAlarm]ValidateAdminAuth bootstrap admin rejected, accounts already exist, username:%s\n", username)
+		return AdminAuthResult{
+			Success:  false,
+			Code:     -994,
+			ErrorMsg: "用户名或密码错误",
+		}
+	}
 
 	return AdminAuthResult{
-		Success: true,
+		Success:  true,
+		Operator: username,
+		Role:     OperatorRole_Admin,
 	}
 }
 
 // ConsultantOrAdminAuthResult 顾问或管理员身份验证结果
 type ConsultantOrAdminAuthResult struct {
-	Success      bool   // 是否验证成功
-	Code         int    // 错误码（验证失败时使用）
-	ErrorMsg     string // 错误信息（验证失败时使用）
-	IsConsultant bool   // 是否为顾问身份
+	Success        bool   // 是否验证成功
+	Code           int    // 错误码（验证失败时使用）
+	ErrorMsg       string // 错误信息（验证失败时使用）
+	IsConsultant   bool   // 是否为顾问身份
 	ConsultantNick string // 顾问昵称（顾问身份时有值）
+	Operator       string // 操作人标识（管理员为登录名，顾问为OpenID）
+	Role           string // 操作人角色
 }
 
 // ValidateConsultantOrAdminAuth 验证顾问或管理员身份
-// 优先通过OpenID识别顾问（需IsOfficialAssistant为true），否则走管理员账号密码校验
+// 优先通过OpenID识别顾问（需IsOfficialAssistant为true），否则校验登录令牌
 func ValidateConsultantOrAdminAuth(r *http.Request) ConsultantOrAdminAuthResult {
+	// 已经过路由权限中间件验证的请求直接复用验证结果
+	if identity := getOperatorIdentity(r); identity != nil {
+		return ConsultantOrAdminAuthResult{
+			Success:        true,
+			IsConsultant:   identity.IsConsultant,
+			ConsultantNick: identity.ConsultantNick,
+			Operator:       identity.Operator,
+			Role:           identity.Role,
+		}
+	}
+	return authenticateOperator(r)
+}
+
+// authenticateOperator 识别请求的操作员身份，小程序顾问通过OpenID识别，其他通过登录令牌识别
+func authenticateOperator(r *http.Request) ConsultantOrAdminAuthResult {
 	strOpenId := r.Header.Get("X-WX-OPENID")
 	if strOpenId != "" {
 		consultantUser, err := dao.ImpUser.GetUserByOpenId(strOpenId)
@@ -139,12 +275,14 @@ func ValidateConsultantOrAdminAuth(r *http.Request) ConsultantOrAdminAuthResult
 				Success:        true,
 				IsConsultant:   true,
 				ConsultantNick: consultantUser.Nick,
+				Operator:       strOpenId,
+				Role:           OperatorRole_Consultant,
 			}
 		}
 	}
 
-	// 非顾问，走管理员账号密码校验
-	adminResult := ValidateAdminAuth(r)
+	// 非顾问，走登录令牌校验
+	adminResult := validateOperatorCredential(r)
 	if !adminResult.Success {
 		return ConsultantOrAdminAuthResult{
 			Success:  false,
@@ -153,6 +291,8 @@ func ValidateConsultantOrAdminAuth(r *http.Request) ConsultantOrAdminAuthResult
 		}
 	}
 	return ConsultantOrAdminAuthResult{
-		Success: true,
+		Success:  true,
+		Operator: adminResult.Operator,
+		Role:     adminResult.Role,
 	}
 }